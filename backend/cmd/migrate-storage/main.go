@@ -0,0 +1,202 @@
+// Command migrate-storage copies product images from the local upload directory
+// into the configured storage (STORAGE_DRIVER) and rewrites products.images to
+// the new keys and URLs. It can be run again safely: files already copied are
+// skipped, and their URLs are only rewritten.
+//
+//	go run ./cmd/migrate-storage -dry-run
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"azaton-backend/internal/config"
+	"azaton-backend/internal/database"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/storage"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would be copied without changing anything")
+	flag.Parse()
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	db, err := database.NewConnection(cfg)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	source, err := storage.NewLocal(cfg.UploadDir, "/uploads", "/api/files", []byte(cfg.StorageSigningKey))
+	if err != nil {
+		log.Fatalf("Failed to open upload directory: %v", err)
+	}
+	target, err := storage.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	m := migrator{db: db, source: source, target: target, dryRun: *dryRun, copied: map[string]string{}}
+	if err := m.run(context.Background()); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	log.Printf("Done: %d products updated, %d files copied, %d missing", m.products, m.files, m.missing)
+	if *dryRun {
+		log.Println("Dry run: nothing was changed")
+	}
+}
+
+type migrator struct {
+	db     *pgxpool.Pool
+	source *storage.Local
+	target storage.Storage
+	dryRun bool
+
+	copied   map[string]string // old key -> new key
+	products int
+	files    int
+	missing  int
+}
+
+func (m *migrator) run(ctx context.Context) error {
+	rows, err := m.db.Query(ctx, `
+		SELECT p.id, p.images, COALESCE(c.is_private, false)
+		FROM products p LEFT JOIN companies c ON c.id = p.company_id
+		WHERE jsonb_array_length(p.images) > 0
+		ORDER BY p.id
+	`)
+	if err != nil {
+		return err
+	}
+
+	type product struct {
+		id      int
+		images  []byte
+		private bool
+	}
+	var products []product
+	for rows.Next() {
+		var p product
+		if err := rows.Scan(&p.id, &p.images, &p.private); err != nil {
+			rows.Close()
+			return err
+		}
+		products = append(products, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range products {
+		var images []models.ProductImage
+		if err := json.Unmarshal(p.images, &images); err != nil {
+			log.Printf("Product %d: invalid images JSON, skipped", p.id)
+			continue
+		}
+
+		changed := false
+		for i := range images {
+			img := &images[i]
+
+			key := img.Key
+			if key == "" && strings.HasPrefix(img.URL, "/uploads/") {
+				key = strings.TrimPrefix(img.URL, "/uploads/")
+			}
+			if key != "" {
+				if newKey, url, ok := m.migrate(ctx, p.id, key, p.private); ok && (newKey != img.Key || url != img.URL) {
+					img.Key, img.URL, img.Filepath = newKey, url, ""
+					changed = true
+				}
+			}
+
+			for name, size := range img.Sizes {
+				if newKey, url, ok := m.migrate(ctx, p.id, size.Key, p.private); ok && (newKey != size.Key || url != size.URL) {
+					size.Key, size.URL = newKey, url
+					changed = true
+				}
+				if newKey, url, ok := m.migrate(ctx, p.id, size.WebPKey, p.private); ok && (newKey != size.WebPKey || url != size.WebPURL) {
+					size.WebPKey, size.WebPURL = newKey, url
+					changed = true
+				}
+				img.Sizes[name] = size
+			}
+		}
+
+		if !changed {
+			continue
+		}
+		m.products++
+		if m.dryRun {
+			continue
+		}
+
+		imagesJSON, _ := json.Marshal(images)
+		if _, err := m.db.Exec(ctx, `UPDATE products SET images = $1::jsonb WHERE id = $2`, string(imagesJSON), p.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate copies one file to the target and returns its new key and URL.
+// Files already stored under their final key are not copied again.
+func (m *migrator) migrate(ctx context.Context, productID int, key string, private bool) (string, string, bool) {
+	if key == "" {
+		return "", "", false
+	}
+	newKey := storage.Key(private, path.Base(key))
+	if done, ok := m.copied[key]; ok {
+		return done, m.target.URL(done), true
+	}
+
+	// Already in place: only the URL may need rewriting
+	if key == newKey {
+		if f, err := m.target.Open(ctx, newKey); err == nil {
+			f.Close()
+			return newKey, m.target.URL(newKey), true
+		}
+	}
+
+	info, err := os.Stat(m.source.Path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Product %d: %s not found in the upload directory", productID, key)
+		m.missing++
+		return "", "", false
+	}
+	if err != nil {
+		log.Printf("Product %d: %s: %v", productID, key, err)
+		return "", "", false
+	}
+	f, err := m.source.Open(ctx, key)
+	if err != nil {
+		log.Printf("Product %d: %s: %v", productID, key, err)
+		return "", "", false
+	}
+	defer f.Close()
+
+	if !m.dryRun {
+		if err := m.target.Put(ctx, newKey, f, info.Size(), storage.ContentType(newKey)); err != nil {
+			log.Printf("Product %d: copying %s failed: %v", productID, key, err)
+			return "", "", false
+		}
+	}
+
+	m.copied[key] = newKey
+	m.files++
+	return newKey, m.target.URL(newKey), true
+}
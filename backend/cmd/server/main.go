@@ -12,8 +12,10 @@ import (
 
 	"azaton-backend/internal/config"
 	"azaton-backend/internal/database"
+	"azaton-backend/internal/events"
 	"azaton-backend/internal/handlers"
 	"azaton-backend/internal/middleware"
+	"azaton-backend/internal/storage"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -41,6 +43,36 @@ func main() {
 		log.Printf("Warning: Migration error: %v", err)
 	}
 
+	handlers.FailInterruptedImportJobs(db)
+
+	// Upload storage
+	store, err := storage.New(cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	// Files uploaded before object storage stay in UploadDir until migrated
+	uploads, err := storage.NewLocal(cfg.UploadDir, "/uploads", "/api/files", []byte(cfg.StorageSigningKey))
+	if err != nil {
+		log.Fatalf("Failed to initialize upload directory: %v", err)
+	}
+
+	// Background workers run until shutdown
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	go handlers.RunScheduledPriceChanges(workerCtx, db, time.Minute)
+	if cfg.ImageGCInterval > 0 {
+		go handlers.RunImageGC(workerCtx, db, store, cfg.ImageGCInterval, cfg.ImageGCMinAge)
+	}
+	if cfg.TrashPurgeInterval > 0 {
+		go handlers.RunTrashPurge(workerCtx, db, store, cfg.TrashPurgeInterval, cfg.TrashRetention)
+	}
+	if cfg.OrderReservationTTL > 0 {
+		go handlers.RunOrderExpiry(workerCtx, db, time.Minute)
+	}
+	// Events published by any instance reach the clients connected here
+	broker := events.NewBroker()
+	go broker.Listen(workerCtx, db)
+
 	// Initialize router
 	router := gin.Default()
 
@@ -48,14 +80,15 @@ func main() {
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "If-Match", "If-None-Match"},
+		ExposeHeaders:    []string{"Content-Length", "ETag"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
 
-	// Static files for uploads
-	router.Static("/uploads", cfg.UploadDir)
+	// Static files for uploads (private files need a signed URL)
+	router.GET("/uploads/*filepath", handlers.ServeUpload(uploads))
+	router.HEAD("/uploads/*filepath", handlers.ServeUpload(uploads))
 
 	// Health check
 	router.GET("/health", func(c *gin.Context) {
@@ -70,48 +103,118 @@ func main() {
 		api.POST("/companies/verify-access", handlers.VerifyCompanyAccess(db))
 		api.GET("/companies", handlers.GetCompanies(db))
 		api.GET("/companies/:id", handlers.GetCompany(db))
+
+		// Signed links to private files (the S3 driver signs its own URLs)
+		if local, ok := store.(*storage.Local); ok {
+			api.GET("/files/*key", handlers.ServeSignedFile(local))
+		}
 		api.GET("/companies/by-company-id/:companyId", handlers.GetCompanyByCompanyId(db))
 		api.POST("/companies", handlers.CreateCompany(db))
 		api.POST("/companies/secure-create", handlers.CreateCompany(db))
 		api.PUT("/companies/:id", handlers.UpdateCompany(db))
-		api.PATCH("/companies/:id/toggle-privacy", handlers.ToggleCompanyPrivacy(db))
+		api.PATCH("/companies/:id/toggle-privacy", handlers.ToggleCompanyPrivacy(db, store))
 		api.DELETE("/companies/:id", handlers.DeleteCompany(db))
+		api.GET("/companies/trash", handlers.GetDeletedCompanies(db))
+		api.POST("/companies/:id/restore", handlers.RestoreCompany(db))
 		api.GET("/companies/:id/profile", handlers.GetCompanyProfile(db))
 		api.POST("/companies/:id/rate", handlers.RateCompany(db))
 		api.GET("/companies/:id/financial-stats", handlers.GetFinancialStats(db))
 
+		// Live product, stock and order events (Server-Sent Events)
+		api.GET("/events", handlers.StreamEvents(broker))
+
 		// Products
-		api.GET("/products", handlers.GetProducts(db))
-		api.GET("/products/paginated", handlers.GetProductsPaginated(db))
+		api.GET("/products", handlers.GetProducts(db, cfg, store))
+		api.GET("/products/paginated", handlers.GetProductsPaginated(db, cfg, store))
+		api.GET("/products/changes", handlers.GetProductChanges(db, cfg, store))
+		api.GET("/products/lookup", handlers.LookupProduct(db, cfg))
+		api.GET("/products/export", handlers.ExportProducts(db))
 		api.POST("/products/add", handlers.CreateProduct(db))
-		api.PUT("/products/:id", handlers.UpdateProduct(db))
+		api.GET("/products/:id", handlers.GetProduct(db, cfg, store))
+		api.PATCH("/products/:id", handlers.UpdateProduct(db, cfg, store))
+		api.PUT("/products/:id", handlers.UpdateProduct(db, cfg, store)) // older clients; same merge patch semantics
 		api.DELETE("/products/:id", handlers.DeleteProduct(db))
-		api.DELETE("/products", handlers.DeleteAllProducts(db))
+		api.POST("/products/bulk-delete/prepare", handlers.PrepareBulkDelete(db))
+		api.POST("/products/bulk-delete", handlers.BulkDeleteProducts(db))
+		api.GET("/products/trash", handlers.GetDeletedProducts(db, cfg, store))
+		api.POST("/products/:id/restore", handlers.RestoreProduct(db))
+		api.GET("/products/:id/bundle", handlers.GetBundle(db))
+		api.PUT("/products/:id/bundle", handlers.SetBundle(db))
+		api.GET("/products/:id/units", handlers.GetProductUnits(db))
+		api.POST("/products/:id/units", handlers.SaveProductUnit(db))
+		api.DELETE("/products/:id/units/:unitId", handlers.DeleteProductUnit(db))
+		api.DELETE("/products/:id/purge", handlers.PurgeProduct(db, store))
 		api.POST("/products/bulk-import", handlers.BulkImportProducts(db))
+		api.POST("/products/import", handlers.ImportProducts(db, cfg))
+		api.GET("/products/import/jobs/:id", handlers.GetImportJob(db))
+		api.GET("/products/import/mappings", handlers.GetImportMappings(db))
+		api.POST("/products/import/mappings", handlers.SaveImportMapping(db))
+		api.DELETE("/products/import/mappings/:id", handlers.DeleteImportMapping(db))
 		api.PUT("/products/:id/toggle-customer-availability", handlers.ToggleProductAvailability(db))
 		api.POST("/products/bulk-toggle-availability", handlers.BulkToggleAvailability(db))
 		api.POST("/products/bulk-update-barcodes", handlers.BulkUpdateBarcodes(db))
-		api.POST("/products/:id/upload-image", handlers.UploadProductImage(db, cfg))
-		api.GET("/products/:id/images", handlers.GetProductImages(db))
-		api.DELETE("/products/:id/images/:index", handlers.DeleteProductImage(db))
+		api.POST("/products/barcodes/generate", handlers.GenerateBarcodes(db, cfg))
+		api.POST("/products/labels", handlers.PrintProductLabels(db))
+		api.POST("/products/reprice/preview", handlers.PreviewReprice(db))
+		api.POST("/products/reprice", handlers.ApplyReprice(db))
+		api.GET("/products/reprice/batches", handlers.GetRepriceBatches(db))
+		api.POST("/products/reprice/batches/:id/undo", handlers.UndoReprice(db))
+		api.GET("/products/duplicates", handlers.FindDuplicateProducts(db))
+		api.POST("/products/merge", handlers.MergeProducts(db))
+		api.GET("/products/merges", handlers.GetProductMerges(db))
+		api.GET("/products/:id/stock-lots", handlers.GetStockLots(db))
+		api.GET("/products/:id/stock-movements", handlers.GetStockMovements(db))
+		api.POST("/products/:id/upload-image", handlers.UploadProductImage(db, cfg, store))
+		api.GET("/products/:id/images", handlers.GetProductImages(db, cfg, store))
+		api.DELETE("/products/:id/images/:index", handlers.DeleteProductImage(db, store))
+		api.GET("/images/gc", handlers.ImageGC(db, cfg, store))
+		api.POST("/images/gc", handlers.ImageGC(db, cfg, store))
+		api.GET("/products/:id/price-history", handlers.GetPriceHistory(db))
+		api.GET("/products/:id/price-schedule", handlers.GetScheduledPriceChanges(db))
+		api.POST("/products/:id/price-schedule", handlers.SchedulePriceChange(db))
+		api.DELETE("/products/:id/price-schedule/:changeId", handlers.CancelScheduledPriceChange(db))
+
+		// Product reviews
+		api.GET("/products/:id/reviews", handlers.GetProductReviews(db, cfg, store))
+		api.POST("/products/:id/reviews", handlers.SaveProductReview(db, cfg, store))
+		api.GET("/reviews", handlers.GetReviews(db, cfg, store))
+		api.DELETE("/reviews/:id", handlers.DeleteProductReview(db, store))
+		api.POST("/reviews/:id/photos", handlers.UploadReviewPhoto(db, cfg, store))
+		api.DELETE("/reviews/:id/photos/:index", handlers.DeleteReviewPhoto(db, store))
+		api.PUT("/reviews/:id/reply", handlers.ReplyToReview(db))
+		api.PUT("/reviews/:id/hide", handlers.HideReview(db))
+		api.PUT("/reviews/:id/publish", handlers.PublishReview(db))
+
+		// Pricing rules
+		api.GET("/pricing-rules", handlers.GetPricingRules(db))
+		api.POST("/pricing-rules", handlers.SavePricingRule(db))
+		api.POST("/pricing-rules/preview", handlers.PreviewPricing(db))
+		api.DELETE("/pricing-rules/:id", handlers.DeletePricingRule(db))
 
 		// Users
 		api.GET("/users", handlers.GetUsers(db))
 		api.POST("/users", handlers.CreateUser(db))
 		api.GET("/users/:phone", handlers.GetUserByPhone(db))
+		api.POST("/users/delete-all/prepare", handlers.PrepareDeleteAllUsers(db))
 		api.DELETE("/users", handlers.DeleteAllUsers(db))
 
 		// Customer Orders
 		api.GET("/customer-orders", handlers.GetCustomerOrders(db))
-		api.POST("/customer-orders", handlers.CreateCustomerOrder(db))
+		api.POST("/customer-orders", handlers.CreateCustomerOrder(db, cfg))
 		api.PUT("/customer-orders/:id/confirm-payment", handlers.ConfirmOrderPayment(db))
 		api.PUT("/customer-orders/:id/cancel", handlers.CancelOrder(db))
+		api.PUT("/customer-orders/:id/status", handlers.UpdateOrderStatus(db))
+		api.GET("/customer-orders/:id/history", handlers.GetOrderStatusHistory(db))
 		api.GET("/customer-orders/search/:code", handlers.SearchOrderByCode(db))
 
 		// Sales History
 		api.GET("/sales-history", handlers.GetSalesHistory(db))
 		api.POST("/sales-history", handlers.CreateSale(db))
 
+		// Stock receipts
+		api.GET("/stock-receipts", handlers.GetStockReceipts(db))
+		api.POST("/stock-receipts", handlers.CreateStockReceipt(db))
+
 		// Expenses
 		api.GET("/expenses", handlers.GetExpenses(db))
 		api.POST("/expenses", handlers.UpdateExpenses(db))
@@ -174,6 +277,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Shutting down server...")
+	stopWorkers()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
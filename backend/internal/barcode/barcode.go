@@ -0,0 +1,175 @@
+package barcode
+
+import (
+	"errors"
+	"strconv"
+)
+
+// ErrNotScaleBarcode is returned when a code is not an in-store weighted EAN-13
+var ErrNotScaleBarcode = errors.New("not a scale barcode")
+
+// ScaleKind describes what the value part of a scale barcode encodes
+type ScaleKind string
+
+const (
+	ScaleWeight ScaleKind = "weight"
+	ScalePrice  ScaleKind = "price"
+)
+
+// ScaleBarcode is a parsed weighted EAN-13 printed by shop scales:
+// 2X PPPPP VVVVV C, where X picks the encoding, P is the product code and V
+// is the weight in grams or the price in soum
+type ScaleBarcode struct {
+	Prefix      string    `json:"prefix"`
+	ProductCode string    `json:"product_code"`
+	Kind        ScaleKind `json:"kind"`
+	Weight      float64   `json:"weight,omitempty"` // kilograms
+	Price       float64   `json:"price,omitempty"`  // soum
+}
+
+// IsDigits reports whether s is a non-empty string of ASCII digits
+func IsDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckDigit computes the EAN/UPC check digit for the given digits (without check digit)
+func CheckDigit(digits string) int {
+	sum := 0
+	// Weights alternate 3,1,3,... starting from the rightmost digit
+	for i, weight := len(digits)-1, 3; i >= 0; i, weight = i-1, 4-weight {
+		sum += int(digits[i]-'0') * weight
+	}
+	return (10 - sum%10) % 10
+}
+
+// ValidEAN13 reports whether code is a 13-digit EAN with a correct check digit
+func ValidEAN13(code string) bool {
+	if len(code) != 13 || !IsDigits(code) {
+		return false
+	}
+	return CheckDigit(code[:12]) == int(code[12]-'0')
+}
+
+// IsScalePrefix reports whether code starts with one of the in-store prefixes 20–29
+func IsScalePrefix(code string) bool {
+	return len(code) >= 2 && code[0] == '2' && code[1] >= '0' && code[1] <= '9'
+}
+
+// ParseScale parses a weighted EAN-13. Prefixes listed in pricePrefixes carry
+// the price in soum, all other 20–29 prefixes carry the weight in grams.
+func ParseScale(code string, pricePrefixes []string) (*ScaleBarcode, error) {
+	if !ValidEAN13(code) || !IsScalePrefix(code) {
+		return nil, ErrNotScaleBarcode
+	}
+
+	value, err := strconv.Atoi(code[7:12])
+	if err != nil {
+		return nil, ErrNotScaleBarcode
+	}
+
+	sb := &ScaleBarcode{
+		Prefix:      code[:2],
+		ProductCode: code[2:7],
+		Kind:        ScaleWeight,
+	}
+
+	for _, p := range pricePrefixes {
+		if p == sb.Prefix {
+			sb.Kind = ScalePrice
+			break
+		}
+	}
+
+	if sb.Kind == ScalePrice {
+		sb.Price = float64(value)
+	} else {
+		sb.Weight = float64(value) / 1000
+	}
+
+	return sb, nil
+}
+
+// ErrInvalidBarcode is returned for codes that fail format or check digit validation
+var ErrInvalidBarcode = errors.New("invalid barcode")
+
+// Validate checks a barcode entered by hand or imported. Numeric codes with a
+// GTIN length (8, 12, 13, 14) must carry a correct check digit; other codes
+// must be 1–100 printable ASCII characters without spaces.
+func Validate(code string) error {
+	if code == "" || len(code) > 100 {
+		return ErrInvalidBarcode
+	}
+	if IsDigits(code) {
+		switch len(code) {
+		case 8, 12, 13, 14:
+			if CheckDigit(code[:len(code)-1]) != int(code[len(code)-1]-'0') {
+				return ErrInvalidBarcode
+			}
+		}
+		return nil
+	}
+	for i := 0; i < len(code); i++ {
+		if code[i] <= ' ' || code[i] > '~' {
+			return ErrInvalidBarcode
+		}
+	}
+	return nil
+}
+
+// InternalEAN13 builds an in-store EAN-13 from a numeric prefix and a sequence number
+func InternalEAN13(prefix string, seq int64) (string, error) {
+	width := 12 - len(prefix)
+	if !IsDigits(prefix) || width <= 0 || seq < 0 {
+		return "", ErrInvalidBarcode
+	}
+	body := strconv.FormatInt(seq, 10)
+	if len(body) > width {
+		return "", errors.New("internal barcode range exhausted")
+	}
+	for len(body) < width {
+		body = "0" + body
+	}
+	body = prefix + body
+	return body + strconv.Itoa(CheckDigit(body)), nil
+}
+
+var (
+	ean13L = [10]string{"0001101", "0011001", "0010011", "0111101", "0100011", "0110001", "0101111", "0111011", "0110111", "0001011"}
+	ean13G = [10]string{"0100111", "0110011", "0011011", "0100001", "0011101", "0111001", "0000101", "0010001", "0001001", "0010111"}
+	ean13R = [10]string{"1110010", "1100110", "1101100", "1000010", "1011100", "1001110", "1010000", "1000100", "1001000", "1110100"}
+	// Parity of the left-hand digits, selected by the first (implicit) digit
+	ean13Parity = [10]string{"LLLLLL", "LLGLGG", "LLGGLG", "LLGGGL", "LGLLGG", "LGGLLG", "LGGGLL", "LGLGLG", "LGLGGL", "LGGLGL"}
+)
+
+// EncodeEAN13 returns the 95 modules of an EAN-13 symbol, '1' for a bar and '0' for a space
+func EncodeEAN13(code string) (string, error) {
+	if !ValidEAN13(code) {
+		return "", ErrInvalidBarcode
+	}
+
+	parity := ean13Parity[code[0]-'0']
+	modules := "101"
+	for i := 1; i <= 6; i++ {
+		d := code[i] - '0'
+		if parity[i-1] == 'L' {
+			modules += ean13L[d]
+		} else {
+			modules += ean13G[d]
+		}
+	}
+	modules += "01010"
+	for i := 7; i <= 12; i++ {
+		modules += ean13R[code[i]-'0']
+	}
+	modules += "101"
+
+	return modules, nil
+}
@@ -0,0 +1,179 @@
+package barcode
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDigit(t *testing.T) {
+	tests := []struct {
+		digits string
+		want   int
+	}{
+		{"400638133393", 1},
+		{"590123412345", 7},
+		{"9638507", 4},     // EAN-8
+		{"03600029145", 2}, // UPC-A
+		{"000000000000", 0},
+	}
+	for _, tt := range tests {
+		if got := CheckDigit(tt.digits); got != tt.want {
+			t.Errorf("CheckDigit(%q) = %d, want %d", tt.digits, got, tt.want)
+		}
+	}
+}
+
+func TestValidEAN13(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"4006381333931", true},
+		{"5901234123457", true},
+		{"4006381333932", false}, // wrong check digit
+		{"400638133393", false},  // too short
+		{"40063813339311", false},
+		{"400638133393A", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := ValidEAN13(tt.code); got != tt.want {
+			t.Errorf("ValidEAN13(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestParseScale(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   string
+		prices []string
+		want   *ScaleBarcode
+		err    error
+	}{
+		{
+			name: "weight in grams",
+			code: "2212345012503",
+			want: &ScaleBarcode{Prefix: "22", ProductCode: "12345", Kind: ScaleWeight, Weight: 1.25},
+		},
+		{
+			name:   "price in soum",
+			code:   "2212345012503",
+			prices: []string{"22", "23"},
+			want:   &ScaleBarcode{Prefix: "22", ProductCode: "12345", Kind: ScalePrice, Price: 1250},
+		},
+		{
+			name:   "other prefix keeps weight",
+			code:   "2000001005002",
+			prices: []string{"22"},
+			want:   &ScaleBarcode{Prefix: "20", ProductCode: "00001", Kind: ScaleWeight, Weight: 0.5},
+		},
+		{name: "not in-store", code: "4006381333931", err: ErrNotScaleBarcode},
+		{name: "bad check digit", code: "2212345012504", err: ErrNotScaleBarcode},
+		{name: "too short", code: "221234501250", err: ErrNotScaleBarcode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseScale(tt.code, tt.prices)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Fatalf("got %+v, want nil", got)
+				}
+				return
+			}
+			if got == nil || *got != *tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{"4006381333931", true},
+		{"96385074", true},       // EAN-8
+		{"036000291452", true},   // UPC-A
+		{"10012345678902", true}, // GTIN-14
+		{"4006381333932", false}, // GTIN length, wrong check digit
+		{"12345", true},          // other lengths carry no check digit
+		{"SKU-001/A", true},
+		{"has space", false},
+		{"tab\there", false},
+		{"кириллица", false},
+		{"", false},
+		{string(make([]byte, 101)), false},
+	}
+	for _, tt := range tests {
+		err := Validate(tt.code)
+		if tt.valid && err != nil {
+			t.Errorf("Validate(%q) = %v, want nil", tt.code, err)
+		}
+		if !tt.valid && !errors.Is(err, ErrInvalidBarcode) {
+			t.Errorf("Validate(%q) = %v, want ErrInvalidBarcode", tt.code, err)
+		}
+	}
+}
+
+func TestInternalEAN13(t *testing.T) {
+	tests := []struct {
+		prefix string
+		seq    int64
+		want   string
+		err    bool
+	}{
+		{prefix: "200", seq: 1, want: "2000000000015"},
+		{prefix: "200", seq: 123456789, want: "2001234567893"},
+		{prefix: "29", seq: 42, want: "2900000000421"},
+		{prefix: "200", seq: 1234567890, err: true}, // does not fit
+		{prefix: "2A", seq: 1, err: true},
+		{prefix: "200", seq: -1, err: true},
+		{prefix: "123456789012", seq: 0, err: true},
+	}
+	for _, tt := range tests {
+		got, err := InternalEAN13(tt.prefix, tt.seq)
+		if (err != nil) != tt.err {
+			t.Errorf("InternalEAN13(%q, %d) error = %v, want error %v", tt.prefix, tt.seq, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("InternalEAN13(%q, %d) = %q, want %q", tt.prefix, tt.seq, got, tt.want)
+		}
+		if !tt.err && !ValidEAN13(got) {
+			t.Errorf("InternalEAN13(%q, %d) = %q is not a valid EAN-13", tt.prefix, tt.seq, got)
+		}
+	}
+}
+
+func TestEncodeEAN13(t *testing.T) {
+	modules, err := EncodeEAN13("4006381333931")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modules) != 95 {
+		t.Fatalf("len = %d, want 95", len(modules))
+	}
+	// Start, centre and end guards
+	if modules[:3] != "101" || modules[45:50] != "01010" || modules[92:] != "101" {
+		t.Errorf("guards missing in %s", modules)
+	}
+	// First digit 4 gives the left half LGLLGG parity: 0 in L, 0 in G, 6 in L
+	if modules[3:10] != "0001101" || modules[10:17] != "0100111" || modules[17:24] != "0101111" {
+		t.Errorf("left half = %s", modules[3:24])
+	}
+	// Right half is always R: the check digit 1
+	if modules[85:92] != "1100110" {
+		t.Errorf("check digit = %s, want 1100110", modules[85:92])
+	}
+
+	for _, code := range []string{"4006381333932", "400638133393", ""} {
+		if _, err := EncodeEAN13(code); !errors.Is(err, ErrInvalidBarcode) {
+			t.Errorf("EncodeEAN13(%q) = %v, want ErrInvalidBarcode", code, err)
+		}
+	}
+}
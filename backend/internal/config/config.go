@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -19,6 +21,36 @@ type Config struct {
 	JWTSecret   string
 	UploadDir   string
 	MaxFileSize int64
+
+	// Weighted EAN-13 prefixes (20–29) whose value part is a price, not a weight
+	ScalePricePrefixes []string
+	// Numeric prefix of generated in-store EAN-13 codes
+	InternalBarcodePrefix string
+
+	// Upload storage: "local" (UploadDir) or "s3"
+	StorageDriver     string
+	StorageSigningKey string
+	SignedURLTTL      time.Duration
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKey       string
+	S3SecretKey       string
+	S3UseSSL          bool
+	S3PublicURL       string
+
+	// Orphaned image files older than ImageGCMinAge are removed every ImageGCInterval (0 disables)
+	ImageGCInterval time.Duration
+	ImageGCMinAge   time.Duration
+
+	// Trashed products and companies are purged TrashRetention after deletion,
+	// checked every TrashPurgeInterval (0 disables)
+	TrashRetention     time.Duration
+	TrashPurgeInterval time.Duration
+
+	// Stock is reserved for a pending order this long; unpaid orders are then
+	// cancelled (0 reserves until the order is closed)
+	OrderReservationTTL time.Duration
 }
 
 func Load() (*Config, error) {
@@ -37,6 +69,43 @@ func Load() (*Config, error) {
 		JWTSecret:   getEnv("JWT_SECRET", "change-this-secret"),
 		UploadDir:   getEnv("UPLOAD_DIR", "./uploads"),
 		MaxFileSize: 10 * 1024 * 1024, // 10MB
+
+		ScalePricePrefixes:    getEnvList("SCALE_PRICE_PREFIXES", "28,29"),
+		InternalBarcodePrefix: getEnv("INTERNAL_BARCODE_PREFIX", "200"),
+
+		StorageDriver: getEnv("STORAGE_DRIVER", "local"),
+		S3Endpoint:    getEnv("S3_ENDPOINT", ""),
+		S3Region:      getEnv("S3_REGION", "us-east-1"),
+		S3Bucket:      getEnv("S3_BUCKET", ""),
+		S3AccessKey:   getEnv("S3_ACCESS_KEY", ""),
+		S3SecretKey:   getEnv("S3_SECRET_KEY", ""),
+		S3UseSSL:      getEnv("S3_USE_SSL", "true") == "true",
+		S3PublicURL:   getEnv("S3_PUBLIC_URL", ""),
+	}
+
+	// Signed URLs fall back to the JWT secret, so they work without extra setup
+	cfg.StorageSigningKey = getEnv("STORAGE_SIGNING_KEY", cfg.JWTSecret)
+
+	ttl, err := time.ParseDuration(getEnv("SIGNED_URL_TTL", "1h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SIGNED_URL_TTL: %w", err)
+	}
+	cfg.SignedURLTTL = ttl
+
+	if cfg.ImageGCInterval, err = time.ParseDuration(getEnv("IMAGE_GC_INTERVAL", "6h")); err != nil {
+		return nil, fmt.Errorf("invalid IMAGE_GC_INTERVAL: %w", err)
+	}
+	if cfg.ImageGCMinAge, err = time.ParseDuration(getEnv("IMAGE_GC_MIN_AGE", "24h")); err != nil {
+		return nil, fmt.Errorf("invalid IMAGE_GC_MIN_AGE: %w", err)
+	}
+	if cfg.TrashRetention, err = time.ParseDuration(getEnv("TRASH_RETENTION", "720h")); err != nil {
+		return nil, fmt.Errorf("invalid TRASH_RETENTION: %w", err)
+	}
+	if cfg.TrashPurgeInterval, err = time.ParseDuration(getEnv("TRASH_PURGE_INTERVAL", "1h")); err != nil {
+		return nil, fmt.Errorf("invalid TRASH_PURGE_INTERVAL: %w", err)
+	}
+	if cfg.OrderReservationTTL, err = time.ParseDuration(getEnv("ORDER_RESERVATION_TTL", "30m")); err != nil {
+		return nil, fmt.Errorf("invalid ORDER_RESERVATION_TTL: %w", err)
 	}
 
 	// Create upload directory if not exists
@@ -60,3 +129,13 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvList(key, defaultValue string) []string {
+	var list []string
+	for _, v := range strings.Split(getEnv(key, defaultValue), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
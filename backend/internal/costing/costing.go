@@ -0,0 +1,68 @@
+package costing
+
+import "math"
+
+// Methods a company can value the stock it sells with
+const (
+	FIFO    = "fifo"    // a sale costs what the oldest stock on hand cost
+	Average = "average" // a sale costs the moving weighted average, updated on every receipt
+)
+
+// Known reports whether method is a supported costing method
+func Known(method string) bool {
+	return method == FIFO || method == Average
+}
+
+// Lot is stock that arrived at one unit cost, with what is left of it
+type Lot struct {
+	Remaining float64
+	UnitCost  float64
+}
+
+// AverageAfterReceipt returns the average unit cost once qty arrives at
+// unitCost on top of onHand at average. Stock at or below zero has no cost
+// left to average with, so the new cost replaces it.
+func AverageAfterReceipt(onHand, average, qty, unitCost float64) float64 {
+	if onHand <= 0 || onHand+qty <= 0 {
+		return unitCost
+	}
+	return (onHand*average + qty*unitCost) / (onHand + qty)
+}
+
+// Cost is what taking qty out of stock costs. lots are the lots still on
+// hand, oldest first; skip is stock already taken from them that has not
+// been written back yet. FIFO takes the lots in order and values anything
+// beyond them at average, which is also what the average method uses.
+func Cost(method string, lots []Lot, skip, qty, average float64) float64 {
+	if method != FIFO {
+		return qty * average
+	}
+	var cost float64
+	left := qty
+	for _, lot := range lots {
+		if left <= 0 {
+			break
+		}
+		available := lot.Remaining
+		if skip > 0 {
+			used := math.Min(skip, available)
+			skip -= used
+			available -= used
+		}
+		if available <= 0 {
+			continue
+		}
+		take := math.Min(available, left)
+		cost += take * lot.UnitCost
+		left -= take
+	}
+	if left > 0 {
+		cost += left * average
+	}
+	return cost
+}
+
+// Money rounds an amount to two decimal places, as amounts are stored
+func Money(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,63 @@
+package costing
+
+import "testing"
+
+func TestCost(t *testing.T) {
+	lots := []Lot{
+		{Remaining: 10, UnitCost: 100},
+		{Remaining: 5, UnitCost: 120},
+		{Remaining: 20, UnitCost: 150},
+	}
+	tests := []struct {
+		name    string
+		method  string
+		lots    []Lot
+		skip    float64
+		qty     float64
+		average float64
+		want    float64
+	}{
+		{name: "fifo within the oldest lot", method: FIFO, lots: lots, qty: 4, average: 130, want: 400},
+		{name: "fifo across lots", method: FIFO, lots: lots, qty: 12, average: 130, want: 10*100 + 2*120},
+		{name: "fifo past the lots at average", method: FIFO, lots: lots, qty: 40, average: 130, want: 1000 + 600 + 3000 + 5*130},
+		{name: "fifo after an earlier line", method: FIFO, lots: lots, skip: 12, qty: 5, average: 130, want: 3*120 + 2*150},
+		{name: "fifo skip past a lot exactly", method: FIFO, lots: lots, skip: 10, qty: 1, average: 130, want: 120},
+		{name: "fifo without lots", method: FIFO, qty: 3, average: 130, want: 390},
+		{name: "fifo weighed quantity", method: FIFO, lots: []Lot{{Remaining: 0.5, UnitCost: 20000}}, qty: 0.25, want: 5000},
+		{name: "average ignores lots", method: Average, lots: lots, qty: 12, average: 130, want: 1560},
+		{name: "unknown method is average", method: "lifo", lots: lots, qty: 2, average: 130, want: 260},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Cost(tt.method, tt.lots, tt.skip, tt.qty, tt.average); Money(got) != tt.want {
+				t.Errorf("Cost = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAverageAfterReceipt(t *testing.T) {
+	tests := []struct {
+		name                           string
+		onHand, average, qty, unitCost float64
+		want                           float64
+	}{
+		{name: "weighted", onHand: 10, average: 100, qty: 30, unitCost: 140, want: 130},
+		{name: "empty stock takes the new cost", onHand: 0, average: 100, qty: 5, unitCost: 90, want: 90},
+		{name: "negative stock takes the new cost", onHand: -3, average: 100, qty: 5, unitCost: 90, want: 90},
+		{name: "return that empties stock", onHand: 4, average: 100, qty: -4, unitCost: 80, want: 80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AverageAfterReceipt(tt.onHand, tt.average, tt.qty, tt.unitCost); Money(got) != tt.want {
+				t.Errorf("AverageAfterReceipt = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKnown(t *testing.T) {
+	if !Known(FIFO) || !Known(Average) || Known("lifo") || Known("") {
+		t.Error("Known does not match the supported methods")
+	}
+}
@@ -0,0 +1,195 @@
+// Package events pushes changes to connected clients.
+//
+// Handlers publish an event with Postgres NOTIFY, inside their transaction
+// when they have one, so it is only sent once the change is committed. Every
+// server instance LISTENs on the same channel and hands the events to the
+// clients of the company they belong to.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Channel is the NOTIFY channel shared by all server instances
+const Channel = "azaton_events"
+
+// Event types
+const (
+	ProductCreated = "product.created"
+	ProductUpdated = "product.updated"
+	ProductDeleted = "product.deleted"
+	StockChanged   = "stock.changed"
+	OrderCreated   = "order.created"
+	OrderUpdated   = "order.updated"
+	SaleCreated    = "sale.created"
+	// Resync tells clients that events may have been lost and they should
+	// reload what they show
+	Resync = "resync"
+)
+
+// maxPayload stays under the 8000 byte limit of a NOTIFY payload
+const maxPayload = 7900
+
+// Event is one change of a company's data
+type Event struct {
+	Type      string          `json:"type"`
+	CompanyID int             `json:"company_id"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Execer is a pool, connection or transaction
+type Execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+// Publish sends an event to the clients of a company on every instance
+func Publish(ctx context.Context, db Execer, eventType string, companyID int, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(Event{Type: eventType, CompanyID: companyID, Data: raw})
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxPayload {
+		return fmt.Errorf("event %s is %d bytes, over the NOTIFY limit", eventType, len(payload))
+	}
+	_, err = db.Exec(ctx, `SELECT pg_notify($1, $2)`, Channel, string(payload))
+	return err
+}
+
+// subscriberBuffer is how many events a slow client may fall behind before
+// it is dropped; it reconnects and resyncs
+const subscriberBuffer = 64
+
+// Subscription receives the events of one company, or of all companies
+// when CompanyID is 0
+type Subscription struct {
+	CompanyID int
+	C         <-chan Event
+	c         chan Event
+	broker    *Broker
+}
+
+// Close stops the subscription
+func (s *Subscription) Close() {
+	s.broker.remove(s)
+}
+
+// Broker hands events received from Postgres to the subscribers of this instance
+type Broker struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe starts receiving the events of a company; 0 receives every event
+func (b *Broker) Subscribe(companyID int) *Subscription {
+	c := make(chan Event, subscriberBuffer)
+	s := &Subscription{CompanyID: companyID, C: c, c: c, broker: b}
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+func (b *Broker) remove(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// dispatch never blocks: a subscriber whose buffer is full is closed
+func (b *Broker) dispatch(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if s.CompanyID != 0 && s.CompanyID != ev.CompanyID && ev.Type != Resync {
+			continue
+		}
+		select {
+		case s.c <- ev:
+		default:
+			delete(b.subs, s)
+			close(s.c)
+		}
+	}
+}
+
+// closeAll ends every subscription, so streams finish on shutdown
+func (b *Broker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// Listen receives the events of all instances until ctx is cancelled. It
+// holds one pooled connection and reconnects when it is lost; since
+// notifications sent in between are gone, clients are then told to resync.
+func (b *Broker) Listen(ctx context.Context, db *pgxpool.Pool) {
+	defer b.closeAll()
+
+	reconnect := false
+	for ctx.Err() == nil {
+		err := b.listen(ctx, db, reconnect)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Event listener disconnected: %v", err)
+		reconnect = true
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (b *Broker) listen(ctx context.Context, db *pgxpool.Pool, reconnect bool) error {
+	pooled, err := db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	// The connection stays in LISTEN state, so it is never handed back to the pool
+	conn := pooled.Hijack()
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, `LISTEN `+Channel); err != nil {
+		return err
+	}
+	if reconnect {
+		b.dispatch(Event{Type: Resync})
+	}
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var ev Event
+		if err := json.Unmarshal([]byte(n.Payload), &ev); err != nil {
+			log.Printf("Ignoring malformed event: %v", err)
+			continue
+		}
+		b.dispatch(ev)
+	}
+}
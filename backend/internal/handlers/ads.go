@@ -2,14 +2,50 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// advertisementColumns are the columns scanAdvertisement reads
+const advertisementColumns = `id, company_id, company_name, title, description,
+	image_url, link_url, status, start_date, end_date, created_at, version`
+
+// scanAdvertisement reads a row of advertisementColumns
+func scanAdvertisement(row pgx.Row) (map[string]interface{}, error) {
+	var id, version int
+	var companyID *int
+	var companyName, title, description, status string
+	var imageURL, linkURL *string
+	var startDate, endDate *time.Time
+	var createdAt time.Time
+
+	if err := row.Scan(&id, &companyID, &companyName, &title, &description,
+		&imageURL, &linkURL, &status, &startDate, &endDate, &createdAt, &version); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"id":           id,
+		"company_id":   companyID,
+		"company_name": companyName,
+		"title":        title,
+		"description":  description,
+		"image_url":    imageURL,
+		"link_url":     linkURL,
+		"status":       status,
+		"start_date":   startDate,
+		"end_date":     endDate,
+		"created_at":   createdAt,
+		"version":      version,
+	}, nil
+}
+
 // GetAdvertisements returns all advertisements
 func GetAdvertisements(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -21,8 +57,7 @@ func GetAdvertisements(db *pgxpool.Pool) gin.HandlerFunc {
 
 		if status != "" {
 			query = `
-				SELECT id, company_id, company_name, title, description, 
-					   image_url, link_url, status, start_date, end_date, created_at
+				SELECT ` + advertisementColumns + `
 				FROM advertisements 
 				WHERE status = $1
 				ORDER BY id DESC
@@ -30,8 +65,7 @@ func GetAdvertisements(db *pgxpool.Pool) gin.HandlerFunc {
 			args = append(args, status)
 		} else {
 			query = `
-				SELECT id, company_id, company_name, title, description, 
-					   image_url, link_url, status, start_date, end_date, created_at
+				SELECT ` + advertisementColumns + `
 				FROM advertisements 
 				ORDER BY id DESC
 			`
@@ -46,31 +80,11 @@ func GetAdvertisements(db *pgxpool.Pool) gin.HandlerFunc {
 
 		var ads []map[string]interface{}
 		for rows.Next() {
-			var id int
-			var companyID *int
-			var companyName, title, description, status string
-			var imageURL, linkURL *string
-			var startDate, endDate *time.Time
-			var createdAt time.Time
-
-			if err := rows.Scan(&id, &companyID, &companyName, &title, &description,
-				&imageURL, &linkURL, &status, &startDate, &endDate, &createdAt); err != nil {
+			ad, err := scanAdvertisement(rows)
+			if err != nil {
 				continue
 			}
-
-			ads = append(ads, map[string]interface{}{
-				"id":           id,
-				"company_id":   companyID,
-				"company_name": companyName,
-				"title":        title,
-				"description":  description,
-				"image_url":    imageURL,
-				"link_url":     linkURL,
-				"status":       status,
-				"start_date":   startDate,
-				"end_date":     endDate,
-				"created_at":   createdAt,
-			})
+			ads = append(ads, ad)
 		}
 
 		c.JSON(http.StatusOK, gin.H{"advertisements": ads})
@@ -166,7 +180,8 @@ func CreateAdvertisement(db *pgxpool.Pool) gin.HandlerFunc {
 	}
 }
 
-// UpdateAdvertisement updates an advertisement
+// UpdateAdvertisement updates an advertisement. If-Match must carry the ETag
+// the edit was based on; an advertisement changed since gets 412.
 func UpdateAdvertisement(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -189,21 +204,53 @@ func UpdateAdvertisement(db *pgxpool.Pool) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		expected, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
 
-		_, err = db.Exec(ctx, `
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		current, err := scanAdvertisement(tx.QueryRow(ctx, `
+			SELECT `+advertisementColumns+` FROM advertisements WHERE id = $1 FOR UPDATE
+		`, id))
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Advertisement not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if version := current["version"].(int); !versionMatches(expected, version) {
+			preconditionFailed(c, version, "advertisement", current)
+			return
+		}
+
+		var version int
+		err = tx.QueryRow(ctx, `
 			UPDATE advertisements 
 			SET title = $1, description = $2, image_url = $3, link_url = $4, 
 				start_date = $5, end_date = $6, updated_at = NOW()
 			WHERE id = $7
+			RETURNING version
 		`, input.Title, input.Description, input.ImageURL, input.LinkURL,
-			input.StartDate, input.EndDate, id)
-
+			input.StartDate, input.EndDate, id).Scan(&version)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		setETag(c, version)
+		c.JSON(http.StatusOK, gin.H{"success": true, "version": version})
 	}
 }
 
@@ -284,8 +331,7 @@ func GetCompanyAdvertisements(db *pgxpool.Pool) gin.HandlerFunc {
 		}
 
 		rows, err := db.Query(ctx, `
-			SELECT id, company_id, company_name, title, description, 
-				   image_url, link_url, status, start_date, end_date, created_at
+			SELECT `+advertisementColumns+`
 			FROM advertisements 
 			WHERE company_id = $1
 			ORDER BY id DESC
@@ -299,31 +345,11 @@ func GetCompanyAdvertisements(db *pgxpool.Pool) gin.HandlerFunc {
 
 		var ads []map[string]interface{}
 		for rows.Next() {
-			var id int
-			var cID *int
-			var companyName, title, description, status string
-			var imageURL, linkURL *string
-			var startDate, endDate *time.Time
-			var createdAt time.Time
-
-			if err := rows.Scan(&id, &cID, &companyName, &title, &description,
-				&imageURL, &linkURL, &status, &startDate, &endDate, &createdAt); err != nil {
+			ad, err := scanAdvertisement(rows)
+			if err != nil {
 				continue
 			}
-
-			ads = append(ads, map[string]interface{}{
-				"id":           id,
-				"company_id":   cID,
-				"company_name": companyName,
-				"title":        title,
-				"description":  description,
-				"image_url":    imageURL,
-				"link_url":     linkURL,
-				"status":       status,
-				"start_date":   startDate,
-				"end_date":     endDate,
-				"created_at":   createdAt,
-			})
+			ads = append(ads, ad)
 		}
 
 		c.JSON(http.StatusOK, gin.H{"advertisements": ads})
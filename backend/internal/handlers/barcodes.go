@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"azaton-backend/internal/barcode"
+	"azaton-backend/internal/config"
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/labels"
+	"azaton-backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// barcodeIndex keeps a barcode to one live product per company
+const barcodeIndex = "idx_products_company_barcode_unique"
+
+// errBarcodeTaken is returned for a barcode another live product of the company holds
+var errBarcodeTaken = errors.New("barcode is already used by another product")
+
+// isBarcodeTaken reports whether err is a write refused by barcodeIndex
+func isBarcodeTaken(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == barcodeIndex
+}
+
+// barcodeTaken reports whether a live product of the company other than
+// exceptID holds code. barcodeIndex enforces the same, but it is only built
+// once a company's old duplicates are merged, so writes check first.
+func barcodeTaken(ctx context.Context, q querier, companyID int, code string, exceptID int) (bool, error) {
+	var taken bool
+	err := q.QueryRow(ctx, `
+		SELECT EXISTS(SELECT 1 FROM products
+			WHERE company_id = $1 AND barcode = $2 AND id <> $3 AND deleted_at IS NULL)
+	`, companyID, code, exceptID).Scan(&taken)
+	return taken, err
+}
+
+// lookupProduct is the subset of product columns a scanner needs to sell an item
+type lookupProduct struct {
+	ID                    int
+	Name                  string
+	Quantity              float64
+	Unit                  string
+	QuantityPrecision     int
+	Price                 float64
+	MarkupAmount          float64
+	SellingPrice          float64
+	Barcode               *string
+	Barid                 *int64
+	Category              string
+	AvailableForCustomers bool
+}
+
+// findProductByCode finds a company product by exact barcode, falling back to barid
+func findProductByCode(ctx context.Context, db *pgxpool.Pool, companyID int, code string) (*lookupProduct, error) {
+	const columns = `id, name, ` + productQuantitySQL + `, unit, quantity_precision, price, markup_amount,
+		selling_price, barcode, barid, category, available_for_customers`
+
+	scan := func(row pgx.Row) (*lookupProduct, error) {
+		var p lookupProduct
+		err := row.Scan(&p.ID, &p.Name, &p.Quantity, &p.Unit, &p.QuantityPrecision, &p.Price, &p.MarkupAmount,
+			&p.SellingPrice, &p.Barcode, &p.Barid, &p.Category, &p.AvailableForCustomers)
+		if err != nil {
+			return nil, err
+		}
+		return &p, nil
+	}
+
+	p, err := scan(db.QueryRow(ctx, `
+		SELECT `+columns+` FROM products
+		WHERE barcode = $1 AND company_id = $2 AND deleted_at IS NULL
+		ORDER BY id DESC LIMIT 1
+	`, code, companyID))
+	if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+		return p, err
+	}
+
+	barid, convErr := strconv.ParseInt(code, 10, 64)
+	if convErr != nil {
+		return nil, pgx.ErrNoRows
+	}
+
+	return scan(db.QueryRow(ctx, `
+		SELECT `+columns+` FROM products
+		WHERE barid = $1 AND company_id = $2 AND deleted_at IS NULL
+		ORDER BY id DESC LIMIT 1
+	`, barid, companyID))
+}
+
+// findProductByID loads the lookup columns of one company product
+func findProductByID(ctx context.Context, db *pgxpool.Pool, companyID, id int) (*lookupProduct, error) {
+	var p lookupProduct
+	err := db.QueryRow(ctx, `
+		SELECT id, name, `+productQuantitySQL+`, unit, quantity_precision, price, markup_amount,
+			selling_price, barcode, barid, category, available_for_customers
+		FROM products WHERE id = $1 AND company_id = $2 AND deleted_at IS NULL
+	`, id, companyID).Scan(&p.ID, &p.Name, &p.Quantity, &p.Unit, &p.QuantityPrecision, &p.Price,
+		&p.MarkupAmount, &p.SellingPrice, &p.Barcode, &p.Barid, &p.Category, &p.AvailableForCustomers)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// LookupProduct returns a single product for a scanned barcode or barid,
+// decoding weighted scale barcodes into a ready-to-sell line
+func LookupProduct(db *pgxpool.Pool, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		companyID, err := strconv.Atoi(c.Query("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+			return
+		}
+
+		code := c.Query("code")
+		if code == "" {
+			code = c.Query("barcode")
+		}
+		if code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code required"})
+			return
+		}
+
+		// An exact match always wins, so products stored with a full 2X... barcode still work
+		product, err := findProductByCode(ctx, db, companyID, code)
+
+		// Then the barcode of a packaging unit, such as a box of 12
+		var packaging *models.ProductUnit
+		if errors.Is(err, pgx.ErrNoRows) {
+			if u, unitErr := findUnitByCode(ctx, db, companyID, code); unitErr == nil {
+				packaging = u
+				product, err = findProductByID(ctx, db, companyID, u.ProductID)
+			} else if !errors.Is(unitErr, pgx.ErrNoRows) {
+				err = unitErr
+			}
+		}
+
+		var scale *barcode.ScaleBarcode
+		if errors.Is(err, pgx.ErrNoRows) {
+			if sb, parseErr := barcode.ParseScale(code, cfg.ScalePricePrefixes); parseErr == nil {
+				scale = sb
+				product, err = findProductByCode(ctx, db, companyID, sb.ProductCode)
+			}
+		}
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found", "code": code})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Line prices are per line unit; a packaging unit costs factor base units
+		quantity := 1.0
+		unit := ""
+		price := product.SellingPrice
+		markupAmount := product.MarkupAmount
+		if packaging != nil {
+			unit = packaging.Name
+			price = roundTo(product.SellingPrice*packaging.Factor, 2)
+			markupAmount = roundTo(product.MarkupAmount*packaging.Factor, 2)
+		}
+		total := price
+		if scale != nil {
+			switch scale.Kind {
+			case barcode.ScaleWeight:
+				quantity = scale.Weight
+				total = roundTo(product.SellingPrice*quantity, 2)
+			case barcode.ScalePrice:
+				total = scale.Price
+				quantity = 0
+				if product.SellingPrice > 0 {
+					quantity = roundTo(scale.Price/product.SellingPrice, 3)
+				}
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"product": map[string]interface{}{
+				"id":                      product.ID,
+				"name":                    product.Name,
+				"quantity":                product.Quantity,
+				"unit":                    product.Unit,
+				"quantity_precision":      product.QuantityPrecision,
+				"price":                   product.Price,
+				"markup_amount":           product.MarkupAmount,
+				"selling_price":           product.SellingPrice,
+				"barcode":                 product.Barcode,
+				"barid":                   product.Barid,
+				"category":                product.Category,
+				"available_for_customers": product.AvailableForCustomers,
+			},
+			"scale":     scale,
+			"packaging": packaging,
+			"line": map[string]interface{}{
+				"product_id":    product.ID,
+				"name":          product.Name,
+				"quantity":      quantity,
+				"unit":          unit,
+				"price":         price,
+				"markup_amount": markupAmount,
+				"selling_price": price,
+				"total":         total,
+				"barcode":       code,
+			},
+		})
+	}
+}
+
+func roundTo(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
+
+// allocateBarcodes reserves n unused in-store EAN-13 codes for a company.
+// The sequence row is locked for the rest of tx, so concurrent allocations never overlap.
+func allocateBarcodes(ctx context.Context, tx pgx.Tx, companyID int, prefix string, n int) ([]string, error) {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO company_barcode_sequences (company_id) VALUES ($1)
+		ON CONFLICT (company_id) DO NOTHING
+	`, companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var seq int64
+	err = tx.QueryRow(ctx, `
+		SELECT last_value FROM company_barcode_sequences WHERE company_id = $1 FOR UPDATE
+	`, companyID).Scan(&seq)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, n)
+	for len(codes) < n {
+		seq++
+		code, err := barcode.InternalEAN13(prefix, seq)
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip codes already typed in by hand or imported
+		taken, err := barcodeTaken(ctx, tx, companyID, code, 0)
+		if err != nil {
+			return nil, err
+		}
+		if !taken {
+			codes = append(codes, code)
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE company_barcode_sequences SET last_value = $1, updated_at = NOW() WHERE company_id = $2
+	`, seq, companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// GenerateBarcodes assigns internal EAN-13 codes to products, or reserves free codes
+func GenerateBarcodes(db *pgxpool.Pool, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input struct {
+			CompanyID  int   `json:"company_id" binding:"required"`
+			ProductIDs []int `json:"product_ids"`
+			AllMissing bool  `json:"all_missing"` // every product of the company without a barcode
+			Overwrite  bool  `json:"overwrite"`   // replace existing barcodes of product_ids
+			Count      int   `json:"count"`       // reserve codes without assigning them
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if len(input.ProductIDs) == 0 && !input.AllMissing && (input.Count < 1 || input.Count > 1000) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "product_ids, all_missing or count (1-1000) required"})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if len(input.ProductIDs) == 0 && !input.AllMissing {
+			codes, err := allocateBarcodes(ctx, tx, input.CompanyID, cfg.InternalBarcodePrefix, input.Count)
+			if err == nil {
+				err = tx.Commit(ctx)
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{"success": true, "barcodes": codes})
+			return
+		}
+
+		rows, err := tx.Query(ctx, `
+			SELECT id FROM products
+			WHERE company_id = $1 AND deleted_at IS NULL
+			  AND (COALESCE(cardinality($2::int[]), 0) = 0 OR id = ANY($2))
+			  AND ($3 OR barcode IS NULL OR barcode = '')
+			ORDER BY id
+			FOR UPDATE
+		`, input.CompanyID, input.ProductIDs, input.Overwrite)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		codes, err := allocateBarcodes(ctx, tx, input.CompanyID, cfg.InternalBarcodePrefix, len(ids))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		updates := make([]map[string]interface{}, 0, len(ids))
+		for i, id := range ids {
+			_, err := tx.Exec(ctx, `
+				UPDATE products SET barcode = $1, updated_at = NOW() WHERE id = $2
+			`, codes[i], id)
+			if isBarcodeTaken(err) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Generated barcode " + codes[i] + ": " + errBarcodeTaken.Error()})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			updates = append(updates, map[string]interface{}{"id": id, "barcode": codes[i]})
+		}
+		publishProducts(ctx, tx, events.ProductUpdated, ids)
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "generated": len(updates), "updates": updates})
+	}
+}
+
+// PrintProductLabels renders price-tag labels for the selected products as a PDF sheet or ZPL
+func PrintProductLabels(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input struct {
+			CompanyID  int             `json:"company_id" binding:"required"`
+			ProductIDs []int           `json:"product_ids" binding:"required"`
+			Format     string          `json:"format"` // pdf (default) or zpl
+			Copies     int             `json:"copies"`
+			Sheet      *labels.Sheet   `json:"sheet"`
+			Thermal    *labels.Thermal `json:"thermal"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if input.Format == "" {
+			input.Format = "pdf"
+		}
+		if input.Format != "pdf" && input.Format != "zpl" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be pdf or zpl"})
+			return
+		}
+		if input.Copies > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "copies must be at most 100"})
+			return
+		}
+
+		// Keep the order in which products were selected
+		rows, err := db.Query(ctx, `
+			SELECT name, selling_price, unit, COALESCE(barcode, '')
+			FROM products
+			WHERE company_id = $1 AND id = ANY($2) AND deleted_at IS NULL
+			ORDER BY array_position($2, id)
+		`, input.CompanyID, input.ProductIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		var tags []labels.Label
+		for rows.Next() {
+			var tag labels.Label
+			if err := rows.Scan(&tag.Name, &tag.Price, &tag.Unit, &tag.Barcode); err != nil {
+				continue
+			}
+			tags = append(tags, tag)
+		}
+
+		if len(tags) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No products found"})
+			return
+		}
+
+		var buf bytes.Buffer
+		var contentType, filename string
+		if input.Format == "zpl" {
+			thermal := labels.DefaultThermal
+			if input.Thermal != nil && input.Thermal.Width > 0 && input.Thermal.Height > 0 && input.Thermal.DPMM > 0 {
+				thermal = *input.Thermal
+			}
+			err = labels.ZPL(&buf, tags, thermal, input.Copies)
+			contentType, filename = "text/plain; charset=utf-8", "labels.zpl"
+		} else {
+			sheet := labels.DefaultSheet
+			if input.Sheet != nil {
+				sheet = *input.Sheet
+			}
+			err = labels.PDF(&buf, tags, sheet, input.Copies)
+			contentType, filename = "application/pdf", "labels.pdf"
+		}
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Data(http.StatusOK, contentType, buf.Bytes())
+	}
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/units"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// productQuantitySQL selects the stock of a product from an unaliased products
+// table. For a bundle it is the number of complete bundles its components make up;
+// a component in the trash counts as out of stock.
+const productQuantitySQL = `CASE WHEN products.is_bundle THEN COALESCE((
+		SELECT MIN(CASE WHEN cp.deleted_at IS NULL THEN GREATEST(FLOOR(cp.quantity / bi.quantity), 0) ELSE 0 END)
+		FROM product_bundle_items bi JOIN products cp ON cp.id = bi.component_id
+		WHERE bi.bundle_id = products.id
+	), 0) ELSE products.quantity END`
+
+// stockLine is a quantity of one product leaving (or returning to) stock.
+// Unit names a packaging unit of the product; empty is the base unit.
+type stockLine struct {
+	ProductID int
+	Quantity  float64
+	Unit      string
+}
+
+// expandBundles converts lines to base units, replaces bundles with their
+// components and sums the quantities per product. Lines come back ordered by
+// product ID, so rows are always locked in the same order.
+func expandBundles(ctx context.Context, q querier, lines []stockLine) ([]stockLine, error) {
+	lines, err := toBaseUnits(ctx, q, lines)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(lines))
+	for _, l := range lines {
+		ids = append(ids, l.ProductID)
+	}
+
+	rows, err := q.Query(ctx, `
+		SELECT bi.bundle_id, bi.component_id, bi.quantity
+		FROM product_bundle_items bi JOIN products b ON b.id = bi.bundle_id
+		WHERE b.is_bundle AND bi.bundle_id = ANY($1)
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	components := map[int][]stockLine{}
+	for rows.Next() {
+		var bundleID int
+		var line stockLine
+		if err := rows.Scan(&bundleID, &line.ProductID, &line.Quantity); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		components[bundleID] = append(components[bundleID], line)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	totals := map[int]float64{}
+	for _, l := range lines {
+		parts, ok := components[l.ProductID]
+		if !ok {
+			totals[l.ProductID] += l.Quantity
+			continue
+		}
+		for _, part := range parts {
+			totals[part.ProductID] += l.Quantity * part.Quantity
+		}
+	}
+
+	expanded := make([]stockLine, 0, len(totals))
+	for id, qty := range totals {
+		expanded = append(expanded, stockLine{ProductID: id, Quantity: units.Round(qty, units.MaxPrecision)})
+	}
+	sort.Slice(expanded, func(i, j int) bool { return expanded[i].ProductID < expanded[j].ProductID })
+	return expanded, nil
+}
+
+// loadBundleItems returns the components of a bundle
+func loadBundleItems(ctx context.Context, q querier, bundleID int) ([]models.BundleItem, error) {
+	rows, err := q.Query(ctx, `
+		SELECT p.id, p.name, bi.quantity, p.quantity, p.selling_price, p.deleted_at IS NOT NULL
+		FROM product_bundle_items bi JOIN products p ON p.id = bi.component_id
+		WHERE bi.bundle_id = $1
+		ORDER BY p.name
+	`, bundleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []models.BundleItem{}
+	for rows.Next() {
+		var item models.BundleItem
+		if err := rows.Scan(&item.ProductID, &item.Name, &item.Quantity, &item.Stock,
+			&item.Price, &item.Deleted); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// bundleAvailable is how many complete bundles the components' stock makes up
+func bundleAvailable(items []models.BundleItem) float64 {
+	available := -1.0
+	for _, item := range items {
+		n := 0.0
+		if !item.Deleted && item.Stock > 0 {
+			n = math.Floor(item.Stock / item.Quantity)
+		}
+		if available < 0 || n < available {
+			available = n
+		}
+	}
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
+// GetBundle returns the components of a bundle and how many bundles are available
+func GetBundle(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		var isBundle bool
+		err = db.QueryRow(ctx, `
+			SELECT is_bundle FROM products WHERE id = $1 AND deleted_at IS NULL
+		`, id).Scan(&isBundle)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+
+		items, err := loadBundleItems(ctx, db, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"is_bundle": isBundle,
+			"items":     items,
+			"available": bundleAvailable(items),
+		})
+	}
+}
+
+// SetBundle replaces the components of a product, making it a bundle.
+// An empty list turns the bundle back into a plain product.
+func SetBundle(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		var input struct {
+			Items []struct {
+				ProductID int     `json:"product_id"`
+				Quantity  float64 `json:"quantity"`
+			} `json:"items"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		seen := map[int]bool{}
+		componentIDs := make([]int, 0, len(input.Items))
+		for _, item := range input.Items {
+			if item.Quantity <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Component quantities must be positive"})
+				return
+			}
+			if item.ProductID == id {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "A bundle cannot contain itself"})
+				return
+			}
+			if seen[item.ProductID] {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Product %d is listed twice", item.ProductID)})
+				return
+			}
+			seen[item.ProductID] = true
+			componentIDs = append(componentIDs, item.ProductID)
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var companyID int
+		err = tx.QueryRow(ctx, `
+			SELECT company_id FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE
+		`, id).Scan(&companyID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Components must be plain products of the same company; bundles do not nest
+		if len(componentIDs) > 0 {
+			var usedInBundle bool
+			err = tx.QueryRow(ctx, `
+				SELECT EXISTS(SELECT 1 FROM product_bundle_items WHERE component_id = $1)
+			`, id).Scan(&usedInBundle)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if usedInBundle {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "This product is a component of another bundle"})
+				return
+			}
+
+			rows, err := tx.Query(ctx, `
+				SELECT id, quantity_precision FROM products
+				WHERE id = ANY($1) AND company_id = $2 AND deleted_at IS NULL AND NOT is_bundle
+			`, componentIDs, companyID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			precision := map[int]int{}
+			for rows.Next() {
+				var componentID, p int
+				if rows.Scan(&componentID, &p) == nil {
+					precision[componentID] = p
+				}
+			}
+			rows.Close()
+
+			for _, item := range input.Items {
+				p, ok := precision[item.ProductID]
+				if !ok {
+					c.JSON(http.StatusBadRequest, gin.H{
+						"error": fmt.Sprintf("Product %d is not a product of this company or is itself a bundle", item.ProductID),
+					})
+					return
+				}
+				if err := units.Validate(item.Quantity, p); err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Product %d: %v", item.ProductID, err)})
+					return
+				}
+			}
+		}
+
+		_, err = tx.Exec(ctx, `DELETE FROM product_bundle_items WHERE bundle_id = $1`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, item := range input.Items {
+			_, err = tx.Exec(ctx, `
+				INSERT INTO product_bundle_items (bundle_id, component_id, quantity) VALUES ($1, $2, $3)
+			`, id, item.ProductID, item.Quantity)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE products SET is_bundle = $1, updated_at = NOW() WHERE id = $2
+		`, len(input.Items) > 0, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		items, err := loadBundleItems(ctx, tx, id)
+		if err == nil {
+			publishProducts(ctx, tx, events.ProductUpdated, []int{id})
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success":   true,
+			"is_bundle": len(items) > 0,
+			"items":     items,
+			"available": bundleAvailable(items),
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"azaton-backend/internal/config"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// catalogVersion returns a counter that grows with every insert, update and
+// purge of the products of a company, or of all companies when companyID is 0.
+// Each write bumps a product's version and a purge leaves a tombstone one
+// version higher, so the sum over both only ever increases.
+func catalogVersion(ctx context.Context, q querier, companyID int) (int64, error) {
+	var version int64
+	err := q.QueryRow(ctx, `
+		SELECT COALESCE((SELECT SUM(version) FROM products WHERE $1 = 0 OR company_id = $1), 0)
+			 + COALESCE((SELECT SUM(version) FROM product_tombstones WHERE $1 = 0 OR company_id = $1), 0)
+	`, companyID).Scan(&version)
+	return version, err
+}
+
+// catalogETag tags a product listing by its query, the catalog version and
+// the stock reservations behind available quantities. Signed image URLs
+// expire, so the tag also moves on every half signing TTL and a cached
+// listing is never served with links about to run out.
+func catalogETag(ctx context.Context, db *pgxpool.Pool, cfg *config.Config, c *gin.Context) (string, error) {
+	companyID, _ := strconv.Atoi(c.Query("company_id"))
+	version, err := catalogVersion(ctx, db, companyID)
+	if err != nil {
+		return "", err
+	}
+	reservations, err := reservationsTag(ctx, db, companyID)
+	if err != nil {
+		return "", err
+	}
+
+	var window int64
+	if half := cfg.SignedURLTTL / 2; half > 0 {
+		window = time.Now().UnixNano() / int64(half)
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%s", c.Request.URL.RawQuery, version, window, reservations)))
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`, nil
+}
+
+// hasPrivateImages reports whether any image of a product is served through a signed URL
+func hasPrivateImages(images []models.ProductImage) bool {
+	for _, img := range images {
+		if storage.IsPrivate(img.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+// syncCursor is a point in the product change stream: every product written
+// by a transaction before XID, plus those of XID itself up to product ID.
+type syncCursor struct {
+	XID int64 `json:"x"`
+	ID  int   `json:"id"`
+}
+
+func (sc syncCursor) encode() string {
+	data, _ := json.Marshal(sc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeSyncCursor(s string) (*syncCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var sc syncCursor
+	if err := json.Unmarshal(data, &sc); err != nil || sc.XID <= 0 {
+		return nil, errInvalidCursor
+	}
+	return &sc, nil
+}
+
+// GetProductChanges returns the products written and removed since a cursor,
+// so a client cache can catch up without downloading the whole catalog.
+// Without since it returns every active product, to seed the cache.
+//
+// Only transactions older than every one still running are reported. A
+// transaction that commits late can therefore not slip in behind a cursor
+// already handed out; it shows up on the next call instead.
+func GetProductChanges(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		companyID := 0
+		if companyIDStr := c.Query("company_id"); companyIDStr != "" {
+			var err error
+			if companyID, err = strconv.Atoi(companyIDStr); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+				return
+			}
+		}
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "500"))
+		if limit <= 0 || limit > 1000 {
+			limit = 500
+		}
+		availableOnly := c.Query("available_only") == "true"
+
+		since := syncCursor{}
+		initial := true
+		if s := c.Query("since"); s != "" {
+			cursor, err := decodeSyncCursor(s)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			since, initial = *cursor, false
+		}
+
+		var horizon int64
+		err := db.QueryRow(ctx, `SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint`).Scan(&horizon)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// A product leaves the client's view when it is trashed or purged, or
+		// for a customer catalog when it is taken off sale
+		rows, err := db.Query(ctx, `
+			SELECT id, change_xid::text::bigint,
+				   deleted_at IS NOT NULL OR ($5 AND NOT COALESCE(available_for_customers, true))
+			FROM products
+			WHERE ($1 = 0 OR company_id = $1)
+			  AND (change_xid, id) > ($2::text::xid8, $3) AND change_xid < $4::text::xid8
+			UNION ALL
+			SELECT product_id, change_xid::text::bigint, true
+			FROM product_tombstones
+			WHERE NOT $6 AND ($1 = 0 OR company_id = $1)
+			  AND (change_xid, product_id) > ($2::text::xid8, $3) AND change_xid < $4::text::xid8
+			ORDER BY 2, 1
+			LIMIT $7
+		`, companyID, strconv.FormatInt(since.XID, 10), since.ID, strconv.FormatInt(horizon, 10),
+			availableOnly, initial, limit+1)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var upsertIDs []int
+		deleted := []int{}
+		var last syncCursor
+		hasMore := false
+		for rows.Next() {
+			if len(upsertIDs)+len(deleted) == limit {
+				hasMore = true
+				break
+			}
+			var id int
+			var xid int64
+			var removed bool
+			if err := rows.Scan(&id, &xid, &removed); err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			last = syncCursor{XID: xid, ID: id}
+			if removed {
+				// A first sync has nothing to remove
+				if !initial {
+					deleted = append(deleted, id)
+				}
+				continue
+			}
+			upsertIDs = append(upsertIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		upserted := []map[string]interface{}{}
+		if len(upsertIDs) > 0 {
+			productRows, err := db.Query(ctx, `
+				SELECT `+productColumns+` FROM products WHERE id = ANY($1) ORDER BY id
+			`, upsertIDs)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			for productRows.Next() {
+				product, err := scanProduct(ctx, productRows, store, cfg.SignedURLTTL)
+				if err != nil {
+					continue
+				}
+				upserted = append(upserted, product)
+			}
+			productRows.Close()
+		}
+
+		// Once caught up, the next call starts from the horizon; rows of
+		// transactions still running then are picked up after it
+		next := syncCursor{XID: horizon}
+		if hasMore {
+			next = last
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"upserted":    upserted,
+			"deleted":     deleted,
+			"next_cursor": next.encode(),
+			"has_more":    hasMore,
+		})
+	}
+}
@@ -2,10 +2,17 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strconv"
+	"time"
+
+	"azaton-backend/internal/costing"
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/storage"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -16,8 +23,8 @@ func GetCompanies(db *pgxpool.Pool) gin.HandlerFunc {
 
 		rows, err := db.Query(ctx, `
 			SELECT id, name, phone, password, access_key, is_private, company_id, 
-				   first_name, last_name, rating, rating_count, created_at
-			FROM companies
+				   first_name, last_name, rating, rating_count, created_at, version
+			FROM companies WHERE deleted_at IS NULL
 			ORDER BY id
 		`)
 		if err != nil {
@@ -33,11 +40,11 @@ func GetCompanies(db *pgxpool.Pool) gin.HandlerFunc {
 			var isPrivate bool
 			var companyID, firstName, lastName *string
 			var rating float64
-			var ratingCount int
+			var ratingCount, version int
 			var createdAt interface{}
 
 			if err := rows.Scan(&id, &name, &phone, &password, &accessKey, &isPrivate,
-				&companyID, &firstName, &lastName, &rating, &ratingCount, &createdAt); err != nil {
+				&companyID, &firstName, &lastName, &rating, &ratingCount, &createdAt, &version); err != nil {
 				continue
 			}
 
@@ -54,6 +61,7 @@ func GetCompanies(db *pgxpool.Pool) gin.HandlerFunc {
 				"rating":       rating,
 				"rating_count": ratingCount,
 				"created_at":   createdAt,
+				"version":      version,
 			})
 		}
 
@@ -61,7 +69,38 @@ func GetCompanies(db *pgxpool.Pool) gin.HandlerFunc {
 	}
 }
 
-// GetCompany returns a single company by ID
+// companyDetails is a single company as GetCompany returns it
+type companyDetails struct {
+	ID            int     `json:"id"`
+	Name          string  `json:"name"`
+	Phone         string  `json:"phone"`
+	Password      string  `json:"password"`
+	AccessKey     string  `json:"access_key"`
+	IsPrivate     bool    `json:"is_private"`
+	CompanyID     *string `json:"company_id"`
+	Rating        float64 `json:"rating"`
+	RatingCount   int     `json:"rating_count"`
+	CostingMethod string  `json:"costing_method"`
+	Version       int     `json:"version"`
+}
+
+// loadCompany returns an active company
+func loadCompany(ctx context.Context, q querier, id int) (*companyDetails, error) {
+	var company companyDetails
+	err := q.QueryRow(ctx, `
+		SELECT id, name, phone, password, access_key, is_private, company_id, rating, rating_count,
+			   costing_method, version
+		FROM companies WHERE id = $1 AND deleted_at IS NULL
+	`, id).Scan(&company.ID, &company.Name, &company.Phone, &company.Password,
+		&company.AccessKey, &company.IsPrivate, &company.CompanyID, &company.Rating, &company.RatingCount,
+		&company.CostingMethod, &company.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &company, nil
+}
+
+// GetCompany returns a single company by ID, with its version as the ETag
 func GetCompany(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -71,29 +110,13 @@ func GetCompany(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
-		var company struct {
-			ID          int      `json:"id"`
-			Name        string   `json:"name"`
-			Phone       string   `json:"phone"`
-			Password    string   `json:"password"`
-			AccessKey   string   `json:"access_key"`
-			IsPrivate   bool     `json:"is_private"`
-			CompanyID   *string  `json:"company_id"`
-			Rating      float64  `json:"rating"`
-			RatingCount int      `json:"rating_count"`
-		}
-
-		err = db.QueryRow(ctx, `
-			SELECT id, name, phone, password, access_key, is_private, company_id, rating, rating_count
-			FROM companies WHERE id = $1
-		`, id).Scan(&company.ID, &company.Name, &company.Phone, &company.Password,
-			&company.AccessKey, &company.IsPrivate, &company.CompanyID, &company.Rating, &company.RatingCount)
-
+		company, err := loadCompany(ctx, db, id)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
 			return
 		}
 
+		setETag(c, company.Version)
 		c.JSON(http.StatusOK, gin.H{"company": company})
 	}
 }
@@ -113,7 +136,7 @@ func GetCompanyByCompanyId(db *pgxpool.Pool) gin.HandlerFunc {
 
 		err := db.QueryRow(ctx, `
 			SELECT id, name, is_private, company_id
-			FROM companies WHERE company_id = $1
+			FROM companies WHERE company_id = $1 AND deleted_at IS NULL
 		`, companyID).Scan(&company.ID, &company.Name, &company.IsPrivate, &company.CompanyID)
 
 		if err != nil {
@@ -172,7 +195,8 @@ func CreateCompany(db *pgxpool.Pool) gin.HandlerFunc {
 	}
 }
 
-// UpdateCompany updates an existing company
+// UpdateCompany updates an existing company. If-Match must carry the ETag the
+// edit was based on; a company changed since gets 412.
 func UpdateCompany(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -187,6 +211,39 @@ func UpdateCompany(db *pgxpool.Pool) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		expected, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var version int
+		err = tx.QueryRow(ctx, `
+			SELECT version FROM companies WHERE id = $1 AND deleted_at IS NULL FOR UPDATE
+		`, id).Scan(&version)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !versionMatches(expected, version) {
+			current, err := loadCompany(ctx, tx, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			preconditionFailed(c, current.Version, "company", current)
+			return
+		}
 
 		// Build dynamic update query
 		query := "UPDATE companies SET updated_at = NOW()"
@@ -213,22 +270,40 @@ func UpdateCompany(db *pgxpool.Pool) gin.HandlerFunc {
 			args = append(args, accessKey)
 			argNum++
 		}
+		if method, ok := input["costing_method"]; ok {
+			// Lots and average costs are both kept up to date, so the
+			// method can change at any time; sales already made keep their cost
+			if m, _ := method.(string); !costing.Known(m) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "costing_method must be fifo or average"})
+				return
+			}
+			query += ", costing_method = $" + strconv.Itoa(argNum)
+			args = append(args, method)
+			argNum++
+		}
 
-		query += " WHERE id = $" + strconv.Itoa(argNum)
+		query += " WHERE id = $" + strconv.Itoa(argNum) + " RETURNING version"
 		args = append(args, id)
 
-		_, err = db.Exec(ctx, query, args...)
+		err = tx.QueryRow(ctx, query, args...).Scan(&version)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"success": true, "company": input})
+		setETag(c, version)
+		c.JSON(http.StatusOK, gin.H{"success": true, "company": input, "version": version})
 	}
 }
 
-// ToggleCompanyPrivacy toggles the privacy mode of a company
-func ToggleCompanyPrivacy(db *pgxpool.Pool) gin.HandlerFunc {
+// ToggleCompanyPrivacy toggles the privacy mode of a company. The files of its
+// product images and review photos move to the keys of the new privacy, so
+// private files are only reachable through signed URLs and public ones
+// through plain URLs.
+func ToggleCompanyPrivacy(db *pgxpool.Pool, store storage.Storage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 		id, err := strconv.Atoi(c.Param("id"))
@@ -247,7 +322,27 @@ func ToggleCompanyPrivacy(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
-		_, err = db.Exec(ctx, `
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var wasPrivate bool
+		err = tx.QueryRow(ctx, `
+			SELECT COALESCE(is_private, false) FROM companies WHERE id = $1 AND deleted_at IS NULL FOR UPDATE
+		`, id).Scan(&wasPrivate)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err = tx.Exec(ctx, `
 			UPDATE companies SET is_private = $1, company_id = $2, updated_at = NOW()
 			WHERE id = $3
 		`, input.IsPrivate, input.CompanyID, id)
@@ -257,11 +352,92 @@ func ToggleCompanyPrivacy(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		var productIDs []int
+		var newKeys, oldKeys []string
+		if wasPrivate != input.IsPrivate {
+			for _, t := range []struct{ table, column string }{
+				{"products", "images"},
+				{"product_reviews", "photos"},
+			} {
+				ids, w, r, err := rekeyCompanyImages(ctx, tx, store, t.table, t.column, id, input.IsPrivate)
+				newKeys = append(newKeys, w...)
+				oldKeys = append(oldKeys, r...)
+				if err != nil {
+					removeKeys(ctx, store, newKeys)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				if t.table == "products" {
+					productIDs = ids
+				}
+			}
+		}
+
+		publishProducts(ctx, tx, events.ProductUpdated, productIDs)
+		if err := tx.Commit(ctx); err != nil {
+			removeKeys(ctx, store, newKeys)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// The old files go once nothing points at them; the image GC
+		// removes any left behind
+		removeKeys(ctx, store, oldKeys)
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "moved_files": len(oldKeys)})
 	}
 }
 
-// DeleteCompany deletes a company
+// rekeyCompanyImages moves the images in column of a company's rows of table
+// to the keys of the given privacy. It returns the rows changed, the keys
+// written and the keys they replace.
+func rekeyCompanyImages(ctx context.Context, tx pgx.Tx, store storage.Storage, table, column string, companyID int, private bool) ([]int, []string, []string, error) {
+	type stored struct {
+		id     int
+		images []byte
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT id, `+column+` FROM `+table+` WHERE company_id = $1 ORDER BY id FOR UPDATE
+	`, companyID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var all []stored
+	for rows.Next() {
+		var s stored
+		if err := rows.Scan(&s.id, &s.images); err != nil {
+			rows.Close()
+			return nil, nil, nil, err
+		}
+		all = append(all, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var ids []int
+	var written, replaced []string
+	for _, s := range all {
+		moved, w, r, err := rekeyImages(ctx, store, s.images, private)
+		written = append(written, w...)
+		replaced = append(replaced, r...)
+		if err != nil {
+			return ids, written, replaced, err
+		}
+		if moved == nil {
+			continue
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE `+table+` SET `+column+` = $1, updated_at = NOW() WHERE id = $2
+		`, moved, s.id); err != nil {
+			return ids, written, replaced, err
+		}
+		ids = append(ids, s.id)
+	}
+	return ids, written, replaced, nil
+}
+
+// DeleteCompany moves a company and its products to the trash
 func DeleteCompany(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -271,13 +447,134 @@ func DeleteCompany(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
-		_, err = db.Exec(ctx, "DELETE FROM companies WHERE id = $1", id)
+		tx, err := db.Begin(ctx)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		defer tx.Rollback(ctx)
 
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		// Products get the company's deleted_at, so restoring the company brings
+		// back exactly these and not products deleted on their own earlier
+		var deletedAt time.Time
+		err = tx.QueryRow(ctx, `
+			UPDATE companies SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL
+			RETURNING deleted_at
+		`, id).Scan(&deletedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Company not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err = tx.Exec(ctx, `
+			UPDATE products SET deleted_at = $1 WHERE company_id = $2 AND deleted_at IS NULL
+		`, deletedAt, id)
+		if err == nil {
+			_, err = tx.Exec(ctx, `DELETE FROM stock_reservations WHERE company_id = $1`, id)
+		}
+		if err == nil {
+			publishCompanyProducts(ctx, tx, id)
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "deleted_at": deletedAt})
+	}
+}
+
+// GetDeletedCompanies returns the companies in the trash
+func GetDeletedCompanies(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		rows, err := db.Query(ctx, `
+			SELECT id, name, phone, deleted_at FROM companies
+			WHERE deleted_at IS NOT NULL
+			ORDER BY deleted_at DESC
+		`)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		companies := []map[string]interface{}{}
+		for rows.Next() {
+			var id int
+			var name, phone string
+			var deletedAt time.Time
+			if err := rows.Scan(&id, &name, &phone, &deletedAt); err != nil {
+				continue
+			}
+			companies = append(companies, map[string]interface{}{
+				"id":         id,
+				"name":       name,
+				"phone":      phone,
+				"deleted_at": deletedAt,
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{"companies": companies})
+	}
+}
+
+// RestoreCompany takes a company out of the trash, with the products deleted along with it
+func RestoreCompany(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company ID"})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var deletedAt time.Time
+		err = tx.QueryRow(ctx, `
+			SELECT deleted_at FROM companies WHERE id = $1 AND deleted_at IS NOT NULL FOR UPDATE
+		`, id).Scan(&deletedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Company not found in trash"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		tag, err := tx.Exec(ctx, `
+			UPDATE products SET deleted_at = NULL WHERE company_id = $1 AND deleted_at = $2
+		`, id, deletedAt)
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE companies SET deleted_at = NULL, updated_at = NOW() WHERE id = $1`, id)
+		}
+		if err == nil {
+			publishCompanyProducts(ctx, tx, id)
+			err = tx.Commit(ctx)
+		}
+		if isBarcodeTaken(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A restored product's " + errBarcodeTaken.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "restored_products": tag.RowsAffected()})
 	}
 }
 
@@ -305,7 +602,7 @@ func LoginCompany(db *pgxpool.Pool) gin.HandlerFunc {
 
 		err := db.QueryRow(ctx, `
 			SELECT id, name, phone, access_key
-			FROM companies WHERE phone = $1 AND password = $2
+			FROM companies WHERE phone = $1 AND password = $2 AND deleted_at IS NULL
 		`, input.Phone, input.Password).Scan(&company.ID, &company.Name, &company.Phone, &company.AccessKey)
 
 		if err != nil {
@@ -338,7 +635,7 @@ func VerifyCompanyAccess(db *pgxpool.Pool) gin.HandlerFunc {
 		}
 
 		err := db.QueryRow(ctx, `
-			SELECT id, name FROM companies WHERE id = $1 AND access_key = $2
+			SELECT id, name FROM companies WHERE id = $1 AND access_key = $2 AND deleted_at IS NULL
 		`, input.CompanyID, input.AccessKey).Scan(&company.ID, &company.Name)
 
 		if err != nil {
@@ -368,7 +665,7 @@ func GetCompanyProfile(db *pgxpool.Pool) gin.HandlerFunc {
 		}
 
 		err = db.QueryRow(ctx, `
-			SELECT id, name, rating, rating_count FROM companies WHERE id = $1
+			SELECT id, name, rating, rating_count FROM companies WHERE id = $1 AND deleted_at IS NULL
 		`, id).Scan(&company.ID, &company.Name, &company.Rating, &company.RatingCount)
 
 		if err != nil {
@@ -442,28 +739,46 @@ func GetFinancialStats(db *pgxpool.Pool) gin.HandlerFunc {
 		var stats struct {
 			TotalMarkupProfit float64 `json:"totalMarkupProfit"`
 			TotalRevenue      float64 `json:"totalRevenue"`
+			TotalCostOfGoods  float64 `json:"totalCostOfGoods"`
 			SalesCount        int     `json:"salesCount"`
 		}
 
+		// Paid orders and till sales both count. Those recorded before
+		// costing have no cost of goods; their markup stands in for the margin.
 		err = db.QueryRow(ctx, `
 			SELECT 
 				COALESCE(SUM(markup_profit), 0) as total_markup_profit,
 				COALESCE(SUM(total_amount), 0) as total_revenue,
+				COALESCE(SUM(COALESCE(cost_of_goods, total_amount - markup_profit)), 0) as total_cost_of_goods,
 				COUNT(*) as sales_count
-			FROM customer_orders
-			WHERE company_id = $1 AND status = 'completed' AND payment_confirmed = true
-		`, companyID).Scan(&stats.TotalMarkupProfit, &stats.TotalRevenue, &stats.SalesCount)
+			FROM (
+				SELECT total_amount, markup_profit, cost_of_goods FROM customer_orders
+				WHERE company_id = $1 AND status = 'completed' AND payment_confirmed = true
+				UNION ALL
+				SELECT total_amount, markup_profit, cost_of_goods FROM sales_history
+				WHERE company_id = $1
+			) sales
+		`, companyID).Scan(&stats.TotalMarkupProfit, &stats.TotalRevenue, &stats.TotalCostOfGoods, &stats.SalesCount)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
+		grossProfit := costing.Money(stats.TotalRevenue - stats.TotalCostOfGoods)
+		grossMargin := 0.0
+		if stats.TotalRevenue > 0 {
+			grossMargin = costing.Money(grossProfit / stats.TotalRevenue * 100)
+		}
+
 		c.JSON(http.StatusOK, gin.H{
-			"success":           true,
-			"totalMarkupProfit": stats.TotalMarkupProfit,
-			"totalRevenue":      stats.TotalRevenue,
-			"salesCount":        stats.SalesCount,
+			"success":            true,
+			"totalMarkupProfit":  stats.TotalMarkupProfit,
+			"totalRevenue":       stats.TotalRevenue,
+			"totalCostOfGoods":   costing.Money(stats.TotalCostOfGoods),
+			"grossProfit":        grossProfit,
+			"grossMarginPercent": grossMargin,
+			"salesCount":         stats.SalesCount,
 		})
 	}
 }
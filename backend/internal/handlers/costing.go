@@ -0,0 +1,502 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"azaton-backend/internal/costing"
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/pricing"
+	"azaton-backend/internal/units"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// maxReceiptItems caps the lines of one stock receipt
+const maxReceiptItems = 500
+
+// companyCostingMethod returns how a company values the stock it sells
+func companyCostingMethod(ctx context.Context, q querier, companyID int) (string, error) {
+	var method string
+	err := q.QueryRow(ctx, `SELECT costing_method FROM companies WHERE id = $1`, companyID).Scan(&method)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return costing.Average, nil
+	}
+	return method, err
+}
+
+// stockCoster values stock about to leave, before the quantities are written.
+// It remembers what it already valued, so two lines of the same product do
+// not take the same lots. Use it in the transaction that writes them: the
+// lots it valued are then the ones the stock_lots trigger consumes.
+type stockCoster struct {
+	q      querier
+	method string
+	taken  map[int]float64
+}
+
+func newStockCoster(ctx context.Context, q querier, companyID int) (*stockCoster, error) {
+	method, err := companyCostingMethod(ctx, q, companyID)
+	if err != nil {
+		return nil, err
+	}
+	return &stockCoster{q: q, method: method, taken: map[int]float64{}}, nil
+}
+
+// cost values qty base units of a product
+func (s *stockCoster) cost(ctx context.Context, productID int, qty float64) (float64, error) {
+	var average float64
+	err := s.q.QueryRow(ctx, `SELECT COALESCE(average_cost, price, 0) FROM products WHERE id = $1`, productID).Scan(&average)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var lots []costing.Lot
+	if s.method == costing.FIFO {
+		rows, err := s.q.Query(ctx, `
+			SELECT remaining, unit_cost FROM stock_lots
+			WHERE product_id = $1 AND remaining > 0
+			ORDER BY received_at, id
+		`, productID)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var lot costing.Lot
+			if err := rows.Scan(&lot.Remaining, &lot.UnitCost); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			lots = append(lots, lot)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	cost := costing.Cost(s.method, lots, s.taken[productID], qty, average)
+	s.taken[productID] += qty
+	return cost, nil
+}
+
+// lineCost values a sold line: packaging units are converted to the base
+// unit and a bundle costs what its components cost
+func (s *stockCoster) lineCost(ctx context.Context, line stockLine) (float64, error) {
+	parts, err := expandBundles(ctx, s.q, []stockLine{line})
+	if err != nil {
+		return 0, err
+	}
+	var total float64
+	for _, part := range parts {
+		cost, err := s.cost(ctx, part.ProductID, part.Quantity)
+		if err != nil {
+			return 0, err
+		}
+		total += cost
+	}
+	return costing.Money(total), nil
+}
+
+// CreateStockReceipt records a delivery. Each line adds a lot at its cost and
+// moves the product's average cost; the unit cost is per the line's unit. The
+// products are repriced from what they were bought at through the pricing rules.
+func CreateStockReceipt(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input struct {
+			CompanyID  int    `json:"company_id" binding:"required"`
+			Supplier   string `json:"supplier"`
+			Note       string `json:"note"`
+			ReceivedBy string `json:"received_by"`
+			Items      []struct {
+				ProductID int     `json:"product_id" binding:"required"`
+				Quantity  float64 `json:"quantity" binding:"required"`
+				Unit      string  `json:"unit"`
+				UnitCost  float64 `json:"unit_cost"`
+			} `json:"items" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if len(input.Items) == 0 || len(input.Items) > maxReceiptItems {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A receipt needs 1 to %d items", maxReceiptItems)})
+			return
+		}
+
+		lines := make([]stockLine, len(input.Items))
+		var ids []int
+		for i, item := range input.Items {
+			if item.Quantity <= 0 || item.UnitCost < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Item %d: quantity must be positive and unit_cost not negative", i+1)})
+				return
+			}
+			lines[i] = stockLine{ProductID: item.ProductID, Quantity: item.Quantity, Unit: strings.TrimSpace(item.Unit)}
+			ids = append(ids, item.ProductID)
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		// This transaction adds the lots itself, at the receipt's costs
+		if _, err := tx.Exec(ctx, `SELECT set_config('azaton.stock_lots', 'manual', true)`); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		type stocked struct {
+			name      string
+			precision int
+			isBundle  bool
+		}
+		products := map[int]stocked{}
+		rows, err := tx.Query(ctx, `
+			SELECT id, name, quantity_precision, COALESCE(is_bundle, false)
+			FROM products
+			WHERE id = ANY($1) AND company_id = $2 AND deleted_at IS NULL
+			ORDER BY id
+			FOR UPDATE
+		`, ids, input.CompanyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			var id int
+			var p stocked
+			if err := rows.Scan(&id, &p.name, &p.precision, &p.isBundle); err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			products[id] = p
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		base, err := toBaseUnits(ctx, tx, lines)
+		if errors.Is(err, errUnknownUnit) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		items := make([]models.StockReceiptItem, len(lines))
+		var totalCost float64
+		for i, line := range lines {
+			p, ok := products[line.ProductID]
+			if !ok {
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Product %d not found in this company", line.ProductID)})
+				return
+			}
+			if p.isBundle {
+				c.JSON(http.StatusConflict, gin.H{"error": "Bundle " + p.name + " has no stock of its own; receive its components"})
+				return
+			}
+			if base[i].Quantity <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": p.name + ": quantity is too small"})
+				return
+			}
+			if err := units.Validate(base[i].Quantity, p.precision); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s: %v", p.name, err)})
+				return
+			}
+			items[i] = models.StockReceiptItem{
+				ProductID:    line.ProductID,
+				Name:         p.name,
+				Quantity:     line.Quantity,
+				Unit:         line.Unit,
+				UnitCost:     input.Items[i].UnitCost,
+				BaseQuantity: base[i].Quantity,
+				TotalCost:    costing.Money(line.Quantity * input.Items[i].UnitCost),
+			}
+			totalCost += items[i].TotalCost
+		}
+
+		receipt := models.StockReceipt{
+			CompanyID:  input.CompanyID,
+			Supplier:   optionalString(input.Supplier),
+			Note:       optionalString(input.Note),
+			ReceivedBy: optionalString(input.ReceivedBy),
+			TotalCost:  costing.Money(totalCost),
+			Items:      items,
+		}
+		err = tx.QueryRow(ctx, `
+			INSERT INTO stock_receipts (company_id, supplier, note, received_by, total_cost)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, created_at
+		`, receipt.CompanyID, receipt.Supplier, receipt.Note, receipt.ReceivedBy, receipt.TotalCost).Scan(&receipt.ID, &receipt.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, item := range items {
+			baseCost := item.Quantity * item.UnitCost / item.BaseQuantity
+			if err := receiveStock(ctx, tx, receipt.ID, item, baseCost); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		repriced, err := repriceReceived(ctx, tx, input.CompanyID, items)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		publishProducts(ctx, tx, events.StockChanged, ids)
+		publishProducts(ctx, tx, events.ProductUpdated, repriced)
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"success": true, "receipt": receipt})
+	}
+}
+
+// receiveStock books one receipt line: the line itself, a lot at baseCost
+// per base unit, and the product's new quantity and average cost
+func receiveStock(ctx context.Context, tx pgx.Tx, receiptID int, item models.StockReceiptItem, baseCost float64) error {
+	var unit *string
+	if item.Unit != "" {
+		unit = &item.Unit
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO stock_receipt_items (receipt_id, product_id, quantity, unit, unit_cost, base_quantity, total_cost)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`, receiptID, item.ProductID, item.Quantity, unit, item.UnitCost, item.BaseQuantity, item.TotalCost)
+	if err != nil {
+		return err
+	}
+
+	var onHand, average float64
+	err = tx.QueryRow(ctx, `
+		SELECT quantity, COALESCE(average_cost, price, 0) FROM products WHERE id = $1
+	`, item.ProductID).Scan(&onHand, &average)
+	if err != nil {
+		return err
+	}
+
+	// Stock below zero was sold before it arrived; that much of the
+	// delivery is already gone
+	remaining := item.BaseQuantity
+	if onHand < 0 {
+		remaining = units.Round(max(onHand+item.BaseQuantity, 0), units.MaxPrecision)
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO stock_lots (product_id, company_id, receipt_id, source, quantity, remaining, unit_cost)
+		SELECT id, company_id, $2, 'receipt', $3, $4, $5 FROM products WHERE id = $1
+	`, item.ProductID, receiptID, item.BaseQuantity, remaining, baseCost)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE products SET quantity = quantity + $2, average_cost = $3, updated_at = NOW() WHERE id = $1
+	`, item.ProductID, item.BaseQuantity, costing.AverageAfterReceipt(onHand, average, item.BaseQuantity, baseCost))
+	if err != nil {
+		return err
+	}
+	return recordStockMovement(ctx, tx, item.ProductID, item.BaseQuantity, movementReceipt, nil, nil, &receiptID)
+}
+
+// repriceReceived makes each received product's cost price what it was just
+// bought at and works its selling price out through the company's pricing
+// rules. Lines received at no cost leave the price alone. It returns the
+// products repriced.
+func repriceReceived(ctx context.Context, tx pgx.Tx, companyID int, items []models.StockReceiptItem) ([]int, error) {
+	if err := setPriceSource(ctx, tx, priceSourceReceipt); err != nil {
+		return nil, err
+	}
+	rules, err := loadPricingRules(ctx, tx, companyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, item := range items {
+		if item.UnitCost <= 0 {
+			continue
+		}
+		var markupPercent *float64
+		var category, supplier string
+		err := tx.QueryRow(ctx, `
+			SELECT markup_percent, category, COALESCE(supplier, '') FROM products WHERE id = $1
+		`, item.ProductID).Scan(&markupPercent, &category, &supplier)
+		if err != nil {
+			return nil, err
+		}
+		price := pricing.Money(item.Quantity * item.UnitCost / item.BaseQuantity)
+		priced := rules.Apply(pricing.Input{
+			Price:         price,
+			MarkupPercent: markupPercent,
+			Category:      category,
+			Supplier:      supplier,
+		})
+		if _, err := tx.Exec(ctx, `
+			UPDATE products SET price = $1, markup_percent = $2, markup_amount = $3,
+				selling_price = $4, updated_at = NOW()
+			WHERE id = $5
+		`, price, priced.MarkupPercent, priced.MarkupAmount, priced.SellingPrice, item.ProductID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, item.ProductID)
+	}
+	return ids, nil
+}
+
+// optionalString is nil for an empty or blank string
+func optionalString(s string) *string {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil
+	}
+	return &s
+}
+
+// GetStockReceipts returns the latest stock receipts of a company with their
+// items, optionally of one product
+func GetStockReceipts(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		companyID, err := strconv.Atoi(c.Query("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+			return
+		}
+		var productID *int
+		if productIDStr := c.Query("product_id"); productIDStr != "" {
+			id, err := strconv.Atoi(productIDStr)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product_id"})
+				return
+			}
+			productID = &id
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT r.id, r.company_id, r.supplier, r.note, r.received_by, r.total_cost, r.created_at,
+				   COALESCE((
+					   SELECT json_agg(json_build_object(
+						   'product_id', i.product_id, 'name', p.name, 'quantity', i.quantity,
+						   'unit', COALESCE(i.unit, ''), 'unit_cost', i.unit_cost,
+						   'base_quantity', i.base_quantity, 'total_cost', i.total_cost) ORDER BY i.id)
+					   FROM stock_receipt_items i JOIN products p ON p.id = i.product_id
+					   WHERE i.receipt_id = r.id
+				   ), '[]')
+			FROM stock_receipts r
+			WHERE r.company_id = $1
+			  AND ($2::int IS NULL OR EXISTS (
+				  SELECT 1 FROM stock_receipt_items i WHERE i.receipt_id = r.id AND i.product_id = $2))
+			ORDER BY r.created_at DESC, r.id DESC
+			LIMIT 100
+		`, companyID, productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		receipts := []models.StockReceipt{}
+		for rows.Next() {
+			var r models.StockReceipt
+			if err := rows.Scan(&r.ID, &r.CompanyID, &r.Supplier, &r.Note, &r.ReceivedBy, &r.TotalCost,
+				&r.CreatedAt, &r.Items); err != nil {
+				continue
+			}
+			receipts = append(receipts, r)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"receipts": receipts})
+	}
+}
+
+// GetStockLots returns the lots a product's stock on hand is made of, with
+// its average cost and what the stock is worth under the company's method
+func GetStockLots(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		var quantity, average float64
+		var method string
+		err = db.QueryRow(ctx, `
+			SELECT p.quantity, COALESCE(p.average_cost, p.price, 0), c.costing_method
+			FROM products p JOIN companies c ON c.id = p.company_id
+			WHERE p.id = $1 AND p.deleted_at IS NULL
+		`, id).Scan(&quantity, &average, &method)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, receipt_id, source, quantity, remaining, unit_cost, received_at
+			FROM stock_lots
+			WHERE product_id = $1 AND remaining > 0
+			ORDER BY received_at, id
+		`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		lots := []models.StockLot{}
+		var costLots []costing.Lot
+		for rows.Next() {
+			var lot models.StockLot
+			if err := rows.Scan(&lot.ID, &lot.ReceiptID, &lot.Source, &lot.Quantity, &lot.Remaining,
+				&lot.UnitCost, &lot.ReceivedAt); err != nil {
+				continue
+			}
+			lots = append(lots, lot)
+			costLots = append(costLots, costing.Lot{Remaining: lot.Remaining, UnitCost: lot.UnitCost})
+		}
+
+		value := 0.0
+		if quantity > 0 {
+			value = costing.Money(costing.Cost(method, costLots, 0, quantity, average))
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"product_id":     id,
+			"costing_method": method,
+			"quantity":       quantity,
+			"average_cost":   average,
+			"stock_value":    value,
+			"lots":           lots,
+		})
+	}
+}
@@ -0,0 +1,748 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// defaultNameSimilarity is the trigram similarity above which two names
+	// count as the same product
+	defaultNameSimilarity = 0.6
+
+	// maxSimilarPairs caps the name pairs one duplicate search looks at
+	maxSimilarPairs = 2000
+
+	// maxMergeDuplicates caps the products merged into a survivor at once
+	maxMergeDuplicates = 50
+)
+
+// DuplicateProduct is a product in a group of likely duplicates
+type DuplicateProduct struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	Barcode      *string   `json:"barcode,omitempty"`
+	Unit         string    `json:"unit"`
+	Quantity     float64   `json:"quantity"`
+	SoldQuantity float64   `json:"sold_quantity"`
+	SellingPrice float64   `json:"selling_price"`
+	Category     string    `json:"category"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// DuplicateGroup is a set of products that are probably the same product.
+// SuggestedSurvivorID is the one that sold the most, or else the oldest.
+type DuplicateGroup struct {
+	Reasons             []string           `json:"reasons"` // barcode, name
+	Barcode             *string            `json:"barcode,omitempty"`
+	Similarity          float64            `json:"similarity,omitempty"` // the highest name similarity in the group
+	SuggestedSurvivorID int                `json:"suggested_survivor_id"`
+	Products            []DuplicateProduct `json:"products"`
+}
+
+// duplicateSets joins products into groups; each product points towards the
+// first product of its group
+type duplicateSets struct {
+	parent     map[int]int
+	reasons    map[int]map[string]bool
+	barcode    map[int]string
+	similarity map[int]float64
+}
+
+func (d *duplicateSets) find(id int) int {
+	if _, ok := d.parent[id]; !ok {
+		d.parent[id] = id
+	}
+	for d.parent[id] != id {
+		d.parent[id] = d.parent[d.parent[id]]
+		id = d.parent[id]
+	}
+	return id
+}
+
+func (d *duplicateSets) join(a, b int, reason string) {
+	ra, rb := d.find(a), d.find(b)
+	if ra != rb {
+		if rb < ra {
+			ra, rb = rb, ra
+		}
+		d.parent[rb] = ra
+		if d.reasons[ra] == nil {
+			d.reasons[ra] = map[string]bool{}
+		}
+		for r := range d.reasons[rb] {
+			d.reasons[ra][r] = true
+		}
+		if d.barcode[ra] == "" {
+			d.barcode[ra] = d.barcode[rb]
+		}
+		if d.similarity[rb] > d.similarity[ra] {
+			d.similarity[ra] = d.similarity[rb]
+		}
+	}
+	if d.reasons[ra] == nil {
+		d.reasons[ra] = map[string]bool{}
+	}
+	d.reasons[ra][reason] = true
+}
+
+// FindDuplicateProducts groups the products of a company that share a barcode
+// or have very similar names. threshold (0-1, default 0.6) is the trigram
+// similarity two names need. Bundles are left out, they cannot be merged.
+func FindDuplicateProducts(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		companyID, err := strconv.Atoi(c.Query("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "company_id is required"})
+			return
+		}
+
+		threshold := defaultNameSimilarity
+		if t := c.Query("threshold"); t != "" {
+			threshold, err = strconv.ParseFloat(t, 64)
+			if err != nil || threshold <= 0 || threshold > 1 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "threshold must be between 0 and 1"})
+				return
+			}
+		}
+
+		sets := &duplicateSets{
+			parent:     map[int]int{},
+			reasons:    map[int]map[string]bool{},
+			barcode:    map[int]string{},
+			similarity: map[int]float64{},
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT barcode, array_agg(id ORDER BY id)
+			FROM products
+			WHERE company_id = $1 AND deleted_at IS NULL AND NOT COALESCE(is_bundle, false)
+			  AND barcode IS NOT NULL AND barcode <> ''
+			GROUP BY barcode
+			HAVING COUNT(*) > 1
+		`, companyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			var barcode string
+			var ids []int
+			if err := rows.Scan(&barcode, &ids); err != nil {
+				continue
+			}
+			sets.barcode[sets.find(ids[0])] = barcode
+			for _, id := range ids[1:] {
+				sets.join(ids[0], id, "barcode")
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The % operator uses the trigram index; its threshold is set for
+		// this transaction only
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		if _, err := tx.Exec(ctx, `SELECT set_config('pg_trgm.similarity_threshold', $1, true)`,
+			strconv.FormatFloat(threshold, 'f', -1, 64)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err = tx.Query(ctx, `
+			SELECT a.id, b.id, similarity(lower(a.name), lower(b.name))
+			FROM products a
+			JOIN products b ON lower(b.name) % lower(a.name) AND b.id > a.id
+			WHERE a.company_id = $1 AND a.deleted_at IS NULL AND NOT COALESCE(a.is_bundle, false)
+			  AND b.company_id = $1 AND b.deleted_at IS NULL AND NOT COALESCE(b.is_bundle, false)
+			ORDER BY 3 DESC, a.id, b.id
+			LIMIT $2
+		`, companyID, maxSimilarPairs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		pairs := 0
+		for rows.Next() {
+			var a, b int
+			var similarity float64
+			if err := rows.Scan(&a, &b, &similarity); err != nil {
+				continue
+			}
+			pairs++
+			sets.join(a, b, "name")
+			if root := sets.find(a); similarity > sets.similarity[root] {
+				sets.similarity[root] = similarity
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		ids := make([]int, 0, len(sets.parent))
+		for id := range sets.parent {
+			ids = append(ids, id)
+		}
+
+		byID := map[int]DuplicateProduct{}
+		rows, err = tx.Query(ctx, `
+			SELECT id, name, barcode, unit, quantity, sold_quantity, selling_price, COALESCE(category, ''), created_at
+			FROM products WHERE id = ANY($1)
+		`, ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			var p DuplicateProduct
+			if err := rows.Scan(&p.ID, &p.Name, &p.Barcode, &p.Unit, &p.Quantity, &p.SoldQuantity,
+				&p.SellingPrice, &p.Category, &p.CreatedAt); err != nil {
+				continue
+			}
+			byID[p.ID] = p
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		members := map[int][]DuplicateProduct{}
+		for _, id := range ids {
+			if p, ok := byID[id]; ok {
+				root := sets.find(id)
+				members[root] = append(members[root], p)
+			}
+		}
+
+		groups := []DuplicateGroup{}
+		for root, products := range members {
+			if len(products) < 2 {
+				continue
+			}
+			sort.Slice(products, func(i, j int) bool { return products[i].ID < products[j].ID })
+			g := DuplicateGroup{
+				Similarity:          sets.similarity[root],
+				SuggestedSurvivorID: products[0].ID,
+				Products:            products,
+			}
+			for _, reason := range []string{"barcode", "name"} {
+				if sets.reasons[root][reason] {
+					g.Reasons = append(g.Reasons, reason)
+				}
+			}
+			if barcode := sets.barcode[root]; barcode != "" {
+				g.Barcode = &barcode
+			}
+			best := products[0]
+			for _, p := range products[1:] {
+				if p.SoldQuantity > best.SoldQuantity {
+					best = p
+				}
+			}
+			g.SuggestedSurvivorID = best.ID
+			groups = append(groups, g)
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			if len(groups[i].Products) != len(groups[j].Products) {
+				return len(groups[i].Products) > len(groups[j].Products)
+			}
+			return groups[i].Products[0].ID < groups[j].Products[0].ID
+		})
+
+		c.JSON(http.StatusOK, gin.H{
+			"groups":    groups,
+			"threshold": threshold,
+			"truncated": pairs == maxSimilarPairs,
+		})
+	}
+}
+
+// MergeProducts merges duplicates into a surviving product. The survivor gets
+// their stock with its cost, sold quantity, images, packaging units and
+// reviews, and the first barcode when it has none. Orders, sales, bundles, likes and carts are
+// rewritten to point at the survivor, pending price changes of the duplicates
+// are cancelled, and the duplicates go to the trash with no stock left. Each
+// merge is recorded in product_merges.
+func MergeProducts(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input struct {
+			CompanyID    int    `json:"company_id" binding:"required"`
+			SurvivorID   int    `json:"survivor_id" binding:"required"`
+			DuplicateIDs []int  `json:"duplicate_ids" binding:"required"`
+			MergedBy     string `json:"merged_by"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		seen := map[int]bool{input.SurvivorID: true}
+		var duplicates []int
+		for _, id := range input.DuplicateIDs {
+			if !seen[id] {
+				seen[id] = true
+				duplicates = append(duplicates, id)
+			}
+		}
+		if len(duplicates) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "duplicate_ids must name products other than the survivor"})
+			return
+		}
+		if len(duplicates) > maxMergeDuplicates {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d products can be merged at once", maxMergeDuplicates)})
+			return
+		}
+		sort.Ints(duplicates)
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		// Lock in id order so merges running side by side cannot deadlock
+		rows, err := tx.Query(ctx, `
+			SELECT id, name, unit, COALESCE(is_bundle, false)
+			FROM products
+			WHERE id = ANY($1) AND company_id = $2 AND deleted_at IS NULL
+			ORDER BY id
+			FOR UPDATE
+		`, append([]int{input.SurvivorID}, duplicates...), input.CompanyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		units := map[int]string{}
+		var conflict string
+		for rows.Next() {
+			var id int
+			var name, unit string
+			var isBundle bool
+			if err := rows.Scan(&id, &name, &unit, &isBundle); err != nil {
+				rows.Close()
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			units[id] = unit
+			if isBundle && conflict == "" {
+				conflict = "Bundle " + name + " cannot be merged"
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(units) != len(duplicates)+1 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Some products were not found in this company"})
+			return
+		}
+		if conflict == "" {
+			for _, id := range duplicates {
+				if units[id] != units[input.SurvivorID] {
+					conflict = fmt.Sprintf("Product %d is counted in %s, the survivor in %s", id, units[id], units[input.SurvivorID])
+					break
+				}
+			}
+		}
+		if conflict != "" {
+			c.JSON(http.StatusConflict, gin.H{"error": conflict})
+			return
+		}
+
+		merge, bundles, err := mergeProducts(ctx, tx, input.CompanyID, input.SurvivorID, duplicates, input.MergedBy)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		publishProducts(ctx, tx, events.ProductUpdated, append([]int{input.SurvivorID}, bundles...))
+		publishProducts(ctx, tx, events.ProductDeleted, duplicates)
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "merge": merge})
+	}
+}
+
+// mergeProducts does the work of MergeProducts on locked products. It returns
+// the merge record and the bundles whose components changed.
+func mergeProducts(ctx context.Context, tx pgx.Tx, companyID, survivorID int, duplicates []int, mergedBy string) (models.ProductMerge, []int, error) {
+	merge := models.ProductMerge{
+		CompanyID:  companyID,
+		SurvivorID: survivorID,
+		MergedIDs:  duplicates,
+		Rewritten:  map[string]int64{},
+	}
+
+	err := tx.QueryRow(ctx, `
+		SELECT jsonb_agg(to_jsonb(p) ORDER BY p.id) FROM products p WHERE p.id = ANY($1)
+	`, duplicates).Scan(&merge.MergedProducts)
+	if err != nil {
+		return merge, nil, err
+	}
+
+	// The duplicates' stock lots move over with their costs
+	if _, err := tx.Exec(ctx, `SELECT set_config('azaton.stock_lots', 'manual', true)`); err != nil {
+		return merge, nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE stock_lots SET product_id = $1 WHERE product_id = ANY($2) AND remaining > 0
+	`, survivorID, duplicates)
+	if err != nil {
+		return merge, nil, err
+	}
+
+	// Images move over; the trashed duplicates drop them so purging them
+	// does not delete files the survivor now shows. A barcode the survivor
+	// lacks moves once the duplicates are trashed and no longer hold it.
+	var barcode *string
+	err = tx.QueryRow(ctx, `
+		UPDATE products s SET
+			average_cost = CASE WHEN GREATEST(s.quantity, 0) + d.quantity > 0
+				THEN (GREATEST(s.quantity, 0) * COALESCE(s.average_cost, s.price, 0) + d.stock_value)
+					 / (GREATEST(s.quantity, 0) + d.quantity)
+				ELSE s.average_cost END,
+			quantity = s.quantity + d.quantity,
+			sold_quantity = s.sold_quantity + d.sold_quantity,
+			quantity_precision = GREATEST(s.quantity_precision, d.quantity_precision),
+			images = COALESCE(s.images, '[]'::jsonb) || d.images,
+			updated_at = NOW()
+		FROM (
+			SELECT COALESCE(SUM(quantity), 0) AS quantity,
+				   COALESCE(SUM(sold_quantity), 0) AS sold_quantity,
+				   COALESCE(SUM(GREATEST(quantity, 0) * COALESCE(average_cost, price, 0)), 0) AS stock_value,
+				   MAX(quantity_precision) AS quantity_precision,
+				   (array_agg(barcode ORDER BY id) FILTER (WHERE barcode <> ''))[1] AS barcode,
+				   (SELECT COALESCE(jsonb_agg(image ORDER BY p.id, i.n), '[]'::jsonb)
+					FROM products p, jsonb_array_elements(p.images) WITH ORDINALITY AS i(image, n)
+					WHERE p.id = ANY($2) AND jsonb_typeof(p.images) = 'array') AS images
+			FROM products WHERE id = ANY($2)
+		) d
+		WHERE s.id = $1
+		RETURNING d.quantity, CASE WHEN COALESCE(s.barcode, '') = '' THEN d.barcode END
+	`, survivorID, duplicates).Scan(&merge.QuantityAdded, &barcode)
+	if err != nil {
+		return merge, nil, err
+	}
+
+	textIDs := make([]string, len(duplicates))
+	for i, id := range duplicates {
+		textIDs[i] = strconv.Itoa(id)
+	}
+
+	// Order and sale lines keep everything but the product they point at
+	for kind, table := range map[string]string{"orders": "customer_orders", "sales": "sales_history"} {
+		tag, err := tx.Exec(ctx, `
+			UPDATE `+table+` SET items = (
+				SELECT jsonb_agg(CASE WHEN item->>'product_id' = ANY($2)
+					THEN jsonb_set(item, '{product_id}', to_jsonb($1::int)) ELSE item END ORDER BY n)
+				FROM jsonb_array_elements(items) WITH ORDINALITY AS i(item, n)
+			)
+			WHERE company_id = $3 AND jsonb_typeof(items) = 'array'
+			  AND EXISTS (SELECT 1 FROM jsonb_array_elements(items) item WHERE item->>'product_id' = ANY($2))
+		`, survivorID, textIDs, companyID)
+		if err != nil {
+			return merge, nil, err
+		}
+		merge.Rewritten[kind] = tag.RowsAffected()
+	}
+
+	// Open orders now name the survivor, so what they hold moves to it
+	moved, err := tx.Exec(ctx, `
+		WITH moved AS (
+			DELETE FROM stock_reservations WHERE product_id = ANY($2)
+			RETURNING order_id, company_id, quantity, expires_at
+		)
+		INSERT INTO stock_reservations (order_id, product_id, company_id, quantity, expires_at)
+		SELECT order_id, $1, MAX(company_id), SUM(quantity),
+			   CASE WHEN bool_or(expires_at IS NULL) THEN NULL ELSE MAX(expires_at) END
+		FROM moved GROUP BY order_id
+		ON CONFLICT (order_id, product_id) DO UPDATE SET
+			quantity = stock_reservations.quantity + EXCLUDED.quantity,
+			expires_at = CASE WHEN stock_reservations.expires_at IS NULL OR EXCLUDED.expires_at IS NULL
+				THEN NULL ELSE GREATEST(stock_reservations.expires_at, EXCLUDED.expires_at) END
+	`, survivorID, duplicates)
+	if err != nil {
+		return merge, nil, err
+	}
+	merge.Rewritten["reservations"] = moved.RowsAffected()
+
+	if merge.Rewritten["carts"], err = rewriteCustomerItems(ctx, tx, "user_cart", "cart_items", survivorID, textIDs, mergeCartItems); err != nil {
+		return merge, nil, err
+	}
+	if merge.Rewritten["likes"], err = rewriteCustomerItems(ctx, tx, "user_likes", "liked_products", survivorID, textIDs, mergeLikedItems); err != nil {
+		return merge, nil, err
+	}
+
+	// Bundles that held a duplicate hold the survivor instead
+	var bundles []int
+	err = tx.QueryRow(ctx, `
+		SELECT COALESCE(array_agg(DISTINCT bundle_id), '{}') FROM product_bundle_items WHERE component_id = ANY($1)
+	`, duplicates).Scan(&bundles)
+	if err != nil {
+		return merge, nil, err
+	}
+	if len(bundles) > 0 {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO product_bundle_items (bundle_id, component_id, quantity)
+			SELECT bundle_id, $1, SUM(quantity) FROM product_bundle_items
+			WHERE component_id = ANY($2)
+			GROUP BY bundle_id
+			ON CONFLICT (bundle_id, component_id) DO UPDATE SET
+				quantity = product_bundle_items.quantity + EXCLUDED.quantity
+		`, survivorID, duplicates)
+		if err == nil {
+			_, err = tx.Exec(ctx, `DELETE FROM product_bundle_items WHERE component_id = ANY($1)`, duplicates)
+		}
+		if err != nil {
+			return merge, nil, err
+		}
+	}
+	merge.Rewritten["bundles"] = int64(len(bundles))
+
+	// Units and reviews the survivor already has stay with the duplicates
+	tag, err := tx.Exec(ctx, `
+		UPDATE product_units SET product_id = $1
+		WHERE id IN (
+			SELECT DISTINCT ON (name) id FROM product_units
+			WHERE product_id = ANY($2)
+			  AND name NOT IN (SELECT name FROM product_units WHERE product_id = $1)
+			ORDER BY name, product_id
+		)
+	`, survivorID, duplicates)
+	if err != nil {
+		return merge, nil, err
+	}
+	merge.Rewritten["units"] = tag.RowsAffected()
+
+	tag, err = tx.Exec(ctx, `
+		UPDATE product_reviews SET product_id = $1
+		WHERE id IN (
+			SELECT DISTINCT ON (user_phone) id FROM product_reviews
+			WHERE product_id = ANY($2)
+			  AND user_phone NOT IN (SELECT user_phone FROM product_reviews WHERE product_id = $1)
+			ORDER BY user_phone, updated_at DESC
+		)
+	`, survivorID, duplicates)
+	if err != nil {
+		return merge, nil, err
+	}
+	merge.Rewritten["reviews"] = tag.RowsAffected()
+	if tag.RowsAffected() > 0 {
+		if err := refreshProductRating(ctx, tx, survivorID); err != nil {
+			return merge, nil, err
+		}
+	}
+
+	tag, err = tx.Exec(ctx, `
+		UPDATE scheduled_price_changes SET status = 'cancelled'
+		WHERE product_id = ANY($1) AND status = 'pending'
+	`, duplicates)
+	if err != nil {
+		return merge, nil, err
+	}
+	merge.Rewritten["price_changes_cancelled"] = tag.RowsAffected()
+
+	_, err = tx.Exec(ctx, `
+		UPDATE products SET deleted_at = NOW(), quantity = 0, sold_quantity = 0, images = '[]'::jsonb, updated_at = NOW()
+		WHERE id = ANY($1)
+	`, duplicates)
+	if err != nil {
+		return merge, nil, err
+	}
+	if barcode != nil {
+		if _, err := tx.Exec(ctx, `UPDATE products SET barcode = $1 WHERE id = $2`, *barcode, survivorID); err != nil {
+			return merge, nil, err
+		}
+	}
+
+	rewrittenJSON, _ := json.Marshal(merge.Rewritten)
+	var by *string
+	if mergedBy = strings.TrimSpace(mergedBy); mergedBy != "" {
+		by = &mergedBy
+	}
+	merge.MergedBy = by
+	err = tx.QueryRow(ctx, `
+		INSERT INTO product_merges (company_id, survivor_id, merged_ids, merged_products, quantity_added, rewritten, merged_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at
+	`, companyID, survivorID, duplicates, merge.MergedProducts, merge.QuantityAdded, rewrittenJSON, by).Scan(&merge.ID, &merge.CreatedAt)
+	return merge, bundles, err
+}
+
+// rewriteCustomerItems rewrites the item lists customers keep per phone
+// number (carts, likes) that mention a duplicate. It returns the rows changed.
+func rewriteCustomerItems(ctx context.Context, tx pgx.Tx, table, column string, survivorID int, duplicates []string,
+	rewrite func(items []map[string]interface{}, survivorID int, duplicates map[string]bool) []map[string]interface{}) (int64, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT id, `+column+` FROM `+table+`
+		WHERE jsonb_typeof(`+column+`) = 'array'
+		  AND EXISTS (SELECT 1 FROM jsonb_array_elements(`+column+`) item WHERE item->>'id' = ANY($1))
+		FOR UPDATE
+	`, duplicates)
+	if err != nil {
+		return 0, err
+	}
+	lists := map[int][]byte{}
+	for rows.Next() {
+		var id int
+		var itemsJSON []byte
+		if err := rows.Scan(&id, &itemsJSON); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lists[id] = itemsJSON
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	isDuplicate := map[string]bool{}
+	for _, id := range duplicates {
+		isDuplicate[id] = true
+	}
+
+	var changed int64
+	for id, itemsJSON := range lists {
+		var items []map[string]interface{}
+		if err := json.Unmarshal(itemsJSON, &items); err != nil {
+			continue
+		}
+		newJSON, _ := json.Marshal(rewrite(items, survivorID, isDuplicate))
+		if _, err := tx.Exec(ctx, `UPDATE `+table+` SET `+column+` = $1, updated_at = NOW() WHERE id = $2`, newJSON, id); err != nil {
+			return changed, err
+		}
+		changed++
+	}
+	return changed, nil
+}
+
+// itemID reads the id of a cart or likes item, which may be a number or a string
+func itemID(item map[string]interface{}) string {
+	return idString(item["id"])
+}
+
+// idString reads an ID stored in JSON as a number or a string
+func idString(v interface{}) string {
+	switch id := v.(type) {
+	case int:
+		return strconv.Itoa(id)
+	case float64:
+		return strconv.FormatFloat(id, 'f', -1, 64)
+	case string:
+		return id
+	}
+	return ""
+}
+
+// mergeCartItems points cart items at the survivor and adds up the quantities
+// of items that end up the same, color included
+func mergeCartItems(items []map[string]interface{}, survivorID int, duplicates map[string]bool) []map[string]interface{} {
+	merged := []map[string]interface{}{}
+	byKey := map[string]map[string]interface{}{}
+	for _, item := range items {
+		if duplicates[itemID(item)] {
+			item["id"] = survivorID
+		}
+		key := itemID(item) + "|" + fmt.Sprint(item["selectedColor"])
+		if first, ok := byKey[key]; ok {
+			q1, ok1 := first["quantity"].(float64)
+			q2, ok2 := item["quantity"].(float64)
+			if ok1 && ok2 {
+				first["quantity"] = q1 + q2
+				continue
+			}
+		}
+		byKey[key] = item
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// mergeLikedItems points liked products at the survivor, keeping one like each
+func mergeLikedItems(items []map[string]interface{}, survivorID int, duplicates map[string]bool) []map[string]interface{} {
+	merged := []map[string]interface{}{}
+	seen := map[string]bool{}
+	for _, item := range items {
+		if duplicates[itemID(item)] {
+			item["id"] = survivorID
+		}
+		if id := itemID(item); id != "" {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		merged = append(merged, item)
+	}
+	return merged
+}
+
+// GetProductMerges returns the latest merges of a company
+func GetProductMerges(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		companyID, err := strconv.Atoi(c.Query("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, company_id, survivor_id, merged_ids, merged_products, quantity_added, rewritten,
+				   merged_by, created_at
+			FROM product_merges WHERE company_id = $1
+			ORDER BY created_at DESC, id DESC
+			LIMIT 100
+		`, companyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		merges := []models.ProductMerge{}
+		for rows.Next() {
+			var m models.ProductMerge
+			if err := rows.Scan(&m.ID, &m.CompanyID, &m.SurvivorID, &m.MergedIDs, &m.MergedProducts,
+				&m.QuantityAdded, &m.Rewritten, &m.MergedBy, &m.CreatedAt); err != nil {
+				continue
+			}
+			merges = append(merges, m)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"merges": merges})
+	}
+}
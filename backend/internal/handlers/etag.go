@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// anyVersion stands for If-Match: *, which matches whatever version is stored
+const anyVersion = -1
+
+// etag formats a row version as a strong entity tag
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// setETag sends the version of the row a response describes
+func setETag(c *gin.Context, version int) {
+	c.Header("ETag", etag(version))
+}
+
+// requireIfMatch reads the version an update was based on from If-Match.
+// Without the header it answers 428, since the update would blindly
+// overwrite whatever another client saved in the meantime.
+func requireIfMatch(c *gin.Context) ([]int, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{
+			"error": "If-Match header is required; send the ETag of the version being edited",
+		})
+		return nil, false
+	}
+	if header == "*" {
+		return []int{anyVersion}, true
+	}
+
+	var versions []int
+	for _, tag := range strings.Split(header, ",") {
+		// Weak tags never match an If-Match precondition
+		tag = strings.TrimSpace(tag)
+		if !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) || len(tag) < 2 {
+			continue
+		}
+		if v, err := strconv.Atoi(tag[1 : len(tag)-1]); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid If-Match header"})
+		return nil, false
+	}
+	return versions, true
+}
+
+// versionMatches reports whether the stored version satisfies If-Match
+func versionMatches(expected []int, current int) bool {
+	for _, v := range expected {
+		if v == anyVersion || v == current {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditionFailed answers 412 with the row as it is now, so the client
+// can merge its edit and retry with the new ETag
+func preconditionFailed(c *gin.Context, version int, key string, current interface{}) {
+	setETag(c, version)
+	c.JSON(http.StatusPreconditionFailed, gin.H{
+		"error":   "The record was changed by someone else",
+		"version": version,
+		key:       current,
+	})
+}
+
+// notModified answers 304 when If-None-Match already names tag. Entity tags
+// are compared weakly, as RFC 9110 requires for If-None-Match.
+func notModified(c *gin.Context, tag string) bool {
+	c.Header("ETag", tag)
+	c.Header("Cache-Control", "private, no-cache")
+
+	header := strings.TrimSpace(c.GetHeader("If-None-Match"))
+	if header == "" {
+		return false
+	}
+	want := strings.TrimPrefix(tag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			c.Status(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
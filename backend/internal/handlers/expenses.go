@@ -3,14 +3,70 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// GetExpenses returns expenses for a company
+// companyExpenses are the monthly expenses of a company. Version is 0 until
+// they are first saved.
+type companyExpenses struct {
+	ID                 int              `json:"id"`
+	CompanyID          int              `json:"company_id"`
+	MonthlyRent        float64          `json:"monthly_rent"`
+	UtilityCosts       float64          `json:"utility_costs"`
+	WorkerSalaries     float64          `json:"worker_salaries"`
+	OtherExpenses      float64          `json:"other_expenses"`
+	Version            int              `json:"version"`
+	CustomExpenseTypes []map[string]any `json:"custom_expense_types"`
+}
+
+// loadExpenses returns the expenses of a company with its custom expense types
+func loadExpenses(ctx context.Context, q querier, companyID int) (*companyExpenses, error) {
+	var expenses companyExpenses
+	err := q.QueryRow(ctx, `
+		SELECT id, company_id, monthly_rent, utility_costs, worker_salaries, other_expenses, version
+		FROM expenses WHERE company_id = $1
+	`, companyID).Scan(&expenses.ID, &expenses.CompanyID,
+		&expenses.MonthlyRent, &expenses.UtilityCosts,
+		&expenses.WorkerSalaries, &expenses.OtherExpenses, &expenses.Version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// Return empty expenses if not found
+		expenses.CompanyID = companyID
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Get custom expense types
+	rows, err := q.Query(ctx, `
+		SELECT id, name, amount, version FROM company_custom_expenses WHERE company_id = $1
+	`, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, version int
+		var name string
+		var amount float64
+		if rows.Scan(&id, &name, &amount, &version) == nil {
+			expenses.CustomExpenseTypes = append(expenses.CustomExpenseTypes, map[string]any{
+				"id":      id,
+				"name":    name,
+				"amount":  amount,
+				"version": version,
+			})
+		}
+	}
+	return &expenses, rows.Err()
+}
+
+// GetExpenses returns expenses for a company, with their version as the ETag
 func GetExpenses(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -23,52 +79,20 @@ func GetExpenses(db *pgxpool.Pool) gin.HandlerFunc {
 
 		companyID, _ := strconv.Atoi(companyIDStr)
 
-		var expenses struct {
-			ID                 int              `json:"id"`
-			CompanyID          int              `json:"company_id"`
-			MonthlyRent        float64          `json:"monthly_rent"`
-			UtilityCosts       float64          `json:"utility_costs"`
-			WorkerSalaries     float64          `json:"worker_salaries"`
-			OtherExpenses      float64          `json:"other_expenses"`
-			CustomExpenseTypes []map[string]any `json:"custom_expense_types"`
-		}
-
-		err := db.QueryRow(ctx, `
-			SELECT id, company_id, monthly_rent, utility_costs, worker_salaries, other_expenses
-			FROM expenses WHERE company_id = $1
-		`, companyID).Scan(&expenses.ID, &expenses.CompanyID, 
-			&expenses.MonthlyRent, &expenses.UtilityCosts, 
-			&expenses.WorkerSalaries, &expenses.OtherExpenses)
-
+		expenses, err := loadExpenses(ctx, db, companyID)
 		if err != nil {
-			// Return empty expenses if not found
-			expenses.CompanyID = companyID
-		}
-
-		// Get custom expense types
-		rows, _ := db.Query(ctx, `
-			SELECT id, name, amount FROM company_custom_expenses WHERE company_id = $1
-		`, companyID)
-		defer rows.Close()
-
-		for rows.Next() {
-			var id int
-			var name string
-			var amount float64
-			if rows.Scan(&id, &name, &amount) == nil {
-				expenses.CustomExpenseTypes = append(expenses.CustomExpenseTypes, map[string]any{
-					"id":     id,
-					"name":   name,
-					"amount": amount,
-				})
-			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
+		setETag(c, expenses.Version)
 		c.JSON(http.StatusOK, gin.H{"expenses": expenses})
 	}
 }
 
-// UpdateExpenses updates expenses for a company (upsert)
+// UpdateExpenses updates expenses for a company (upsert). If-Match must carry
+// the ETag the edit was based on ("0" before the first save); expenses
+// changed since get 412.
 func UpdateExpenses(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -85,8 +109,43 @@ func UpdateExpenses(db *pgxpool.Pool) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		expected, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
 
-		_, err := db.Exec(ctx, `
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var version int
+		err = tx.QueryRow(ctx, `
+			SELECT version FROM expenses WHERE company_id = $1 FOR UPDATE
+		`, input.CompanyID).Scan(&version)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		conflict := func() {
+			current, err := loadExpenses(ctx, tx, input.CompanyID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			preconditionFailed(c, current.Version, "expenses", current)
+		}
+		if !versionMatches(expected, version) {
+			conflict()
+			return
+		}
+
+		// A row inserted by someone else after the read above fails the
+		// version check of the upsert instead of being overwritten
+		err = tx.QueryRow(ctx, `
 			INSERT INTO expenses (company_id, monthly_rent, utility_costs, worker_salaries, other_expenses)
 			VALUES ($1, $2, $3, $4, $5)
 			ON CONFLICT (company_id) DO UPDATE SET
@@ -95,15 +154,24 @@ func UpdateExpenses(db *pgxpool.Pool) gin.HandlerFunc {
 				worker_salaries = EXCLUDED.worker_salaries,
 				other_expenses = EXCLUDED.other_expenses,
 				updated_at = NOW()
-		`, input.CompanyID, input.MonthlyRent, input.UtilityCosts, 
-			input.WorkerSalaries, input.OtherExpenses)
-
+			WHERE expenses.version = $6
+			RETURNING version
+		`, input.CompanyID, input.MonthlyRent, input.UtilityCosts,
+			input.WorkerSalaries, input.OtherExpenses, version).Scan(&version)
+		if errors.Is(err, pgx.ErrNoRows) {
+			conflict()
+			return
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		setETag(c, version)
+		c.JSON(http.StatusOK, gin.H{"success": true, "version": version})
 	}
 }
 
@@ -139,7 +207,8 @@ func AddCustomExpenseType(db *pgxpool.Pool) gin.HandlerFunc {
 	}
 }
 
-// UpdateCustomExpenseType updates a custom expense type
+// UpdateCustomExpenseType updates a custom expense type. If-Match must carry
+// the ETag the edit was based on; a type changed since gets 412.
 func UpdateCustomExpenseType(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -158,17 +227,55 @@ func UpdateCustomExpenseType(db *pgxpool.Pool) gin.HandlerFunc {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		expected, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
 
-		_, err = db.Exec(ctx, `
-			UPDATE company_custom_expenses SET name = $1, amount = $2 WHERE id = $3
-		`, input.Name, input.Amount, id)
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var name string
+		var amount float64
+		var version int
+		err = tx.QueryRow(ctx, `
+			SELECT name, amount, version FROM company_custom_expenses WHERE id = $1 FOR UPDATE
+		`, id).Scan(&name, &amount, &version)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Expense type not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !versionMatches(expected, version) {
+			preconditionFailed(c, version, "expense", map[string]any{
+				"id":      id,
+				"name":    name,
+				"amount":  amount,
+				"version": version,
+			})
+			return
+		}
 
+		err = tx.QueryRow(ctx, `
+			UPDATE company_custom_expenses SET name = $1, amount = $2 WHERE id = $3 RETURNING version
+		`, input.Name, input.Amount, id).Scan(&version)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		setETag(c, version)
+		c.JSON(http.StatusOK, gin.H{"success": true, "version": version})
 	}
 }
 
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"azaton-backend/internal/spreadsheet"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// exportColumns are the header names of a catalog export. The importable ones
+// match importFields, so an export can be re-imported without a mapping.
+var exportColumns = []string{
+	"name", "quantity", "unit", "price", "markup_percent", "markup_amount", "selling_price",
+	"barcode", "barid", "category", "supplier", "available_for_customers", "images",
+}
+
+// ExportProducts streams a company's catalog as XLSX or CSV, using the same
+// filters as GetProductsPaginated
+func ExportProducts(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		if c.Query("company_id") == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "company_id required"})
+			return
+		}
+
+		format := c.DefaultQuery("format", "xlsx")
+		if format != "xlsx" && format != "csv" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "format must be xlsx or csv"})
+			return
+		}
+
+		filters, args, err := productFilters(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		rows, err := db.Query(ctx, `
+			SELECT name, quantity, unit, price, markup_percent, markup_amount, selling_price,
+				   barcode, barid, category, supplier, available_for_customers, images
+			FROM products WHERE deleted_at IS NULL`+filters+`
+			ORDER BY id
+		`, args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		// The server's write timeout would cut a large export off
+		http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+		filename := fmt.Sprintf("products_%s_%s.%s", c.Query("company_id"), time.Now().Format("20060102"), format)
+		c.Header("Content-Type", spreadsheet.ContentType(format))
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		c.Status(http.StatusOK)
+
+		// From here on the response is streamed; errors can only be logged
+		w, err := spreadsheet.NewWriter(c.Writer, format)
+		if err != nil {
+			log.Printf("Export failed: %v", err)
+			return
+		}
+
+		header := make([]interface{}, len(exportColumns))
+		for i, col := range exportColumns {
+			header[i] = col
+		}
+		w.WriteRow(header)
+
+		for rows.Next() {
+			var name, category, unit string
+			var quantity, price, markupPercent, markupAmount, sellingPrice float64
+			var barcode, supplier *string
+			var barid *int64
+			var availableForCustomers bool
+			var imagesJSON []byte
+
+			if err := rows.Scan(&name, &quantity, &unit, &price, &markupPercent, &markupAmount, &sellingPrice,
+				&barcode, &barid, &category, &supplier, &availableForCustomers, &imagesJSON); err != nil {
+				continue
+			}
+
+			var images []struct {
+				URL string `json:"url"`
+			}
+			json.Unmarshal(imagesJSON, &images)
+			urls := make([]string, 0, len(images))
+			for _, img := range images {
+				urls = append(urls, img.URL)
+			}
+
+			var baridCell interface{}
+			if barid != nil {
+				baridCell = *barid
+			}
+
+			// Barcodes are written as text so leading zeros survive
+			if err := w.WriteRow([]interface{}{
+				name, quantity, unit, price, markupPercent, markupAmount, sellingPrice,
+				barcode, baridCell, category, supplier, availableForCustomers, strings.Join(urls, " "),
+			}); err != nil {
+				log.Printf("Export failed: %v", err)
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			log.Printf("Export failed: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			log.Printf("Export failed: %v", err)
+		}
+	}
+}
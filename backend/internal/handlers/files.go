@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"azaton-backend/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServeUpload serves public files of the local upload directory. Private keys
+// are refused here; they are only reachable through ServeSignedFile.
+func ServeUpload(local *storage.Local) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Checked on the key as it is opened, so //private/ or ./private/ cannot slip past
+		key := strings.TrimPrefix(path.Clean("/"+c.Param("filepath")), "/")
+		file := local.Path(key)
+		if file == "" || storage.IsPrivate(key) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if info, err := os.Stat(file); err != nil || info.IsDir() {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.File(file)
+	}
+}
+
+// ServeSignedFile serves a local file through a signed, expiring URL
+func ServeSignedFile(local *storage.Local) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+		if !local.Verify(key, c.Query("expires"), c.Query("signature")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired link"})
+			return
+		}
+
+		path := local.Path(key)
+		if info, err := os.Stat(path); path == "" || err != nil || info.IsDir() {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Header("Cache-Control", "private, max-age=300")
+		c.File(path)
+	}
+}
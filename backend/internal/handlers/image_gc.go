@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"azaton-backend/internal/config"
+	"azaton-backend/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Orphans listed in a GC report; the counts cover all of them
+const imageGCReportLimit = 1000
+
+// legacyImageKey matches files uploaded before storage keys: "<product id>_<uuid>.<ext>"
+var legacyImageKey = regexp.MustCompile(`^\d+_[0-9a-f-]{36}\.[A-Za-z0-9]+$`)
+
+// ImageGCReport is the result of one image GC run
+type ImageGCReport struct {
+	DryRun     bool      `json:"dry_run"`
+	Scanned    int       `json:"scanned"`
+	Referenced int       `json:"referenced"`
+	Orphaned   int       `json:"orphaned"`
+	Deleted    int       `json:"deleted"`
+	Bytes      int64     `json:"bytes"`
+	TooRecent  int       `json:"too_recent"` // orphans younger than the safety delay, kept for now
+	Orphans    []string  `json:"orphans"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// isProductImageKey limits the GC to files it knows were product image or
+// review photo uploads
+func isProductImageKey(key string) bool {
+	key = strings.TrimPrefix(key, storage.PrivatePrefix)
+	return strings.HasPrefix(key, "products/") || strings.HasPrefix(key, "reviews/") ||
+		legacyImageKey.MatchString(key)
+}
+
+// referencedImageKeys returns every key referenced by products.images,
+// including products in the trash, and by review photos
+func referencedImageKeys(ctx context.Context, db *pgxpool.Pool) (map[string]bool, error) {
+	rows, err := db.Query(ctx, `
+		SELECT images FROM products WHERE jsonb_array_length(images) > 0
+		UNION ALL
+		SELECT photos FROM product_reviews WHERE jsonb_array_length(photos) > 0
+	`)
+	if err != nil {
+		return nil, err
+	}
+	all, err := collectImages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]bool{}
+	for _, imagesJSON := range all {
+		for _, img := range decodeStoredImages(imagesJSON) {
+			for _, key := range imageKeys(img) {
+				keys[key] = true
+			}
+		}
+	}
+	return keys, nil
+}
+
+// collectImageGarbage removes stored product images that no product references.
+// Files younger than minAge are kept, so an upload whose product row is not
+// written yet is never removed.
+func collectImageGarbage(ctx context.Context, db *pgxpool.Pool, store storage.Storage, minAge time.Duration, dryRun bool) (ImageGCReport, error) {
+	report := ImageGCReport{DryRun: dryRun, Orphans: []string{}, StartedAt: time.Now().UTC()}
+
+	// Files are listed after the references are read: a file uploaded in between
+	// is younger than minAge and skipped
+	referenced, err := referencedImageKeys(ctx, db)
+	if err != nil {
+		return report, err
+	}
+	cutoff := time.Now().Add(-minAge)
+
+	err = store.List(ctx, func(obj storage.Object) error {
+		if !isProductImageKey(obj.Key) {
+			return nil
+		}
+		report.Scanned++
+		if referenced[obj.Key] {
+			report.Referenced++
+			return nil
+		}
+		if obj.ModTime.After(cutoff) {
+			report.TooRecent++
+			return nil
+		}
+
+		report.Orphaned++
+		report.Bytes += obj.Size
+		if len(report.Orphans) < imageGCReportLimit {
+			report.Orphans = append(report.Orphans, obj.Key)
+		}
+		if dryRun {
+			return nil
+		}
+		if err := store.Delete(ctx, obj.Key); err != nil {
+			log.Printf("Image GC: failed to delete %s: %v", obj.Key, err)
+			return nil
+		}
+		report.Deleted++
+		return nil
+	})
+
+	report.FinishedAt = time.Now().UTC()
+	return report, err
+}
+
+// RunImageGC removes orphaned image files every interval until ctx is cancelled
+func RunImageGC(ctx context.Context, db *pgxpool.Pool, store storage.Storage, interval, minAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := collectImageGarbage(ctx, db, store, minAge, false)
+		if err != nil {
+			log.Printf("Image GC failed: %v", err)
+			continue
+		}
+		if report.Deleted > 0 {
+			log.Printf("Image GC: deleted %d orphaned files (%d bytes)", report.Deleted, report.Bytes)
+		}
+	}
+}
+
+// ImageGC reports orphaned image files. GET is always a dry run; POST deletes
+// them unless dry_run=true. The safety delay can be changed with min_age (e.g. "6h"),
+// but never below an hour.
+func ImageGC(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		minAge := cfg.ImageGCMinAge
+		if v := c.Query("min_age"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < time.Hour {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "min_age must be a duration of at least 1h"})
+				return
+			}
+			minAge = d
+		}
+
+		dryRun := c.Request.Method == http.MethodGet || c.Query("dry_run") == "true"
+		report, err := collectImageGarbage(ctx, db, store, minAge, dryRun)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "report": report})
+	}
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"azaton-backend/internal/imaging"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/storage"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+// saveImageVariants stores every size of an upload and its WebP copy, under
+// the keys keyOf gives for the file names. It returns the written keys so the
+// caller can clean up if a later step fails.
+func saveImageVariants(ctx context.Context, store storage.Storage, keyOf func(name string) string, ownerID int, variants []imaging.Variant) (models.ProductImage, []string, error) {
+	base := fmt.Sprintf("%d_%s", ownerID, uuid.New().String())
+	image := models.ProductImage{Sizes: map[string]models.ImageSize{}}
+	written := []string{}
+
+	put := func(name string, data []byte) (string, error) {
+		key := keyOf(name)
+		err := store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), storage.ContentType(key))
+		if err != nil {
+			return "", err
+		}
+		written = append(written, key)
+		return key, nil
+	}
+
+	for _, v := range variants {
+		key, err := put(fmt.Sprintf("%s_%s.%s", base, v.Size, v.Ext), v.Data)
+		if err != nil {
+			return image, written, err
+		}
+		webpKey, err := put(fmt.Sprintf("%s_%s.webp", base, v.Size), v.WebP)
+		if err != nil {
+			return image, written, err
+		}
+
+		size := models.ImageSize{
+			URL:     store.URL(key),
+			Key:     key,
+			WebPURL: store.URL(webpKey),
+			WebPKey: webpKey,
+			Width:   v.Width,
+			Height:  v.Height,
+		}
+		image.Sizes[v.Size] = size
+
+		if v.Size == "full" {
+			image.URL = size.URL
+			image.Key = size.Key
+			image.Width = size.Width
+			image.Height = size.Height
+		}
+	}
+	return image, written, nil
+}
+
+func removeKeys(ctx context.Context, store storage.Storage, keys []string) {
+	for _, key := range keys {
+		store.Delete(ctx, key)
+	}
+}
+
+// imageKeys returns the storage keys of every file of an image. Images stored
+// before keys were recorded have a single file, found from their /uploads/ URL.
+func imageKeys(img models.ProductImage) []string {
+	keys := []string{}
+	switch {
+	case img.Key != "":
+		keys = append(keys, img.Key)
+	case strings.HasPrefix(img.URL, "/uploads/"):
+		keys = append(keys, strings.TrimPrefix(img.URL, "/uploads/"))
+	}
+	for _, size := range img.Sizes {
+		if size.Key != "" && size.Key != img.Key {
+			keys = append(keys, size.Key)
+		}
+		if size.WebPKey != "" {
+			keys = append(keys, size.WebPKey)
+		}
+	}
+	return keys
+}
+
+// deleteImageFiles removes the files of products.images values. Failures are only
+// logged: the image GC removes whatever is left behind.
+func deleteImageFiles(ctx context.Context, store storage.Storage, imagesJSON ...[]byte) {
+	for _, data := range imagesJSON {
+		for _, img := range decodeStoredImages(data) {
+			for _, key := range imageKeys(img) {
+				if err := store.Delete(ctx, key); err != nil {
+					log.Printf("Failed to delete image file %s: %v", key, err)
+				}
+			}
+		}
+	}
+}
+
+// collectImages reads a column of products.images values
+func collectImages(rows pgx.Rows) ([][]byte, error) {
+	defer rows.Close()
+	var all [][]byte
+	for rows.Next() {
+		var imagesJSON []byte
+		if err := rows.Scan(&imagesJSON); err != nil {
+			return nil, err
+		}
+		all = append(all, imagesJSON)
+	}
+	return all, rows.Err()
+}
+
+// decodeStoredImages parses a products.images value as stored
+func decodeStoredImages(imagesJSON []byte) []models.ProductImage {
+	images := []models.ProductImage{}
+	json.Unmarshal(imagesJSON, &images)
+	return images
+}
+
+// decodeImages parses a products.images value and signs the URLs of private images
+func decodeImages(ctx context.Context, store storage.Storage, ttl time.Duration, imagesJSON []byte) []models.ProductImage {
+	images := decodeStoredImages(imagesJSON)
+	for i := range images {
+		signImage(ctx, store, ttl, &images[i])
+	}
+	return images
+}
+
+// signImage replaces the URLs of a private image with signed ones that expire after ttl
+func signImage(ctx context.Context, store storage.Storage, ttl time.Duration, img *models.ProductImage) {
+	sign := func(key string, url *string) {
+		if key == "" || !storage.IsPrivate(key) {
+			return
+		}
+		if signed, err := store.SignedURL(ctx, key, ttl); err == nil {
+			*url = signed
+		}
+	}
+
+	sign(img.Key, &img.URL)
+	for name, size := range img.Sizes {
+		sign(size.Key, &size.URL)
+		sign(size.WebPKey, &size.WebPURL)
+		img.Sizes[name] = size
+	}
+}
+
+// rekeyImages copies the files of a stored images value to the keys of the
+// other privacy: under storage.PrivatePrefix when private, out of it when
+// not. It returns the value pointing at the new keys, or nil when nothing
+// moved, with the keys written and the keys they replace.
+func rekeyImages(ctx context.Context, store storage.Storage, imagesJSON []byte, private bool) ([]byte, []string, []string, error) {
+	var written, replaced []string
+	// The full size shares the image's own key; each file is copied once
+	copied := map[string]bool{}
+	move := func(key string) (string, error) {
+		moved := strings.TrimPrefix(key, storage.PrivatePrefix)
+		if private {
+			moved = storage.PrivatePrefix + moved
+		}
+		if key == "" || moved == key {
+			return key, nil
+		}
+		if copied[key] {
+			return moved, nil
+		}
+		copied[key] = true
+		rc, err := store.Open(ctx, key)
+		if errors.Is(err, storage.ErrNotFound) {
+			// Nothing to copy; the image points at the new key all the same
+			return moved, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+		if err := store.Put(ctx, moved, bytes.NewReader(data), int64(len(data)), storage.ContentType(moved)); err != nil {
+			return "", err
+		}
+		written = append(written, moved)
+		replaced = append(replaced, key)
+		return moved, nil
+	}
+
+	images := decodeStoredImages(imagesJSON)
+	changed := false
+	for i := range images {
+		img := &images[i]
+		key := img.Key
+		if key == "" && strings.HasPrefix(img.URL, "/uploads/") {
+			key = strings.TrimPrefix(img.URL, "/uploads/")
+		}
+		if key != "" {
+			moved, err := move(key)
+			if err != nil {
+				return nil, written, replaced, err
+			}
+			if moved != img.Key {
+				img.Key, img.URL = moved, store.URL(moved)
+				changed = true
+			}
+		}
+		for name, size := range img.Sizes {
+			moved, err := move(size.Key)
+			if err != nil {
+				return nil, written, replaced, err
+			}
+			webpMoved, err := move(size.WebPKey)
+			if err != nil {
+				return nil, written, replaced, err
+			}
+			if moved != size.Key || webpMoved != size.WebPKey {
+				size.Key, size.WebPKey = moved, webpMoved
+				if moved != "" {
+					size.URL = store.URL(moved)
+				}
+				if webpMoved != "" {
+					size.WebPURL = store.URL(webpMoved)
+				}
+				img.Sizes[name] = size
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil, written, replaced, nil
+	}
+	data, err := json.Marshal(images)
+	return data, written, replaced, err
+}
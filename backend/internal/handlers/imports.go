@@ -0,0 +1,758 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"azaton-backend/internal/barcode"
+	"azaton-backend/internal/config"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/pricing"
+	"azaton-backend/internal/spreadsheet"
+	"azaton-backend/internal/units"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	importBatchSize = 200
+	// Only the first errors are kept on a job; counts stay exact
+	importMaxStoredErrors = 1000
+)
+
+// importFields are the product fields a spreadsheet column can be mapped to
+var importFields = []string{"name", "quantity", "unit", "price", "markup_percent", "barcode", "barid", "category", "supplier"}
+
+// importRow is a validated spreadsheet row; nil pointers are columns that were not mapped
+type importRow struct {
+	Row           int
+	Name          string
+	Quantity      *float64
+	Unit          *string
+	Price         *float64
+	MarkupPercent *float64
+	Barcode       *string
+	Barid         *int64
+	Category      *string
+	Supplier      *string
+}
+
+// resolveImportMapping turns a field -> column mapping into column indexes.
+// Columns may be given as a 0-based index (as ExcelColumnMapper sends them),
+// a header name, or a column letter such as "C".
+func resolveImportMapping(mapping map[string]interface{}, header []string) (map[string]int, error) {
+	columns := map[string]int{}
+	for _, field := range importFields {
+		ref, ok := mapping[field]
+		if !ok || ref == nil {
+			continue
+		}
+
+		idx := -1
+		switch v := ref.(type) {
+		case float64:
+			idx = int(v)
+		case string:
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			for i, h := range header {
+				if strings.EqualFold(strings.TrimSpace(h), v) {
+					idx = i
+					break
+				}
+			}
+			if idx < 0 {
+				if n, err := strconv.Atoi(v); err == nil {
+					idx = n
+				} else if isColumnLetter(v) {
+					idx = spreadsheet.ColumnIndex(v)
+				}
+			}
+		}
+
+		if idx < 0 {
+			return nil, fmt.Errorf("column for %s not found: %v", field, ref)
+		}
+		columns[field] = idx
+	}
+
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New("mapping for name is required")
+	}
+	return columns, nil
+}
+
+// isColumnLetter reports whether s looks like a spreadsheet column name such as "C" or "AB"
+func isColumnLetter(s string) bool {
+	if len(s) == 0 || len(s) > 3 {
+		return false
+	}
+	for _, r := range strings.ToUpper(s) {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNumber accepts spreadsheet numbers such as "12 500", "12500,50" or "12,500.50"
+func parseNumber(s string) (float64, error) {
+	s = strings.NewReplacer(" ", "", "\u00a0", "", "\u202f", "", "'", "").Replace(strings.TrimSpace(s))
+	comma, dot := strings.LastIndex(s, ","), strings.LastIndex(s, ".")
+	switch {
+	case comma >= 0 && dot >= 0 && comma > dot:
+		s = strings.ReplaceAll(s, ".", "")
+		s = strings.Replace(s, ",", ".", 1)
+	case comma >= 0 && dot >= 0:
+		s = strings.ReplaceAll(s, ",", "")
+	case comma >= 0:
+		s = strings.ReplaceAll(s, ",", ".")
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parseImportRows validates data rows against the mapping. Row numbers are 1-based as in the spreadsheet.
+func parseImportRows(rows [][]string, columns map[string]int, firstRow int) ([]importRow, []models.ImportRowError) {
+	var valid []importRow
+	var rowErrors []models.ImportRowError
+	seenBarcodes := map[string]int{}
+
+	for i, cells := range rows {
+		rowNum := firstRow + i
+		cell := func(field string) (string, bool) {
+			idx, ok := columns[field]
+			if !ok {
+				return "", false
+			}
+			if idx >= len(cells) {
+				return "", true
+			}
+			return strings.TrimSpace(cells[idx]), true
+		}
+
+		// Skip blank lines silently
+		blank := true
+		for _, c := range cells {
+			if strings.TrimSpace(c) != "" {
+				blank = false
+				break
+			}
+		}
+		if blank {
+			continue
+		}
+
+		row := importRow{Row: rowNum}
+		var errs []models.ImportRowError
+		fail := func(field, value, msg string) {
+			errs = append(errs, models.ImportRowError{Row: rowNum, Field: field, Value: value, Message: msg})
+		}
+
+		row.Name, _ = cell("name")
+		if row.Name == "" {
+			fail("name", "", "Name is required")
+		} else if len([]rune(row.Name)) > 500 {
+			fail("name", "", "Name is longer than 500 characters")
+		}
+
+		// Without a unit column the product's own precision is checked when it is written
+		precision := units.MaxPrecision
+		if v, ok := cell("unit"); ok && v != "" {
+			v = strings.ToLower(v)
+			if !units.Known(v) {
+				fail("unit", v, "Unknown unit")
+			} else {
+				precision = units.DefaultPrecision(v)
+				row.Unit = &v
+			}
+		}
+
+		if v, ok := cell("quantity"); ok && v != "" {
+			f, err := parseNumber(v)
+			if err == nil {
+				err = units.Validate(f, precision)
+			}
+			if err != nil {
+				fail("quantity", v, "Quantity must be a non-negative number with at most "+strconv.Itoa(precision)+" decimal places")
+			} else {
+				row.Quantity = &f
+			}
+		}
+
+		if v, ok := cell("price"); ok && v != "" {
+			if f, err := parseNumber(v); err != nil || f < 0 {
+				fail("price", v, "Price must be a non-negative number")
+			} else {
+				row.Price = &f
+			}
+		}
+
+		if v, ok := cell("markup_percent"); ok && v != "" {
+			v = strings.TrimSuffix(v, "%")
+			if f, err := parseNumber(v); err != nil || f < 0 || f >= 1000 {
+				fail("markup_percent", v, "Markup must be a number between 0 and 999.99")
+			} else {
+				row.MarkupPercent = &f
+			}
+		}
+
+		if v, ok := cell("barcode"); ok && v != "" {
+			if err := barcode.Validate(v); err != nil {
+				fail("barcode", v, "Invalid barcode")
+			} else if prev, dup := seenBarcodes[v]; dup {
+				fail("barcode", v, fmt.Sprintf("Duplicate barcode, already used in row %d", prev))
+			} else {
+				seenBarcodes[v] = rowNum
+				code := v
+				row.Barcode = &code
+			}
+		}
+
+		if v, ok := cell("barid"); ok && v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+				fail("barid", v, "Barid must be a positive number")
+			} else {
+				row.Barid = &n
+			}
+		}
+
+		if v, ok := cell("category"); ok && v != "" {
+			row.Category = &v
+		}
+
+		if v, ok := cell("supplier"); ok && v != "" {
+			row.Supplier = &v
+		}
+
+		if len(errs) > 0 {
+			rowErrors = append(rowErrors, errs...)
+			continue
+		}
+		valid = append(valid, row)
+	}
+
+	return valid, rowErrors
+}
+
+// countFailedRows counts distinct rows among row errors
+func countFailedRows(rowErrors []models.ImportRowError) int {
+	rows := map[int]bool{}
+	for _, e := range rowErrors {
+		rows[e.Row] = true
+	}
+	return len(rows)
+}
+
+// ImportProducts imports products from an uploaded XLSX or CSV file.
+// With dry_run=true it only validates and reports what would be created or updated;
+// otherwise it starts a background job whose progress is read from GetImportJob.
+func ImportProducts(db *pgxpool.Pool, cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		companyID, err := strconv.Atoi(c.PostForm("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+			return
+		}
+		dryRun := c.PostForm("dry_run") == "true"
+
+		file, header, err := c.Request.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+			return
+		}
+		defer file.Close()
+
+		if header.Size > cfg.MaxFileSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(file, cfg.MaxFileSize+1))
+		if err != nil || int64(len(data)) > cfg.MaxFileSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+			return
+		}
+
+		// Mapping comes inline, from a saved mapping, or from the header row
+		var mapping map[string]interface{}
+		hasHeader := c.DefaultPostForm("has_header", "true") == "true"
+		if raw := c.PostForm("mapping"); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid mapping JSON"})
+				return
+			}
+		} else if mappingID, err := strconv.Atoi(c.PostForm("mapping_id")); err == nil {
+			var mappingJSON []byte
+			err := db.QueryRow(ctx, `
+				SELECT mapping, has_header FROM import_mappings WHERE id = $1 AND company_id = $2
+			`, mappingID, companyID).Scan(&mappingJSON, &hasHeader)
+			if err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Mapping not found"})
+				return
+			}
+			json.Unmarshal(mappingJSON, &mapping)
+		} else if !hasHeader {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mapping or mapping_id required"})
+			return
+		}
+
+		rows, err := spreadsheet.Read(data, header.Filename)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var headerRow []string
+		firstRow := 1
+		if hasHeader && len(rows) > 0 {
+			headerRow, rows = rows[0], rows[1:]
+			firstRow = 2
+		}
+
+		// Without a mapping, header cells named like the fields are used (as in ExportProducts)
+		if mapping == nil {
+			mapping = map[string]interface{}{}
+			for _, h := range headerRow {
+				for _, field := range importFields {
+					if strings.EqualFold(strings.TrimSpace(h), field) {
+						mapping[field] = field
+					}
+				}
+			}
+		}
+
+		columns, err := resolveImportMapping(mapping, headerRow)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		valid, rowErrors := parseImportRows(rows, columns, firstRow)
+		totalRows := len(valid) + countFailedRows(rowErrors)
+
+		if dryRun {
+			// Rows whose barcode already exists would update that product
+			var codes []string
+			for _, r := range valid {
+				if r.Barcode != nil {
+					codes = append(codes, *r.Barcode)
+				}
+			}
+			existing := map[string]bool{}
+			if len(codes) > 0 {
+				barcodeRows, err := db.Query(ctx, `
+					SELECT DISTINCT barcode FROM products WHERE company_id = $1 AND barcode = ANY($2) AND deleted_at IS NULL
+				`, companyID, codes)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+					return
+				}
+				for barcodeRows.Next() {
+					var code string
+					if barcodeRows.Scan(&code) == nil {
+						existing[code] = true
+					}
+				}
+				barcodeRows.Close()
+			}
+
+			updated := 0
+			for _, r := range valid {
+				if r.Barcode != nil && existing[*r.Barcode] {
+					updated++
+				}
+			}
+
+			if rowErrors == nil {
+				rowErrors = []models.ImportRowError{}
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"success":    true,
+				"dry_run":    true,
+				"total_rows": totalRows,
+				"created":    len(valid) - updated,
+				"updated":    updated,
+				"failed":     countFailedRows(rowErrors),
+				"errors":     rowErrors,
+			})
+			return
+		}
+
+		storedErrors := rowErrors
+		if len(storedErrors) > importMaxStoredErrors {
+			storedErrors = storedErrors[:importMaxStoredErrors]
+		}
+		if storedErrors == nil {
+			storedErrors = []models.ImportRowError{}
+		}
+		errorsJSON, _ := json.Marshal(storedErrors)
+
+		var jobID string
+		err = db.QueryRow(ctx, `
+			INSERT INTO import_jobs (company_id, filename, status, total_rows, processed_rows, failed_count, errors)
+			VALUES ($1, $2, 'pending', $3, $4, $4, $5)
+			RETURNING id
+		`, companyID, header.Filename, totalRows, countFailedRows(rowErrors), errorsJSON).Scan(&jobID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		go runImportJob(db, jobID, companyID, valid)
+
+		c.JSON(http.StatusAccepted, gin.H{"success": true, "job_id": jobID, "total_rows": totalRows})
+	}
+}
+
+// runImportJob upserts validated rows in batches and records progress on the job
+func runImportJob(db *pgxpool.Pool, jobID string, companyID int, rows []importRow) {
+	ctx := context.Background()
+
+	db.Exec(ctx, `UPDATE import_jobs SET status = 'running', started_at = NOW() WHERE id = $1`, jobID)
+
+	for start := 0; start < len(rows); start += importBatchSize {
+		end := start + importBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		created, updated, rowErrors, err := importBatch(ctx, db, companyID, rows[start:end])
+		if err != nil {
+			log.Printf("Import job %s failed: %v", jobID, err)
+			db.Exec(ctx, `
+				UPDATE import_jobs SET status = 'failed', error_message = $1, finished_at = NOW() WHERE id = $2
+			`, err.Error(), jobID)
+			return
+		}
+
+		errorsJSON, _ := json.Marshal(rowErrors)
+		_, err = db.Exec(ctx, `
+			UPDATE import_jobs SET
+				processed_rows = processed_rows + $1,
+				created_count = created_count + $2,
+				updated_count = updated_count + $3,
+				failed_count = failed_count + $4,
+				errors = CASE WHEN jsonb_array_length(errors) < $5 THEN errors || $6::jsonb ELSE errors END
+			WHERE id = $7
+		`, end-start, created, updated, len(rowErrors), importMaxStoredErrors, string(errorsJSON), jobID)
+		if err != nil {
+			log.Printf("Import job %s progress update failed: %v", jobID, err)
+		}
+	}
+
+	db.Exec(ctx, `UPDATE import_jobs SET status = 'completed', finished_at = NOW() WHERE id = $1`, jobID)
+}
+
+// importBatch writes one batch in a transaction. A row that fails is rolled back
+// to its savepoint and reported, without losing the rest of the batch.
+func importBatch(ctx context.Context, db *pgxpool.Pool, companyID int, rows []importRow) (int, int, []models.ImportRowError, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := setPriceSource(ctx, tx, priceSourceImport); err != nil {
+		return 0, 0, nil, err
+	}
+
+	rules, err := loadPricingRules(ctx, tx, companyID)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	created, updated := 0, 0
+	rowErrors := []models.ImportRowError{}
+
+	for _, row := range rows {
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+
+		wasUpdate, err := upsertImportRow(ctx, sp, companyID, rules, row)
+		if isBarcodeTaken(err) {
+			err = errBarcodeTaken
+		}
+		if err != nil {
+			sp.Rollback(ctx)
+			rowErrors = append(rowErrors, models.ImportRowError{Row: row.Row, Message: err.Error()})
+			continue
+		}
+		if err := sp.Commit(ctx); err != nil {
+			return 0, 0, nil, err
+		}
+
+		if wasUpdate {
+			updated++
+		} else {
+			created++
+		}
+	}
+	if created+updated > 0 {
+		publishCompanyProducts(ctx, tx, companyID)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, 0, nil, err
+	}
+	return created, updated, rowErrors, nil
+}
+
+// upsertImportRow updates the company product with the row's barcode, or inserts a new one.
+// Columns that were not mapped keep their current values on update. Prices go through
+// the company pricing rules; a row without a markup gets the rule markup when inserted.
+func upsertImportRow(ctx context.Context, tx pgx.Tx, companyID int, rules pricing.Rules, row importRow) (bool, error) {
+	if row.Barcode != nil {
+		var id, precision int
+		var price, markupPercent float64
+		var category, supplier, unit string
+		err := tx.QueryRow(ctx, `
+			SELECT id, price, markup_percent, category, COALESCE(supplier, ''), unit, quantity_precision
+			FROM products
+			WHERE company_id = $1 AND barcode = $2 AND deleted_at IS NULL
+			ORDER BY id LIMIT 1 FOR UPDATE
+		`, companyID, *row.Barcode).Scan(&id, &price, &markupPercent, &category, &supplier, &unit, &precision)
+
+		if err == nil {
+			// A new unit brings its default precision
+			if row.Unit != nil && *row.Unit != unit {
+				unit = *row.Unit
+				precision = units.DefaultPrecision(unit)
+			}
+			if row.Quantity != nil {
+				if err := units.Validate(*row.Quantity, precision); err != nil {
+					return false, fmt.Errorf("%v for %s", err, unit)
+				}
+			}
+			if row.Price != nil {
+				price = *row.Price
+			}
+			if row.MarkupPercent != nil {
+				markupPercent = *row.MarkupPercent
+			}
+			if row.Category != nil {
+				category = *row.Category
+			}
+			if row.Supplier != nil {
+				supplier = *row.Supplier
+			}
+			priced := rules.Apply(pricing.Input{
+				Price:         price,
+				MarkupPercent: &markupPercent,
+				Category:      category,
+				Supplier:      supplier,
+			})
+
+			_, err = tx.Exec(ctx, `
+				UPDATE products SET
+					name = $1,
+					quantity = COALESCE($2, quantity),
+					price = $3,
+					markup_percent = $4,
+					markup_amount = $5,
+					selling_price = $6,
+					barid = COALESCE($7, barid),
+					category = $8,
+					supplier = COALESCE($9, supplier),
+					unit = $10,
+					quantity_precision = $11,
+					updated_at = NOW()
+				WHERE id = $12
+			`, row.Name, row.Quantity, price, priced.MarkupPercent, priced.MarkupAmount,
+				priced.SellingPrice, row.Barid, category, row.Supplier, unit, precision, id)
+			return true, err
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return false, err
+		}
+	}
+
+	unit := units.Piece
+	if row.Unit != nil {
+		unit = *row.Unit
+	}
+	precision := units.DefaultPrecision(unit)
+	quantity := 0.0
+	if row.Quantity != nil {
+		quantity = *row.Quantity
+		if err := units.Validate(quantity, precision); err != nil {
+			return false, fmt.Errorf("%v for %s", err, unit)
+		}
+	}
+	price := 0.0
+	if row.Price != nil {
+		price = *row.Price
+	}
+	category := "Без категории"
+	if row.Category != nil {
+		category = *row.Category
+	}
+
+	priced := rules.Apply(pricing.Input{
+		Price:         price,
+		MarkupPercent: row.MarkupPercent,
+		Category:      category,
+		Supplier:      stringValue(row.Supplier),
+	})
+
+	_, err := tx.Exec(ctx, `
+		INSERT INTO products (company_id, name, quantity, unit, quantity_precision, price, markup_percent,
+							  markup_amount, selling_price, barcode, barid, category, supplier)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	`, companyID, row.Name, quantity, unit, precision, price, priced.MarkupPercent, priced.MarkupAmount,
+		priced.SellingPrice, row.Barcode, row.Barid, category, row.Supplier)
+	return false, err
+}
+
+// GetImportJob returns the progress and report of an import job
+func GetImportJob(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var job models.ImportJob
+		var filename *string
+		var errorsJSON []byte
+		err := db.QueryRow(ctx, `
+			SELECT id, company_id, filename, status, total_rows, processed_rows, created_count,
+				   updated_count, failed_count, errors, error_message, created_at, started_at, finished_at
+			FROM import_jobs WHERE id = $1
+		`, c.Param("id")).Scan(&job.ID, &job.CompanyID, &filename, &job.Status, &job.TotalRows,
+			&job.ProcessedRows, &job.Created, &job.Updated, &job.Failed, &errorsJSON,
+			&job.ErrorMessage, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Import job not found"})
+			return
+		}
+
+		if filename != nil {
+			job.Filename = *filename
+		}
+		json.Unmarshal(errorsJSON, &job.Errors)
+		if job.Errors == nil {
+			job.Errors = []models.ImportRowError{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"job": job})
+	}
+}
+
+// FailInterruptedImportJobs marks jobs left running by a previous server process as failed
+func FailInterruptedImportJobs(db *pgxpool.Pool) {
+	_, err := db.Exec(context.Background(), `
+		UPDATE import_jobs SET status = 'failed', error_message = 'Interrupted by server restart', finished_at = NOW()
+		WHERE status IN ('pending', 'running')
+	`)
+	if err != nil {
+		log.Printf("Warning: failed to reset interrupted import jobs: %v", err)
+	}
+}
+
+// GetImportMappings returns saved column mappings for a company
+func GetImportMappings(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		companyID, err := strconv.Atoi(c.Query("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, company_id, name, mapping, has_header, created_at
+			FROM import_mappings WHERE company_id = $1 ORDER BY name
+		`, companyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		mappings := []models.ImportMapping{}
+		for rows.Next() {
+			var m models.ImportMapping
+			var mappingJSON []byte
+			if err := rows.Scan(&m.ID, &m.CompanyID, &m.Name, &mappingJSON, &m.HasHeader, &m.CreatedAt); err != nil {
+				continue
+			}
+			json.Unmarshal(mappingJSON, &m.Mapping)
+			mappings = append(mappings, m)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"mappings": mappings})
+	}
+}
+
+// SaveImportMapping creates or replaces a named column mapping
+func SaveImportMapping(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input struct {
+			CompanyID int                    `json:"company_id" binding:"required"`
+			Name      string                 `json:"name" binding:"required"`
+			Mapping   map[string]interface{} `json:"mapping" binding:"required"`
+			HasHeader *bool                  `json:"has_header"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		hasHeader := input.HasHeader == nil || *input.HasHeader
+		mappingJSON, _ := json.Marshal(input.Mapping)
+
+		var id int
+		err := db.QueryRow(ctx, `
+			INSERT INTO import_mappings (company_id, name, mapping, has_header)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (company_id, name) DO UPDATE SET
+				mapping = EXCLUDED.mapping,
+				has_header = EXCLUDED.has_header,
+				updated_at = NOW()
+			RETURNING id
+		`, input.CompanyID, input.Name, mappingJSON, hasHeader).Scan(&id)
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "id": id})
+	}
+}
+
+// DeleteImportMapping deletes a saved column mapping
+func DeleteImportMapping(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+			return
+		}
+
+		_, err = db.Exec(ctx, `DELETE FROM import_mappings WHERE id = $1`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"azaton-backend/internal/pricing"
+	"azaton-backend/internal/units"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errInvalidItem is returned for an order line that cannot be read
+var errInvalidItem = errors.New("invalid item")
+
+// unavailableItem is an order line that cannot be sold
+type unavailableItem struct {
+	ProductID int    `json:"product_id"`
+	Name      string `json:"name,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// priceMismatch is an amount the client sent that differs from the server's
+type priceMismatch struct {
+	ProductID *int    `json:"product_id,omitempty"` // nil for the order's own totals
+	Name      string  `json:"name,omitempty"`
+	Field     string  `json:"field"`
+	Client    float64 `json:"client"`
+	Server    float64 `json:"server"`
+}
+
+// priceOptions are the rules an order is priced under
+type priceOptions struct {
+	companyID    *int // every product must belong to this company
+	forCustomers bool // only products available for customers can be ordered
+	discounts    bool // lines may carry a discount_percent
+}
+
+// pricedOrder is an order or sale priced from the products as they are now.
+// Items are the lines as stored: each one a snapshot of the prices it was
+// sold at, never repriced afterwards.
+type pricedOrder struct {
+	Items        []map[string]interface{}
+	CompanyID    *int // of the first line's product
+	Total        float64
+	MarkupProfit float64
+	Unavailable  []unavailableItem
+	Mismatches   []priceMismatch
+}
+
+// pricedProduct is what an order line is priced from
+type pricedProduct struct {
+	companyID    int
+	name         string
+	price        float64 // cost price per base unit
+	sellingPrice float64 // per base unit
+	forCustomers bool
+	deleted      bool
+	unit         string
+	precision    int
+	factors      map[string]float64 // packaging units
+}
+
+// lineAmounts are the per-line amounts a client may send, as the server computed them
+var lineAmounts = []struct {
+	key   string
+	value func(cost, selling float64, line pricing.Line) float64
+}{
+	{"price", func(cost, _ float64, _ pricing.Line) float64 { return cost }},
+	{"selling_price", func(_, selling float64, _ pricing.Line) float64 { return selling }},
+	{"price_with_markup", func(_, selling float64, _ pricing.Line) float64 { return selling }},
+	{"markup_amount", func(cost, selling float64, _ pricing.Line) float64 { return selling - cost }},
+	{"total", func(_, _ float64, line pricing.Line) float64 { return line.Total }},
+	{"line_total", func(_, _ float64, line pricing.Line) float64 { return line.Total }},
+}
+
+// itemProductID reads the product of an order line. Older clients send it as id.
+func itemProductID(item map[string]interface{}) (int, bool) {
+	id := idString(item["product_id"])
+	if id == "" {
+		id = itemID(item)
+	}
+	productID, err := strconv.Atoi(id)
+	return productID, err == nil && productID > 0
+}
+
+// loadPricedProducts loads the products order lines are priced from
+func loadPricedProducts(ctx context.Context, q querier, ids []int) (map[int]*pricedProduct, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, company_id, name, COALESCE(price, 0),
+			   COALESCE(NULLIF(selling_price, 0), COALESCE(price, 0) * (1 + COALESCE(markup_percent, 0) / 100)),
+			   available_for_customers, deleted_at IS NOT NULL, unit, quantity_precision
+		FROM products WHERE id = ANY($1)
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	products := map[int]*pricedProduct{}
+	for rows.Next() {
+		var id int
+		p := &pricedProduct{factors: map[string]float64{}}
+		if err := rows.Scan(&id, &p.companyID, &p.name, &p.price, &p.sellingPrice, &p.forCustomers,
+			&p.deleted, &p.unit, &p.precision); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		products[id] = p
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = q.Query(ctx, `SELECT product_id, name, factor FROM product_units WHERE product_id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		var factor float64
+		if err := rows.Scan(&id, &name, &factor); err != nil {
+			return nil, err
+		}
+		if p := products[id]; p != nil {
+			p.factors[name] = factor
+		}
+	}
+	return products, rows.Err()
+}
+
+// priceOrder prices the lines a client sent from the products' current
+// prices. Products that cannot be sold are collected in Unavailable, client
+// amounts that differ from the server's in Mismatches. Lines that cannot be
+// read fail with errInvalidItem or errUnknownUnit. Every line must be sold by
+// opts.companyID, or else by the company of the first line.
+func priceOrder(ctx context.Context, q querier, items []map[string]interface{}, opts priceOptions) (*pricedOrder, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("%w: the order has no items", errInvalidItem)
+	}
+	ids := make([]int, 0, len(items))
+	for i, item := range items {
+		id, ok := itemProductID(item)
+		if !ok {
+			return nil, fmt.Errorf("%w: item %d has no product_id", errInvalidItem, i+1)
+		}
+		ids = append(ids, id)
+	}
+	products, err := loadPricedProducts(ctx, q, ids)
+	if err != nil {
+		return nil, err
+	}
+	// An order is sold by one company: the first line's
+	if opts.companyID == nil {
+		for _, id := range ids {
+			if p := products[id]; p != nil && !p.deleted {
+				companyID := p.companyID
+				opts.companyID = &companyID
+				break
+			}
+		}
+	}
+
+	order := &pricedOrder{Items: make([]map[string]interface{}, 0, len(items))}
+	pricedAt := time.Now().UTC()
+	for i, item := range items {
+		productID := ids[i]
+		quantity, ok := item["quantity"].(float64)
+		if !ok || quantity <= 0 {
+			return nil, fmt.Errorf("%w: item %d has no quantity", errInvalidItem, i+1)
+		}
+		discountPercent, _ := item["discount_percent"].(float64)
+		if discountPercent != 0 && !opts.discounts {
+			return nil, fmt.Errorf("%w: discounts are only given on sales", errInvalidItem)
+		}
+		if err := pricing.ValidateDiscount(discountPercent); err != nil {
+			return nil, fmt.Errorf("%w: item %d: %v", errInvalidItem, i+1, err)
+		}
+
+		p := products[productID]
+		name, _ := item["name"].(string)
+		if p != nil {
+			name = p.name
+		}
+		switch {
+		case p == nil || p.deleted:
+			order.Unavailable = append(order.Unavailable, unavailableItem{productID, name, "not found"})
+			continue
+		case opts.companyID != nil && p.companyID != *opts.companyID:
+			order.Unavailable = append(order.Unavailable, unavailableItem{productID, name, "sold by another company"})
+			continue
+		case opts.forCustomers && !p.forCustomers:
+			order.Unavailable = append(order.Unavailable, unavailableItem{productID, name, "not available for customers"})
+			continue
+		}
+
+		// A line in a packaging unit is priced at factor base units
+		unit, _ := item["unit"].(string)
+		factor := 1.0
+		if unit == "" || unit == p.unit {
+			unit = ""
+			if err := units.Validate(quantity, p.precision); err != nil {
+				return nil, fmt.Errorf("%w: %s: %v", errInvalidItem, p.name, err)
+			}
+		} else if factor, ok = p.factors[unit]; !ok {
+			return nil, fmt.Errorf("%w %q for product %d", errUnknownUnit, unit, productID)
+		}
+		cost := pricing.Money(p.price * factor)
+		selling := pricing.Money(p.sellingPrice * factor)
+		line := pricing.PriceLine(cost, selling, quantity, discountPercent)
+
+		for _, amount := range lineAmounts {
+			if client, ok := item[amount.key].(float64); ok {
+				if server := amount.value(cost, selling, line); !pricing.Matches(client, server) {
+					id := productID
+					order.Mismatches = append(order.Mismatches, priceMismatch{&id, p.name, amount.key, client, server})
+				}
+			}
+		}
+
+		priced := map[string]interface{}{
+			"product_id":    productID,
+			"company_id":    p.companyID,
+			"name":          p.name,
+			"quantity":      quantity,
+			"price":         cost,
+			"selling_price": selling,
+			"markup_amount": pricing.Money(selling - cost),
+			"line_total":    line.Total,
+			"markup_profit": line.MarkupProfit,
+			"priced_at":     pricedAt,
+		}
+		if unit != "" {
+			priced["unit"] = unit
+		}
+		if discountPercent > 0 {
+			priced["discount_percent"] = discountPercent
+			priced["discount"] = line.Discount
+		}
+		// What the customer chose, not priced
+		for _, key := range []string{"color", "image_url"} {
+			if v, ok := item[key].(string); ok && v != "" {
+				priced[key] = v
+			}
+		}
+		order.Items = append(order.Items, priced)
+
+		if order.CompanyID == nil {
+			companyID := p.companyID
+			order.CompanyID = &companyID
+		}
+		order.Total += line.Total
+		order.MarkupProfit += line.MarkupProfit
+	}
+	order.Total = pricing.Money(order.Total)
+	order.MarkupProfit = pricing.Money(order.MarkupProfit)
+	return order, nil
+}
+
+// compareTotals checks the order totals a client sent, if any
+func (o *pricedOrder) compareTotals(total, markupProfit *float64) {
+	if total != nil && !pricing.Matches(*total, o.Total) {
+		o.Mismatches = append(o.Mismatches, priceMismatch{Field: "total_amount", Client: *total, Server: o.Total})
+	}
+	if markupProfit != nil && !pricing.Matches(*markupProfit, o.MarkupProfit) {
+		o.Mismatches = append(o.Mismatches, priceMismatch{Field: "markup_profit", Client: *markupProfit, Server: o.MarkupProfit})
+	}
+}
+
+// priceOrderFailed answers a pricing error, unavailable items or a price
+// mismatch, and reports whether it did
+func priceOrderFailed(c *gin.Context, order *pricedOrder, err error) bool {
+	switch {
+	case errors.Is(err, errInvalidItem), errors.Is(err, errUnknownUnit):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	case len(order.Unavailable) > 0:
+		reasons := make([]string, 0, len(order.Unavailable))
+		for _, u := range order.Unavailable {
+			reasons = append(reasons, fmt.Sprintf("%s (%s)", itemLabel(u.ProductID, u.Name), u.Reason))
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"error":             "Some items are unavailable: " + strings.Join(reasons, ", "),
+			"unavailable_items": order.Unavailable,
+		})
+	case len(order.Mismatches) > 0:
+		diffs := make([]string, 0, len(order.Mismatches))
+		for _, m := range order.Mismatches {
+			label := m.Field
+			if m.ProductID != nil {
+				label = itemLabel(*m.ProductID, m.Name) + " " + m.Field
+			}
+			diffs = append(diffs, fmt.Sprintf("%s: %s → %s", label, formatAmount(m.Client), formatAmount(m.Server)))
+		}
+		c.JSON(http.StatusConflict, gin.H{
+			"error":            "Prices have changed: " + strings.Join(diffs, "; "),
+			"price_mismatches": order.Mismatches,
+			"items":            order.Items,
+			"total_amount":     order.Total,
+			"markup_profit":    order.MarkupProfit,
+		})
+	default:
+		return false
+	}
+	return true
+}
+
+func itemLabel(productID int, name string) string {
+	if name == "" {
+		return "product " + strconv.Itoa(productID)
+	}
+	return name
+}
+
+func formatAmount(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
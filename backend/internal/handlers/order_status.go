@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/orderstatus"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// errOrderChanged is returned when an order's status changed under a transition
+var errOrderChanged = errors.New("the order was changed by someone else; reload it")
+
+// orderActor is who moves an order along, as the request names them
+type orderActor struct {
+	Role      string `json:"actor"` // customer or company; worked out from company_id or user_phone when empty
+	CompanyID *int   `json:"company_id"`
+	UserPhone string `json:"user_phone"`
+	ChangedBy string `json:"changed_by"` // a name for the history
+	Note      string `json:"note"`
+}
+
+// bindOrderActor reads the actor from the body. Older clients send no body at all.
+func bindOrderActor(c *gin.Context, actor interface{}) bool {
+	if err := c.ShouldBindJSON(actor); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// resolve works out the actor's role and checks it against the order: a
+// company acts on its own orders and a customer on the orders placed with
+// their phone. Callers that name nobody get fallback. The admin role is
+// never taken from a request: nothing in it proves who sent it.
+func (a *orderActor) resolve(orderCompanyID *int, orderPhone *string, fallback string) error {
+	if a.Role == "" {
+		switch {
+		case a.CompanyID != nil:
+			a.Role = orderstatus.Company
+		case strings.TrimSpace(a.UserPhone) != "":
+			a.Role = orderstatus.Customer
+		default:
+			a.Role = fallback
+		}
+	}
+	switch a.Role {
+	case orderstatus.Company:
+		if a.CompanyID == nil || orderCompanyID == nil || *a.CompanyID != *orderCompanyID {
+			return fmt.Errorf("%w: the order belongs to another company", orderstatus.ErrForbidden)
+		}
+	case orderstatus.Customer:
+		phone := strings.TrimSpace(a.UserPhone)
+		if phone == "" {
+			return fmt.Errorf("%w: user_phone is required", orderstatus.ErrForbidden)
+		}
+		if orderPhone == nil || phone != strings.TrimSpace(*orderPhone) {
+			return fmt.Errorf("%w: the order was placed by another customer", orderstatus.ErrForbidden)
+		}
+	case "":
+		return errors.New("actor, company_id or user_phone is required")
+	default:
+		// System transitions come from the server itself, never from a request
+		return fmt.Errorf("%w: unknown actor %q", orderstatus.ErrForbidden, a.Role)
+	}
+	return nil
+}
+
+// name is how the actor is shown in the history
+func (a *orderActor) name() string {
+	switch {
+	case strings.TrimSpace(a.ChangedBy) != "":
+		return strings.TrimSpace(a.ChangedBy)
+	case strings.TrimSpace(a.UserPhone) != "":
+		return strings.TrimSpace(a.UserPhone)
+	case a.CompanyID != nil:
+		return "company " + strconv.Itoa(*a.CompanyID)
+	}
+	return ""
+}
+
+// orderStatusError answers a failed transition check
+func orderStatusError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, orderstatus.ErrForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, orderstatus.ErrIllegal), errors.Is(err, errOrderChanged):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	}
+}
+
+// recordOrderStatus adds a transition to an order's history
+func recordOrderStatus(ctx context.Context, q querier, orderID int, from *string, to, role, actor, note string) error {
+	_, err := q.Exec(ctx, `
+		INSERT INTO order_status_history (order_id, from_status, to_status, actor_role, actor, note)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''))
+	`, orderID, from, to, role, actor, strings.TrimSpace(note))
+	return err
+}
+
+// setOrderStatus moves an order from one status to another and records it.
+// The order must still be in from.
+func setOrderStatus(ctx context.Context, q querier, orderID int, from, to, role, actor, note string) error {
+	tag, err := q.Exec(ctx, `
+		UPDATE customer_orders SET status = $3, updated_at = NOW() WHERE id = $1 AND status = $2
+	`, orderID, from, to)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errOrderChanged
+	}
+	return recordOrderStatus(ctx, q, orderID, &from, to, role, actor, note)
+}
+
+// orderStockLines reads the stock lines of an order's items
+func orderStockLines(items []map[string]interface{}) ([]stockLine, error) {
+	lines := make([]stockLine, 0, len(items))
+	for i, item := range items {
+		productID, ok := itemProductID(item)
+		if !ok {
+			return nil, fmt.Errorf("item %d has no product_id", i+1)
+		}
+		quantity, ok := item["quantity"].(float64)
+		if !ok || quantity <= 0 {
+			return nil, fmt.Errorf("item %d has no quantity", i+1)
+		}
+		unit, _ := item["unit"].(string)
+		lines = append(lines, stockLine{ProductID: productID, Quantity: quantity, Unit: unit})
+	}
+	return lines, nil
+}
+
+// restockOrder puts the items of a paid order back in stock and takes them
+// off the products' sales. It returns the products whose stock changed.
+func restockOrder(ctx context.Context, q querier, orderID int, items []map[string]interface{}) ([]int, error) {
+	lines, err := orderStockLines(items)
+	if err != nil {
+		return nil, err
+	}
+	sold, err := toBaseUnits(ctx, q, lines)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := expandBundles(ctx, q, sold)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]int, 0, len(parts))
+	for _, part := range parts {
+		if _, err := q.Exec(ctx, `
+			UPDATE products SET quantity = quantity + $1, updated_at = NOW() WHERE id = $2
+		`, part.Quantity, part.ProductID); err != nil {
+			return nil, err
+		}
+		if err := recordStockMovement(ctx, q, part.ProductID, part.Quantity, movementRefund, &orderID, nil, nil); err != nil {
+			return nil, err
+		}
+		ids = append(ids, part.ProductID)
+	}
+	for _, line := range sold {
+		if _, err := q.Exec(ctx, `
+			UPDATE products SET sold_quantity = GREATEST(sold_quantity - $1, 0) WHERE id = $2
+		`, line.Quantity, line.ProductID); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// UpdateOrderStatus moves an order along its lifecycle. Only legal
+// transitions are accepted, each only from the roles allowed to make it.
+// Orders are completed by confirming payment, not here. A refund with
+// restock puts the items back in stock.
+func UpdateOrderStatus(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		orderID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+			return
+		}
+
+		var input struct {
+			orderActor
+			Status  string `json:"status" binding:"required"`
+			Restock bool   `json:"restock"` // refunds only
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !orderstatus.Known(input.Status) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown status " + input.Status})
+			return
+		}
+		if input.Status == orderstatus.Completed {
+			c.JSON(http.StatusConflict, gin.H{"error": "Orders are completed by confirming payment"})
+			return
+		}
+
+		transitionOrder(c, db, orderID, input.Status, &input.orderActor, "", input.Restock)
+	}
+}
+
+// transitionOrder moves an order to a status other than completed on behalf
+// of actor, and answers the request
+func transitionOrder(c *gin.Context, db *pgxpool.Pool, orderID int, to string, actor *orderActor, fallback string, restock bool) {
+	ctx := context.Background()
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var from string
+	var companyID *int
+	var userPhone *string
+	var items []map[string]interface{}
+	err = tx.QueryRow(ctx, `
+		SELECT status, company_id, user_phone, items FROM customer_orders WHERE id = $1 FOR UPDATE
+	`, orderID).Scan(&from, &companyID, &userPhone, &items)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := actor.resolve(companyID, userPhone, fallback); err != nil {
+		orderStatusError(c, err)
+		return
+	}
+	if err := orderstatus.Check(from, to, actor.Role); err != nil {
+		orderStatusError(c, err)
+		return
+	}
+
+	var stockIDs []int
+	if to == orderstatus.Refunded && restock {
+		stockIDs, err = restockOrder(ctx, tx, orderID, items)
+		if errors.Is(err, errUnknownUnit) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Accepted orders hold their stock until closed; cancelled ones give it back
+	switch to {
+	case orderstatus.Accepted:
+		err = holdReservations(ctx, tx, orderID)
+	case orderstatus.Cancelled:
+		var released []int
+		released, err = releaseReservations(ctx, tx, orderID)
+		stockIDs = append(stockIDs, released...)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := setOrderStatus(ctx, tx, orderID, from, to, actor.Role, actor.name(), actor.Note); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	publishProducts(ctx, tx, events.StockChanged, stockIDs)
+	if companyID != nil {
+		publish(ctx, tx, events.OrderUpdated, *companyID, gin.H{"order_id": orderID, "status": to})
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"status":        to,
+		"next_statuses": orderstatus.Next(to, actor.Role),
+	})
+}
+
+// GetOrderStatusHistory returns an order's transitions, oldest first
+func GetOrderStatusHistory(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		orderID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
+			return
+		}
+
+		var status string
+		err = db.QueryRow(ctx, `SELECT status FROM customer_orders WHERE id = $1`, orderID).Scan(&status)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, from_status, to_status, actor_role, actor, note, created_at
+			FROM order_status_history WHERE order_id = $1
+			ORDER BY created_at, id
+		`, orderID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		history := []models.OrderStatusChange{}
+		for rows.Next() {
+			var h models.OrderStatusChange
+			if err := rows.Scan(&h.ID, &h.FromStatus, &h.ToStatus, &h.ActorRole, &h.Actor, &h.Note,
+				&h.CreatedAt); err != nil {
+				continue
+			}
+			history = append(history, h)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"order_id": orderID, "status": status, "history": history})
+	}
+}
@@ -3,13 +3,20 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
+	"azaton-backend/internal/config"
+	"azaton-backend/internal/costing"
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/orderstatus"
+
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -32,7 +39,7 @@ func GetCustomerOrders(db *pgxpool.Pool) gin.HandlerFunc {
 
 		rows, err := db.Query(ctx, `
 			SELECT id, company_id, user_id, user_name, user_phone, order_code, items,
-				   total_amount, markup_profit, status, payment_confirmed,
+				   total_amount, markup_profit, cost_of_goods, status, payment_confirmed,
 				   created_date, confirmed_date, order_date
 			FROM customer_orders 
 			WHERE company_id = $1
@@ -53,12 +60,13 @@ func GetCustomerOrders(db *pgxpool.Pool) gin.HandlerFunc {
 			var userName, userPhone, orderCode, status string
 			var itemsJSON []byte
 			var totalAmount, markupProfit float64
+			var costOfGoods *float64
 			var paymentConfirmed bool
 			var createdDate, orderDate time.Time
 			var confirmedDate *time.Time
 
 			if err := rows.Scan(&id, &cID, &userID, &userName, &userPhone, &orderCode,
-				&itemsJSON, &totalAmount, &markupProfit, &status, &paymentConfirmed,
+				&itemsJSON, &totalAmount, &markupProfit, &costOfGoods, &status, &paymentConfirmed,
 				&createdDate, &confirmedDate, &orderDate); err != nil {
 				continue
 			}
@@ -76,7 +84,9 @@ func GetCustomerOrders(db *pgxpool.Pool) gin.HandlerFunc {
 				"items":             items,
 				"total_amount":      totalAmount,
 				"markup_profit":     markupProfit,
+				"cost_of_goods":     costOfGoods,
 				"status":            status,
+				"next_statuses":     orderstatus.Next(status, orderstatus.Company),
 				"payment_confirmed": paymentConfirmed,
 				"created_date":      createdDate,
 				"confirmed_date":    confirmedDate,
@@ -88,72 +98,137 @@ func GetCustomerOrders(db *pgxpool.Pool) gin.HandlerFunc {
 	}
 }
 
-// CreateCustomerOrder creates a new customer order
-func CreateCustomerOrder(db *pgxpool.Pool) gin.HandlerFunc {
+// CreateCustomerOrder creates a new customer order and reserves its items.
+// Lines are priced from the products' current prices; amounts the client
+// sends are only checked against them. An order the available stock cannot
+// cover is refused with the short items. Only products available for
+// customers can be ordered, without discounts; till sales go through
+// CreateSale.
+func CreateCustomerOrder(db *pgxpool.Pool, cfg *config.Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 
 		var input struct {
-			UserID      *int                     `json:"user_id"`
-			UserName    string                   `json:"user_name"`
-			UserPhone   string                   `json:"user_phone"`
-			Items       []map[string]interface{} `json:"items" binding:"required"`
-			TotalAmount float64                  `json:"total_amount"`
+			CompanyID    *int                     `json:"company_id"` // refused; till sales go through CreateSale
+			UserID       *int                     `json:"user_id"`
+			UserName     string                   `json:"user_name"`
+			UserPhone    string                   `json:"user_phone"`
+			Items        []map[string]interface{} `json:"items" binding:"required"`
+			TotalAmount  *float64                 `json:"total_amount"`
+			MarkupProfit *float64                 `json:"markup_profit"`
 		}
 
 		if err := c.ShouldBindJSON(&input); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if input.CompanyID != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Orders are placed by customers; record till sales with POST /api/sales-history"})
+			return
+		}
 
 		// Generate order code
 		orderCode := fmt.Sprintf("ORD-%s-%s", 
 			time.Now().Format("20060102"),
 			uuid.New().String()[:8])
 
-		// Calculate markup profit
-		var markupProfit float64
-		var companyID *int
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
 
-		for _, item := range input.Items {
-			if markup, ok := item["markup_amount"].(float64); ok {
-				quantity := 1
-				if q, ok := item["quantity"].(float64); ok {
-					quantity = int(q)
-				}
-				markupProfit += markup * float64(quantity)
-			}
-			if cid, ok := item["company_id"].(float64); ok && companyID == nil {
-				cidInt := int(cid)
-				companyID = &cidInt
-			}
+		order, err := priceOrder(ctx, tx, input.Items, priceOptions{forCustomers: true})
+		if err == nil {
+			order.compareTotals(input.TotalAmount, input.MarkupProfit)
+		}
+		if priceOrderFailed(c, order, err) {
+			return
 		}
+		companyID := order.CompanyID
+		itemsJSON, _ := json.Marshal(order.Items)
 
-		itemsJSON, _ := json.Marshal(input.Items)
+		// Reservations are held per product, bundles as their components, in base units
+		lines, err := orderStockLines(order.Items)
+		if err == nil {
+			lines, err = expandBundles(ctx, tx, lines)
+		}
+		if errors.Is(err, errUnknownUnit) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		short, err := lockStock(ctx, tx, lines, 0)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(short) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Not enough stock", "short_items": short})
+			return
+		}
 
 		var orderID int
-		err := db.QueryRow(ctx, `
+		err = tx.QueryRow(ctx, `
 			INSERT INTO customer_orders (company_id, user_id, user_name, user_phone, order_code,
 										 items, total_amount, markup_profit, status)
 			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, 'pending')
 			RETURNING id
 		`, companyID, input.UserID, input.UserName, input.UserPhone, orderCode,
-			itemsJSON, input.TotalAmount, markupProfit).Scan(&orderID)
+			itemsJSON, order.Total, order.MarkupProfit).Scan(&orderID)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		actor := input.UserName
+		if actor == "" {
+			actor = input.UserPhone
+		}
+		if err := recordOrderStatus(ctx, tx, orderID, nil, orderstatus.Pending, orderstatus.Customer, actor, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := reserveStock(ctx, tx, orderID, lines, cfg.OrderReservationTTL); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		stockIDs := make([]int, 0, len(lines))
+		for _, line := range lines {
+			stockIDs = append(stockIDs, line.ProductID)
+		}
+		publishProducts(ctx, tx, events.StockChanged, stockIDs)
+		if companyID != nil {
+			publish(ctx, tx, events.OrderCreated, *companyID, gin.H{
+				"order_id": orderID, "order_code": orderCode, "status": "pending",
+			})
+		}
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
 		c.JSON(http.StatusCreated, gin.H{
-			"success":    true,
-			"order_id":   orderID,
-			"order_code": orderCode,
+			"success":       true,
+			"order_id":      orderID,
+			"order_code":    orderCode,
+			"items":         order.Items,
+			"total_amount":  order.Total,
+			"markup_profit": order.MarkupProfit,
 		})
 	}
 }
 
-// ConfirmOrderPayment confirms payment for an order
+// ConfirmOrderPayment confirms payment for an order, completing it. The body
+// names who confirms it, usually the order's company by company_id. The order
+// and the products it takes out of stock are locked for the whole
+// confirmation: if any of them is short nothing is deducted and the short
+// items are returned.
+// Confirming a completed order again changes nothing.
 func ConfirmOrderPayment(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -163,71 +238,135 @@ func ConfirmOrderPayment(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
+		var actor orderActor
+		if !bindOrderActor(c, &actor) {
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
 		// Get order items to deduct from inventory
 		var itemsJSON []byte
 		var companyID *int
-		err = db.QueryRow(ctx, `
-			SELECT items, company_id FROM customer_orders WHERE id = $1
-		`, orderID).Scan(&itemsJSON, &companyID)
-
-		if err != nil {
+		var status string
+		var userPhone *string
+		var paymentConfirmed bool
+		err = tx.QueryRow(ctx, `
+			SELECT items, company_id, status, user_phone, payment_confirmed
+			FROM customer_orders WHERE id = $1 FOR UPDATE
+		`, orderID).Scan(&itemsJSON, &companyID, &status, &userPhone, &paymentConfirmed)
+
+		if errors.Is(err, pgx.ErrNoRows) {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
 			return
 		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := actor.resolve(companyID, userPhone, ""); err != nil {
+			orderStatusError(c, err)
+			return
+		}
+		if status == orderstatus.Completed && paymentConfirmed {
+			c.JSON(http.StatusOK, gin.H{"success": true, "already_confirmed": true})
+			return
+		}
+		if err := orderstatus.Check(status, orderstatus.Completed, actor.Role); err != nil {
+			orderStatusError(c, err)
+			return
+		}
 
 		var items []map[string]interface{}
 		json.Unmarshal(itemsJSON, &items)
 
-		// Deduct quantities from products
-		for _, item := range items {
-			productID := int(item["product_id"].(float64))
-			quantity := int(item["quantity"].(float64))
+		// Deduct quantities from products; bundles take their components out of stock
+		// Lines sold in a packaging unit (a box of 12) are converted to the base unit
+		lines, err := orderStockLines(items)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		costingCompany := 0
+		if companyID != nil {
+			costingCompany = *companyID
+		}
+		// All or nothing: the whole order must be in stock
+		taken, err := takeStock(ctx, tx, costingCompany, lines, &orderID, nil)
+		if errors.Is(err, errUnknownUnit) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(taken.Short) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Not enough stock", "short_items": taken.Short})
+			return
+		}
+		for i, cost := range taken.Costs {
+			items[i]["cost_of_goods"] = cost
+		}
+		itemsJSON, _ = json.Marshal(items)
 
-			db.Exec(ctx, `
-				UPDATE products SET quantity = quantity - $1, updated_at = NOW()
-				WHERE id = $2 AND quantity >= $1
-			`, quantity, productID)
+		// The stock has left; what the order held is no longer reserved
+		if _, err := releaseReservations(ctx, tx, orderID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
 		// Update order status
 		now := time.Now().UTC()
-		_, err = db.Exec(ctx, `
+		_, err = tx.Exec(ctx, `
 			UPDATE customer_orders 
 			SET status = 'completed', payment_confirmed = true, 
-				confirmed_date = $1, updated_at = NOW()
+				confirmed_date = $1, items = $3, cost_of_goods = $4, updated_at = NOW()
 			WHERE id = $2
-		`, now, orderID)
-
+		`, now, orderID, itemsJSON, costing.Money(taken.CostOfGoods))
+		if err == nil {
+			err = recordOrderStatus(ctx, tx, orderID, &status, orderstatus.Completed, actor.Role, actor.name(), actor.Note)
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		publishProducts(ctx, tx, events.StockChanged, taken.ProductIDs)
+		if companyID != nil {
+			publish(ctx, tx, events.OrderUpdated, *companyID, gin.H{"order_id": orderID, "status": "completed"})
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
 		c.JSON(http.StatusOK, gin.H{"success": true})
 	}
 }
 
-// CancelOrder cancels an order
+// CancelOrder cancels an order. The customer cancels it, naming the phone the
+// order was placed with, unless the body names another actor; customers can
+// only withdraw orders not yet accepted.
 func CancelOrder(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctx := context.Background()
 		orderID, err := strconv.Atoi(c.Param("id"))
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order ID"})
 			return
 		}
 
-		_, err = db.Exec(ctx, `
-			UPDATE customer_orders SET status = 'cancelled', updated_at = NOW()
-			WHERE id = $1
-		`, orderID)
-
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		var actor orderActor
+		if !bindOrderActor(c, &actor) {
 			return
 		}
-
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		transitionOrder(c, db, orderID, orderstatus.Cancelled, &actor, orderstatus.Customer, false)
 	}
 }
 
@@ -275,7 +414,7 @@ func GetSalesHistory(db *pgxpool.Pool) gin.HandlerFunc {
 		companyID, _ := strconv.Atoi(companyIDStr)
 
 		rows, err := db.Query(ctx, `
-			SELECT id, company_id, items, total_amount, markup_profit, sale_date
+			SELECT id, company_id, items, total_amount, markup_profit, cost_of_goods, sale_date
 			FROM sales_history 
 			WHERE company_id = $1
 			ORDER BY id DESC
@@ -293,9 +432,10 @@ func GetSalesHistory(db *pgxpool.Pool) gin.HandlerFunc {
 			var id, cID int
 			var itemsJSON []byte
 			var totalAmount, markupProfit float64
+			var costOfGoods *float64
 			var saleDate time.Time
 
-			if err := rows.Scan(&id, &cID, &itemsJSON, &totalAmount, &markupProfit, &saleDate); err != nil {
+			if err := rows.Scan(&id, &cID, &itemsJSON, &totalAmount, &markupProfit, &costOfGoods, &saleDate); err != nil {
 				continue
 			}
 
@@ -308,6 +448,7 @@ func GetSalesHistory(db *pgxpool.Pool) gin.HandlerFunc {
 				"items":         items,
 				"total_amount":  totalAmount,
 				"markup_profit": markupProfit,
+				"cost_of_goods": costOfGoods,
 				"sale_date":     saleDate,
 			})
 		}
@@ -316,15 +457,21 @@ func GetSalesHistory(db *pgxpool.Pool) gin.HandlerFunc {
 	}
 }
 
-// CreateSale creates a new sale record
+// CreateSale records a sale made at a company's till. Lines are priced from
+// the company's products as they are now and may carry a discount; amounts
+// the client sends are only checked against them. The sale takes its items
+// out of stock through the same locked step as confirming an order's payment:
+// if any of them is short, once customer orders' reservations are held back,
+// nothing is recorded and the short items are returned.
 func CreateSale(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 
 		var input struct {
-			CompanyID   int                      `json:"company_id" binding:"required"`
-			Items       []map[string]interface{} `json:"items" binding:"required"`
-			TotalAmount float64                  `json:"total_amount"`
+			CompanyID    int                      `json:"company_id" binding:"required"`
+			Items        []map[string]interface{} `json:"items" binding:"required"`
+			TotalAmount  *float64                 `json:"total_amount"`
+			MarkupProfit *float64                 `json:"markup_profit"`
 		}
 
 		if err := c.ShouldBindJSON(&input); err != nil {
@@ -332,32 +479,78 @@ func CreateSale(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
-		// Calculate markup profit
-		var markupProfit float64
-		for _, item := range input.Items {
-			if markup, ok := item["markup_amount"].(float64); ok {
-				quantity := 1
-				if q, ok := item["quantity"].(float64); ok {
-					quantity = int(q)
-				}
-				markupProfit += markup * float64(quantity)
-			}
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		sale, err := priceOrder(ctx, tx, input.Items, priceOptions{companyID: &input.CompanyID, discounts: true})
+		if err == nil {
+			sale.compareTotals(input.TotalAmount, input.MarkupProfit)
+		}
+		if priceOrderFailed(c, sale, err) {
+			return
+		}
+
+		lines, err := orderStockLines(sale.Items)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		itemsJSON, _ := json.Marshal(input.Items)
+		itemsJSON, _ := json.Marshal(sale.Items)
 
 		var saleID int
-		err := db.QueryRow(ctx, `
+		err = tx.QueryRow(ctx, `
 			INSERT INTO sales_history (company_id, items, total_amount, markup_profit)
 			VALUES ($1, $2, $3, $4)
 			RETURNING id
-		`, input.CompanyID, itemsJSON, input.TotalAmount, markupProfit).Scan(&saleID)
+		`, input.CompanyID, itemsJSON, sale.Total, sale.MarkupProfit).Scan(&saleID)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusCreated, gin.H{"success": true, "sale_id": saleID})
+		taken, err := takeStock(ctx, tx, input.CompanyID, lines, nil, &saleID)
+		if errors.Is(err, errUnknownUnit) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(taken.Short) > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Not enough stock", "short_items": taken.Short})
+			return
+		}
+		for i, cost := range taken.Costs {
+			sale.Items[i]["cost_of_goods"] = cost
+		}
+		itemsJSON, _ = json.Marshal(sale.Items)
+		if _, err := tx.Exec(ctx, `
+			UPDATE sales_history SET items = $2, cost_of_goods = $3 WHERE id = $1
+		`, saleID, itemsJSON, costing.Money(taken.CostOfGoods)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		publishProducts(ctx, tx, events.StockChanged, taken.ProductIDs)
+		publish(ctx, tx, events.SaleCreated, input.CompanyID, gin.H{"sale_id": saleID, "total_amount": sale.Total})
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"success":       true,
+			"sale_id":       saleID,
+			"items":         sale.Items,
+			"total_amount":  sale.Total,
+			"markup_profit": sale.MarkupProfit,
+		})
 	}
 }
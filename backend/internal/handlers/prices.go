@@ -0,0 +1,329 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/pricing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Sources recorded in product_price_history
+const (
+	priceSourceImport      = "import"
+	priceSourceReceipt     = "receipt"
+	priceSourceScheduled   = "scheduled"
+	priceSourceReprice     = "reprice"
+	priceSourceRepriceUndo = "reprice_undo"
+)
+
+// setPriceSource tags price changes made in tx for the price history trigger
+func setPriceSource(ctx context.Context, tx pgx.Tx, source string) error {
+	_, err := tx.Exec(ctx, `SELECT set_config('azaton.price_source', $1, true)`, source)
+	return err
+}
+
+// GetPriceHistory returns all recorded prices of a product, newest first
+func GetPriceHistory(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, product_id, price, markup_percent, markup_amount, selling_price,
+				   source, effective_from, effective_to
+			FROM product_price_history
+			WHERE product_id = $1
+			ORDER BY effective_from DESC, id DESC
+			LIMIT 500
+		`, productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		history := []models.PriceHistoryEntry{}
+		for rows.Next() {
+			var h models.PriceHistoryEntry
+			if err := rows.Scan(&h.ID, &h.ProductID, &h.Price, &h.MarkupPercent, &h.MarkupAmount,
+				&h.SellingPrice, &h.Source, &h.EffectiveFrom, &h.EffectiveTo); err != nil {
+				continue
+			}
+			history = append(history, h)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"history": history})
+	}
+}
+
+// GetScheduledPriceChanges returns scheduled price changes of a product
+func GetScheduledPriceChanges(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, product_id, company_id, price, markup_percent, effective_at, status,
+				   note, error_message, created_at, applied_at
+			FROM scheduled_price_changes
+			WHERE product_id = $1
+			ORDER BY effective_at DESC
+			LIMIT 200
+		`, productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		changes := []models.ScheduledPriceChange{}
+		for rows.Next() {
+			var s models.ScheduledPriceChange
+			if err := rows.Scan(&s.ID, &s.ProductID, &s.CompanyID, &s.Price, &s.MarkupPercent,
+				&s.EffectiveAt, &s.Status, &s.Note, &s.ErrorMessage, &s.CreatedAt, &s.AppliedAt); err != nil {
+				continue
+			}
+			changes = append(changes, s)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"changes": changes})
+	}
+}
+
+// SchedulePriceChange schedules a future price and/or markup change for a product
+func SchedulePriceChange(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		var input struct {
+			Price         *float64  `json:"price"`
+			MarkupPercent *float64  `json:"markup_percent"`
+			EffectiveAt   time.Time `json:"effective_at" binding:"required"`
+			Note          *string   `json:"note"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if input.Price == nil && input.MarkupPercent == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "price or markup_percent required"})
+			return
+		}
+		if (input.Price != nil && *input.Price < 0) || (input.MarkupPercent != nil && *input.MarkupPercent < 0) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "price and markup_percent must not be negative"})
+			return
+		}
+		if input.EffectiveAt.Before(time.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "effective_at must be in the future"})
+			return
+		}
+
+		var id int
+		err = db.QueryRow(ctx, `
+			INSERT INTO scheduled_price_changes (product_id, company_id, price, markup_percent, effective_at, note)
+			SELECT id, company_id, $2, $3, $4, $5 FROM products WHERE id = $1 AND deleted_at IS NULL
+			RETURNING id
+		`, productID, input.Price, input.MarkupPercent, input.EffectiveAt, input.Note).Scan(&id)
+
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"success": true, "id": id})
+	}
+}
+
+// CancelScheduledPriceChange cancels a pending scheduled price change
+func CancelScheduledPriceChange(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+		changeID, err := strconv.Atoi(c.Param("changeId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid change ID"})
+			return
+		}
+
+		tag, err := db.Exec(ctx, `
+			UPDATE scheduled_price_changes SET status = 'cancelled'
+			WHERE id = $1 AND product_id = $2 AND status = 'pending'
+		`, changeID, productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Pending price change not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// RunScheduledPriceChanges applies due price changes every interval until ctx is cancelled
+func RunScheduledPriceChanges(ctx context.Context, db *pgxpool.Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			applied, err := applyNextScheduledPriceChange(ctx, db)
+			if err != nil {
+				log.Printf("Scheduled price change failed: %v", err)
+			}
+			if !applied {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyNextScheduledPriceChange applies the oldest due change. Rows are claimed
+// with SKIP LOCKED, so several backend instances can run the scheduler at once.
+// A change that cannot be applied is marked failed, so it does not hold up
+// the ones after it.
+func applyNextScheduledPriceChange(ctx context.Context, db *pgxpool.Pool) (bool, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var id, productID int
+	var newPrice, newMarkup *float64
+	err = tx.QueryRow(ctx, `
+		SELECT id, product_id, price, markup_percent FROM scheduled_price_changes
+		WHERE status = 'pending' AND effective_at <= NOW()
+		ORDER BY effective_at, id
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`).Scan(&id, &productID, &newPrice, &newMarkup)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Applied under a savepoint, so a failure leaves the claimed row to mark
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	applyErr := applyScheduledPriceChange(ctx, sp, id, productID, newPrice, newMarkup)
+	if applyErr == nil {
+		applyErr = sp.Commit(ctx)
+	}
+	if applyErr != nil {
+		if err := sp.Rollback(ctx); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE scheduled_price_changes SET status = 'failed', error_message = $1 WHERE id = $2
+		`, applyErr.Error(), id); err != nil {
+			return false, err
+		}
+		log.Printf("Scheduled price change %d failed: %v", id, applyErr)
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// applyScheduledPriceChange reprices a product as a scheduled change sets it
+// and marks the change applied
+func applyScheduledPriceChange(ctx context.Context, tx pgx.Tx, id, productID int, newPrice, newMarkup *float64) error {
+	var companyID int
+	var price, markupPercent float64
+	var category, supplier string
+	err := tx.QueryRow(ctx, `
+		SELECT company_id, price, markup_percent, category, COALESCE(supplier, '')
+		FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE
+	`, productID).Scan(&companyID, &price, &markupPercent, &category, &supplier)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errors.New("product not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if newPrice != nil {
+		price = *newPrice
+	}
+	if newMarkup != nil {
+		markupPercent = *newMarkup
+	}
+
+	rules, err := loadPricingRules(ctx, tx, companyID)
+	if err != nil {
+		return err
+	}
+	priced := rules.Apply(pricing.Input{
+		Price:         price,
+		MarkupPercent: &markupPercent,
+		Category:      category,
+		Supplier:      supplier,
+	})
+
+	if err := setPriceSource(ctx, tx, priceSourceScheduled); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE products SET price = $1, markup_percent = $2, markup_amount = $3,
+			selling_price = $4, updated_at = NOW()
+		WHERE id = $5
+	`, price, priced.MarkupPercent, priced.MarkupAmount, priced.SellingPrice, productID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE scheduled_price_changes SET status = 'applied', applied_at = NOW() WHERE id = $1
+	`, id)
+	if err != nil {
+		return err
+	}
+	publishProducts(ctx, tx, events.ProductUpdated, []int{productID})
+	return nil
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"azaton-backend/internal/pricing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// querier is implemented by both *pgxpool.Pool and pgx.Tx
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// loadPricingRules returns all pricing rules of a company
+func loadPricingRules(ctx context.Context, q querier, companyID int) (pricing.Rules, error) {
+	rows, err := q.Query(ctx, `
+		SELECT id, company_id, scope, match, markup_percent, min_margin_percent,
+			   rounding_mode, rounding_step, rounding_ending
+		FROM pricing_rules WHERE company_id = $1
+		ORDER BY scope, match
+	`, companyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := pricing.Rules{}
+	for rows.Next() {
+		var r pricing.Rule
+		if err := rows.Scan(&r.ID, &r.CompanyID, &r.Scope, &r.Match, &r.MarkupPercent,
+			&r.MinMarginPercent, &r.RoundingMode, &r.RoundingStep, &r.RoundingEnding); err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// GetPricingRules returns the pricing rules of a company
+func GetPricingRules(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		companyID, err := strconv.Atoi(c.Query("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+			return
+		}
+
+		rules, err := loadPricingRules(ctx, db, companyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"rules": rules})
+	}
+}
+
+// SavePricingRule creates a pricing rule, or replaces the rule with the same scope and match
+func SavePricingRule(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var rule pricing.Rule
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if rule.CompanyID == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "company_id required"})
+			return
+		}
+		if rule.Scope == "" {
+			rule.Scope = pricing.ScopeDefault
+		}
+		if rule.Scope == pricing.ScopeDefault {
+			rule.Match = nil
+		}
+		if err := rule.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var id int
+		err := db.QueryRow(ctx, `
+			INSERT INTO pricing_rules (company_id, scope, match, markup_percent, min_margin_percent,
+									   rounding_mode, rounding_step, rounding_ending)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (company_id, scope, COALESCE(match, '')) DO UPDATE SET
+				markup_percent = EXCLUDED.markup_percent,
+				min_margin_percent = EXCLUDED.min_margin_percent,
+				rounding_mode = EXCLUDED.rounding_mode,
+				rounding_step = EXCLUDED.rounding_step,
+				rounding_ending = EXCLUDED.rounding_ending,
+				updated_at = NOW()
+			RETURNING id
+		`, rule.CompanyID, rule.Scope, rule.Match, rule.MarkupPercent, rule.MinMarginPercent,
+			rule.RoundingMode, rule.RoundingStep, rule.RoundingEnding).Scan(&id)
+
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "id": id})
+	}
+}
+
+// DeletePricingRule deletes a pricing rule
+func DeletePricingRule(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+			return
+		}
+
+		_, err = db.Exec(ctx, `DELETE FROM pricing_rules WHERE id = $1`, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// PreviewPricing shows what the company's rules make of given prices, or of
+// existing products next to their current selling price. Nothing is saved.
+func PreviewPricing(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input struct {
+			CompanyID int `json:"company_id" binding:"required"`
+			Items     []struct {
+				Price         float64  `json:"price"`
+				MarkupPercent *float64 `json:"markup_percent"`
+				Category      string   `json:"category"`
+				Supplier      string   `json:"supplier"`
+			} `json:"items"`
+			ProductIDs []int `json:"product_ids"`
+			// For product_ids: ignore stored markups and use the rules' markup
+			UseRuleMarkup bool `json:"use_rule_markup"`
+		}
+
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		rules, err := loadPricingRules(ctx, db, input.CompanyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		items := []map[string]interface{}{}
+		for _, item := range input.Items {
+			res := rules.Apply(pricing.Input{
+				Price:         item.Price,
+				MarkupPercent: item.MarkupPercent,
+				Category:      item.Category,
+				Supplier:      item.Supplier,
+			})
+			items = append(items, map[string]interface{}{
+				"price":    item.Price,
+				"category": item.Category,
+				"supplier": item.Supplier,
+				"result":   res,
+			})
+		}
+
+		products := []map[string]interface{}{}
+		if len(input.ProductIDs) > 0 {
+			rows, err := db.Query(ctx, `
+				SELECT id, name, price, markup_percent, selling_price, category, COALESCE(supplier, '')
+				FROM products WHERE company_id = $1 AND id = ANY($2) AND deleted_at IS NULL
+				ORDER BY id
+			`, input.CompanyID, input.ProductIDs)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				var id int
+				var name, category, supplier string
+				var price, markupPercent, sellingPrice float64
+				if err := rows.Scan(&id, &name, &price, &markupPercent, &sellingPrice, &category, &supplier); err != nil {
+					continue
+				}
+
+				in := pricing.Input{Price: price, Category: category, Supplier: supplier}
+				if !input.UseRuleMarkup {
+					in.MarkupPercent = &markupPercent
+				}
+				res := rules.Apply(in)
+
+				products = append(products, map[string]interface{}{
+					"id":                    id,
+					"name":                  name,
+					"price":                 price,
+					"current_selling_price": sellingPrice,
+					"result":                res,
+					"difference":            roundTo(res.SellingPrice-sellingPrice, 2),
+				})
+			}
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "items": items, "products": products})
+	}
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// productSort is one ordering of the product listing. Rows are ordered by
+// expr and then by id in the same direction, so every position is unique
+// and a cursor can resume right after the last row of a page.
+type productSort struct {
+	expr    string // over an unaliased products table
+	desc    bool   // default direction
+	textual bool   // expr is text; otherwise it is compared as numeric
+	idOnly  bool   // the order is the id itself
+}
+
+var productSorts = map[string]productSort{
+	"newest":       {expr: "id", desc: true, idOnly: true},
+	"name":         {expr: "name", textual: true},
+	"price":        {expr: "COALESCE(selling_price, 0)"}, // idx_products_company_price_sort
+	"stock":        {expr: "COALESCE(" + productQuantitySQL + ", 0)", desc: true},
+	"best_selling": {expr: "sold_quantity", desc: true},
+}
+
+// productCursor marks the last row of a page. It carries the sort it was
+// made for, so it cannot be replayed against a different ordering.
+type productCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v,omitempty"`
+	ID    int    `json:"id"`
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// numericCursorValue matches a numeric sort value as Postgres prints it
+var numericCursorValue = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+func (pc productCursor) encode() string {
+	data, _ := json.Marshal(pc)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeProductCursor(s string) (*productCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var pc productCursor
+	if err := json.Unmarshal(data, &pc); err != nil || pc.ID <= 0 {
+		return nil, errInvalidCursor
+	}
+	// The value is cast to the sort's type in SQL, so it is checked here
+	sort, ok := productSorts[pc.Sort]
+	if !ok || (!sort.idOnly && !sort.textual && !numericCursorValue.MatchString(pc.Value)) {
+		return nil, errInvalidCursor
+	}
+	return &pc, nil
+}
+
+// parseProductSort reads the sort and order query parameters
+func parseProductSort(sortName, order string) (string, productSort, bool, error) {
+	if sortName == "" {
+		sortName = "newest"
+	}
+	sort, ok := productSorts[sortName]
+	if !ok {
+		return "", productSort{}, false, fmt.Errorf("sort must be one of newest, name, price, stock, best_selling")
+	}
+	desc := sort.desc
+	switch order {
+	case "":
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	default:
+		return "", productSort{}, false, fmt.Errorf("order must be asc or desc")
+	}
+	return sortName, sort, desc, nil
+}
+
+// orderBy returns the ORDER BY clause of the sort
+func (s productSort) orderBy(desc bool) string {
+	dir := "ASC"
+	if desc {
+		dir = "DESC"
+	}
+	if s.idOnly {
+		return " ORDER BY id " + dir
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, id %s", s.expr, dir, dir)
+}
+
+// after returns the condition selecting rows past the cursor, with its arguments
+// numbered from argNum
+func (s productSort) after(pc *productCursor, argNum int) (string, []interface{}) {
+	op := ">"
+	if pc.Desc {
+		op = "<"
+	}
+	if s.idOnly {
+		return fmt.Sprintf(" AND id %s $%d", op, argNum), []interface{}{pc.ID}
+	}
+	cast := "numeric"
+	if s.textual {
+		cast = "text"
+	}
+	return fmt.Sprintf(" AND (%s, id) %s ($%d::%s, $%d)", s.expr, op, argNum, cast, argNum+1),
+		[]interface{}{pc.Value, pc.ID}
+}
+
+// productCountLimit is how many rows are counted exactly; past it the
+// total is the planner's estimate
+const productCountLimit = 10000
+
+// countProducts returns the number of products matching where. Large results
+// are estimated from the query plan instead of counted row by row.
+func countProducts(ctx context.Context, q querier, where string, args []interface{}) (int, bool, error) {
+	var total int
+	err := q.QueryRow(ctx, fmt.Sprintf(`
+		SELECT COUNT(*) FROM (SELECT 1 FROM products WHERE deleted_at IS NULL%s LIMIT %d) t
+	`, where, productCountLimit+1), args...).Scan(&total)
+	if err != nil {
+		return 0, false, err
+	}
+	if total <= productCountLimit {
+		return total, false, nil
+	}
+
+	var plan []struct {
+		Plan struct {
+			Rows float64 `json:"Plan Rows"`
+		} `json:"Plan"`
+	}
+	var planJSON []byte
+	err = q.QueryRow(ctx, `EXPLAIN (FORMAT JSON) SELECT 1 FROM products WHERE deleted_at IS NULL`+where,
+		args...).Scan(&planJSON)
+	if err == nil {
+		err = json.Unmarshal(planJSON, &plan)
+	}
+	if err != nil || len(plan) == 0 || int(plan[0].Plan.Rows) <= productCountLimit {
+		// Known to be more than the limit even if the estimate says otherwise
+		return productCountLimit + 1, true, nil
+	}
+	return int(plan[0].Plan.Rows), true, nil
+}
+
+// splitList splits a comma separated query value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+func TestDecodeProductCursor(t *testing.T) {
+	raw := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	valid := []productCursor{
+		{Sort: "newest", Desc: true, ID: 42},
+		{Sort: "name", Value: "Олма; DROP TABLE products", ID: 7},
+		{Sort: "price", Value: "12500.00", ID: 3},
+		{Sort: "stock", Desc: true, Value: "-1.250", ID: 9},
+		{Sort: "best_selling", Desc: true, Value: "0", ID: 1},
+	}
+	for _, pc := range valid {
+		got, err := decodeProductCursor(pc.encode())
+		if err != nil {
+			t.Errorf("decode(%+v) = %v", pc, err)
+			continue
+		}
+		if *got != pc {
+			t.Errorf("decode(%+v) = %+v", pc, *got)
+		}
+	}
+
+	invalid := map[string]string{
+		"not base64":        "!!!",
+		"not json":          raw("nope"),
+		"no id":             raw(`{"s":"newest"}`),
+		"negative id":       raw(`{"s":"newest","id":-1}`),
+		"unknown sort":      raw(`{"s":"random","id":1}`),
+		"text price":        productCursor{Sort: "price", Value: "abc", ID: 1}.encode(),
+		"empty price":       productCursor{Sort: "price", ID: 1}.encode(),
+		"exponent price":    productCursor{Sort: "price", Value: "1e5", ID: 1}.encode(),
+		"injected stock":    productCursor{Sort: "stock", Value: "1); --", ID: 1}.encode(),
+		"fraction no digit": productCursor{Sort: "best_selling", Value: "1.", ID: 1}.encode(),
+	}
+	for name, s := range invalid {
+		if _, err := decodeProductCursor(s); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("%s: err = %v, want errInvalidCursor", name, err)
+		}
+	}
+}
+
+func TestParseProductSort(t *testing.T) {
+	name, sort, desc, err := parseProductSort("", "")
+	if err != nil || name != "newest" || !sort.idOnly || !desc {
+		t.Errorf("default sort = %q %+v desc=%v err=%v", name, sort, desc, err)
+	}
+	if _, _, desc, _ := parseProductSort("price", ""); desc {
+		t.Error("price should sort ascending by default")
+	}
+	if _, _, desc, _ := parseProductSort("price", "desc"); !desc {
+		t.Error("order=desc ignored")
+	}
+	if _, _, _, err := parseProductSort("random", ""); err == nil {
+		t.Error("unknown sort accepted")
+	}
+	if _, _, _, err := parseProductSort("name", "up"); err == nil {
+		t.Error("unknown order accepted")
+	}
+}
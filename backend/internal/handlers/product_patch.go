@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"azaton-backend/internal/barcode"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/units"
+)
+
+// optional is one field of a JSON Merge Patch (RFC 7396): absent leaves the
+// stored value alone, null clears it, anything else replaces it
+type optional[T any] struct {
+	Set   bool
+	Null  bool
+	Value T
+}
+
+func (o *optional[T]) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	if string(data) == "null" {
+		o.Null = true
+		return nil
+	}
+	return json.Unmarshal(data, &o.Value)
+}
+
+// productPatch is the set of product fields a client may change. Selling price
+// and markup amount are derived by the pricing rules; stock ownership, images
+// and bundle components have endpoints of their own.
+type productPatch struct {
+	Name                  optional[string]
+	Quantity              optional[float64]
+	Unit                  optional[string]
+	QuantityPrecision     optional[int] // null resets to the unit's default
+	Price                 optional[float64]
+	MarkupPercent         optional[float64] // null hands the markup back to the pricing rules
+	Barcode               optional[string]
+	Barid                 optional[int64]
+	Category              optional[string] // null or empty resets to the default category
+	Supplier              optional[string]
+	HasColorOptions       optional[bool]
+	AvailableForCustomers optional[bool]
+}
+
+func (p *productPatch) fields() map[string]json.Unmarshaler {
+	return map[string]json.Unmarshaler{
+		"name":                    &p.Name,
+		"quantity":                &p.Quantity,
+		"unit":                    &p.Unit,
+		"quantity_precision":      &p.QuantityPrecision,
+		"price":                   &p.Price,
+		"markup_percent":          &p.MarkupPercent,
+		"barcode":                 &p.Barcode,
+		"barid":                   &p.Barid,
+		"category":                &p.Category,
+		"supplier":                &p.Supplier,
+		"has_color_options":       &p.HasColorOptions,
+		"available_for_customers": &p.AvailableForCustomers,
+	}
+}
+
+// readOnlyProductFields explains why known product fields cannot be patched
+var readOnlyProductFields = map[string]string{
+	"id":            "cannot be changed",
+	"company_id":    "cannot be changed",
+	"markup_amount": "is calculated from price and markup_percent",
+	"selling_price": "is calculated from price and markup_percent",
+	"is_bundle":     "is set through /products/:id/bundle",
+	"images":        "is changed through the image endpoints",
+	"created_at":    "cannot be changed",
+	"updated_at":    "cannot be changed",
+	"deleted_at":    "is changed through delete and restore",
+}
+
+// maxMarkupPercent is the largest markup products.markup_percent (DECIMAL(5,2)) holds
+const maxMarkupPercent = 999.99
+
+// errPatchNotObject is returned for a patch body that is not a JSON object
+var errPatchNotObject = errors.New("request body must be a JSON object")
+
+// decodeProductPatch parses a merge patch, rejecting fields outside the whitelist
+// and values of the wrong type. Every rejected field is reported, not just the first.
+func decodeProductPatch(body []byte) (*productPatch, []models.FieldError, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil || raw == nil {
+		return nil, nil, errPatchNotObject
+	}
+
+	patch := &productPatch{}
+	fields := patch.fields()
+	var errs []models.FieldError
+	for name, value := range raw {
+		field, ok := fields[name]
+		if !ok {
+			msg, known := readOnlyProductFields[name]
+			if !known {
+				msg = "is not a product field"
+			}
+			errs = append(errs, models.FieldError{Field: name, Message: msg})
+			continue
+		}
+		if err := field.UnmarshalJSON(value); err != nil {
+			errs = append(errs, models.FieldError{Field: name, Message: patchTypeError(err)})
+		}
+	}
+	sortFieldErrors(errs)
+	return patch, errs, nil
+}
+
+// patchTypeError describes the type a field expected
+func patchTypeError(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		switch typeErr.Type.Kind() {
+		case reflect.String:
+			return "must be a string"
+		case reflect.Bool:
+			return "must be true or false"
+		case reflect.Int, reflect.Int64:
+			return "must be a whole number"
+		case reflect.Float64:
+			return "must be a number"
+		}
+	}
+	return "is not valid JSON"
+}
+
+func sortFieldErrors(errs []models.FieldError) {
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+}
+
+// productState is the stored value of every patchable product field
+type productState struct {
+	CompanyID             int
+	Name                  string
+	Quantity              float64
+	Unit                  string
+	QuantityPrecision     int
+	Price                 float64
+	MarkupPercent         *float64 // nil after a patch lets the pricing rules pick it
+	MarkupAmount          float64
+	SellingPrice          float64
+	Barcode               *string
+	Barid                 *int64
+	Category              string
+	Supplier              *string
+	HasColorOptions       bool
+	AvailableForCustomers bool
+	IsBundle              bool
+	Version               int
+}
+
+// repricing reports whether the patch changes anything the selling price depends on
+func (p *productPatch) repricing() bool {
+	return p.Price.Set || p.MarkupPercent.Set || p.Category.Set || p.Supplier.Set
+}
+
+// apply validates the patch and writes it over s. Quantity is checked against
+// the precision the product ends up with, since both may change together.
+func (p *productPatch) apply(s *productState) []models.FieldError {
+	var errs []models.FieldError
+	fail := func(field, msg string) {
+		errs = append(errs, models.FieldError{Field: field, Message: msg})
+	}
+	const notNull = "cannot be null"
+
+	if p.Name.Set {
+		name := strings.TrimSpace(p.Name.Value)
+		switch {
+		case p.Name.Null:
+			fail("name", notNull)
+		case name == "":
+			fail("name", "must not be empty")
+		case utf8.RuneCountInString(name) > 500:
+			fail("name", "must be at most 500 characters")
+		default:
+			s.Name = name
+		}
+	}
+
+	if p.Unit.Set {
+		switch {
+		case p.Unit.Null:
+			fail("unit", notNull)
+		case !units.Known(p.Unit.Value):
+			fail("unit", fmt.Sprintf("must be one of %s", strings.Join(units.Codes, ", ")))
+		default:
+			if p.Unit.Value != s.Unit && !p.QuantityPrecision.Set {
+				s.QuantityPrecision = units.DefaultPrecision(p.Unit.Value)
+			}
+			s.Unit = p.Unit.Value
+		}
+	}
+	if p.QuantityPrecision.Set {
+		if p.QuantityPrecision.Null {
+			s.QuantityPrecision = units.DefaultPrecision(s.Unit)
+		} else if err := units.ValidatePrecision(p.QuantityPrecision.Value); err != nil {
+			fail("quantity_precision", strings.TrimPrefix(err.Error(), "quantity_precision "))
+		} else {
+			s.QuantityPrecision = p.QuantityPrecision.Value
+		}
+	}
+	if p.Quantity.Set {
+		if s.IsBundle {
+			fail("quantity", "is made up by the bundle's components")
+		} else if p.Quantity.Null {
+			fail("quantity", notNull)
+		} else if err := units.Validate(p.Quantity.Value, s.QuantityPrecision); err != nil {
+			fail("quantity", strings.TrimPrefix(err.Error(), "quantity "))
+		} else {
+			s.Quantity = p.Quantity.Value
+		}
+	} else if p.Unit.Set || p.QuantityPrecision.Set {
+		// The stock already held must still fit
+		if units.Validate(s.Quantity, s.QuantityPrecision) != nil {
+			fail("quantity_precision", fmt.Sprintf("the current quantity %g does not fit %d decimal places",
+				s.Quantity, s.QuantityPrecision))
+		}
+	}
+
+	if p.Price.Set {
+		switch {
+		case p.Price.Null:
+			fail("price", notNull)
+		case p.Price.Value < 0:
+			fail("price", "must not be negative")
+		default:
+			s.Price = p.Price.Value
+		}
+	}
+	if p.MarkupPercent.Set {
+		switch {
+		case p.MarkupPercent.Null:
+			s.MarkupPercent = nil
+		case p.MarkupPercent.Value < 0:
+			fail("markup_percent", "must not be negative")
+		case p.MarkupPercent.Value > maxMarkupPercent:
+			fail("markup_percent", fmt.Sprintf("must be at most %.2f", maxMarkupPercent))
+		default:
+			markup := p.MarkupPercent.Value
+			s.MarkupPercent = &markup
+		}
+	}
+
+	if p.Barcode.Set {
+		code := strings.TrimSpace(p.Barcode.Value)
+		if p.Barcode.Null || code == "" {
+			s.Barcode = nil
+		} else if barcode.Validate(code) != nil {
+			fail("barcode", "must be a GTIN with a correct check digit or up to 100 printable characters without spaces")
+		} else {
+			s.Barcode = &code
+		}
+	}
+	if p.Barid.Set {
+		if p.Barid.Null {
+			s.Barid = nil
+		} else if p.Barid.Value <= 0 {
+			fail("barid", "must be positive")
+		} else {
+			barid := p.Barid.Value
+			s.Barid = &barid
+		}
+	}
+
+	if p.Category.Set {
+		category := strings.TrimSpace(p.Category.Value)
+		if p.Category.Null || category == "" {
+			category = "Без категории"
+		}
+		if utf8.RuneCountInString(category) > 255 {
+			fail("category", "must be at most 255 characters")
+		} else {
+			s.Category = category
+		}
+	}
+	if p.Supplier.Set {
+		supplier := strings.TrimSpace(p.Supplier.Value)
+		if p.Supplier.Null || supplier == "" {
+			s.Supplier = nil
+		} else if utf8.RuneCountInString(supplier) > 255 {
+			fail("supplier", "must be at most 255 characters")
+		} else {
+			s.Supplier = &supplier
+		}
+	}
+
+	if p.HasColorOptions.Set {
+		if p.HasColorOptions.Null {
+			fail("has_color_options", notNull)
+		} else {
+			s.HasColorOptions = p.HasColorOptions.Value
+		}
+	}
+	if p.AvailableForCustomers.Set {
+		if p.AvailableForCustomers.Null {
+			fail("available_for_customers", notNull)
+		} else {
+			s.AvailableForCustomers = p.AvailableForCustomers.Value
+		}
+	}
+
+	sortFieldErrors(errs)
+	return errs
+}
@@ -3,28 +3,108 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"azaton-backend/internal/barcode"
 	"azaton-backend/internal/config"
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/imaging"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/pricing"
+	"azaton-backend/internal/storage"
+	"azaton-backend/internal/units"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// productColumns are the columns scanProduct reads, selected from an unaliased products table
+var productColumns = `id, company_id, name, ` + productQuantitySQL + `, price, markup_percent, markup_amount,
+	selling_price, barcode, barid, category, supplier, has_color_options,
+	available_for_customers, is_bundle, unit, quantity_precision, images, created_at, rating, rating_count, version,
+	` + productAvailableSQL
+
+// scanProduct reads a row of productColumns into the JSON shape of a product.
+// Columns selected after them are scanned into extra.
+func scanProduct(ctx context.Context, row pgx.Row, store storage.Storage, ttl time.Duration, extra ...interface{}) (map[string]interface{}, error) {
+	var id, companyID, quantityPrecision, ratingCount, version int
+	var quantity, price, markupPercent, markupAmount, sellingPrice, rating, available float64
+	var name, category, unit string
+	var barcode, supplier *string
+	var barid *int64
+	var hasColorOptions, availableForCustomers, isBundle bool
+	var imagesJSON []byte
+	var createdAt time.Time
+
+	dest := []interface{}{&id, &companyID, &name, &quantity, &price, &markupPercent,
+		&markupAmount, &sellingPrice, &barcode, &barid, &category, &supplier, &hasColorOptions,
+		&availableForCustomers, &isBundle, &unit, &quantityPrecision, &imagesJSON, &createdAt, &rating, &ratingCount, &version,
+		&available}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"id":                      id,
+		"company_id":              companyID,
+		"name":                    name,
+		"quantity":                quantity,
+		"available_quantity":      available, // quantity less what open orders hold
+		"reserved_quantity":       units.Round(quantity-available, units.MaxPrecision),
+		"unit":                    unit,
+		"quantity_precision":      quantityPrecision,
+		"price":                   price,
+		"markup_percent":          markupPercent,
+		"markup_amount":           markupAmount,
+		"selling_price":           sellingPrice,
+		"barcode":                 barcode,
+		"barid":                   barid,
+		"category":                category,
+		"supplier":                supplier,
+		"has_color_options":       hasColorOptions,
+		"available_for_customers": availableForCustomers,
+		"is_bundle":               isBundle,
+		"images":                  decodeImages(ctx, store, ttl, imagesJSON),
+		"created_at":              createdAt,
+		"rating":                  rating,
+		"rating_count":            ratingCount,
+		"version":                 version,
+	}, nil
+}
+
+// loadProduct returns an active product in the JSON shape of the listings, with its version
+func loadProduct(ctx context.Context, q querier, store storage.Storage, ttl time.Duration, id int) (map[string]interface{}, int, error) {
+	product, err := scanProduct(ctx, q.QueryRow(ctx, `
+		SELECT `+productColumns+` FROM products WHERE id = $1 AND deleted_at IS NULL
+	`, id), store, ttl)
+	if err != nil {
+		return nil, 0, err
+	}
+	return product, product["version"].(int), nil
+}
+
 // GetProducts returns all products or filtered by company
-func GetProducts(db *pgxpool.Pool) gin.HandlerFunc {
+func GetProducts(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 		companyIDStr := c.Query("company_id")
 
+		tag, err := catalogETag(ctx, db, cfg, c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if notModified(c, tag) {
+			return
+		}
+
 		var query string
 		var args []interface{}
 
@@ -35,18 +115,14 @@ func GetProducts(db *pgxpool.Pool) gin.HandlerFunc {
 				return
 			}
 			query = `
-				SELECT id, company_id, name, quantity, price, markup_percent, markup_amount, 
-					   selling_price, barcode, barid, category, has_color_options, 
-					   available_for_customers, images, created_at
-				FROM products WHERE company_id = $1 ORDER BY id DESC
+				SELECT ` + productColumns + `
+				FROM products WHERE company_id = $1 AND deleted_at IS NULL ORDER BY id DESC
 			`
 			args = append(args, companyID)
 		} else {
 			query = `
-				SELECT id, company_id, name, quantity, price, markup_percent, markup_amount, 
-					   selling_price, barcode, barid, category, has_color_options, 
-					   available_for_customers, images, created_at
-				FROM products ORDER BY id DESC
+				SELECT ` + productColumns + `
+				FROM products WHERE deleted_at IS NULL ORDER BY id DESC
 			`
 		}
 
@@ -59,97 +135,117 @@ func GetProducts(db *pgxpool.Pool) gin.HandlerFunc {
 
 		products := []map[string]interface{}{}
 		for rows.Next() {
-			var id, companyID, quantity int
-			var price, markupPercent, markupAmount, sellingPrice float64
-			var name, category string
-			var barcode *string
-			var barid *int64
-			var hasColorOptions, availableForCustomers bool
-			var imagesJSON []byte
-			var createdAt time.Time
-
-			if err := rows.Scan(&id, &companyID, &name, &quantity, &price, &markupPercent,
-				&markupAmount, &sellingPrice, &barcode, &barid, &category, &hasColorOptions,
-				&availableForCustomers, &imagesJSON, &createdAt); err != nil {
+			product, err := scanProduct(ctx, rows, store, cfg.SignedURLTTL)
+			if err != nil {
 				continue
 			}
-
-			var images []interface{}
-			json.Unmarshal(imagesJSON, &images)
-
-			products = append(products, map[string]interface{}{
-				"id":                      id,
-				"company_id":              companyID,
-				"name":                    name,
-				"quantity":                quantity,
-				"price":                   price,
-				"markup_percent":          markupPercent,
-				"markup_amount":           markupAmount,
-				"selling_price":           sellingPrice,
-				"barcode":                 barcode,
-				"barid":                   barid,
-				"category":                category,
-				"has_color_options":       hasColorOptions,
-				"available_for_customers": availableForCustomers,
-				"images":                  images,
-				"created_at":              createdAt,
-			})
+			products = append(products, product)
 		}
 
 		c.JSON(http.StatusOK, gin.H{"products": products})
 	}
 }
 
-// GetProductsPaginated returns paginated products
-func GetProductsPaginated(db *pgxpool.Pool) gin.HandlerFunc {
+// GetProduct returns a single product with its version as the ETag
+func GetProduct(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		product, version, err := loadProduct(ctx, db, store, cfg.SignedURLTTL, id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Signed image links expire, so such a product is always sent again
+		if !hasPrivateImages(product["images"].([]models.ProductImage)) && notModified(c, etag(version)) {
+			return
+		}
+		setETag(c, version)
+		c.JSON(http.StatusOK, gin.H{"product": product})
+	}
+}
+
+// GetProductsPaginated returns a page of products. Pages are chained with the
+// next_cursor of the previous one, which stays fast on deep pages and does not
+// skip or repeat rows when products are added in between. offset is still
+// accepted for older clients when no cursor is sent.
+func GetProductsPaginated(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 
 		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if limit <= 0 || limit > 200 {
+			limit = 50
+		}
 		offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
-		companyIDStr := c.Query("company_id")
-		search := c.Query("search")
-		availableOnly := c.Query("available_only") == "true"
 
-		var queryBuilder strings.Builder
-		queryBuilder.WriteString(`
-			SELECT id, company_id, name, quantity, price, markup_percent, markup_amount, 
-				   selling_price, barcode, barid, category, has_color_options, 
-				   available_for_customers, images, created_at
-			FROM products WHERE 1=1
-		`)
-
-		args := []interface{}{}
-		argNum := 1
+		tag, err := catalogETag(ctx, db, cfg, c)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if notModified(c, tag) {
+			return
+		}
 
-		if companyIDStr != "" {
-			companyID, _ := strconv.Atoi(companyIDStr)
-			queryBuilder.WriteString(fmt.Sprintf(" AND company_id = $%d", argNum))
-			args = append(args, companyID)
-			argNum++
+		sortName, sort, desc, err := parseProductSort(c.Query("sort"), c.Query("order"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
-		if availableOnly {
-			queryBuilder.WriteString(" AND available_for_customers = true")
+		filters, args, err := productFilters(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
-		if search != "" {
-			queryBuilder.WriteString(fmt.Sprintf(" AND (name ILIKE $%d OR barcode ILIKE $%d)", argNum, argNum))
-			args = append(args, "%"+search+"%")
-			argNum++
+		total, estimated, err := countProducts(ctx, db, filters, args)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		// Get total count
-		countQuery := strings.Replace(queryBuilder.String(), 
-			"SELECT id, company_id, name, quantity, price, markup_percent, markup_amount, selling_price, barcode, barid, category, has_color_options, available_for_customers, images, created_at",
-			"SELECT COUNT(*)", 1)
-		
-		var total int
-		db.QueryRow(ctx, countQuery, args...).Scan(&total)
+		var queryBuilder strings.Builder
+		queryBuilder.WriteString(`
+			SELECT ` + productColumns + `, (` + sort.expr + `)::text
+			FROM products WHERE deleted_at IS NULL
+		`)
+		queryBuilder.WriteString(filters)
 
-		// Add pagination
-		queryBuilder.WriteString(fmt.Sprintf(" ORDER BY id DESC LIMIT $%d OFFSET $%d", argNum, argNum+1))
-		args = append(args, limit, offset)
+		if cursorStr := c.Query("cursor"); cursorStr != "" {
+			cursor, err := decodeProductCursor(cursorStr)
+			if err == nil && (cursor.Sort != sortName || cursor.Desc != desc) {
+				err = errors.New("cursor belongs to a different sort order")
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			after, afterArgs := sort.after(cursor, len(args)+1)
+			queryBuilder.WriteString(after)
+			args = append(args, afterArgs...)
+			offset = 0
+		}
+
+		// One row more than the page tells whether another page follows
+		queryBuilder.WriteString(sort.orderBy(desc))
+		queryBuilder.WriteString(fmt.Sprintf(" LIMIT $%d", len(args)+1))
+		args = append(args, limit+1)
+		if offset > 0 {
+			queryBuilder.WriteString(fmt.Sprintf(" OFFSET $%d", len(args)+1))
+			args = append(args, offset)
+		}
 
 		rows, err := db.Query(ctx, queryBuilder.String(), args...)
 		if err != nil {
@@ -159,67 +255,131 @@ func GetProductsPaginated(db *pgxpool.Pool) gin.HandlerFunc {
 		defer rows.Close()
 
 		products := []map[string]interface{}{}
+		var last productCursor
+		hasMore := false
 		for rows.Next() {
-			var id, companyID, quantity int
-			var price, markupPercent, markupAmount, sellingPrice float64
-			var name, category string
-			var barcode *string
-			var barid *int64
-			var hasColorOptions, availableForCustomers bool
-			var imagesJSON []byte
-			var createdAt time.Time
-
-			if err := rows.Scan(&id, &companyID, &name, &quantity, &price, &markupPercent,
-				&markupAmount, &sellingPrice, &barcode, &barid, &category, &hasColorOptions,
-				&availableForCustomers, &imagesJSON, &createdAt); err != nil {
+			if len(products) == limit {
+				hasMore = true
+				break
+			}
+			var sortValue string
+			product, err := scanProduct(ctx, rows, store, cfg.SignedURLTTL, &sortValue)
+			if err != nil {
 				continue
 			}
+			products = append(products, product)
+			last = productCursor{Sort: sortName, Desc: desc, ID: product["id"].(int)}
+			if !sort.idOnly {
+				last.Value = sortValue
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
-			var images []interface{}
-			json.Unmarshal(imagesJSON, &images)
-
-			products = append(products, map[string]interface{}{
-				"id":                      id,
-				"company_id":              companyID,
-				"name":                    name,
-				"quantity":                quantity,
-				"price":                   price,
-				"markup_percent":          markupPercent,
-				"markup_amount":           markupAmount,
-				"selling_price":           sellingPrice,
-				"barcode":                 barcode,
-				"barid":                   barid,
-				"category":                category,
-				"has_color_options":       hasColorOptions,
-				"available_for_customers": availableForCustomers,
-				"images":                  images,
-				"created_at":              createdAt,
-			})
+		var nextCursor *string
+		if hasMore && len(products) > 0 {
+			encoded := last.encode()
+			nextCursor = &encoded
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"products": products,
-			"total":    total,
-			"hasMore":  offset+limit < total,
+			"products":        products,
+			"total":           total,
+			"total_estimated": estimated,
+			"next_cursor":     nextCursor,
+			"hasMore":         hasMore,
 		})
 	}
 }
 
+// productFilters builds the WHERE conditions shared by product listing and export
+// from the company_id, search, available_only, min_price, max_price, category,
+// in_stock, has_images and has_barcode query parameters
+func productFilters(c *gin.Context) (string, []interface{}, error) {
+	var where strings.Builder
+	args := []interface{}{}
+	argNum := 1
+
+	if companyIDStr := c.Query("company_id"); companyIDStr != "" {
+		companyID, _ := strconv.Atoi(companyIDStr)
+		where.WriteString(fmt.Sprintf(" AND company_id = $%d", argNum))
+		args = append(args, companyID)
+		argNum++
+	}
+
+	if c.Query("available_only") == "true" {
+		where.WriteString(" AND available_for_customers = true")
+	}
+
+	if search := c.Query("search"); search != "" {
+		where.WriteString(fmt.Sprintf(" AND (name ILIKE $%d OR barcode ILIKE $%d)", argNum, argNum))
+		args = append(args, "%"+search+"%")
+		argNum++
+	}
+
+	// Price filters apply to the selling price customers see
+	for _, bound := range []struct{ param, op string }{{"min_price", ">="}, {"max_price", "<="}} {
+		value := c.Query(bound.param)
+		if value == "" {
+			continue
+		}
+		price, err := strconv.ParseFloat(value, 64)
+		if err != nil || price < 0 {
+			return "", nil, fmt.Errorf("%s must be a non-negative number", bound.param)
+		}
+		where.WriteString(fmt.Sprintf(" AND COALESCE(selling_price, 0) %s $%d", bound.op, argNum))
+		args = append(args, price)
+		argNum++
+	}
+
+	if categories := splitList(c.Query("category")); len(categories) > 0 {
+		where.WriteString(fmt.Sprintf(" AND category = ANY($%d)", argNum))
+		args = append(args, categories)
+		argNum++
+	}
+
+	if c.Query("in_stock") == "true" {
+		where.WriteString(" AND " + productAvailableSQL + " > 0")
+	}
+
+	switch c.Query("has_images") {
+	case "true":
+		where.WriteString(" AND jsonb_array_length(COALESCE(images, '[]'::jsonb)) > 0")
+	case "false":
+		where.WriteString(" AND jsonb_array_length(COALESCE(images, '[]'::jsonb)) = 0")
+	}
+
+	switch c.Query("has_barcode") {
+	case "true":
+		where.WriteString(" AND COALESCE(barcode, '') <> ''")
+	case "false":
+		where.WriteString(" AND COALESCE(barcode, '') = ''")
+	}
+
+	return where.String(), args, nil
+}
+
 // CreateProduct creates a new product
 func CreateProduct(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 
 		var input struct {
-			CompanyID       int      `json:"company_id" binding:"required"`
-			Name            string   `json:"name" binding:"required"`
-			Quantity        int      `json:"quantity"`
-			Price           float64  `json:"price"`
-			MarkupPercent   float64  `json:"markup_percent"`
-			Barcode         *string  `json:"barcode"`
-			Barid           *int64   `json:"barid"`
-			Category        string   `json:"category"`
-			HasColorOptions bool     `json:"has_color_options"`
+			CompanyID         int      `json:"company_id" binding:"required"`
+			Name              string   `json:"name" binding:"required"`
+			Quantity          float64  `json:"quantity"`
+			Unit              string   `json:"unit"`
+			QuantityPrecision *int     `json:"quantity_precision"` // defaults to the unit's precision
+			Price             float64  `json:"price"`
+			MarkupPercent     *float64 `json:"markup_percent"` // nil uses the company pricing rules
+			Barcode           *string  `json:"barcode"`
+			Barid             *int64   `json:"barid"`
+			Category          string   `json:"category"`
+			Supplier          *string  `json:"supplier"`
+			HasColorOptions   bool     `json:"has_color_options"`
 		}
 
 		if err := c.ShouldBindJSON(&input); err != nil {
@@ -227,41 +387,89 @@ func CreateProduct(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
-		// Calculate markup
-		markupAmount := input.Price * (input.MarkupPercent / 100)
-		sellingPrice := input.Price + markupAmount
-
 		if input.Category == "" {
 			input.Category = "Без категории"
 		}
 
+		if input.Unit == "" {
+			input.Unit = units.Piece
+		}
+		precision := units.DefaultPrecision(input.Unit)
+		if input.QuantityPrecision != nil {
+			precision = *input.QuantityPrecision
+		}
+		if err := validateUnit(input.Unit, precision); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := units.Validate(input.Quantity, precision); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if input.Barcode != nil && *input.Barcode != "" {
+			taken, err := barcodeTaken(ctx, db, input.CompanyID, *input.Barcode, 0)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if taken {
+				c.JSON(http.StatusConflict, gin.H{"error": errBarcodeTaken.Error()})
+				return
+			}
+		}
+
+		// Calculate markup
+		rules, err := loadPricingRules(ctx, db, input.CompanyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		priced := rules.Apply(pricing.Input{
+			Price:         input.Price,
+			MarkupPercent: input.MarkupPercent,
+			Category:      input.Category,
+			Supplier:      stringValue(input.Supplier),
+		})
+
 		var id int
-		err := db.QueryRow(ctx, `
+		err = db.QueryRow(ctx, `
 			INSERT INTO products (company_id, name, quantity, price, markup_percent, markup_amount, 
-								  selling_price, barcode, barid, category, has_color_options)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+								  selling_price, barcode, barid, category, supplier, has_color_options,
+								  unit, quantity_precision)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 			RETURNING id
-		`, input.CompanyID, input.Name, input.Quantity, input.Price, input.MarkupPercent,
-			markupAmount, sellingPrice, input.Barcode, input.Barid, input.Category, input.HasColorOptions).Scan(&id)
+		`, input.CompanyID, input.Name, input.Quantity, input.Price, priced.MarkupPercent,
+			priced.MarkupAmount, priced.SellingPrice, input.Barcode, input.Barid, input.Category,
+			input.Supplier, input.HasColorOptions, input.Unit, precision).Scan(&id)
 
+		if isBarcodeTaken(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": errBarcodeTaken.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		publishProducts(ctx, db, events.ProductCreated, []int{id})
 
 		c.JSON(http.StatusCreated, gin.H{
 			"success": true,
 			"product": map[string]interface{}{
-				"id":            id,
-				"name":          input.Name,
-				"selling_price": sellingPrice,
+				"id":             id,
+				"name":           input.Name,
+				"markup_percent": priced.MarkupPercent,
+				"markup_amount":  priced.MarkupAmount,
+				"selling_price":  priced.SellingPrice,
 			},
 		})
 	}
 }
 
-// UpdateProduct updates an existing product
-func UpdateProduct(db *pgxpool.Pool) gin.HandlerFunc {
+// UpdateProduct applies a JSON Merge Patch to a product. Only whitelisted fields
+// may be sent; every invalid field is reported in "errors". If-Match must carry
+// the ETag the edit was based on; a product changed since gets 412.
+func UpdateProduct(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 		id, err := strconv.Atoi(c.Param("id"))
@@ -270,66 +478,136 @@ func UpdateProduct(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
-		var input map[string]interface{}
-		if err := c.ShouldBindJSON(&input); err != nil {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		patch, fieldErrs, err := decodeProductPatch(body)
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if len(fieldErrs) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product update", "errors": fieldErrs})
+			return
+		}
+		expected, ok := requireIfMatch(c)
+		if !ok {
+			return
+		}
 
-		// Remove company_id from updates (should not be changed)
-		delete(input, "company_id")
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var s productState
+		err = tx.QueryRow(ctx, `
+			SELECT company_id, name, quantity, unit, quantity_precision, COALESCE(price, 0),
+				   markup_percent, COALESCE(markup_amount, 0), COALESCE(selling_price, 0), barcode, barid,
+				   COALESCE(category, 'Без категории'), supplier, COALESCE(has_color_options, false),
+				   COALESCE(available_for_customers, true), is_bundle, version
+			FROM products WHERE id = $1 AND deleted_at IS NULL
+			FOR UPDATE
+		`, id).Scan(&s.CompanyID, &s.Name, &s.Quantity, &s.Unit, &s.QuantityPrecision, &s.Price,
+			&s.MarkupPercent, &s.MarkupAmount, &s.SellingPrice, &s.Barcode, &s.Barid,
+			&s.Category, &s.Supplier, &s.HasColorOptions, &s.AvailableForCustomers, &s.IsBundle, &s.Version)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
-		// Build dynamic update query
-		setClauses := []string{"updated_at = NOW()"}
-		args := []interface{}{}
-		argNum := 1
+		if !versionMatches(expected, s.Version) {
+			current, version, err := loadProduct(ctx, tx, store, cfg.SignedURLTTL, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			preconditionFailed(c, version, "product", current)
+			return
+		}
 
-		for key, value := range input {
-			if value == nil {
-				continue
+		if fieldErrs := patch.apply(&s); len(fieldErrs) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product update", "errors": fieldErrs})
+			return
+		}
+
+		if patch.Barcode.Set && s.Barcode != nil {
+			taken, err := barcodeTaken(ctx, tx, s.CompanyID, *s.Barcode, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
 			}
-			setClauses = append(setClauses, fmt.Sprintf("%s = $%d", key, argNum))
-			args = append(args, value)
-			argNum++
-		}
-
-		// Recalculate markup if price or markup_percent changed
-		if price, ok := input["price"].(float64); ok {
-			markupPercent := float64(0)
-			if mp, ok := input["markup_percent"].(float64); ok {
-				markupPercent = mp
-			} else {
-				// Get current markup_percent
-				var currentMarkup float64
-				db.QueryRow(ctx, "SELECT markup_percent FROM products WHERE id = $1", id).Scan(&currentMarkup)
-				markupPercent = currentMarkup
+			if taken {
+				c.JSON(http.StatusConflict, gin.H{"error": errBarcodeTaken.Error()})
+				return
 			}
-			markupAmount := price * (markupPercent / 100)
-			sellingPrice := price + markupAmount
-			
-			setClauses = append(setClauses, fmt.Sprintf("markup_amount = $%d", argNum))
-			args = append(args, markupAmount)
-			argNum++
-			
-			setClauses = append(setClauses, fmt.Sprintf("selling_price = $%d", argNum))
-			args = append(args, sellingPrice)
-			argNum++
 		}
 
-		query := fmt.Sprintf("UPDATE products SET %s WHERE id = $%d", strings.Join(setClauses, ", "), argNum)
-		args = append(args, id)
+		// Recalculate the selling price through the pricing rules if anything it depends on changed
+		if patch.repricing() {
+			rules, err := loadPricingRules(ctx, tx, s.CompanyID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			priced := rules.Apply(pricing.Input{
+				Price:         s.Price,
+				MarkupPercent: s.MarkupPercent,
+				Category:      s.Category,
+				Supplier:      stringValue(s.Supplier),
+			})
+			s.MarkupPercent = &priced.MarkupPercent
+			s.MarkupAmount = priced.MarkupAmount
+			s.SellingPrice = priced.SellingPrice
+		}
 
-		_, err = db.Exec(ctx, query, args...)
+		err = tx.QueryRow(ctx, `
+			UPDATE products SET name = $1, quantity = $2, unit = $3, quantity_precision = $4, price = $5,
+				   markup_percent = $6, markup_amount = $7, selling_price = $8, barcode = $9, barid = $10,
+				   category = $11, supplier = $12, has_color_options = $13, available_for_customers = $14,
+				   updated_at = NOW()
+			WHERE id = $15
+			RETURNING version
+		`, s.Name, s.Quantity, s.Unit, s.QuantityPrecision, s.Price, s.MarkupPercent, s.MarkupAmount,
+			s.SellingPrice, s.Barcode, s.Barid, s.Category, s.Supplier, s.HasColorOptions,
+			s.AvailableForCustomers, id).Scan(&s.Version)
+		if err == nil {
+			publishProducts(ctx, tx, events.ProductUpdated, []int{id})
+			err = tx.Commit(ctx)
+		}
+		if isBarcodeTaken(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": errBarcodeTaken.Error()})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		setETag(c, s.Version)
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"product": map[string]interface{}{
+				"id":             id,
+				"name":           s.Name,
+				"markup_percent": s.MarkupPercent,
+				"markup_amount":  s.MarkupAmount,
+				"selling_price":  s.SellingPrice,
+				"version":        s.Version,
+			},
+		})
 	}
 }
 
-// DeleteProduct deletes a product
+// DeleteProduct moves a product to the trash. Its images are kept until it is purged.
 func DeleteProduct(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
@@ -339,25 +617,34 @@ func DeleteProduct(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
-		_, err = db.Exec(ctx, "DELETE FROM products WHERE id = $1", id)
+		tx, err := db.Begin(ctx)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		defer tx.Rollback(ctx)
 
-		c.JSON(http.StatusOK, gin.H{"success": true})
-	}
-}
-
-// DeleteAllProducts deletes all products
-func DeleteAllProducts(db *pgxpool.Pool) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ctx := context.Background()
-		_, err := db.Exec(ctx, "DELETE FROM products")
+		tag, err := tx.Exec(ctx, `
+			UPDATE products SET deleted_at = NOW() WHERE id = $1 AND deleted_at IS NULL
+		`, id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		if tag.RowsAffected() == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		err = releaseProductReservations(ctx, tx, []int{id})
+		if err == nil {
+			publishProducts(ctx, tx, events.ProductDeleted, []int{id})
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
 		c.JSON(http.StatusOK, gin.H{"success": true})
 	}
 }
@@ -377,35 +664,66 @@ func BulkImportProducts(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
+		rules, err := loadPricingRules(ctx, db, input.CompanyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
 		imported := 0
 		for _, p := range input.Products {
 			name, _ := p["name"].(string)
-			quantity := int(getFloat(p, "quantity"))
+			unit, _ := p["unit"].(string)
+			if !units.Known(unit) {
+				unit = units.Piece
+			}
+			quantity := units.Round(getFloat(p, "quantity"), units.DefaultPrecision(unit))
 			price := getFloat(p, "price")
-			markupPercent := getFloat(p, "markup_percent")
 			category, _ := p["category"].(string)
 			if category == "" {
 				category = "Без категории"
 			}
+			supplier, _ := p["supplier"].(string)
 
-			markupAmount := price * (markupPercent / 100)
-			sellingPrice := price + markupAmount
+			// Rows without a markup get the company's rule markup
+			var markupPercent *float64
+			if _, ok := p["markup_percent"]; ok {
+				mp := getFloat(p, "markup_percent")
+				markupPercent = &mp
+			}
+			priced := rules.Apply(pricing.Input{
+				Price:         price,
+				MarkupPercent: markupPercent,
+				Category:      category,
+				Supplier:      supplier,
+			})
 
 			_, err := db.Exec(ctx, `
 				INSERT INTO products (company_id, name, quantity, price, markup_percent, 
-									  markup_amount, selling_price, category)
-				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-			`, input.CompanyID, name, quantity, price, markupPercent, markupAmount, sellingPrice, category)
+									  markup_amount, selling_price, category, supplier, unit, quantity_precision)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11)
+			`, input.CompanyID, name, quantity, price, priced.MarkupPercent, priced.MarkupAmount,
+				priced.SellingPrice, category, supplier, unit, units.DefaultPrecision(unit))
 
 			if err == nil {
 				imported++
 			}
 		}
+		if imported > 0 {
+			publishCompanyProducts(ctx, db, input.CompanyID)
+		}
 
 		c.JSON(http.StatusOK, gin.H{"success": true, "imported": imported})
 	}
 }
 
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
 func getFloat(m map[string]interface{}, key string) float64 {
 	if v, ok := m[key].(float64); ok {
 		return v
@@ -428,13 +746,14 @@ func ToggleProductAvailability(db *pgxpool.Pool) gin.HandlerFunc {
 
 		_, err = db.Exec(ctx, `
 			UPDATE products SET available_for_customers = NOT available_for_customers, updated_at = NOW()
-			WHERE id = $1
+			WHERE id = $1 AND deleted_at IS NULL
 		`, id)
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		publishProducts(ctx, db, events.ProductUpdated, []int{id})
 
 		c.JSON(http.StatusOK, gin.H{"success": true})
 	}
@@ -465,7 +784,7 @@ func BulkToggleAvailability(db *pgxpool.Pool) gin.HandlerFunc {
 
 		query := fmt.Sprintf(`
 			UPDATE products SET available_for_customers = $1, updated_at = NOW()
-			WHERE id IN (%s)
+			WHERE id IN (%s) AND deleted_at IS NULL
 		`, strings.Join(placeholders, ","))
 
 		args := append([]interface{}{input.SetAvailable}, ids...)
@@ -475,6 +794,7 @@ func BulkToggleAvailability(db *pgxpool.Pool) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		publishProducts(ctx, db, events.ProductUpdated, input.ProductIDs)
 
 		c.JSON(http.StatusOK, gin.H{"success": true, "updated": len(input.ProductIDs)})
 	}
@@ -498,21 +818,55 @@ func BulkUpdateBarcodes(db *pgxpool.Pool) gin.HandlerFunc {
 		}
 
 		updated := 0
+		var updatedIDs []int
+		failed := []map[string]interface{}{}
 		for _, u := range input.Updates {
-			_, err := db.Exec(ctx, `
-				UPDATE products SET barcode = $1, updated_at = NOW() WHERE id = $2
-			`, u.Barcode, u.ID)
-			if err == nil {
-				updated++
+			code := strings.TrimSpace(u.Barcode)
+
+			// An empty barcode clears it
+			var value *string
+			if code != "" {
+				if err := barcode.Validate(code); err != nil {
+					failed = append(failed, map[string]interface{}{"id": u.ID, "barcode": u.Barcode, "error": "Invalid barcode"})
+					continue
+				}
+				value = &code
+			}
+
+			var companyID int
+			err := db.QueryRow(ctx, `SELECT company_id FROM products WHERE id = $1 AND deleted_at IS NULL`, u.ID).Scan(&companyID)
+			if errors.Is(err, pgx.ErrNoRows) {
+				failed = append(failed, map[string]interface{}{"id": u.ID, "barcode": u.Barcode, "error": "Product not found"})
+				continue
+			}
+
+			// A barcode may only be used once within a company
+			taken := false
+			if err == nil && value != nil {
+				taken, err = barcodeTaken(ctx, db, companyID, code, u.ID)
+			}
+			if err == nil && !taken {
+				_, err = db.Exec(ctx, `UPDATE products SET barcode = $1, updated_at = NOW() WHERE id = $2`, value, u.ID)
+			}
+			if taken || isBarcodeTaken(err) {
+				failed = append(failed, map[string]interface{}{"id": u.ID, "barcode": u.Barcode, "error": errBarcodeTaken.Error(), "status": http.StatusConflict})
+				continue
+			}
+			if err != nil {
+				failed = append(failed, map[string]interface{}{"id": u.ID, "barcode": u.Barcode, "error": err.Error()})
+				continue
 			}
+			updated++
+			updatedIDs = append(updatedIDs, u.ID)
 		}
+		publishProducts(ctx, db, events.ProductUpdated, updatedIDs)
 
-		c.JSON(http.StatusOK, gin.H{"success": true, "updated": updated})
+		c.JSON(http.StatusOK, gin.H{"success": true, "updated": updated, "failed": failed})
 	}
 }
 
 // UploadProductImage handles image upload for a product
-func UploadProductImage(db *pgxpool.Pool, cfg *config.Config) gin.HandlerFunc {
+func UploadProductImage(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 		productID, err := strconv.Atoi(c.Param("id"))
@@ -521,6 +875,18 @@ func UploadProductImage(db *pgxpool.Pool, cfg *config.Config) gin.HandlerFunc {
 			return
 		}
 
+		// Images of private companies are only served through signed URLs
+		var private bool
+		err = db.QueryRow(ctx, `
+			SELECT COALESCE(c.is_private, false)
+			FROM products p LEFT JOIN companies c ON c.id = p.company_id
+			WHERE p.id = $1 AND p.deleted_at IS NULL
+		`, productID).Scan(&private)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+
 		file, header, err := c.Request.FormFile("image")
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "No image file provided"})
@@ -528,51 +894,63 @@ func UploadProductImage(db *pgxpool.Pool, cfg *config.Config) gin.HandlerFunc {
 		}
 		defer file.Close()
 
-		// Generate unique filename
-		ext := filepath.Ext(header.Filename)
-		filename := fmt.Sprintf("%d_%s%s", productID, uuid.New().String(), ext)
-		filepath := filepath.Join(cfg.UploadDir, filename)
+		if header.Size > cfg.MaxFileSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(file, cfg.MaxFileSize+1))
+		if err != nil || int64(len(data)) > cfg.MaxFileSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+			return
+		}
 
-		// Create file
-		out, err := os.Create(filepath)
+		// Decode and re-encode every size; this also drops EXIF metadata
+		variants, err := imaging.Process(data)
+		if errors.Is(err, imaging.ErrUnsupported) || errors.Is(err, imaging.ErrTooLarge) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process image"})
 			return
 		}
-		defer out.Close()
 
-		_, err = io.Copy(out, file)
+		productKey := func(name string) string { return storage.Key(private, name) }
+		image, written, err := saveImageVariants(ctx, store, productKey, productID, variants)
 		if err != nil {
+			removeKeys(ctx, store, written)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
 			return
 		}
+		image.UploadedAt = time.Now().UTC()
+		imageJSON, _ := json.Marshal(image)
 
-		// Update product images array
-		imageURL := fmt.Sprintf("/uploads/%s", filename)
-		imageData := map[string]interface{}{
-			"url":         imageURL,
-			"filepath":    filepath,
-			"uploaded_at": time.Now().UTC(),
-		}
-		imageJSON, _ := json.Marshal(imageData)
-
-		_, err = db.Exec(ctx, `
+		tag, err := db.Exec(ctx, `
 			UPDATE products 
 			SET images = images || $1::jsonb, updated_at = NOW()
-			WHERE id = $2
+			WHERE id = $2 AND deleted_at IS NULL
 		`, string(imageJSON), productID)
 
 		if err != nil {
+			removeKeys(ctx, store, written)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		if tag.RowsAffected() == 0 {
+			removeKeys(ctx, store, written)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+
+		publishProducts(ctx, db, events.ProductUpdated, []int{productID})
 
-		c.JSON(http.StatusOK, gin.H{"success": true, "url": imageURL})
+		signImage(ctx, store, cfg.SignedURLTTL, &image)
+		c.JSON(http.StatusOK, gin.H{"success": true, "url": image.URL, "image": image})
 	}
 }
 
 // GetProductImages returns all images for a product
-func GetProductImages(db *pgxpool.Pool) gin.HandlerFunc {
+func GetProductImages(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 		productID, err := strconv.Atoi(c.Param("id"))
@@ -582,21 +960,20 @@ func GetProductImages(db *pgxpool.Pool) gin.HandlerFunc {
 		}
 
 		var imagesJSON []byte
-		err = db.QueryRow(ctx, "SELECT images FROM products WHERE id = $1", productID).Scan(&imagesJSON)
+		err = db.QueryRow(ctx, "SELECT images FROM products WHERE id = $1 AND deleted_at IS NULL", productID).Scan(&imagesJSON)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
 		}
 
-		var images []interface{}
-		json.Unmarshal(imagesJSON, &images)
+		images := decodeImages(ctx, store, cfg.SignedURLTTL, imagesJSON)
 
 		c.JSON(http.StatusOK, gin.H{"images": images})
 	}
 }
 
 // DeleteProductImage deletes an image from a product
-func DeleteProductImage(db *pgxpool.Pool) gin.HandlerFunc {
+func DeleteProductImage(db *pgxpool.Pool, store storage.Storage) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
 		productID, err := strconv.Atoi(c.Param("id"))
@@ -611,15 +988,22 @@ func DeleteProductImage(db *pgxpool.Pool) gin.HandlerFunc {
 			return
 		}
 
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
 		// Get current images
 		var imagesJSON []byte
-		err = db.QueryRow(ctx, "SELECT images FROM products WHERE id = $1", productID).Scan(&imagesJSON)
+		err = tx.QueryRow(ctx, "SELECT images FROM products WHERE id = $1 AND deleted_at IS NULL FOR UPDATE", productID).Scan(&imagesJSON)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
 			return
 		}
 
-		var images []interface{}
+		var images []json.RawMessage
 		json.Unmarshal(imagesJSON, &images)
 
 		if index < 0 || index >= len(images) {
@@ -628,18 +1012,27 @@ func DeleteProductImage(db *pgxpool.Pool) gin.HandlerFunc {
 		}
 
 		// Remove image at index
+		removed := images[index]
 		images = append(images[:index], images[index+1:]...)
 		newImagesJSON, _ := json.Marshal(images)
 
-		_, err = db.Exec(ctx, `
+		_, err = tx.Exec(ctx, `
 			UPDATE products SET images = $1::jsonb, updated_at = NOW() WHERE id = $2
 		`, string(newImagesJSON), productID)
+		if err == nil {
+			publishProducts(ctx, tx, events.ProductUpdated, []int{productID})
+			err = tx.Commit(ctx)
+		}
 
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
+		var img models.ProductImage
+		json.Unmarshal(removed, &img)
+		removeKeys(ctx, store, imageKeys(img))
+
 		c.JSON(http.StatusOK, gin.H{"success": true})
 	}
 }
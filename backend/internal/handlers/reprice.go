@@ -0,0 +1,426 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/pricing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const repricePreviewLimit = 500
+
+// repriceFilter selects the products of a bulk repricing. Empty fields do not filter.
+type repriceFilter struct {
+	Category   *string `json:"category,omitempty"`
+	Supplier   *string `json:"supplier,omitempty"`
+	Search     *string `json:"search,omitempty"`
+	ProductIDs []int   `json:"product_ids,omitempty"`
+}
+
+// repriceInput is a bulk repricing request: change target by value, in percent or a fixed amount
+type repriceInput struct {
+	CompanyID int           `json:"company_id" binding:"required"`
+	Filter    repriceFilter `json:"filter"`
+	Target    string        `json:"target"` // price, markup_percent
+	Mode      string        `json:"mode"`   // percent, fixed
+	Value     float64       `json:"value"`
+	Note      *string       `json:"note"`
+}
+
+func (in *repriceInput) validate() error {
+	if in.Target == "" {
+		in.Target = "price"
+	}
+	if in.Mode == "" {
+		in.Mode = "percent"
+	}
+	if in.Target != "price" && in.Target != "markup_percent" {
+		return errors.New("target must be price or markup_percent")
+	}
+	if in.Mode != "percent" && in.Mode != "fixed" {
+		return errors.New("mode must be percent or fixed")
+	}
+	if in.Value == 0 {
+		return errors.New("value must not be zero")
+	}
+	if in.Mode == "percent" && in.Value <= -100 {
+		return errors.New("a percent change must be greater than -100")
+	}
+	return nil
+}
+
+// repriceItem is the old and new price of one product
+type repriceItem struct {
+	ProductID        int     `json:"product_id"`
+	Name             string  `json:"name"`
+	OldPrice         float64 `json:"old_price"`
+	OldMarkupPercent float64 `json:"old_markup_percent"`
+	OldMarkupAmount  float64 `json:"old_markup_amount"`
+	OldSellingPrice  float64 `json:"old_selling_price"`
+	NewPrice         float64 `json:"new_price"`
+	NewMarkupPercent float64 `json:"new_markup_percent"`
+	NewMarkupAmount  float64 `json:"new_markup_amount"`
+	NewSellingPrice  float64 `json:"new_selling_price"`
+	Error            string  `json:"error,omitempty"`
+}
+
+// repriceItems selects the filtered products and computes their new prices through
+// the company pricing rules. With lock the rows are locked for update.
+func repriceItems(ctx context.Context, q querier, in repriceInput, lock bool) ([]repriceItem, error) {
+	rules, err := loadPricingRules(ctx, q, in.CompanyID)
+	if err != nil {
+		return nil, err
+	}
+
+	var where strings.Builder
+	args := []interface{}{in.CompanyID}
+	if in.Filter.Category != nil {
+		args = append(args, *in.Filter.Category)
+		where.WriteString(fmt.Sprintf(" AND category = $%d", len(args)))
+	}
+	if in.Filter.Supplier != nil {
+		args = append(args, *in.Filter.Supplier)
+		where.WriteString(fmt.Sprintf(" AND supplier = $%d", len(args)))
+	}
+	if in.Filter.Search != nil && *in.Filter.Search != "" {
+		args = append(args, "%"+*in.Filter.Search+"%")
+		where.WriteString(fmt.Sprintf(" AND (name ILIKE $%d OR barcode ILIKE $%d)", len(args), len(args)))
+	}
+	if len(in.Filter.ProductIDs) > 0 {
+		args = append(args, in.Filter.ProductIDs)
+		where.WriteString(fmt.Sprintf(" AND id = ANY($%d)", len(args)))
+	}
+
+	query := `
+		SELECT id, name, price, markup_percent, markup_amount, selling_price, category, COALESCE(supplier, '')
+		FROM products WHERE company_id = $1 AND deleted_at IS NULL` + where.String() + `
+		ORDER BY id`
+	if lock {
+		query += " FOR UPDATE"
+	}
+
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []repriceItem{}
+	for rows.Next() {
+		var item repriceItem
+		var category, supplier string
+		if err := rows.Scan(&item.ProductID, &item.Name, &item.OldPrice, &item.OldMarkupPercent,
+			&item.OldMarkupAmount, &item.OldSellingPrice, &category, &supplier); err != nil {
+			return nil, err
+		}
+
+		item.NewPrice, item.NewMarkupPercent = item.OldPrice, item.OldMarkupPercent
+		if in.Target == "price" {
+			item.NewPrice = adjust(item.OldPrice, in.Mode, in.Value)
+		} else {
+			item.NewMarkupPercent = adjust(item.OldMarkupPercent, in.Mode, in.Value)
+		}
+
+		switch {
+		case item.NewPrice < 0:
+			item.Error = "Price would be negative"
+		case item.NewMarkupPercent < 0 || item.NewMarkupPercent >= 1000:
+			item.Error = "Markup must stay between 0 and 999.99"
+		}
+
+		priced := rules.Apply(pricing.Input{
+			Price:         item.NewPrice,
+			MarkupPercent: &item.NewMarkupPercent,
+			Category:      category,
+			Supplier:      supplier,
+		})
+		item.NewMarkupAmount = priced.MarkupAmount
+		item.NewSellingPrice = priced.SellingPrice
+
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func adjust(v float64, mode string, value float64) float64 {
+	if mode == "percent" {
+		v *= 1 + value/100
+	} else {
+		v += value
+	}
+	return math.Round(v*100) / 100
+}
+
+// PreviewReprice shows the old and new prices of a bulk repricing without saving anything
+func PreviewReprice(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input repriceInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := input.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		items, err := repriceItems(ctx, db, input, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		failed := 0
+		oldTotal, newTotal := 0.0, 0.0
+		for _, item := range items {
+			if item.Error != "" {
+				failed++
+				continue
+			}
+			oldTotal += item.OldSellingPrice
+			newTotal += item.NewSellingPrice
+		}
+
+		total := len(items)
+		if len(items) > repricePreviewLimit {
+			items = items[:repricePreviewLimit]
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success":               true,
+			"total":                 total,
+			"failed":                failed,
+			"old_selling_price_sum": roundTo(oldTotal, 2),
+			"new_selling_price_sum": roundTo(newTotal, 2),
+			"items":                 items,
+			"truncated":             total > len(items),
+		})
+	}
+}
+
+// ApplyReprice applies a bulk repricing and records it as a batch that can be undone.
+// Nothing is changed if any selected product would get an invalid price.
+func ApplyReprice(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input repriceInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := input.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		items, err := repriceItems(ctx, tx, input, true)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(items) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No products match the filter"})
+			return
+		}
+
+		invalid := []repriceItem{}
+		for _, item := range items {
+			if item.Error != "" {
+				invalid = append(invalid, item)
+			}
+		}
+		if len(invalid) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Some products would get invalid prices", "items": invalid})
+			return
+		}
+
+		if err := setPriceSource(ctx, tx, priceSourceReprice); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		filterJSON, _ := json.Marshal(input.Filter)
+		var batchID int
+		err = tx.QueryRow(ctx, `
+			INSERT INTO reprice_batches (company_id, filter, target, mode, value, note, product_count)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id
+		`, input.CompanyID, filterJSON, input.Target, input.Mode, input.Value, input.Note, len(items)).Scan(&batchID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		for _, item := range items {
+			_, err = tx.Exec(ctx, `
+				UPDATE products SET price = $1, markup_percent = $2, markup_amount = $3,
+					selling_price = $4, updated_at = NOW()
+				WHERE id = $5
+			`, item.NewPrice, item.NewMarkupPercent, item.NewMarkupAmount, item.NewSellingPrice, item.ProductID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			_, err = tx.Exec(ctx, `
+				INSERT INTO reprice_batch_items (batch_id, product_id, old_price, old_markup_percent,
+					old_markup_amount, old_selling_price, new_price, new_markup_percent,
+					new_markup_amount, new_selling_price)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			`, batchID, item.ProductID, item.OldPrice, item.OldMarkupPercent, item.OldMarkupAmount,
+				item.OldSellingPrice, item.NewPrice, item.NewMarkupPercent, item.NewMarkupAmount, item.NewSellingPrice)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		publishCompanyProducts(ctx, tx, input.CompanyID)
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "batch_id": batchID, "updated": len(items)})
+	}
+}
+
+// GetRepriceBatches returns the bulk repricing batches of a company, newest first
+func GetRepriceBatches(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		companyID, err := strconv.Atoi(c.Query("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, company_id, filter, target, mode, value, note, product_count, status,
+				   created_at, undone_at
+			FROM reprice_batches WHERE company_id = $1
+			ORDER BY created_at DESC
+			LIMIT 100
+		`, companyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		batches := []models.RepriceBatch{}
+		for rows.Next() {
+			var b models.RepriceBatch
+			if err := rows.Scan(&b.ID, &b.CompanyID, &b.Filter, &b.Target, &b.Mode, &b.Value, &b.Note,
+				&b.ProductCount, &b.Status, &b.CreatedAt, &b.UndoneAt); err != nil {
+				continue
+			}
+			batches = append(batches, b)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"batches": batches})
+	}
+}
+
+// UndoReprice restores the prices a batch replaced. Products whose price was
+// changed again after the batch are left alone and reported as skipped.
+func UndoReprice(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		batchID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var status string
+		var companyID int
+		err = tx.QueryRow(ctx, `
+			SELECT status, company_id FROM reprice_batches WHERE id = $1 FOR UPDATE
+		`, batchID).Scan(&status, &companyID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if status != "applied" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Batch is already undone"})
+			return
+		}
+
+		if err := setPriceSource(ctx, tx, priceSourceRepriceUndo); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Only rows still carrying the batch's new price are restored
+		tag, err := tx.Exec(ctx, `
+			UPDATE products p SET
+				price = i.old_price,
+				markup_percent = i.old_markup_percent,
+				markup_amount = i.old_markup_amount,
+				selling_price = i.old_selling_price,
+				updated_at = NOW()
+			FROM reprice_batch_items i
+			WHERE i.batch_id = $1 AND p.id = i.product_id
+			  AND p.price = i.new_price
+			  AND p.markup_percent = i.new_markup_percent
+			  AND p.selling_price = i.new_selling_price
+		`, batchID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var total int
+		tx.QueryRow(ctx, `SELECT COUNT(*) FROM reprice_batch_items WHERE batch_id = $1`, batchID).Scan(&total)
+
+		_, err = tx.Exec(ctx, `
+			UPDATE reprice_batches SET status = 'undone', undone_at = NOW() WHERE id = $1
+		`, batchID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		publishCompanyProducts(ctx, tx, companyID)
+
+		if err := tx.Commit(ctx); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		restored := int(tag.RowsAffected())
+		c.JSON(http.StatusOK, gin.H{"success": true, "restored": restored, "skipped": total - restored})
+	}
+}
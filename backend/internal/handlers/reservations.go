@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/orderstatus"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// productReservedSQL selects what open orders hold of the product in table
+func productReservedSQL(table string) string {
+	return fmt.Sprintf(`COALESCE((
+		SELECT SUM(r.quantity) FROM stock_reservations r
+		WHERE r.product_id = %s.id AND (r.expires_at IS NULL OR r.expires_at > NOW())
+	), 0)`, table)
+}
+
+// productAvailableSQL selects the stock of a product from an unaliased
+// products table less what open orders hold. For a bundle it is the number
+// of complete bundles the components' available stock makes up.
+var productAvailableSQL = `CASE WHEN products.is_bundle THEN COALESCE((
+		SELECT MIN(CASE WHEN cp.deleted_at IS NULL
+			THEN GREATEST(FLOOR((cp.quantity - ` + productReservedSQL("cp") + `) / bi.quantity), 0) ELSE 0 END)
+		FROM product_bundle_items bi JOIN products cp ON cp.id = bi.component_id
+		WHERE bi.bundle_id = products.id
+	), 0) ELSE products.quantity - ` + productReservedSQL("products") + ` END`
+
+// reserveStock holds the lines of a new order until it is paid or
+// cancelled. Lines must come from expandBundles and have been checked with
+// lockStock. A pending order's reservations run out after ttl; 0 holds them
+// until the order is closed.
+func reserveStock(ctx context.Context, q querier, orderID int, lines []stockLine, ttl time.Duration) error {
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		expiresAt = &t
+	}
+	ids := make([]int, 0, len(lines))
+	for _, l := range lines {
+		if _, err := q.Exec(ctx, `
+			INSERT INTO stock_reservations (order_id, product_id, company_id, quantity, expires_at)
+			SELECT $1, id, company_id, $3, $4 FROM products WHERE id = $2
+		`, orderID, l.ProductID, l.Quantity, expiresAt); err != nil {
+			return err
+		}
+		ids = append(ids, l.ProductID)
+	}
+	return touchReserved(ctx, q, ids)
+}
+
+// touchReserved writes the products whose reservations changed, and the
+// bundles made of them, so their version and change_xid move and clients
+// syncing changes pick up the new available quantity
+func touchReserved(ctx context.Context, q querier, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := q.Exec(ctx, `
+		UPDATE products SET updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM products
+			WHERE id = ANY($1) OR id IN (SELECT bundle_id FROM product_bundle_items WHERE component_id = ANY($1))
+			ORDER BY id
+			FOR UPDATE
+		)
+	`, ids)
+	return err
+}
+
+// holdReservations keeps an order's reservations until it is closed; an
+// accepted order no longer runs out
+func holdReservations(ctx context.Context, q querier, orderID int) error {
+	_, err := q.Exec(ctx, `UPDATE stock_reservations SET expires_at = NULL WHERE order_id = $1`, orderID)
+	return err
+}
+
+// releaseReservations frees the stock an order holds and returns the
+// products it was held of
+func releaseReservations(ctx context.Context, q querier, orderID int) ([]int, error) {
+	rows, err := q.Query(ctx, `DELETE FROM stock_reservations WHERE order_id = $1 RETURNING product_id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, touchReserved(ctx, q, ids)
+}
+
+// releaseProductReservations frees what open orders hold of products that
+// leave the catalog; a product in the trash cannot be handed over
+func releaseProductReservations(ctx context.Context, q querier, ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if _, err := q.Exec(ctx, `DELETE FROM stock_reservations WHERE product_id = ANY($1)`, ids); err != nil {
+		return err
+	}
+	return touchReserved(ctx, q, ids)
+}
+
+// reservationsTag fingerprints the reservations of a company, or of all
+// companies when companyID is 0. Reservations change what listings show as
+// available without writing the products.
+func reservationsTag(ctx context.Context, q querier, companyID int) (string, error) {
+	var tag string
+	err := q.QueryRow(ctx, `
+		SELECT COALESCE(md5(string_agg(id || ':' || COALESCE(expires_at::text, ''), ',' ORDER BY id)), '')
+		FROM stock_reservations WHERE $1 = 0 OR company_id = $1
+	`, companyID).Scan(&tag)
+	return tag, err
+}
+
+// RunOrderExpiry cancels pending orders whose reservations have run out,
+// releasing them, every interval until ctx is cancelled. An order that fails
+// to expire is logged and passed over for the rest of the run, so it cannot
+// hold up the others; the next run tries it again.
+func RunOrderExpiry(ctx context.Context, db *pgxpool.Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		failed := []int{}
+		for {
+			orderID, err := expireNextOrder(ctx, db, failed)
+			if err != nil && orderID == 0 {
+				log.Printf("Expiring pending orders failed: %v", err)
+				break
+			}
+			if err != nil {
+				log.Printf("Expiring pending order %d failed: %v", orderID, err)
+				failed = append(failed, orderID)
+				continue
+			}
+			if orderID == 0 {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expireNextOrder cancels the oldest pending order whose reservations have
+// run out, other than the skipped ones, and returns its ID; 0 when there is
+// none. Orders placed without reservations never expire. Orders are claimed
+// with SKIP LOCKED, so several backend instances can run the job at once.
+func expireNextOrder(ctx context.Context, db *pgxpool.Pool, skip []int) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var orderID int
+	var companyID *int
+	err = tx.QueryRow(ctx, `
+		SELECT o.id, o.company_id FROM customer_orders o
+		WHERE o.status = 'pending' AND o.id <> ALL($1) AND EXISTS (
+			SELECT 1 FROM stock_reservations r WHERE r.order_id = o.id AND r.expires_at <= NOW()
+		)
+		ORDER BY o.created_at, o.id
+		LIMIT 1
+		FOR UPDATE OF o SKIP LOCKED
+	`, skip).Scan(&orderID, &companyID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := setOrderStatus(ctx, tx, orderID, orderstatus.Pending, orderstatus.Cancelled,
+		orderstatus.System, "", "not paid in time"); err != nil {
+		return orderID, err
+	}
+	released, err := releaseReservations(ctx, tx, orderID)
+	if err != nil {
+		return orderID, err
+	}
+
+	publishProducts(ctx, tx, events.StockChanged, released)
+	if companyID != nil {
+		publish(ctx, tx, events.OrderUpdated, *companyID, gin.H{"order_id": orderID, "status": orderstatus.Cancelled})
+	}
+	return orderID, tx.Commit(ctx)
+}
@@ -0,0 +1,661 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"azaton-backend/internal/config"
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/imaging"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	reviewPublished = "published"
+	reviewHidden    = "hidden"
+
+	maxReviewLength = 2000
+	maxReviewPhotos = 5
+)
+
+// reviewColumns are the columns scanReview reads
+const reviewColumns = `id, product_id, company_id, order_id, user_name, user_phone, rating, body, photos,
+	status, moderation_reason, moderated_by, moderated_at, reply, replied_at, created_at, updated_at`
+
+// scanReview reads a row of reviewColumns. The customer's phone is only kept
+// for moderators.
+func scanReview(ctx context.Context, row pgx.Row, store storage.Storage, ttl time.Duration, withPhone bool) (models.ProductReview, error) {
+	var r models.ProductReview
+	var photosJSON []byte
+	err := row.Scan(&r.ID, &r.ProductID, &r.CompanyID, &r.OrderID, &r.UserName, &r.UserPhone, &r.Rating,
+		&r.Body, &photosJSON, &r.Status, &r.ModerationReason, &r.ModeratedBy, &r.ModeratedAt,
+		&r.Reply, &r.RepliedAt, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return r, err
+	}
+	r.Photos = decodeImages(ctx, store, ttl, photosJSON)
+	if !withPhone {
+		r.UserPhone = ""
+	}
+	return r, nil
+}
+
+// refreshProductRating recomputes a product's rating from its published reviews
+func refreshProductRating(ctx context.Context, q querier, productID int) error {
+	_, err := q.Exec(ctx, `
+		UPDATE products SET
+			rating = COALESCE((SELECT AVG(rating)::numeric(3,2) FROM product_reviews
+							   WHERE product_id = $1 AND status = 'published'), 0),
+			rating_count = (SELECT COUNT(*) FROM product_reviews WHERE product_id = $1 AND status = 'published')
+		WHERE id = $1
+	`, productID)
+	if err != nil {
+		return err
+	}
+	publishProducts(ctx, q, events.ProductUpdated, []int{productID})
+	return nil
+}
+
+// receivedOrder returns the latest completed order in which the customer got the product
+func receivedOrder(ctx context.Context, q querier, phone string, productID int) (int, error) {
+	var orderID int
+	err := q.QueryRow(ctx, `
+		SELECT o.id FROM customer_orders o
+		WHERE o.user_phone = $1 AND o.status = 'completed'
+		  AND EXISTS (SELECT 1 FROM jsonb_array_elements(o.items) item WHERE item->>'product_id' = $2::text)
+		ORDER BY o.confirmed_date DESC NULLS LAST, o.id DESC
+		LIMIT 1
+	`, phone, strconv.Itoa(productID)).Scan(&orderID)
+	return orderID, err
+}
+
+// loadOwnReview loads a review for a change by its author, identified by phone
+func loadOwnReview(ctx context.Context, tx pgx.Tx, id int, phone string) (productID int, photosJSON []byte, err error) {
+	var owner string
+	err = tx.QueryRow(ctx, `
+		SELECT product_id, photos, user_phone FROM product_reviews WHERE id = $1 FOR UPDATE
+	`, id).Scan(&productID, &photosJSON, &owner)
+	if err == nil && (phone == "" || owner != phone) {
+		err = errNotReviewAuthor
+	}
+	return productID, photosJSON, err
+}
+
+var errNotReviewAuthor = errors.New("only the author can change a review")
+
+// GetProductReviews returns the published reviews of a product, newest first,
+// with the rating summary
+func GetProductReviews(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+		if limit <= 0 || limit > 100 {
+			limit = 20
+		}
+		offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if offset < 0 {
+			offset = 0
+		}
+
+		var rating float64
+		var ratingCount int
+		err = db.QueryRow(ctx, `
+			SELECT rating, rating_count FROM products WHERE id = $1 AND deleted_at IS NULL
+		`, productID).Scan(&rating, &ratingCount)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+
+		distribution := map[string]int{"1": 0, "2": 0, "3": 0, "4": 0, "5": 0}
+		rows, err := db.Query(ctx, `
+			SELECT rating, COUNT(*) FROM product_reviews
+			WHERE product_id = $1 AND status = 'published'
+			GROUP BY rating
+		`, productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for rows.Next() {
+			var stars, count int
+			if err := rows.Scan(&stars, &count); err == nil {
+				distribution[strconv.Itoa(stars)] = count
+			}
+		}
+		rows.Close()
+
+		rows, err = db.Query(ctx, `
+			SELECT `+reviewColumns+` FROM product_reviews
+			WHERE product_id = $1 AND status = 'published'
+			ORDER BY created_at DESC, id DESC
+			LIMIT $2 OFFSET $3
+		`, productID, limit, offset)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		reviews := []models.ProductReview{}
+		for rows.Next() {
+			review, err := scanReview(ctx, rows, store, cfg.SignedURLTTL, false)
+			if err != nil {
+				continue
+			}
+			reviews = append(reviews, review)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"reviews":      reviews,
+			"rating":       rating,
+			"rating_count": ratingCount,
+			"distribution": distribution,
+			"hasMore":      offset+len(reviews) < ratingCount,
+		})
+	}
+}
+
+// SaveProductReview creates or replaces the customer's review of a product.
+// Only customers who received the product in a completed order may review it.
+// A review hidden by a moderator stays hidden when it is edited.
+func SaveProductReview(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		var input struct {
+			UserID    *int   `json:"user_id"`
+			UserName  string `json:"user_name"`
+			UserPhone string `json:"user_phone" binding:"required"`
+			Rating    int    `json:"rating" binding:"required,min=1,max=5"`
+			Body      string `json:"body"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		input.UserPhone = strings.TrimSpace(input.UserPhone)
+		input.Body = strings.TrimSpace(input.Body)
+		if utf8.RuneCountInString(input.Body) > maxReviewLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Review must be at most %d characters", maxReviewLength)})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var companyID int
+		err = tx.QueryRow(ctx, `
+			SELECT company_id FROM products WHERE id = $1 AND deleted_at IS NULL
+		`, productID).Scan(&companyID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+
+		orderID, err := receivedOrder(ctx, tx, input.UserPhone, productID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only customers who received this product in a completed order can review it"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var userName *string
+		if name := strings.TrimSpace(input.UserName); name != "" {
+			userName = &name
+		}
+
+		review, err := scanReview(ctx, tx.QueryRow(ctx, `
+			INSERT INTO product_reviews (product_id, company_id, order_id, user_id, user_phone, user_name, rating, body)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (product_id, user_phone) DO UPDATE SET
+				order_id = EXCLUDED.order_id,
+				user_id = COALESCE(EXCLUDED.user_id, product_reviews.user_id),
+				user_name = COALESCE(EXCLUDED.user_name, product_reviews.user_name),
+				rating = EXCLUDED.rating,
+				body = EXCLUDED.body,
+				updated_at = NOW()
+			RETURNING `+reviewColumns+`
+		`, productID, companyID, orderID, input.UserID, input.UserPhone, userName, input.Rating, input.Body),
+			store, cfg.SignedURLTTL, false)
+		if err == nil {
+			err = refreshProductRating(ctx, tx, productID)
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "review": review})
+	}
+}
+
+// DeleteProductReview lets the author remove their review, with its photos
+func DeleteProductReview(db *pgxpool.Pool, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		productID, photosJSON, err := loadOwnReview(ctx, tx, id, strings.TrimSpace(c.Query("user_phone")))
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return
+		}
+		if errors.Is(err, errNotReviewAuthor) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err = tx.Exec(ctx, `DELETE FROM product_reviews WHERE id = $1`, id)
+		if err == nil {
+			err = refreshProductRating(ctx, tx, productID)
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		deleteImageFiles(ctx, store, photosJSON)
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// UploadReviewPhoto adds a photo to the author's review
+func UploadReviewPhoto(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+			return
+		}
+		phone := strings.TrimSpace(c.PostForm("user_phone"))
+
+		var owner string
+		var photoCount int
+		var private bool
+		err = db.QueryRow(ctx, `
+			SELECT r.user_phone, jsonb_array_length(r.photos), COALESCE(c.is_private, false)
+			FROM product_reviews r LEFT JOIN companies c ON c.id = r.company_id
+			WHERE r.id = $1
+		`, id).Scan(&owner, &photoCount, &private)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return
+		}
+		if phone == "" || owner != phone {
+			c.JSON(http.StatusForbidden, gin.H{"error": errNotReviewAuthor.Error()})
+			return
+		}
+		if photoCount >= maxReviewPhotos {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A review can have at most %d photos", maxReviewPhotos)})
+			return
+		}
+
+		file, header, err := c.Request.FormFile("image")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No image file provided"})
+			return
+		}
+		defer file.Close()
+
+		if header.Size > cfg.MaxFileSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(file, cfg.MaxFileSize+1))
+		if err != nil || int64(len(data)) > cfg.MaxFileSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+			return
+		}
+
+		variants, err := imaging.Process(data)
+		if errors.Is(err, imaging.ErrUnsupported) || errors.Is(err, imaging.ErrTooLarge) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process image"})
+			return
+		}
+
+		reviewKey := func(name string) string { return storage.ReviewKey(private, name) }
+		photo, written, err := saveImageVariants(ctx, store, reviewKey, id, variants)
+		if err != nil {
+			removeKeys(ctx, store, written)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+			return
+		}
+		photo.UploadedAt = time.Now().UTC()
+		photoJSON, _ := json.Marshal(photo)
+
+		// The limit is checked again here, against uploads running side by side
+		tag, err := db.Exec(ctx, `
+			UPDATE product_reviews SET photos = photos || $1::jsonb, updated_at = NOW()
+			WHERE id = $2 AND jsonb_array_length(photos) < $3
+		`, string(photoJSON), id, maxReviewPhotos)
+		if err != nil {
+			removeKeys(ctx, store, written)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			removeKeys(ctx, store, written)
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("A review can have at most %d photos", maxReviewPhotos)})
+			return
+		}
+
+		signImage(ctx, store, cfg.SignedURLTTL, &photo)
+		c.JSON(http.StatusOK, gin.H{"success": true, "photo": photo})
+	}
+}
+
+// DeleteReviewPhoto removes a photo from the author's review
+func DeleteReviewPhoto(db *pgxpool.Pool, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+			return
+		}
+		index, err := strconv.Atoi(c.Param("index"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid photo index"})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		_, photosJSON, err := loadOwnReview(ctx, tx, id, strings.TrimSpace(c.Query("user_phone")))
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return
+		}
+		if errors.Is(err, errNotReviewAuthor) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var photos []json.RawMessage
+		json.Unmarshal(photosJSON, &photos)
+		if index < 0 || index >= len(photos) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Photo index out of range"})
+			return
+		}
+		removed := photos[index]
+		photos = append(photos[:index], photos[index+1:]...)
+		newPhotosJSON, _ := json.Marshal(photos)
+
+		_, err = tx.Exec(ctx, `
+			UPDATE product_reviews SET photos = $1::jsonb, updated_at = NOW() WHERE id = $2
+		`, string(newPhotosJSON), id)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var photo models.ProductImage
+		json.Unmarshal(removed, &photo)
+		removeKeys(ctx, store, imageKeys(photo))
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// ReplyToReview sets the company's public reply to a review of one of its
+// products. An empty reply removes it.
+func ReplyToReview(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+			return
+		}
+
+		var input struct {
+			CompanyID int    `json:"company_id" binding:"required"`
+			Reply     string `json:"reply"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		input.Reply = strings.TrimSpace(input.Reply)
+		if utf8.RuneCountInString(input.Reply) > maxReviewLength {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Reply must be at most %d characters", maxReviewLength)})
+			return
+		}
+
+		var reply *string
+		if input.Reply != "" {
+			reply = &input.Reply
+		}
+
+		var companyID int
+		err = db.QueryRow(ctx, `SELECT company_id FROM product_reviews WHERE id = $1`, id).Scan(&companyID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return
+		}
+		if companyID != input.CompanyID {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the company selling the product can reply"})
+			return
+		}
+
+		_, err = db.Exec(ctx, `
+			UPDATE product_reviews SET reply = $1,
+				replied_at = CASE WHEN $1::text IS NULL THEN NULL ELSE NOW() END
+			WHERE id = $2
+		`, reply, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// GetReviews lists reviews for moderation, newest first. status, company_id
+// and product_id narrow the list.
+func GetReviews(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if limit <= 0 || limit > 200 {
+			limit = 50
+		}
+		offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if offset < 0 {
+			offset = 0
+		}
+
+		where := " WHERE true"
+		args := []interface{}{}
+		if status := c.Query("status"); status != "" {
+			if status != reviewPublished && status != reviewHidden {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "status must be published or hidden"})
+				return
+			}
+			args = append(args, status)
+			where += fmt.Sprintf(" AND status = $%d", len(args))
+		}
+		for _, param := range []string{"company_id", "product_id"} {
+			if v := c.Query(param); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid " + param})
+					return
+				}
+				args = append(args, n)
+				where += fmt.Sprintf(" AND %s = $%d", param, len(args))
+			}
+		}
+
+		var total int
+		if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM product_reviews`+where, args...).Scan(&total); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		args = append(args, limit, offset)
+		rows, err := db.Query(ctx, fmt.Sprintf(`
+			SELECT %s FROM product_reviews%s
+			ORDER BY created_at DESC, id DESC
+			LIMIT $%d OFFSET $%d
+		`, reviewColumns, where, len(args)-1, len(args)), args...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		reviews := []models.ProductReview{}
+		for rows.Next() {
+			review, err := scanReview(ctx, rows, store, cfg.SignedURLTTL, true)
+			if err != nil {
+				continue
+			}
+			reviews = append(reviews, review)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"reviews": reviews, "total": total})
+	}
+}
+
+// moderateReview publishes or hides a review and updates the product rating
+func moderateReview(db *pgxpool.Pool, status string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid review ID"})
+			return
+		}
+
+		var input struct {
+			Reason      string `json:"reason"`
+			ModeratedBy string `json:"moderated_by"`
+		}
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&input); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		var reason, moderatedBy *string
+		if r := strings.TrimSpace(input.Reason); r != "" && status == reviewHidden {
+			reason = &r
+		}
+		if m := strings.TrimSpace(input.ModeratedBy); m != "" {
+			moderatedBy = &m
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var productID int
+		err = tx.QueryRow(ctx, `
+			UPDATE product_reviews SET status = $1, moderation_reason = $2, moderated_by = $3,
+				moderated_at = NOW()
+			WHERE id = $4
+			RETURNING product_id
+		`, status, reason, moderatedBy, id).Scan(&productID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Review not found"})
+			return
+		}
+		if err == nil {
+			err = refreshProductRating(ctx, tx, productID)
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// HideReview takes a review out of the product page and its rating
+func HideReview(db *pgxpool.Pool) gin.HandlerFunc {
+	return moderateReview(db, reviewHidden)
+}
+
+// PublishReview puts a hidden review back
+func PublishReview(db *pgxpool.Pool) gin.HandlerFunc {
+	return moderateReview(db, reviewPublished)
+}
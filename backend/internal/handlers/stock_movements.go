@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/units"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Reasons stock moves
+const (
+	movementSale    = "sale"
+	movementRefund  = "refund"
+	movementReceipt = "receipt"
+)
+
+// recordStockMovement records that a product's stock just changed by
+// quantity base units, naming the order, till sale or receipt it belongs to.
+// Call it after the update, in the same transaction.
+func recordStockMovement(ctx context.Context, q querier, productID int, quantity float64, reason string, orderID, saleID, receiptID *int) error {
+	_, err := q.Exec(ctx, `
+		INSERT INTO stock_movements (product_id, company_id, reason, quantity, quantity_after, order_id, sale_id, receipt_id)
+		SELECT id, company_id, $2, $3, quantity, $4, $5, $6 FROM products WHERE id = $1
+	`, productID, reason, quantity, orderID, saleID, receiptID)
+	return err
+}
+
+// shortItem is a product there is not enough stock of
+type shortItem struct {
+	ProductID int     `json:"product_id"`
+	Name      string  `json:"name"`
+	Unit      string  `json:"unit"`
+	Requested float64 `json:"requested"`
+	Available float64 `json:"available"`          // on hand less what other orders hold
+	Reserved  float64 `json:"reserved,omitempty"` // held by other orders
+}
+
+// lockStock locks the products the lines take out of stock and returns the
+// ones there is not enough of once other orders' reservations are held back;
+// orderID's own do not count. Lines must come from expandBundles, so rows
+// are locked in product ID order.
+func lockStock(ctx context.Context, q querier, lines []stockLine, orderID int) ([]shortItem, error) {
+	ids := make([]int, 0, len(lines))
+	for _, l := range lines {
+		ids = append(ids, l.ProductID)
+	}
+
+	rows, err := q.Query(ctx, `
+		SELECT id, name, unit, quantity, COALESCE((
+			SELECT SUM(r.quantity) FROM stock_reservations r
+			WHERE r.product_id = products.id AND r.order_id <> $2
+			  AND (r.expires_at IS NULL OR r.expires_at > NOW())
+		), 0)
+		FROM products WHERE id = ANY($1) ORDER BY id FOR UPDATE
+	`, ids, orderID)
+	if err != nil {
+		return nil, err
+	}
+	stock := map[int]shortItem{}
+	for rows.Next() {
+		var s shortItem
+		var onHand float64
+		if err := rows.Scan(&s.ProductID, &s.Name, &s.Unit, &onHand, &s.Reserved); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.Available = units.Round(onHand-s.Reserved, units.MaxPrecision)
+		stock[s.ProductID] = s
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	short := []shortItem{}
+	for _, l := range lines {
+		s, ok := stock[l.ProductID]
+		if !ok {
+			s = shortItem{ProductID: l.ProductID}
+		}
+		s.Requested = units.Round(l.Quantity, units.MaxPrecision)
+		if s.Available < s.Requested {
+			short = append(short, s)
+		}
+	}
+	return short, nil
+}
+
+// takenStock is what takeStock took out of stock
+type takenStock struct {
+	Short       []shortItem // set when nothing was taken
+	Costs       []float64   // cost of goods of each sold line
+	CostOfGoods float64
+	ProductIDs  []int // whose stock changed
+}
+
+// takeStock takes sold lines out of stock, all or nothing. It is the one
+// path stock leaves by, for paid orders and till sales alike: packaging
+// units are converted, bundles expanded, the products locked and checked
+// against what other orders hold, the lines valued before the stock leaves,
+// and every change recorded as a sale movement of orderID or saleID. When
+// anything is short, Short lists it and nothing changes.
+func takeStock(ctx context.Context, tx pgx.Tx, companyID int, lines []stockLine, orderID, saleID *int) (*takenStock, error) {
+	sold, err := toBaseUnits(ctx, tx, lines)
+	if err != nil {
+		return nil, err
+	}
+	parts, err := expandBundles(ctx, tx, sold)
+	if err != nil {
+		return nil, err
+	}
+
+	holder := 0
+	if orderID != nil {
+		holder = *orderID
+	}
+	short, err := lockStock(ctx, tx, parts, holder)
+	if err != nil || len(short) > 0 {
+		return &takenStock{Short: short}, err
+	}
+
+	coster, err := newStockCoster(ctx, tx, companyID)
+	if err != nil {
+		return nil, err
+	}
+	taken := &takenStock{Costs: make([]float64, len(sold)), ProductIDs: make([]int, 0, len(parts))}
+	for i, line := range sold {
+		if taken.Costs[i], err = coster.lineCost(ctx, line); err != nil {
+			return nil, err
+		}
+		taken.CostOfGoods += taken.Costs[i]
+	}
+
+	for _, part := range parts {
+		if _, err := tx.Exec(ctx, `
+			UPDATE products SET quantity = quantity - $1, updated_at = NOW() WHERE id = $2
+		`, part.Quantity, part.ProductID); err != nil {
+			return nil, err
+		}
+		if err := recordStockMovement(ctx, tx, part.ProductID, -part.Quantity, movementSale, orderID, saleID, nil); err != nil {
+			return nil, err
+		}
+		taken.ProductIDs = append(taken.ProductIDs, part.ProductID)
+	}
+
+	// Sales are counted per product sold, a bundle as itself, for the best-selling sort
+	for _, line := range sold {
+		if _, err := tx.Exec(ctx, `
+			UPDATE products SET sold_quantity = sold_quantity + $1 WHERE id = $2
+		`, line.Quantity, line.ProductID); err != nil {
+			return nil, err
+		}
+	}
+	return taken, nil
+}
+
+// GetStockMovements returns the latest changes to a product's stock
+func GetStockMovements(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+		limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if limit <= 0 || limit > 500 {
+			limit = 100
+		}
+
+		var quantity float64
+		err = db.QueryRow(ctx, `SELECT quantity FROM products WHERE id = $1`, id).Scan(&quantity)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, reason, quantity, quantity_after, order_id, sale_id, receipt_id, created_at
+			FROM stock_movements WHERE product_id = $1
+			ORDER BY created_at DESC, id DESC
+			LIMIT $2
+		`, id, limit)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		movements := []models.StockMovement{}
+		for rows.Next() {
+			var m models.StockMovement
+			if err := rows.Scan(&m.ID, &m.Reason, &m.Quantity, &m.QuantityAfter, &m.OrderID, &m.SaleID, &m.ReceiptID,
+				&m.CreatedAt); err != nil {
+				continue
+			}
+			movements = append(movements, m)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"product_id": id, "quantity": quantity, "movements": movements})
+	}
+}
@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"azaton-backend/internal/events"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamHeartbeat keeps idle streams open through proxies
+const streamHeartbeat = 25 * time.Second
+
+// StreamEvents streams the product, stock and order events of a company as
+// Server-Sent Events. Without company_id every company's events are sent.
+// Missed events are not replayed: after a reconnect, or a resync event, the
+// client reloads or catches up through /products/changes.
+func StreamEvents(broker *events.Broker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		companyID := 0
+		if companyIDStr := c.Query("company_id"); companyIDStr != "" {
+			var err error
+			if companyID, err = strconv.Atoi(companyIDStr); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid company_id"})
+				return
+			}
+		}
+
+		// The server's write timeout would cut the stream off
+		http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{})
+
+		sub := broker.Subscribe(companyID)
+		defer sub.Close()
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+		fmt.Fprint(c.Writer, "retry: 3000\n\n")
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				return
+			case ev, ok := <-sub.C:
+				if !ok {
+					// Dropped for falling behind, or the server is shutting down
+					fmt.Fprintf(c.Writer, "event: %s\ndata: {}\n\n", events.Resync)
+					c.Writer.Flush()
+					return
+				}
+				data, _ := json.Marshal(ev)
+				fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", ev.Type, data)
+			case <-heartbeat.C:
+				fmt.Fprint(c.Writer, ": ping\n\n")
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// publishProducts tells clients that products changed, one event per company.
+// Each entry carries the product's version, stock and available stock, so a
+// client can update stock in place and fetch the rest through /products/changes.
+func publishProducts(ctx context.Context, q querier, eventType string, ids []int) {
+	if len(ids) == 0 {
+		return
+	}
+	rows, err := q.Query(ctx, `
+		SELECT company_id, json_agg(json_build_object(
+			'id', id, 'version', version, 'quantity', `+productQuantitySQL+`,
+			'available_quantity', `+productAvailableSQL+`) ORDER BY id)
+		FROM (
+			SELECT *, (row_number() OVER (PARTITION BY company_id ORDER BY id) - 1) / $2 AS chunk
+			FROM products WHERE id = ANY($1)
+		) products
+		GROUP BY company_id, chunk
+	`, ids, productsPerEvent)
+	if err != nil {
+		log.Printf("Publishing %s failed: %v", eventType, err)
+		return
+	}
+	type batch struct {
+		companyID int
+		products  json.RawMessage
+	}
+	var batches []batch
+	for rows.Next() {
+		var b batch
+		if err := rows.Scan(&b.companyID, &b.products); err == nil {
+			batches = append(batches, b)
+		}
+	}
+	rows.Close()
+
+	for _, b := range batches {
+		publish(ctx, q, eventType, b.companyID, gin.H{"products": b.products})
+	}
+}
+
+// productsPerEvent keeps a product event within the NOTIFY payload limit
+const productsPerEvent = 80
+
+// publishCompanyProducts tells clients that many products of a company
+// changed at once, without listing them
+func publishCompanyProducts(ctx context.Context, q querier, companyID int) {
+	publish(ctx, q, events.ProductUpdated, companyID, gin.H{"all": true})
+}
+
+// publish sends an event, logging instead of failing the request
+func publish(ctx context.Context, q querier, eventType string, companyID int, data interface{}) {
+	if err := events.Publish(ctx, q, eventType, companyID, data); err != nil {
+		log.Printf("Publishing %s failed: %v", eventType, err)
+	}
+}
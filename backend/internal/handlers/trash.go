@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"azaton-backend/internal/config"
+	"azaton-backend/internal/events"
+	"azaton-backend/internal/storage"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// How long a bulk delete confirmation token stays valid
+const deleteConfirmationTTL = 5 * time.Minute
+
+// Rows hard-deleted per purge transaction
+const trashPurgeBatch = 500
+
+// GetDeletedProducts returns the products of a company that are in the trash
+func GetDeletedProducts(db *pgxpool.Pool, cfg *config.Config, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		companyID, err := strconv.Atoi(c.Query("company_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "company_id is required"})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, name, quantity, unit, selling_price, barcode, category, images, deleted_at
+			FROM products
+			WHERE company_id = $1 AND deleted_at IS NOT NULL
+			ORDER BY deleted_at DESC, id DESC
+		`, companyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		products := []map[string]interface{}{}
+		for rows.Next() {
+			var id int
+			var quantity, sellingPrice float64
+			var name, unit, category string
+			var barcode *string
+			var imagesJSON []byte
+			var deletedAt time.Time
+
+			if err := rows.Scan(&id, &name, &quantity, &unit, &sellingPrice, &barcode, &category,
+				&imagesJSON, &deletedAt); err != nil {
+				continue
+			}
+
+			products = append(products, map[string]interface{}{
+				"id":            id,
+				"name":          name,
+				"quantity":      quantity,
+				"unit":          unit,
+				"selling_price": sellingPrice,
+				"barcode":       barcode,
+				"category":      category,
+				"images":        decodeImages(ctx, store, cfg.SignedURLTTL, imagesJSON),
+				"deleted_at":    deletedAt,
+				"purge_at":      deletedAt.Add(cfg.TrashRetention),
+			})
+		}
+
+		c.JSON(http.StatusOK, gin.H{"products": products})
+	}
+}
+
+// RestoreProduct takes a product out of the trash
+func RestoreProduct(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var companyID int
+		var barcode *string
+		var companyDeleted bool
+		err = tx.QueryRow(ctx, `
+			SELECT p.company_id, p.barcode, c.deleted_at IS NOT NULL
+			FROM products p JOIN companies c ON c.id = p.company_id
+			WHERE p.id = $1 AND p.deleted_at IS NOT NULL
+			FOR UPDATE OF p
+		`, id).Scan(&companyID, &barcode, &companyDeleted)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found in trash"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if companyDeleted {
+			c.JSON(http.StatusConflict, gin.H{"error": "The company is in the trash; restore the company instead"})
+			return
+		}
+
+		// The barcode may have been given to another product in the meantime
+		if barcode != nil && *barcode != "" {
+			taken, err := barcodeTaken(ctx, tx, companyID, *barcode, id)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if taken {
+				c.JSON(http.StatusConflict, gin.H{"error": "Barcode " + *barcode + " is used by another product"})
+				return
+			}
+		}
+
+		_, err = tx.Exec(ctx, `UPDATE products SET deleted_at = NULL, updated_at = NOW() WHERE id = $1`, id)
+		if err == nil {
+			// Back in the catalog, so to clients it is a new product
+			publishProducts(ctx, tx, events.ProductCreated, []int{id})
+			err = tx.Commit(ctx)
+		}
+		if isBarcodeTaken(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": errBarcodeTaken.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// PurgeProduct permanently deletes a product from the trash, with its images.
+// A component of a bundle still in the catalog is kept.
+func PurgeProduct(db *pgxpool.Pool, store storage.Storage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var found bool
+		var bundles []int
+		err = tx.QueryRow(ctx, `
+			SELECT true, ARRAY(
+				SELECT b.id FROM product_bundle_items bi JOIN products b ON b.id = bi.bundle_id
+				WHERE bi.component_id = p.id AND b.deleted_at IS NULL ORDER BY b.id
+			)
+			FROM products p WHERE p.id = $1 AND p.deleted_at IS NOT NULL
+			FOR UPDATE OF p
+		`, id).Scan(&found, &bundles)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found in trash"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// Purging would take the product out of these bundles for good
+		if len(bundles) > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":      "The product is a component of bundles still in the catalog; remove it from them or trash them first",
+				"bundle_ids": bundles,
+			})
+			return
+		}
+
+		var imagesJSON []byte
+		err = tx.QueryRow(ctx, `DELETE FROM products WHERE id = $1 RETURNING images`, id).Scan(&imagesJSON)
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		deleteImageFiles(ctx, store, imagesJSON)
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// PrepareBulkDelete counts the products a bulk delete would move to the trash and
+// issues a short-lived token for exactly that selection. Without product_ids
+// every product of the company is selected.
+func PrepareBulkDelete(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input struct {
+			CompanyID  int   `json:"company_id" binding:"required"`
+			ProductIDs []int `json:"product_ids"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var ids []int
+		err := db.QueryRow(ctx, `
+			SELECT COALESCE(array_agg(id ORDER BY id), '{}')
+			FROM products
+			WHERE company_id = $1 AND deleted_at IS NULL
+			  AND (COALESCE(cardinality($2::int[]), 0) = 0 OR id = ANY($2))
+		`, input.CompanyID, input.ProductIDs).Scan(&ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(ids) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No products to delete"})
+			return
+		}
+
+		buf := make([]byte, 24)
+		if _, err := rand.Read(buf); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		token := hex.EncodeToString(buf)
+		expiresAt := time.Now().Add(deleteConfirmationTTL).UTC()
+
+		_, err = db.Exec(ctx, `
+			INSERT INTO delete_confirmations (token, company_id, product_ids, product_count, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, token, input.CompanyID, ids, len(ids), expiresAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success":    true,
+			"token":      token,
+			"count":      len(ids),
+			"expires_at": expiresAt,
+		})
+	}
+}
+
+// BulkDeleteProducts moves the products selected by PrepareBulkDelete to the trash.
+// A token can be used once, and only before it expires.
+func BulkDeleteProducts(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var input struct {
+			CompanyID int    `json:"company_id" binding:"required"`
+			Token     string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var ids []int
+		var expiresAt time.Time
+		var usedAt *time.Time
+		err = tx.QueryRow(ctx, `
+			SELECT product_ids, expires_at, used_at FROM delete_confirmations
+			WHERE token = $1 AND company_id = $2
+			FOR UPDATE
+		`, input.Token, input.CompanyID).Scan(&ids, &expiresAt, &usedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invalid confirmation token"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if usedAt != nil {
+			c.JSON(http.StatusGone, gin.H{"error": "Confirmation token was already used"})
+			return
+		}
+		if time.Now().After(expiresAt) {
+			c.JSON(http.StatusGone, gin.H{"error": "Confirmation token has expired"})
+			return
+		}
+
+		tag, err := tx.Exec(ctx, `
+			UPDATE products SET deleted_at = NOW()
+			WHERE company_id = $1 AND id = ANY($2) AND deleted_at IS NULL
+		`, input.CompanyID, ids)
+		if err == nil {
+			err = releaseProductReservations(ctx, tx, ids)
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE delete_confirmations SET used_at = NOW() WHERE token = $1`, input.Token)
+		}
+		if err == nil {
+			publishProducts(ctx, tx, events.ProductDeleted, ids)
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "deleted": tag.RowsAffected()})
+	}
+}
+
+// purgeProductBatch hard-deletes one batch of products trashed before cutoff
+// and returns how many were deleted. Components of bundles still in the
+// catalog are kept until the bundles go.
+func purgeProductBatch(ctx context.Context, db *pgxpool.Pool, store storage.Storage, cutoff time.Time) (int, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	// SKIP LOCKED lets several instances purge side by side
+	rows, err := tx.Query(ctx, `
+		DELETE FROM products WHERE id IN (
+			SELECT id FROM products
+			WHERE deleted_at < $1 AND NOT EXISTS (
+				SELECT 1 FROM product_bundle_items bi JOIN products b ON b.id = bi.bundle_id
+				WHERE bi.component_id = products.id AND b.deleted_at IS NULL
+			)
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING images
+	`, cutoff, trashPurgeBatch)
+	if err != nil {
+		return 0, err
+	}
+	images, err := collectImages(rows)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	deleteImageFiles(ctx, store, images...)
+	return len(images), nil
+}
+
+// purgeTrash permanently deletes products and companies trashed longer than retention.
+// A company's products are trashed no later than the company itself, so they
+// (and their images) are always purged first.
+func purgeTrash(ctx context.Context, db *pgxpool.Pool, store storage.Storage, retention time.Duration) (int, int, error) {
+	cutoff := time.Now().Add(-retention)
+
+	products := 0
+	for {
+		n, err := purgeProductBatch(ctx, db, store, cutoff)
+		if err != nil {
+			return products, 0, err
+		}
+		products += n
+		if n < trashPurgeBatch {
+			break
+		}
+	}
+
+	tag, err := db.Exec(ctx, `DELETE FROM companies WHERE deleted_at < $1`, cutoff)
+	if err != nil {
+		return products, 0, err
+	}
+	return products, int(tag.RowsAffected()), nil
+}
+
+// RunTrashPurge purges expired trash every interval until ctx is cancelled
+func RunTrashPurge(ctx context.Context, db *pgxpool.Pool, store storage.Storage, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		products, companies, err := purgeTrash(ctx, db, store, retention)
+		if err != nil {
+			log.Printf("Trash purge failed: %v", err)
+		}
+		if products > 0 || companies > 0 {
+			log.Printf("Trash purge: deleted %d products and %d companies", products, companies)
+		}
+
+		// Used and expired confirmation tokens are of no further use
+		db.Exec(ctx, `DELETE FROM delete_confirmations WHERE expires_at < NOW() - INTERVAL '1 day'`)
+	}
+}
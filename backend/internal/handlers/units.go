@@ -0,0 +1,269 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"azaton-backend/internal/barcode"
+	"azaton-backend/internal/models"
+	"azaton-backend/internal/units"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// errUnknownUnit is returned for a line in a unit the product is not sold in
+var errUnknownUnit = errors.New("unknown unit")
+
+// toBaseUnits converts lines given in a packaging unit to the product's base unit.
+// Naming the base unit itself is the same as leaving Unit empty.
+func toBaseUnits(ctx context.Context, q querier, lines []stockLine) ([]stockLine, error) {
+	var ids []int
+	for _, l := range lines {
+		if l.Unit != "" {
+			ids = append(ids, l.ProductID)
+		}
+	}
+	if len(ids) == 0 {
+		return lines, nil
+	}
+
+	rows, err := q.Query(ctx, `
+		SELECT p.id, p.unit, pu.name, pu.factor
+		FROM products p LEFT JOIN product_units pu ON pu.product_id = p.id
+		WHERE p.id = ANY($1)
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	factors := map[int]map[string]float64{}
+	for rows.Next() {
+		var id int
+		var base string
+		var name *string
+		var factor *float64
+		if err := rows.Scan(&id, &base, &name, &factor); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if factors[id] == nil {
+			factors[id] = map[string]float64{base: 1}
+		}
+		if name != nil && factor != nil {
+			factors[id][*name] = *factor
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	converted := make([]stockLine, 0, len(lines))
+	for _, l := range lines {
+		if l.Unit != "" {
+			factor, ok := factors[l.ProductID][l.Unit]
+			if !ok {
+				return nil, fmt.Errorf("%w %q for product %d", errUnknownUnit, l.Unit, l.ProductID)
+			}
+			l.Quantity = units.Round(l.Quantity*factor, units.MaxPrecision)
+			l.Unit = ""
+		}
+		converted = append(converted, l)
+	}
+	return converted, nil
+}
+
+// findUnitByCode finds the packaging unit of a company product with the given barcode
+func findUnitByCode(ctx context.Context, db *pgxpool.Pool, companyID int, code string) (*models.ProductUnit, error) {
+	var u models.ProductUnit
+	err := db.QueryRow(ctx, `
+		SELECT pu.id, pu.product_id, pu.name, pu.factor, pu.barcode, pu.created_at
+		FROM product_units pu JOIN products p ON p.id = pu.product_id
+		WHERE pu.barcode = $1 AND p.company_id = $2 AND p.deleted_at IS NULL
+		ORDER BY pu.id DESC LIMIT 1
+	`, code, companyID).Scan(&u.ID, &u.ProductID, &u.Name, &u.Factor, &u.Barcode, &u.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetProductUnits returns the base unit of a product and its packaging units
+func GetProductUnits(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		var unit string
+		var precision int
+		err = db.QueryRow(ctx, `
+			SELECT unit, quantity_precision FROM products WHERE id = $1 AND deleted_at IS NULL
+		`, productID).Scan(&unit, &precision)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+
+		rows, err := db.Query(ctx, `
+			SELECT id, product_id, name, factor, barcode, created_at
+			FROM product_units WHERE product_id = $1
+			ORDER BY factor
+		`, productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer rows.Close()
+
+		packaging := []models.ProductUnit{}
+		for rows.Next() {
+			var u models.ProductUnit
+			if err := rows.Scan(&u.ID, &u.ProductID, &u.Name, &u.Factor, &u.Barcode, &u.CreatedAt); err != nil {
+				continue
+			}
+			packaging = append(packaging, u)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"unit":               unit,
+			"quantity_precision": precision,
+			"units":              packaging,
+		})
+	}
+}
+
+// SaveProductUnit creates a packaging unit of a product, or replaces the one with the same name
+func SaveProductUnit(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+
+		var input struct {
+			Name    string  `json:"name" binding:"required"`
+			Factor  float64 `json:"factor" binding:"required"`
+			Barcode *string `json:"barcode"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		input.Name = strings.TrimSpace(input.Name)
+		if input.Barcode != nil {
+			code := strings.TrimSpace(*input.Barcode)
+			input.Barcode = &code
+			if code == "" {
+				input.Barcode = nil
+			} else if err := barcode.Validate(code); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid barcode"})
+				return
+			}
+		}
+
+		var companyID, precision int
+		var unit string
+		err = db.QueryRow(ctx, `
+			SELECT company_id, unit, quantity_precision FROM products WHERE id = $1 AND deleted_at IS NULL
+		`, productID).Scan(&companyID, &unit, &precision)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+			return
+		}
+
+		if input.Name == "" || input.Name == unit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name must differ from the product's base unit"})
+			return
+		}
+		// A box of pieces holds a whole number of them
+		if input.Factor <= 0 || units.Validate(input.Factor, precision) != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("factor must be a positive number of %s with at most %d decimal places", unit, precision),
+			})
+			return
+		}
+
+		// The barcode must not already identify another product or unit of the company
+		if input.Barcode != nil {
+			var taken bool
+			err = db.QueryRow(ctx, `
+				SELECT EXISTS(
+					SELECT 1 FROM products WHERE company_id = $1 AND barcode = $2 AND deleted_at IS NULL
+				) OR EXISTS(
+					SELECT 1 FROM product_units pu JOIN products p ON p.id = pu.product_id
+					WHERE p.company_id = $1 AND pu.barcode = $2 AND NOT (pu.product_id = $3 AND pu.name = $4)
+				)
+			`, companyID, *input.Barcode, productID, input.Name).Scan(&taken)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if taken {
+				c.JSON(http.StatusConflict, gin.H{"error": "Barcode is already used"})
+				return
+			}
+		}
+
+		var u models.ProductUnit
+		err = db.QueryRow(ctx, `
+			INSERT INTO product_units (product_id, name, factor, barcode)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (product_id, name) DO UPDATE SET factor = EXCLUDED.factor, barcode = EXCLUDED.barcode
+			RETURNING id, product_id, name, factor, barcode, created_at
+		`, productID, input.Name, input.Factor, input.Barcode).Scan(&u.ID, &u.ProductID, &u.Name,
+			&u.Factor, &u.Barcode, &u.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "unit": u})
+	}
+}
+
+// DeleteProductUnit removes a packaging unit of a product
+func DeleteProductUnit(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		productID, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid product ID"})
+			return
+		}
+		unitID, err := strconv.Atoi(c.Param("unitId"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid unit ID"})
+			return
+		}
+
+		tag, err := db.Exec(ctx, `DELETE FROM product_units WHERE id = $1 AND product_id = $2`, unitID, productID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if tag.RowsAffected() == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Unit not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	}
+}
+
+// validateUnit checks a product's unit and quantity precision settings
+func validateUnit(unit string, precision int) error {
+	if !units.Known(unit) {
+		return fmt.Errorf("unit must be one of %s", strings.Join(units.Codes, ", "))
+	}
+	return units.ValidatePrecision(precision)
+}
@@ -2,9 +2,14 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -127,15 +132,107 @@ func GetUserByPhone(db *pgxpool.Pool) gin.HandlerFunc {
 	}
 }
 
-// DeleteAllUsers deletes all users
+// PrepareDeleteAllUsers issues a short-lived token for deleting every user
+// there is now. DeleteAllUsers only deletes with it.
+func PrepareDeleteAllUsers(db *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+
+		var ids []int
+		err := db.QueryRow(ctx, `SELECT COALESCE(array_agg(id ORDER BY id), '{}') FROM users`).Scan(&ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(ids) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No users to delete"})
+			return
+		}
+
+		buf := make([]byte, 24)
+		if _, err := rand.Read(buf); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		token := hex.EncodeToString(buf)
+		expiresAt := time.Now().Add(deleteConfirmationTTL).UTC()
+
+		_, err = db.Exec(ctx, `
+			INSERT INTO user_delete_confirmations (token, user_ids, user_count, expires_at)
+			VALUES ($1, $2, $3, $4)
+		`, token, ids, len(ids), expiresAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"success":    true,
+			"token":      token,
+			"count":      len(ids),
+			"expires_at": expiresAt,
+		})
+	}
+}
+
+// DeleteAllUsers deletes the users selected by PrepareDeleteAllUsers. A token
+// can be used once, and only before it expires.
 func DeleteAllUsers(db *pgxpool.Pool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx := context.Background()
-		_, err := db.Exec(ctx, "DELETE FROM users")
+
+		var input struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tx, err := db.Begin(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback(ctx)
+
+		var ids []int
+		var expiresAt time.Time
+		var usedAt *time.Time
+		err = tx.QueryRow(ctx, `
+			SELECT user_ids, expires_at, used_at FROM user_delete_confirmations
+			WHERE token = $1
+			FOR UPDATE
+		`, input.Token).Scan(&ids, &expiresAt, &usedAt)
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invalid confirmation token"})
+			return
+		}
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"success": true})
+		if usedAt != nil {
+			c.JSON(http.StatusGone, gin.H{"error": "Confirmation token was already used"})
+			return
+		}
+		if time.Now().After(expiresAt) {
+			c.JSON(http.StatusGone, gin.H{"error": "Confirmation token has expired"})
+			return
+		}
+
+		tag, err := tx.Exec(ctx, `DELETE FROM users WHERE id = ANY($1)`, ids)
+		if err == nil {
+			_, err = tx.Exec(ctx, `UPDATE user_delete_confirmations SET used_at = NOW() WHERE token = $1`, input.Token)
+		}
+		if err == nil {
+			err = tx.Commit(ctx)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "deleted": tag.RowsAffected()})
 	}
 }
@@ -0,0 +1,159 @@
+// Package imaging validates uploaded images and re-encodes them into the sizes
+// served to the apps. Re-encoding drops all metadata, including EXIF GPS tags.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"github.com/HugoSmits86/nativewebp"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // registers the WebP decoder
+)
+
+var (
+	ErrUnsupported = errors.New("file is not a JPEG, PNG, GIF or WebP image")
+	ErrTooLarge    = errors.New("image dimensions are too large")
+)
+
+// MaxPixels guards against decompression bombs: a small file declaring a huge canvas
+const MaxPixels = 50_000_000
+
+// Size is a stored variant, scaled so its longer side is at most MaxSide
+type Size struct {
+	Name    string
+	MaxSide int
+}
+
+// Sizes are the stored variants of every product image
+var Sizes = []Size{
+	{Name: "thumb", MaxSide: 200},
+	{Name: "card", MaxSide: 600},
+	{Name: "full", MaxSide: 1600},
+}
+
+const jpegQuality = 85
+
+// Variant is one encoded size of an image
+type Variant struct {
+	Size   string
+	Width  int
+	Height int
+	Ext    string // "jpg" or "png"
+	Data   []byte
+	WebP   []byte
+}
+
+// Sniff returns the image format from the file content, ignoring the file name
+func Sniff(data []byte) (string, error) {
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		return "jpeg", nil
+	case "image/png":
+		return "png", nil
+	case "image/gif":
+		return "gif", nil
+	case "image/webp":
+		return "webp", nil
+	}
+	return "", ErrUnsupported
+}
+
+// Process validates an upload and returns it in all Sizes. Opaque images are
+// stored as JPEG, images with transparency as PNG; each also gets a WebP copy.
+func Process(data []byte) ([]Variant, error) {
+	format, err := Sniff(data)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	var src image.Image
+	if format == "gif" {
+		// Animated GIFs are stored as their first frame
+		src, err = gif.Decode(bytes.NewReader(data))
+	} else {
+		src, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+
+	if format == "jpeg" {
+		src = applyOrientation(src, jpegOrientation(data))
+	}
+
+	opaque := isOpaque(src)
+	variants := make([]Variant, 0, len(Sizes))
+	for _, size := range Sizes {
+		img := resize(src, size.MaxSide)
+		b := img.Bounds()
+		v := Variant{Size: size.Name, Width: b.Dx(), Height: b.Dy()}
+
+		var buf bytes.Buffer
+		if opaque {
+			v.Ext = "jpg"
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			v.Ext = "png"
+			err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+		}
+		if err != nil {
+			return nil, err
+		}
+		v.Data = buf.Bytes()
+
+		var webpBuf bytes.Buffer
+		if err := nativewebp.Encode(&webpBuf, img, nil); err != nil {
+			return nil, err
+		}
+		v.WebP = webpBuf.Bytes()
+
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// resize scales img down so its longer side is at most maxSide. Smaller images
+// are copied unscaled, so the result is always a fresh *image.NRGBA.
+func resize(img image.Image, maxSide int) *image.NRGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			h = max(1, h*maxSide/w)
+			w = maxSide
+		} else {
+			w = max(1, w*maxSide/h)
+			h = maxSide
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	if w == b.Dx() && h == b.Dy() {
+		draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	} else {
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, xdraw.Src, nil)
+	}
+	return dst
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package labels
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"azaton-backend/internal/barcode"
+	"azaton-backend/internal/units"
+)
+
+// Label is one price tag: product name, selling price and barcode
+type Label struct {
+	Name    string
+	Price   float64
+	Unit    string // price is per unit; empty or "pcs" prints no unit
+	Barcode string
+}
+
+// PriceText is the price as printed on the tag: "12 500 so'm" or "48 000 so'm / kg"
+func (l Label) PriceText() string {
+	if l.Unit == "" || l.Unit == units.Piece {
+		return FormatPrice(l.Price)
+	}
+	return FormatPrice(l.Price) + " / " + l.Unit
+}
+
+// Sheet describes a grid of labels on an A4 page, all sizes in millimetres
+type Sheet struct {
+	Columns     int     `json:"columns"`
+	Rows        int     `json:"rows"`
+	LabelWidth  float64 `json:"label_width"`
+	LabelHeight float64 `json:"label_height"`
+	MarginLeft  float64 `json:"margin_left"`
+	MarginTop   float64 `json:"margin_top"`
+}
+
+// DefaultSheet is the common 3×8 sheet of 70×37 mm self-adhesive labels
+var DefaultSheet = Sheet{Columns: 3, Rows: 8, LabelWidth: 70, LabelHeight: 37, MarginLeft: 0, MarginTop: 0.5}
+
+// Thermal describes a single label on a roll for a ZPL printer
+type Thermal struct {
+	Width  float64 `json:"width"`  // mm
+	Height float64 `json:"height"` // mm
+	DPMM   int     `json:"dpmm"`   // dots per mm: 8 for 203 dpi, 12 for 300 dpi
+}
+
+// DefaultThermal is a 58×40 mm label on a 203 dpi printer
+var DefaultThermal = Thermal{Width: 58, Height: 40, DPMM: 8}
+
+// FormatPrice formats an amount in soum with space-separated thousands: "12 500 so'm"
+func FormatPrice(price float64) string {
+	s := strconv.FormatInt(int64(math.Round(price)), 10)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(r)
+	}
+
+	if neg {
+		return "-" + b.String() + " so'm"
+	}
+	return b.String() + " so'm"
+}
+
+// printableEAN13 returns the code as an EAN-13 if it can be drawn as one (UPC-A is zero-padded)
+func printableEAN13(code string) (string, bool) {
+	if len(code) == 12 && barcode.IsDigits(code) {
+		code = "0" + code
+	}
+	return code, barcode.ValidEAN13(code)
+}
+
+// ZPL writes one ZPL label per tag for thermal printers. Names are sent as
+// UTF-8 (^CI28), so Cyrillic and Uzbek text print with a Unicode printer font.
+func ZPL(w io.Writer, tags []Label, t Thermal, copies int) error {
+	if copies < 1 {
+		copies = 1
+	}
+	dots := func(mm float64) int { return int(math.Round(mm * float64(t.DPMM))) }
+	width, height := dots(t.Width), dots(t.Height)
+	pad := dots(2)
+
+	for _, tag := range tags {
+		var b strings.Builder
+		b.WriteString("^XA\n^CI28\n")
+		fmt.Fprintf(&b, "^PW%d\n^LL%d\n", width, height)
+		fmt.Fprintf(&b, "^FO%d,%d^A0N,%d,%d^FB%d,2,0,L^FD%s^FS\n",
+			pad, pad, dots(3), dots(3), width-2*pad, zplText(tag.Name))
+		fmt.Fprintf(&b, "^FO%d,%d^A0N,%d,%d^FD%s^FS\n",
+			pad, pad+dots(7), dots(5), dots(5), zplText(tag.PriceText()))
+
+		if tag.Barcode != "" {
+			barY := pad + dots(14)
+			barH := height - barY - dots(5)
+			if code, ok := printableEAN13(tag.Barcode); ok {
+				// ^BE computes the check digit itself from the first 12 digits
+				fmt.Fprintf(&b, "^FO%d,%d^BY2^BEN,%d,Y,N^FD%s^FS\n", pad+dots(2), barY, barH, code[:12])
+			} else {
+				fmt.Fprintf(&b, "^FO%d,%d^BY2^BCN,%d,Y,N,N^FD%s^FS\n", pad, barY, barH, zplText(tag.Barcode))
+			}
+		}
+
+		fmt.Fprintf(&b, "^PQ%d\n^XZ\n", copies)
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zplText removes the ZPL command prefixes from field data
+func zplText(s string) string {
+	return strings.NewReplacer("^", " ", "~", " ", "\n", " ").Replace(s)
+}
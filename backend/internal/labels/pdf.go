@@ -0,0 +1,246 @@
+package labels
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"azaton-backend/internal/barcode"
+)
+
+const (
+	mmToPt      = 72 / 25.4
+	a4Width     = 210.0
+	a4Height    = 297.0
+	fontRegular = "F1"
+	fontBold    = "F2"
+)
+
+// PDF writes the tags as A4 label sheets. Each tag is repeated copies times.
+//
+// The document uses the standard Helvetica font, so no font files are needed;
+// Cyrillic names are transliterated to Latin, which every shop can read.
+func PDF(w io.Writer, tags []Label, sheet Sheet, copies int) error {
+	if copies < 1 {
+		copies = 1
+	}
+	if sheet.Columns < 1 || sheet.Rows < 1 || sheet.LabelWidth <= 0 || sheet.LabelHeight <= 0 {
+		sheet = DefaultSheet
+	}
+
+	var all []Label
+	for _, tag := range tags {
+		for i := 0; i < copies; i++ {
+			all = append(all, tag)
+		}
+	}
+
+	perPage := sheet.Columns * sheet.Rows
+	var pages [][]byte
+	for start := 0; start < len(all); start += perPage {
+		end := start + perPage
+		if end > len(all) {
+			end = len(all)
+		}
+
+		var content bytes.Buffer
+		for i, tag := range all[start:end] {
+			col, row := i%sheet.Columns, i/sheet.Columns
+			x := sheet.MarginLeft + float64(col)*sheet.LabelWidth
+			y := sheet.MarginTop + float64(row)*sheet.LabelHeight
+			drawLabel(&content, tag, x, y, sheet.LabelWidth, sheet.LabelHeight)
+		}
+		pages = append(pages, content.Bytes())
+	}
+	if len(pages) == 0 {
+		pages = append(pages, nil)
+	}
+
+	return writePDF(w, pages)
+}
+
+// drawLabel renders one tag whose top-left corner is at (x, y) mm from the page's top-left
+func drawLabel(b *bytes.Buffer, tag Label, x, y, width, height float64) {
+	const pad = 2.5
+	inner := width - 2*pad
+
+	// Name: up to two lines at 8pt
+	nameSize := 8.0
+	lines := wrapText(pdfText(tag.Name), inner, nameSize, 2)
+	for i, line := range lines {
+		text(b, fontRegular, nameSize, x+pad, y+pad+3+float64(i)*3.4, line)
+	}
+
+	// Price: bold, 14pt
+	text(b, fontBold, 14, x+pad, y+pad+13, pdfText(tag.PriceText()))
+
+	if tag.Barcode == "" {
+		return
+	}
+
+	barTop := y + pad + 16
+	barHeight := height - (barTop - y) - pad - 3
+	if code, ok := printableEAN13(tag.Barcode); ok && barHeight > 4 {
+		modules, _ := barcode.EncodeEAN13(code)
+		module := inner / float64(len(modules)+8)
+		left := x + pad + 4*module
+
+		b.WriteString("0 g\n")
+		for i := 0; i < len(modules); {
+			if modules[i] != '1' {
+				i++
+				continue
+			}
+			j := i
+			for j < len(modules) && modules[j] == '1' {
+				j++
+			}
+			rect(b, left+float64(i)*module, barTop, float64(j-i)*module, barHeight)
+			i = j
+		}
+		text(b, fontRegular, 7, left, barTop+barHeight+2.6, code)
+		return
+	}
+
+	// Codes that are not EAN-13 are printed as text only
+	text(b, fontRegular, 9, x+pad, barTop+4, pdfText(tag.Barcode))
+}
+
+// text writes a single line with its baseline at (x, y) mm from the page's top-left
+func text(b *bytes.Buffer, font string, size, x, y float64, s string) {
+	fmt.Fprintf(b, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n",
+		font, size, x*mmToPt, (a4Height-y)*mmToPt, escapePDF(s))
+}
+
+// rect fills a rectangle whose top-left corner is at (x, y) mm from the page's top-left
+func rect(b *bytes.Buffer, x, y, w, h float64) {
+	fmt.Fprintf(b, "%.3f %.3f %.3f %.3f re f\n",
+		x*mmToPt, (a4Height-y-h)*mmToPt, w*mmToPt, h*mmToPt)
+}
+
+// wrapText splits s into at most maxLines lines fitting width mm, using an
+// average Helvetica glyph width; the last line is cut with an ellipsis
+func wrapText(s string, width, size float64, maxLines int) []string {
+	perLine := int(width / (size * 0.5 / mmToPt))
+	if perLine < 1 {
+		perLine = 1
+	}
+
+	var lines []string
+	words := strings.Fields(s)
+	line := ""
+	for len(words) > 0 && len(lines) < maxLines {
+		word := words[0]
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if len(candidate) <= perLine {
+			line = candidate
+			words = words[1:]
+			continue
+		}
+		if line == "" {
+			// A single word longer than a line is cut
+			line = word[:perLine]
+			words[0] = word[perLine:]
+		}
+		lines = append(lines, line)
+		line = ""
+	}
+	if line != "" && len(lines) < maxLines {
+		lines = append(lines, line)
+		line = ""
+	}
+
+	if (len(words) > 0 || line != "") && len(lines) > 0 {
+		last := lines[len(lines)-1]
+		if len(last) > perLine-3 && perLine > 3 {
+			last = last[:perLine-3]
+		}
+		lines[len(lines)-1] = last + "..."
+	}
+	return lines
+}
+
+// writePDF assembles a PDF with one page per content stream
+func writePDF(w io.Writer, pages [][]byte) error {
+	var out bytes.Buffer
+	var offsets []int
+
+	obj := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	// Objects 1–4 are fixed; each page then takes a page object and a content stream
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, content := range pages {
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /%s 3 0 R /%s 4 0 R >> >> /Contents %d 0 R >>",
+			a4Width*mmToPt, a4Height*mmToPt, fontRegular, fontBold, 6+2*i))
+		obj(fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+var cyrillicToLatin = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo", 'ж': "j",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "x", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "sh", 'ъ': "'", 'ы': "i", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya", 'ў': "o'", 'қ': "q", 'ғ': "g'", 'ҳ': "h",
+}
+
+// pdfText converts s to the single-byte WinAnsi range used by the standard fonts
+func pdfText(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case r == 'ʻ' || r == 'ʼ' || r == '‘' || r == '’':
+			b.WriteByte('\'')
+		case r >= 0xA0 && r <= 0xFF:
+			b.WriteByte(byte(r))
+		default:
+			lower := []rune(strings.ToLower(string(r)))[0]
+			if latin, ok := cyrillicToLatin[lower]; ok {
+				if lower != r && latin != "" {
+					latin = strings.ToUpper(latin[:1]) + latin[1:]
+				}
+				b.WriteString(latin)
+			} else {
+				b.WriteByte('?')
+			}
+		}
+	}
+	return b.String()
+}
+
+// escapePDF escapes the characters that are special inside a PDF string literal
+func escapePDF(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`, "\r", " ", "\n", " ").Replace(s)
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -34,29 +35,51 @@ type User struct {
 
 // Product represents an item in inventory
 type Product struct {
-	ID                    int             `json:"id"`
-	CompanyID             int             `json:"company_id"`
-	Name                  string          `json:"name"`
-	Quantity              int             `json:"quantity"`
-	Price                 float64         `json:"price"`
-	MarkupPercent         float64         `json:"markup_percent"`
-	MarkupAmount          float64         `json:"markup_amount"`
-	SellingPrice          float64         `json:"selling_price"`
-	Barcode               *string         `json:"barcode,omitempty"`
-	Barid                 *int64          `json:"barid,omitempty"`
-	Category              string          `json:"category"`
-	HasColorOptions       bool            `json:"has_color_options"`
-	AvailableForCustomers bool            `json:"available_for_customers"`
-	Images                []ProductImage  `json:"images"`
-	CreatedAt             time.Time       `json:"created_at"`
-	UpdatedAt             time.Time       `json:"updated_at"`
-}
-
-// ProductImage represents an image associated with a product
+	ID                    int            `json:"id"`
+	CompanyID             int            `json:"company_id"`
+	Name                  string         `json:"name"`
+	Quantity              float64        `json:"quantity"` // in Unit
+	Unit                  string         `json:"unit"`
+	QuantityPrecision     int            `json:"quantity_precision"` // decimal places allowed in quantities
+	Price                 float64        `json:"price"`
+	MarkupPercent         float64        `json:"markup_percent"`
+	MarkupAmount          float64        `json:"markup_amount"`
+	SellingPrice          float64        `json:"selling_price"`
+	Barcode               *string        `json:"barcode,omitempty"`
+	Barid                 *int64         `json:"barid,omitempty"`
+	Category              string         `json:"category"`
+	Supplier              *string        `json:"supplier,omitempty"`
+	HasColorOptions       bool           `json:"has_color_options"`
+	AvailableForCustomers bool           `json:"available_for_customers"`
+	IsBundle              bool           `json:"is_bundle"`
+	Images                []ProductImage `json:"images"`
+	Rating                float64        `json:"rating"` // average of published reviews
+	RatingCount           int            `json:"rating_count"`
+	CreatedAt             time.Time      `json:"created_at"`
+	UpdatedAt             time.Time      `json:"updated_at"`
+}
+
+// ProductImage represents an image associated with a product.
+// URL and Key point to the full size; Sizes has every stored variant.
+// Filepath is only set on images uploaded before storage keys existed.
 type ProductImage struct {
-	URL        string    `json:"url"`
-	Filepath   string    `json:"filepath"`
-	UploadedAt time.Time `json:"uploaded_at"`
+	URL        string               `json:"url"`
+	Key        string               `json:"key,omitempty"`
+	Filepath   string               `json:"filepath,omitempty"`
+	Width      int                  `json:"width,omitempty"`
+	Height     int                  `json:"height,omitempty"`
+	Sizes      map[string]ImageSize `json:"sizes,omitempty"` // thumb, card, full
+	UploadedAt time.Time            `json:"uploaded_at"`
+}
+
+// ImageSize is one stored size of a product image, with its WebP copy
+type ImageSize struct {
+	URL     string `json:"url"`
+	Key     string `json:"key"`
+	WebPURL string `json:"webp_url"`
+	WebPKey string `json:"webp_key"`
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
 }
 
 // CustomerOrder represents a customer's order
@@ -83,13 +106,25 @@ type CustomerOrder struct {
 type OrderItem struct {
 	ProductID    int     `json:"product_id"`
 	Name         string  `json:"name"`
-	Quantity     int     `json:"quantity"`
-	Price        float64 `json:"price"`
+	Quantity     float64 `json:"quantity"`
+	Unit         string  `json:"unit,omitempty"` // a packaging unit of the product; empty is the base unit
+	Price        float64 `json:"price"`          // per Unit
 	MarkupAmount float64 `json:"markup_amount,omitempty"`
 	SellingPrice float64 `json:"selling_price,omitempty"`
 	Color        string  `json:"color,omitempty"`
 }
 
+// OrderStatusChange is one transition in an order's lifecycle
+type OrderStatusChange struct {
+	ID         int       `json:"id"`
+	FromStatus *string   `json:"from_status"` // nil when the order was placed
+	ToStatus   string    `json:"to_status"`
+	ActorRole  string    `json:"actor_role"`
+	Actor      *string   `json:"actor,omitempty"`
+	Note       *string   `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
 // SalesHistory represents a completed sale
 type SalesHistory struct {
 	ID           int         `json:"id"`
@@ -175,3 +210,188 @@ type CompanyRating struct {
 	Rating     int       `json:"rating"`
 	CreatedAt  time.Time `json:"created_at"`
 }
+
+// ProductReview is a customer's rating and review of a product they received
+type ProductReview struct {
+	ID               int            `json:"id"`
+	ProductID        int            `json:"product_id"`
+	CompanyID        int            `json:"company_id"`
+	OrderID          *int           `json:"order_id,omitempty"`
+	UserName         *string        `json:"user_name,omitempty"`
+	UserPhone        string         `json:"user_phone,omitempty"` // only shown to moderators
+	Rating           int            `json:"rating"`
+	Body             string         `json:"body"`
+	Photos           []ProductImage `json:"photos"`
+	Status           string         `json:"status"`
+	ModerationReason *string        `json:"moderation_reason,omitempty"`
+	ModeratedBy      *string        `json:"moderated_by,omitempty"`
+	ModeratedAt      *time.Time     `json:"moderated_at,omitempty"`
+	Reply            *string        `json:"reply,omitempty"`
+	RepliedAt        *time.Time     `json:"replied_at,omitempty"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+}
+
+// ImportMapping is a saved spreadsheet column mapping for product imports
+type ImportMapping struct {
+	ID        int                    `json:"id"`
+	CompanyID int                    `json:"company_id"`
+	Name      string                 `json:"name"`
+	Mapping   map[string]interface{} `json:"mapping"`
+	HasHeader bool                   `json:"has_header"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// ImportRowError describes why a spreadsheet row was rejected
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// FieldError describes why one field of a request was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ImportJob tracks a background product import
+type ImportJob struct {
+	ID            string           `json:"id"`
+	CompanyID     int              `json:"company_id"`
+	Filename      string           `json:"filename"`
+	Status        string           `json:"status"`
+	TotalRows     int              `json:"total_rows"`
+	ProcessedRows int              `json:"processed_rows"`
+	Created       int              `json:"created"`
+	Updated       int              `json:"updated"`
+	Failed        int              `json:"failed"`
+	Errors        []ImportRowError `json:"errors"`
+	ErrorMessage  *string          `json:"error_message,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	StartedAt     *time.Time       `json:"started_at,omitempty"`
+	FinishedAt    *time.Time       `json:"finished_at,omitempty"`
+}
+
+// PriceHistoryEntry is one price state of a product and the period it was in effect
+type PriceHistoryEntry struct {
+	ID            int        `json:"id"`
+	ProductID     int        `json:"product_id"`
+	Price         float64    `json:"price"`
+	MarkupPercent float64    `json:"markup_percent"`
+	MarkupAmount  float64    `json:"markup_amount"`
+	SellingPrice  float64    `json:"selling_price"`
+	Source        string     `json:"source"`
+	EffectiveFrom time.Time  `json:"effective_from"`
+	EffectiveTo   *time.Time `json:"effective_to,omitempty"`
+}
+
+// ScheduledPriceChange is a future price or markup change for a product
+type ScheduledPriceChange struct {
+	ID            int        `json:"id"`
+	ProductID     int        `json:"product_id"`
+	CompanyID     int        `json:"company_id"`
+	Price         *float64   `json:"price,omitempty"`
+	MarkupPercent *float64   `json:"markup_percent,omitempty"`
+	EffectiveAt   time.Time  `json:"effective_at"`
+	Status        string     `json:"status"`
+	Note          *string    `json:"note,omitempty"`
+	ErrorMessage  *string    `json:"error_message,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	AppliedAt     *time.Time `json:"applied_at,omitempty"`
+}
+
+// RepriceBatch is a bulk repricing that can be undone
+type RepriceBatch struct {
+	ID           int             `json:"id"`
+	CompanyID    int             `json:"company_id"`
+	Filter       json.RawMessage `json:"filter"`
+	Target       string          `json:"target"`
+	Mode         string          `json:"mode"`
+	Value        float64         `json:"value"`
+	Note         *string         `json:"note,omitempty"`
+	ProductCount int             `json:"product_count"`
+	Status       string          `json:"status"`
+	CreatedAt    time.Time       `json:"created_at"`
+	UndoneAt     *time.Time      `json:"undone_at,omitempty"`
+}
+
+// ProductMerge records duplicates that were merged into a surviving product
+type ProductMerge struct {
+	ID             int              `json:"id"`
+	CompanyID      int              `json:"company_id"`
+	SurvivorID     int              `json:"survivor_id"`
+	MergedIDs      []int            `json:"merged_ids"`
+	MergedProducts json.RawMessage  `json:"merged_products"`
+	QuantityAdded  float64          `json:"quantity_added"`
+	Rewritten      map[string]int64 `json:"rewritten"`
+	MergedBy       *string          `json:"merged_by,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+}
+
+// StockReceipt is a delivery of stock at its purchase cost
+type StockReceipt struct {
+	ID         int                `json:"id"`
+	CompanyID  int                `json:"company_id"`
+	Supplier   *string            `json:"supplier,omitempty"`
+	Note       *string            `json:"note,omitempty"`
+	ReceivedBy *string            `json:"received_by,omitempty"`
+	TotalCost  float64            `json:"total_cost"`
+	Items      []StockReceiptItem `json:"items"`
+	CreatedAt  time.Time          `json:"created_at"`
+}
+
+// StockReceiptItem is one product of a stock receipt
+type StockReceiptItem struct {
+	ProductID    int     `json:"product_id"`
+	Name         string  `json:"name,omitempty"`
+	Quantity     float64 `json:"quantity"`
+	Unit         string  `json:"unit,omitempty"` // a packaging unit of the product; empty is the base unit
+	UnitCost     float64 `json:"unit_cost"`      // per Unit
+	BaseQuantity float64 `json:"base_quantity"`
+	TotalCost    float64 `json:"total_cost"`
+}
+
+// StockLot is stock of a product that arrived at one unit cost
+type StockLot struct {
+	ID         int       `json:"id"`
+	ReceiptID  *int      `json:"receipt_id,omitempty"`
+	Source     string    `json:"source"` // receipt, opening, adjustment
+	Quantity   float64   `json:"quantity"`
+	Remaining  float64   `json:"remaining"`
+	UnitCost   float64   `json:"unit_cost"` // per base unit
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// StockMovement is one change to a product's stock, in its base unit
+type StockMovement struct {
+	ID            int       `json:"id"`
+	Reason        string    `json:"reason"`   // sale, refund, receipt
+	Quantity      float64   `json:"quantity"` // negative when stock left
+	QuantityAfter float64   `json:"quantity_after"`
+	OrderID       *int      `json:"order_id,omitempty"`
+	SaleID        *int      `json:"sale_id,omitempty"`
+	ReceiptID     *int      `json:"receipt_id,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// BundleItem is one component of a bundle product
+type BundleItem struct {
+	ProductID int     `json:"product_id"`
+	Name      string  `json:"name"`
+	Quantity  float64 `json:"quantity"` // per bundle
+	Stock     float64 `json:"stock"`
+	Price     float64 `json:"selling_price"`
+	Deleted   bool    `json:"deleted,omitempty"`
+}
+
+// ProductUnit is a packaging unit of a product, e.g. a box of 12 pieces
+type ProductUnit struct {
+	ID        int       `json:"id"`
+	ProductID int       `json:"product_id"`
+	Name      string    `json:"name"`
+	Factor    float64   `json:"factor"` // base units in one
+	Barcode   *string   `json:"barcode,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,126 @@
+package orderstatus
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Statuses of a customer order. An order is placed pending, the company
+// accepts and packs it, hands it over from ready (pickup) or
+// out_for_delivery, and it is completed once paid. It can be cancelled until
+// completed; a completed order can only be refunded.
+const (
+	Pending        = "pending"
+	Accepted       = "accepted"
+	Packing        = "packing"
+	Ready          = "ready"
+	OutForDelivery = "out_for_delivery"
+	Completed      = "completed"
+	Cancelled      = "cancelled"
+	Refunded       = "refunded"
+)
+
+// Statuses lists every status in lifecycle order
+var Statuses = []string{Pending, Accepted, Packing, Ready, OutForDelivery, Completed, Cancelled, Refunded}
+
+// Roles that move orders along
+const (
+	Customer = "customer" // the customer who placed the order
+	Company  = "company"  // the company the order was placed with
+	Admin    = "admin"
+	System   = "system" // payment callbacks and background jobs
+)
+
+var (
+	// ErrIllegal is returned for a transition the lifecycle does not have
+	ErrIllegal = errors.New("illegal status transition")
+	// ErrForbidden is returned for a transition the role may not make
+	ErrForbidden = errors.New("not allowed to make this transition")
+)
+
+var (
+	staff         = []string{Company, Admin}
+	staffOrSystem = []string{Company, Admin, System}
+	anyone        = []string{Customer, Company, Admin, System}
+)
+
+// transitions maps each status to the statuses it can move to and the roles
+// allowed to move it there. Completed is reached by confirming payment, which
+// an open order can be at any stage. Customers can only withdraw an order the
+// company has not accepted yet.
+var transitions = map[string]map[string][]string{
+	Pending: {
+		Accepted:  staff,
+		Completed: staffOrSystem,
+		Cancelled: anyone,
+	},
+	Accepted: {
+		Packing:   staff,
+		Completed: staffOrSystem,
+		Cancelled: staffOrSystem,
+	},
+	Packing: {
+		Ready:          staff,
+		OutForDelivery: staff,
+		Completed:      staffOrSystem,
+		Cancelled:      staffOrSystem,
+	},
+	Ready: {
+		OutForDelivery: staff,
+		Completed:      staffOrSystem,
+		Cancelled:      staffOrSystem,
+	},
+	OutForDelivery: {
+		Completed: staffOrSystem,
+		Cancelled: staffOrSystem,
+	},
+	Completed: {
+		Refunded: staff,
+	},
+}
+
+// Known reports whether status is an order status
+func Known(status string) bool {
+	for _, s := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// KnownRole reports whether role can move orders
+func KnownRole(role string) bool {
+	return role == Customer || role == Company || role == Admin || role == System
+}
+
+// Open reports whether an order in status can still be fulfilled or cancelled
+func Open(status string) bool {
+	_, ok := transitions[status][Cancelled]
+	return ok
+}
+
+// Check returns nil if role may move an order from one status to another
+func Check(from, to, role string) error {
+	roles, ok := transitions[from][to]
+	if !ok {
+		return fmt.Errorf("%w: %s → %s", ErrIllegal, from, to)
+	}
+	for _, r := range roles {
+		if r == role {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s cannot move an order from %s to %s", ErrForbidden, role, from, to)
+}
+
+// Next lists the statuses role may move an order in status to, in lifecycle order
+func Next(status, role string) []string {
+	next := []string{}
+	for _, to := range Statuses {
+		if Check(status, to, role) == nil {
+			next = append(next, to)
+		}
+	}
+	return next
+}
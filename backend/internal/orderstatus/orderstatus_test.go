@@ -0,0 +1,81 @@
+package orderstatus
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		from, to, role string
+		err            error
+	}{
+		{Pending, Accepted, Company, nil},
+		{Pending, Cancelled, Customer, nil},
+		{Pending, Completed, System, nil},
+		{Accepted, Packing, Admin, nil},
+		{Packing, Ready, Company, nil},
+		{Packing, OutForDelivery, Company, nil},
+		{Ready, OutForDelivery, Company, nil},
+		{OutForDelivery, Completed, Company, nil},
+		{Completed, Refunded, Company, nil},
+
+		{Pending, Accepted, Customer, ErrForbidden},
+		{Accepted, Cancelled, Customer, ErrForbidden}, // too late to withdraw
+		{Completed, Refunded, System, ErrForbidden},
+		{Accepted, Packing, System, ErrForbidden},
+		{Pending, Accepted, "", ErrForbidden},
+		{Pending, Accepted, "guest", ErrForbidden},
+
+		{Pending, Packing, Company, ErrIllegal},
+		{Pending, Ready, Company, ErrIllegal},
+		{Completed, Cancelled, Company, ErrIllegal},
+		{Cancelled, Pending, Admin, ErrIllegal},
+		{Refunded, Completed, Company, ErrIllegal},
+		{Pending, Pending, Company, ErrIllegal},
+		{"lost", Pending, Company, ErrIllegal},
+	}
+	for _, tt := range tests {
+		err := Check(tt.from, tt.to, tt.role)
+		if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+			t.Errorf("Check(%s, %s, %s) = %v, want %v", tt.from, tt.to, tt.role, err, tt.err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		status, role string
+		want         []string
+	}{
+		{Pending, Customer, []string{Cancelled}},
+		{Pending, Company, []string{Accepted, Completed, Cancelled}},
+		{Pending, System, []string{Completed, Cancelled}},
+		{Packing, Company, []string{Ready, OutForDelivery, Completed, Cancelled}},
+		{Accepted, Customer, []string{}},
+		{Completed, Company, []string{Refunded}},
+		{Refunded, Admin, []string{}},
+		{Cancelled, Company, []string{}},
+	}
+	for _, tt := range tests {
+		if got := Next(tt.status, tt.role); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Next(%s, %s) = %v, want %v", tt.status, tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	for _, s := range Statuses {
+		want := s != Completed && s != Cancelled && s != Refunded
+		if got := Open(s); got != want {
+			t.Errorf("Open(%s) = %v, want %v", s, got, want)
+		}
+		if !Known(s) {
+			t.Errorf("%s is listed but not known", s)
+		}
+	}
+	if Known("lost") || KnownRole("guest") {
+		t.Error("unknown status or role accepted")
+	}
+}
@@ -0,0 +1,48 @@
+package pricing
+
+import (
+	"errors"
+	"math"
+)
+
+// Tolerance is how far a client's amount may be from the computed one and
+// still be taken as the same, in soum
+const Tolerance = 0.01
+
+// Line is what an order line comes to
+type Line struct {
+	Gross        float64 `json:"gross"`         // selling price × quantity
+	Discount     float64 `json:"discount"`      // off Gross
+	Total        float64 `json:"line_total"`    // what the customer pays
+	MarkupProfit float64 `json:"markup_profit"` // over the cost price, less the discount
+}
+
+// ValidateDiscount checks a line discount in percent
+func ValidateDiscount(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return errors.New("discount_percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// PriceLine totals qty units bought at cost and sold at selling, less
+// discountPercent. Amounts are rounded to the soum fraction they are stored in.
+func PriceLine(cost, selling, qty, discountPercent float64) Line {
+	var l Line
+	l.Gross = Money(selling * qty)
+	l.Discount = Money(l.Gross * discountPercent / 100)
+	l.Total = Money(l.Gross - l.Discount)
+	l.MarkupProfit = Money((selling-cost)*qty - l.Discount)
+	return l
+}
+
+// Matches reports whether a client's amount is the computed one. The
+// difference is rounded first: 10000.01 - 10000 is a hair over 0.01 in binary.
+func Matches(client, computed float64) bool {
+	return math.Round(math.Abs(client-computed)*1e6)/1e6 <= Tolerance
+}
+
+// Money rounds an amount to two decimal places, as amounts are stored
+func Money(v float64) float64 {
+	return math.Round(v*100) / 100
+}
@@ -0,0 +1,89 @@
+package pricing
+
+import "testing"
+
+func TestPriceLine(t *testing.T) {
+	tests := []struct {
+		name                         string
+		cost, selling, qty, discount float64
+		want                         Line
+	}{
+		{
+			name: "no discount",
+			cost: 8000, selling: 10000, qty: 3,
+			want: Line{Gross: 30000, Total: 30000, MarkupProfit: 6000},
+		},
+		{
+			name: "discount comes off the profit",
+			cost: 8000, selling: 10000, qty: 3, discount: 10,
+			want: Line{Gross: 30000, Discount: 3000, Total: 27000, MarkupProfit: 3000},
+		},
+		{
+			name: "weighed quantity is rounded to money",
+			cost: 12000, selling: 15990, qty: 0.333,
+			want: Line{Gross: 5324.67, Total: 5324.67, MarkupProfit: 1328.67},
+		},
+		{
+			name: "full discount sells at a loss",
+			cost: 500, selling: 1000, qty: 2, discount: 100,
+			want: Line{Gross: 2000, Discount: 2000, Total: 0, MarkupProfit: -1000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PriceLine(tt.cost, tt.selling, tt.qty, tt.discount); got != tt.want {
+				t.Errorf("PriceLine = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		in, want float64
+	}{
+		{1.005, 1}, // 1.005 is 1.00499... in binary
+		{1.006, 1.01},
+		{2.675, 2.68},
+		{-1.235, -1.24},
+		{12345.678, 12345.68},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		if got := Money(tt.in); got != tt.want {
+			t.Errorf("Money(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		client, computed float64
+		want             bool
+	}{
+		{10000, 10000, true},
+		{10000.01, 10000, true},
+		{9999.99, 10000, true},
+		{10000.02, 10000, false},
+		{0.1 + 0.2, 0.3, true},
+		{0, 10000, false},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.client, tt.computed); got != tt.want {
+			t.Errorf("Matches(%v, %v) = %v, want %v", tt.client, tt.computed, got, tt.want)
+		}
+	}
+}
+
+func TestValidateDiscount(t *testing.T) {
+	for _, p := range []float64{0, 12.5, 100} {
+		if err := ValidateDiscount(p); err != nil {
+			t.Errorf("ValidateDiscount(%v) = %v", p, err)
+		}
+	}
+	for _, p := range []float64{-0.01, 100.01} {
+		if err := ValidateDiscount(p); err == nil {
+			t.Errorf("ValidateDiscount(%v) accepted", p)
+		}
+	}
+}
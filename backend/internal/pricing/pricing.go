@@ -0,0 +1,201 @@
+package pricing
+
+import (
+	"errors"
+	"math"
+)
+
+// Rule scopes, from least to most specific
+const (
+	ScopeDefault  = "default"
+	ScopeCategory = "category"
+	ScopeSupplier = "supplier"
+)
+
+// Rounding modes for the selling price
+const (
+	RoundNone    = "none"
+	RoundUp      = "up"      // up to the next multiple of step: 12 347 → 12 500
+	RoundNearest = "nearest" // to the nearest multiple of step
+	RoundDown    = "down"    // down to a multiple of step, never below the margin guard
+	RoundEnding  = "ending"  // up to the next price ending in Ending: step 1000, ending 900 → 12 900
+)
+
+// Rule is a company pricing rule. Empty fields inherit from less specific rules,
+// so a category rule may only set a markup and keep the company's rounding.
+type Rule struct {
+	ID               int      `json:"id"`
+	CompanyID        int      `json:"company_id"`
+	Scope            string   `json:"scope"`
+	Match            *string  `json:"match,omitempty"` // category or supplier name
+	MarkupPercent    *float64 `json:"markup_percent,omitempty"`
+	MinMarginPercent *float64 `json:"min_margin_percent,omitempty"`
+	RoundingMode     *string  `json:"rounding_mode,omitempty"`
+	RoundingStep     *float64 `json:"rounding_step,omitempty"`
+	RoundingEnding   *float64 `json:"rounding_ending,omitempty"`
+}
+
+// Validate checks that a rule can be applied
+func (r Rule) Validate() error {
+	switch r.Scope {
+	case ScopeDefault:
+	case ScopeCategory, ScopeSupplier:
+		if r.Match == nil || *r.Match == "" {
+			return errors.New("match is required for category and supplier rules")
+		}
+	default:
+		return errors.New("scope must be default, category or supplier")
+	}
+
+	if r.MarkupPercent != nil && (*r.MarkupPercent < 0 || *r.MarkupPercent >= 1000) {
+		return errors.New("markup_percent must be between 0 and 999.99")
+	}
+	if r.MinMarginPercent != nil && (*r.MinMarginPercent < 0 || *r.MinMarginPercent >= 100) {
+		return errors.New("min_margin_percent must be between 0 and 99.99")
+	}
+
+	if r.RoundingMode != nil {
+		switch *r.RoundingMode {
+		case RoundNone:
+		case RoundUp, RoundNearest, RoundDown:
+			if r.RoundingStep == nil || *r.RoundingStep <= 0 {
+				return errors.New("rounding_step must be positive")
+			}
+		case RoundEnding:
+			if r.RoundingStep == nil || *r.RoundingStep <= 0 {
+				return errors.New("rounding_step must be positive")
+			}
+			if r.RoundingEnding == nil || *r.RoundingEnding < 0 || *r.RoundingEnding >= *r.RoundingStep {
+				return errors.New("rounding_ending must be between 0 and rounding_step")
+			}
+		default:
+			return errors.New("rounding_mode must be none, up, nearest, down or ending")
+		}
+	}
+	return nil
+}
+
+// Rules are all pricing rules of a company
+type Rules []Rule
+
+// Input is what a price is computed from
+type Input struct {
+	Price         float64  // cost price
+	MarkupPercent *float64 // explicit markup; nil uses the rules
+	Category      string
+	Supplier      string
+}
+
+// Result is a computed selling price. MarkupPercent is the markup that was
+// chosen; MarkupAmount is the real profit per unit after guards and rounding.
+type Result struct {
+	MarkupPercent float64 `json:"markup_percent"`
+	MarkupAmount  float64 `json:"markup_amount"`
+	SellingPrice  float64 `json:"selling_price"`
+	MarginGuarded bool    `json:"margin_guarded"`
+	Rounded       bool    `json:"rounded"`
+	RuleIDs       []int   `json:"rule_ids"`
+}
+
+// effective merges the matching rules, the most specific one winning per field
+func (rs Rules) effective(category, supplier string) (Rule, []int) {
+	var merged Rule
+	ids := []int{}
+
+	for _, scope := range []string{ScopeDefault, ScopeCategory, ScopeSupplier} {
+		for _, r := range rs {
+			if r.Scope != scope {
+				continue
+			}
+			switch scope {
+			case ScopeCategory:
+				if r.Match == nil || *r.Match != category {
+					continue
+				}
+			case ScopeSupplier:
+				if r.Match == nil || supplier == "" || *r.Match != supplier {
+					continue
+				}
+			}
+
+			ids = append(ids, r.ID)
+			if r.MarkupPercent != nil {
+				merged.MarkupPercent = r.MarkupPercent
+			}
+			if r.MinMarginPercent != nil {
+				merged.MinMarginPercent = r.MinMarginPercent
+			}
+			if r.RoundingMode != nil {
+				merged.RoundingMode = r.RoundingMode
+				merged.RoundingStep = r.RoundingStep
+				merged.RoundingEnding = r.RoundingEnding
+			}
+		}
+	}
+	return merged, ids
+}
+
+// Apply computes the selling price: markup, then the minimum margin guard, then rounding.
+// With no rules it is the plain price × (1 + markup%).
+func (rs Rules) Apply(in Input) Result {
+	rule, ids := rs.effective(in.Category, in.Supplier)
+	res := Result{RuleIDs: ids}
+
+	switch {
+	case in.MarkupPercent != nil:
+		res.MarkupPercent = *in.MarkupPercent
+	case rule.MarkupPercent != nil:
+		res.MarkupPercent = *rule.MarkupPercent
+	}
+
+	selling := in.Price * (1 + res.MarkupPercent/100)
+
+	// Margin is measured on the selling price: (selling - cost) / selling
+	minSelling := 0.0
+	if rule.MinMarginPercent != nil && in.Price > 0 {
+		minSelling = in.Price / (1 - *rule.MinMarginPercent/100)
+		if selling < minSelling-0.005 {
+			selling = minSelling
+			res.MarginGuarded = true
+		}
+	}
+
+	if rule.RoundingMode != nil && *rule.RoundingMode != RoundNone && rule.RoundingStep != nil {
+		ending := 0.0
+		if rule.RoundingEnding != nil {
+			ending = *rule.RoundingEnding
+		}
+		rounded := round(selling, *rule.RoundingMode, *rule.RoundingStep, ending)
+		if rounded < minSelling-0.005 {
+			// Rounding down must not undo the margin guard
+			rounded = round(selling, RoundUp, *rule.RoundingStep, ending)
+		}
+		res.Rounded = math.Abs(rounded-selling) >= 0.005
+		selling = rounded
+	}
+
+	res.SellingPrice = math.Round(selling*100) / 100
+	res.MarkupAmount = math.Round((res.SellingPrice-in.Price)*100) / 100
+	return res
+}
+
+func round(v float64, mode string, step, ending float64) float64 {
+	// Work around float noise such as 12500.000000001 before ceil/floor
+	units := math.Round(v/step*1e6) / 1e6
+
+	switch mode {
+	case RoundUp:
+		return math.Ceil(units) * step
+	case RoundNearest:
+		return math.Round(units) * step
+	case RoundDown:
+		return math.Floor(units) * step
+	case RoundEnding:
+		candidate := math.Floor(units)*step + ending
+		if candidate < v-0.005 {
+			candidate += step
+		}
+		return candidate
+	}
+	return v
+}
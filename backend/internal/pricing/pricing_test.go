@@ -0,0 +1,97 @@
+package pricing
+
+import (
+	"reflect"
+	"testing"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestApply(t *testing.T) {
+	rules := Rules{
+		{ID: 1, Scope: ScopeDefault, MarkupPercent: ptr(20.0), RoundingMode: ptr(RoundUp), RoundingStep: ptr(100.0)},
+		{ID: 2, Scope: ScopeCategory, Match: ptr("Ичимликлар"), MarkupPercent: ptr(50.0)},
+		{ID: 3, Scope: ScopeSupplier, Match: ptr("Coca-Cola"), MinMarginPercent: ptr(40.0)},
+		{ID: 4, Scope: ScopeCategory, Match: ptr("Нон"), RoundingMode: ptr(RoundEnding), RoundingStep: ptr(1000.0), RoundingEnding: ptr(900.0)},
+	}
+
+	tests := []struct {
+		name string
+		in   Input
+		want Result
+	}{
+		{
+			name: "default markup, rounded up",
+			in:   Input{Price: 10290},
+			want: Result{MarkupPercent: 20, MarkupAmount: 2110, SellingPrice: 12400, Rounded: true, RuleIDs: []int{1}},
+		},
+		{
+			name: "category markup inherits rounding",
+			in:   Input{Price: 1000, Category: "Ичимликлар"},
+			want: Result{MarkupPercent: 50, MarkupAmount: 500, SellingPrice: 1500, RuleIDs: []int{1, 2}},
+		},
+		{
+			name: "margin guard lifts the price",
+			in:   Input{Price: 6000, Category: "Ичимликлар", Supplier: "Coca-Cola"},
+			want: Result{MarkupPercent: 50, MarkupAmount: 4000, SellingPrice: 10000, MarginGuarded: true, RuleIDs: []int{1, 2, 3}},
+		},
+		{
+			name: "price ending",
+			in:   Input{Price: 10000, Category: "Нон"},
+			want: Result{MarkupPercent: 20, MarkupAmount: 2900, SellingPrice: 12900, Rounded: true, RuleIDs: []int{1, 4}},
+		},
+		{
+			name: "explicit markup wins over rules",
+			in:   Input{Price: 1000, MarkupPercent: ptr(0.0), Category: "Ичимликлар"},
+			want: Result{MarkupPercent: 0, MarkupAmount: 0, SellingPrice: 1000, RuleIDs: []int{1, 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.Apply(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply(%+v) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	// Without rules it is the plain markup
+	got := Rules{}.Apply(Input{Price: 1000, MarkupPercent: ptr(12.5)})
+	if got.SellingPrice != 1125 || got.MarkupAmount != 125 || got.Rounded || len(got.RuleIDs) != 0 {
+		t.Errorf("Apply without rules = %+v", got)
+	}
+}
+
+func TestApplyRoundingKeepsMarginGuard(t *testing.T) {
+	rules := Rules{{
+		ID: 1, Scope: ScopeDefault, MarkupPercent: ptr(10.0), MinMarginPercent: ptr(20.0),
+		RoundingMode: ptr(RoundDown), RoundingStep: ptr(1000.0),
+	}}
+	// The guard asks for 12 500; rounding down to 12 000 would undo it
+	got := rules.Apply(Input{Price: 10000})
+	if got.SellingPrice != 13000 || !got.MarginGuarded {
+		t.Errorf("Apply = %+v, want 13000 guarded", got)
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		valid bool
+	}{
+		{"default", Rule{Scope: ScopeDefault, MarkupPercent: ptr(25.0)}, true},
+		{"category without match", Rule{Scope: ScopeCategory}, false},
+		{"unknown scope", Rule{Scope: "brand"}, false},
+		{"negative markup", Rule{Scope: ScopeDefault, MarkupPercent: ptr(-1.0)}, false},
+		{"margin of 100%", Rule{Scope: ScopeDefault, MinMarginPercent: ptr(100.0)}, false},
+		{"rounding without step", Rule{Scope: ScopeDefault, RoundingMode: ptr(RoundUp)}, false},
+		{"ending past step", Rule{Scope: ScopeDefault, RoundingMode: ptr(RoundEnding), RoundingStep: ptr(100.0), RoundingEnding: ptr(100.0)}, false},
+		{"ending", Rule{Scope: ScopeDefault, RoundingMode: ptr(RoundEnding), RoundingStep: ptr(1000.0), RoundingEnding: ptr(900.0)}, true},
+		{"unknown rounding", Rule{Scope: ScopeDefault, RoundingMode: ptr("bankers")}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package spreadsheet
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedFormat is returned for files that are neither XLSX nor CSV
+var ErrUnsupportedFormat = errors.New("unsupported file format, expected .xlsx or .csv")
+
+// Limits of a worksheet, as in Excel
+const (
+	MaxRows    = 1048576
+	MaxColumns = 16384
+)
+
+// maxPartSize caps how much a single XLSX part may decompress to
+const maxPartSize = 64 << 20
+
+// Read parses an uploaded spreadsheet into rows of cell strings. XLSX is
+// detected by its zip signature, anything else with a .csv/.txt name is CSV.
+func Read(data []byte, filename string) ([][]string, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return ReadXLSX(data)
+	}
+
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".csv", ".txt", "":
+		return ReadCSV(bytes.NewReader(data))
+	}
+	return nil, ErrUnsupportedFormat
+}
+
+// ReadCSV parses CSV written by Excel or LibreOffice: an optional UTF-8 BOM
+// and either comma or semicolon separators
+func ReadCSV(r io.Reader) ([][]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	firstLine := data
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		firstLine = data[:i]
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		reader.Comma = ';'
+	}
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV: %w", err)
+	}
+	// Undo the apostrophe exports put before formula-like text
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > 1 && cell[0] == '\'' && strings.ContainsRune(formulaPrefixes, rune(cell[1])) {
+				row[i] = cell[1:]
+			}
+		}
+	}
+	return trimEmptyRows(rows), nil
+}
+
+// ReadXLSX returns the rows of the first worksheet of an XLSX workbook
+func ReadXLSX(data []byte) ([][]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid XLSX: %w", err)
+	}
+
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	sheetPath, err := firstSheetPath(files)
+	if err != nil {
+		return nil, err
+	}
+
+	var shared []string
+	if f, ok := files["xl/sharedStrings.xml"]; ok {
+		if shared, err = readSharedStrings(f); err != nil {
+			return nil, err
+		}
+	}
+
+	f, ok := files[sheetPath]
+	if !ok {
+		return nil, fmt.Errorf("invalid XLSX: missing %s", sheetPath)
+	}
+	return readSheet(f, shared)
+}
+
+// firstSheetPath resolves the first sheet of the workbook through its relationships
+func firstSheetPath(files map[string]*zip.File) (string, error) {
+	var workbook struct {
+		Sheets []struct {
+			RID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var rels struct {
+		Relationships []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+
+	if err := decodeXML(files["xl/workbook.xml"], &workbook); err != nil || len(workbook.Sheets) == 0 {
+		return "", errors.New("invalid XLSX: workbook has no sheets")
+	}
+	if err := decodeXML(files["xl/_rels/workbook.xml.rels"], &rels); err != nil {
+		return "xl/worksheets/sheet1.xml", nil
+	}
+
+	for _, rel := range rels.Relationships {
+		if rel.ID != workbook.Sheets[0].RID {
+			continue
+		}
+		if strings.HasPrefix(rel.Target, "/") {
+			return strings.TrimPrefix(rel.Target, "/"), nil
+		}
+		return path.Join("xl", rel.Target), nil
+	}
+	return "xl/worksheets/sheet1.xml", nil
+}
+
+func decodeXML(f *zip.File, v interface{}) error {
+	if f == nil {
+		return errors.New("missing part")
+	}
+	rc, err := openPart(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// openPart opens a part of an XLSX zip for reading; it fails once the part
+// decompresses past maxPartSize
+func openPart(f *zip.File) (io.ReadCloser, error) {
+	if f.UncompressedSize64 > maxPartSize {
+		return nil, fmt.Errorf("invalid XLSX: %s is too large", f.Name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return &partReader{rc: rc, name: f.Name, left: maxPartSize}, nil
+}
+
+// partReader reads a part up to its limit, whatever its header claims
+type partReader struct {
+	rc   io.ReadCloser
+	name string
+	left int64
+}
+
+func (r *partReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, fmt.Errorf("invalid XLSX: %s is too large", r.name)
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.rc.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
+
+func (r *partReader) Close() error {
+	return r.rc.Close()
+}
+
+// readSharedStrings collects the shared string table, joining rich-text runs
+func readSharedStrings(f *zip.File) ([]string, error) {
+	rc, err := openPart(f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var strs []string
+	var current strings.Builder
+	inText, inPhonetic := false, false
+
+	dec := xml.NewDecoder(rc)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return strs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid XLSX shared strings: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "si":
+				current.Reset()
+			case "t":
+				inText = true
+			case "rPh":
+				inPhonetic = true
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "si":
+				strs = append(strs, current.String())
+			case "t":
+				inText = false
+			case "rPh":
+				inPhonetic = false
+			}
+		case xml.CharData:
+			if inText && !inPhonetic {
+				current.Write(t)
+			}
+		}
+	}
+}
+
+// readSheet streams a worksheet and places each cell by its reference
+func readSheet(f *zip.File, shared []string) ([][]string, error) {
+	rc, err := openPart(f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var rows [][]string
+	var row []string
+	var cellRef, cellType string
+	var value strings.Builder
+	inValue := false
+	col := 0
+
+	dec := xml.NewDecoder(rc)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid XLSX sheet: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				row = nil
+				col = 0
+				// Rows may be skipped in the file; keep positions intact
+				for _, a := range t.Attr {
+					if a.Name.Local == "r" {
+						if n, err := strconv.Atoi(a.Value); err == nil {
+							if n > MaxRows {
+								return nil, fmt.Errorf("invalid XLSX sheet: row %d is past the last row", n)
+							}
+							for len(rows) < n-1 {
+								rows = append(rows, nil)
+							}
+						}
+					}
+				}
+			case "c":
+				cellRef, cellType = "", ""
+				value.Reset()
+				for _, a := range t.Attr {
+					switch a.Name.Local {
+					case "r":
+						cellRef = a.Value
+					case "t":
+						cellType = a.Value
+					}
+				}
+			case "v", "t":
+				inValue = true
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "v", "t":
+				inValue = false
+			case "c":
+				idx := col
+				if cellRef != "" {
+					idx = ColumnIndex(cellRef)
+				}
+				if idx < 0 || idx >= MaxColumns {
+					return nil, fmt.Errorf("invalid XLSX sheet: bad cell reference %q", cellRef)
+				}
+				for len(row) <= idx {
+					row = append(row, "")
+				}
+				row[idx] = cellValue(value.String(), cellType, shared)
+				col = idx + 1
+			case "row":
+				if len(rows) >= MaxRows {
+					return nil, errors.New("invalid XLSX sheet: too many rows")
+				}
+				rows = append(rows, row)
+			}
+		case xml.CharData:
+			if inValue {
+				value.Write(t)
+			}
+		}
+	}
+
+	return trimEmptyRows(rows), nil
+}
+
+func cellValue(raw, cellType string, shared []string) string {
+	switch cellType {
+	case "s":
+		if i, err := strconv.Atoi(raw); err == nil && i >= 0 && i < len(shared) {
+			return shared[i]
+		}
+		return ""
+	case "b":
+		if raw == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "inlineStr", "str", "e":
+		return raw
+	}
+
+	// Numbers such as long barcodes may be stored in exponent form
+	if strings.ContainsAny(raw, "eE") {
+		if f, err := strconv.ParseFloat(raw, 64); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	}
+	return raw
+}
+
+// ColumnIndex converts a cell reference such as "B7" or a column name such as
+// "AB" to a 0-based index. It is -1 without a column and at least MaxColumns
+// past the last one.
+func ColumnIndex(ref string) int {
+	idx := 0
+	for _, r := range strings.ToUpper(ref) {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		idx = idx*26 + int(r-'A'+1)
+		if idx > MaxColumns {
+			return MaxColumns
+		}
+	}
+	return idx - 1
+}
+
+// trimEmptyRows drops trailing rows without any non-blank cell
+func trimEmptyRows(rows [][]string) [][]string {
+	for len(rows) > 0 {
+		empty := true
+		for _, cell := range rows[len(rows)-1] {
+			if strings.TrimSpace(cell) != "" {
+				empty = false
+				break
+			}
+		}
+		if !empty {
+			break
+		}
+		rows = rows[:len(rows)-1]
+	}
+	return rows
+}
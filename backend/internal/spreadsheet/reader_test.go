@@ -0,0 +1,117 @@
+package spreadsheet
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildXLSX zips a one-sheet workbook around the given sheetData
+func buildXLSX(t *testing.T, sheetData string, shared ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+			`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="S" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/worksheets/sheet1.xml": `<worksheet><sheetData>` + sheetData + `</sheetData></worksheet>`,
+	}
+	if len(shared) > 0 {
+		parts["xl/sharedStrings.xml"] = `<sst><si><t>` + strings.Join(shared, `</t></si><si><t>`) + `</t></si></sst>`
+	}
+	for name, body := range parts {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadXLSX(t *testing.T) {
+	data := buildXLSX(t, `<row r="1"><c r="A1" t="s"><v>0</v></c><c r="C1"><v>4.006381333931E12</v></c></row>`+
+		`<row r="3"><c r="B3" t="inlineStr"><is><t>Олма</t></is></c><c t="b"><v>1</v></c></row>`,
+		"Name")
+	rows, err := ReadXLSX(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Name", "", "4006381333931"},
+		nil,
+		{"", "Олма", "TRUE"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("rows = %q, want %q", rows, want)
+	}
+}
+
+func TestReadXLSXBounds(t *testing.T) {
+	tests := []struct {
+		name  string
+		sheet string
+	}{
+		{"reference without a column", `<row r="1"><c r="1"><v>1</v></c></row>`},
+		{"column past the last", `<row r="1"><c r="XFE1"><v>1</v></c></row>`},
+		{"overlong column", `<row r="1"><c r="ZZZZZZZZZZZZZZ1"><v>1</v></c></row>`},
+		{"row past the last", `<row r="1048577"><c r="A1048577"><v>1</v></c></row>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadXLSX(buildXLSX(t, tt.sheet)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	// The last column itself is fine
+	rows, err := ReadXLSX(buildXLSX(t, `<row r="1"><c r="XFD1"><v>1</v></c></row>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || len(rows[0]) != MaxColumns {
+		t.Errorf("got %d rows, want one of %d cells", len(rows), MaxColumns)
+	}
+}
+
+func TestReadXLSXPartSize(t *testing.T) {
+	// Whitespace compresses to almost nothing but decompresses past the limit
+	padding := strings.Repeat(" ", maxPartSize+1)
+	if _, err := ReadXLSX(buildXLSX(t, padding)); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("err = %v, want a too large error", err)
+	}
+}
+
+func TestColumnIndex(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want int
+	}{
+		{"A1", 0},
+		{"b7", 1},
+		{"Z", 25},
+		{"AA10", 26},
+		{"AB", 27},
+		{"XFD1", MaxColumns - 1},
+		{"XFE1", MaxColumns},
+		{"ZZZZZZZZ1", MaxColumns},
+		{"1", -1},
+		{"", -1},
+	}
+	for _, tt := range tests {
+		if got := ColumnIndex(tt.ref); got != tt.want {
+			t.Errorf("ColumnIndex(%q) = %d, want %d", tt.ref, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package spreadsheet
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEscapeFormula(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"=SUM(A1:A2)", "'=SUM(A1:A2)"},
+		{"+998901234567", "'+998901234567"},
+		{"-5", "'-5"},
+		{"@cmd", "'@cmd"},
+		{"\tx", "'\tx"},
+		{"\rx", "'\rx"},
+		{"Олма", "Олма"},
+		{"a=b", "a=b"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := escapeFormula(tt.in); got != tt.want {
+			t.Errorf("escapeFormula(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewCSVWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Numbers are written as they are; only text is escaped
+	if err := w.WriteRow([]interface{}{"=HYPERLINK(\"x\")", -5, -1.5, "-5", "plain", nil}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "\xef\xbb\xbf\"'=HYPERLINK(\"\"x\"\")\",-5,-1.5,'-5,plain,\n"
+	if got := buf.String(); got != want {
+		t.Errorf("csv = %q, want %q", got, want)
+	}
+
+	rows, err := ReadCSV(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRows := [][]string{{"=HYPERLINK(\"x\")", "-5", "-1.5", "-5", "plain", ""}}
+	if !reflect.DeepEqual(rows, wantRows) {
+		t.Errorf("rows = %q, want %q", rows, wantRows)
+	}
+}
@@ -0,0 +1,97 @@
+// Package storage stores uploaded files on local disk or in an S3-compatible bucket.
+//
+// Files are addressed by keys such as "products/12_<uuid>_full.jpg". Keys under
+// PrivatePrefix belong to private companies and are only reachable through
+// signed, expiring URLs.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"azaton-backend/internal/config"
+)
+
+// PrivatePrefix marks keys that are never served publicly
+const PrivatePrefix = "private/"
+
+var ErrNotFound = errors.New("file not found")
+
+// Object is a stored file
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is implemented by the local and S3 drivers
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every stored object
+	List(ctx context.Context, fn func(Object) error) error
+	// URL is the public URL of a key
+	URL(key string) string
+	// SignedURL is a URL that stops working after ttl
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// New returns the driver selected by STORAGE_DRIVER
+func New(cfg *config.Config) (Storage, error) {
+	switch cfg.StorageDriver {
+	case "", "local":
+		return NewLocal(cfg.UploadDir, "/uploads", "/api/files", []byte(cfg.StorageSigningKey))
+	case "s3":
+		return NewS3(S3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			UseSSL:    cfg.S3UseSSL,
+			PublicURL: cfg.S3PublicURL,
+		})
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", cfg.StorageDriver)
+}
+
+// Key returns the key of a product file, under PrivatePrefix for private companies
+func Key(private bool, name string) string {
+	if private {
+		return PrivatePrefix + "products/" + name
+	}
+	return "products/" + name
+}
+
+// ReviewKey returns the key of a review photo file, under PrivatePrefix for private companies
+func ReviewKey(private bool, name string) string {
+	if private {
+		return PrivatePrefix + "reviews/" + name
+	}
+	return "reviews/" + name
+}
+
+// IsPrivate reports whether a key is only served through signed URLs
+func IsPrivate(key string) bool {
+	return strings.HasPrefix(key, PrivatePrefix)
+}
+
+// ContentType guesses the MIME type of an upload from its key
+func ContentType(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".jpg"), strings.HasSuffix(key, ".jpeg"):
+		return "image/jpeg"
+	case strings.HasSuffix(key, ".png"):
+		return "image/png"
+	case strings.HasSuffix(key, ".webp"):
+		return "image/webp"
+	case strings.HasSuffix(key, ".gif"):
+		return "image/gif"
+	}
+	return "application/octet-stream"
+}
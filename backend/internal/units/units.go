@@ -0,0 +1,79 @@
+package units
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Base units a product can be stocked and sold in
+const (
+	Piece      = "pcs"
+	Kilogram   = "kg"
+	Gram       = "g"
+	Litre      = "l"
+	Millilitre = "ml"
+	Metre      = "m"
+	Centimetre = "cm"
+)
+
+// Codes lists the base units in display order
+var Codes = []string{Piece, Kilogram, Gram, Litre, Millilitre, Metre, Centimetre}
+
+// MaxPrecision is the most decimal places a quantity can have; it matches
+// the NUMERIC(15,3) quantity columns
+const MaxPrecision = 3
+
+// defaultPrecision is the number of decimal places each unit allows unless
+// a product sets its own: weighed and measured goods down to a gram, millilitre
+// or millimetre, everything else in whole units
+var defaultPrecision = map[string]int{
+	Piece:      0,
+	Kilogram:   3,
+	Gram:       0,
+	Litre:      3,
+	Millilitre: 0,
+	Metre:      3,
+	Centimetre: 0,
+}
+
+// Known reports whether unit is a supported base unit
+func Known(unit string) bool {
+	_, ok := defaultPrecision[unit]
+	return ok
+}
+
+// DefaultPrecision returns the decimal places allowed for unit by default
+func DefaultPrecision(unit string) int {
+	return defaultPrecision[unit]
+}
+
+// Round rounds a quantity to precision decimal places
+func Round(q float64, precision int) float64 {
+	p := math.Pow(10, float64(precision))
+	return math.Round(q*p) / p
+}
+
+// Validate checks that q is a non-negative quantity with at most precision
+// decimal places, e.g. 1.25 kg with precision 3 but not 1.5 pcs with precision 0
+func Validate(q float64, precision int) error {
+	if q < 0 || math.IsNaN(q) || math.IsInf(q, 0) {
+		return errors.New("quantity must not be negative")
+	}
+	// Tolerate float noise such as 0.1+0.2
+	if math.Abs(q-Round(q, precision)) > 1e-9 {
+		if precision == 0 {
+			return errors.New("quantity must be a whole number")
+		}
+		return fmt.Errorf("quantity must have at most %d decimal places", precision)
+	}
+	return nil
+}
+
+// ValidatePrecision checks a per-product precision setting
+func ValidatePrecision(precision int) error {
+	if precision < 0 || precision > MaxPrecision {
+		return fmt.Errorf("quantity_precision must be between 0 and %d", MaxPrecision)
+	}
+	return nil
+}
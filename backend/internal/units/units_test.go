@@ -0,0 +1,67 @@
+package units
+
+import (
+	"math"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		q         float64
+		precision int
+		valid     bool
+	}{
+		{3, 0, true},
+		{0, 0, true},
+		{1.5, 0, false},
+		{1.25, 3, true},
+		{1.2345, 3, false},
+		{0.1 + 0.2, 1, true}, // float noise
+		{0.001, 3, true},
+		{0.0005, 3, false},
+		{12.5, 1, true},
+		{-1, 0, false},
+		{math.NaN(), 3, false},
+		{math.Inf(1), 3, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(tt.q, tt.precision); (err == nil) != tt.valid {
+			t.Errorf("Validate(%v, %d) = %v, want valid %v", tt.q, tt.precision, err, tt.valid)
+		}
+	}
+}
+
+func TestRound(t *testing.T) {
+	tests := []struct {
+		q         float64
+		precision int
+		want      float64
+	}{
+		{1.2345, 3, 1.235},
+		{1.5, 0, 2},
+		{0.1 + 0.2, 3, 0.3},
+		{12 * 0.333, 3, 3.996},
+	}
+	for _, tt := range tests {
+		if got := Round(tt.q, tt.precision); got != tt.want {
+			t.Errorf("Round(%v, %d) = %v, want %v", tt.q, tt.precision, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultPrecision(t *testing.T) {
+	for _, code := range Codes {
+		if !Known(code) {
+			t.Errorf("%s is listed but not known", code)
+		}
+		if err := ValidatePrecision(DefaultPrecision(code)); err != nil {
+			t.Errorf("%s: %v", code, err)
+		}
+	}
+	if Known("box") {
+		t.Error("box is a packaging unit, not a base unit")
+	}
+	if ValidatePrecision(-1) == nil || ValidatePrecision(MaxPrecision+1) == nil {
+		t.Error("precision out of range accepted")
+	}
+}
@@ -0,0 +1,12 @@
+-- ============================================
+-- INTERNAL BARCODE SEQUENCES
+-- Per-company counter for generated in-store EAN-13 codes
+-- ============================================
+CREATE TABLE IF NOT EXISTS company_barcode_sequences (
+    company_id INTEGER PRIMARY KEY REFERENCES companies(id) ON DELETE CASCADE,
+    last_value BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Barcode lookups are always scoped to a company
+CREATE INDEX IF NOT EXISTS idx_products_company_barcode ON products(company_id, barcode);
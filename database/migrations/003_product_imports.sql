@@ -0,0 +1,39 @@
+-- ============================================
+-- PRODUCT IMPORT MAPPINGS
+-- Saved spreadsheet column mappings per company
+-- ============================================
+CREATE TABLE IF NOT EXISTS import_mappings (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    mapping JSONB NOT NULL DEFAULT '{}'::jsonb, -- field -> column index or header name
+    has_header BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(company_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_import_mappings_company ON import_mappings(company_id);
+
+-- ============================================
+-- PRODUCT IMPORT JOBS
+-- Background XLSX/CSV imports with progress
+-- ============================================
+CREATE TABLE IF NOT EXISTS import_jobs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    filename VARCHAR(500),
+    status VARCHAR(50) DEFAULT 'pending', -- pending, running, completed, failed
+    total_rows INTEGER DEFAULT 0,
+    processed_rows INTEGER DEFAULT 0,
+    created_count INTEGER DEFAULT 0,
+    updated_count INTEGER DEFAULT 0,
+    failed_count INTEGER DEFAULT 0,
+    errors JSONB DEFAULT '[]'::jsonb,
+    error_message TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    started_at TIMESTAMP WITH TIME ZONE,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_import_jobs_company ON import_jobs(company_id);
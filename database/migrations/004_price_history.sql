@@ -0,0 +1,87 @@
+-- ============================================
+-- PRODUCT PRICE HISTORY
+-- One row per price state; effective_to is NULL for the current price
+-- ============================================
+CREATE TABLE IF NOT EXISTS product_price_history (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    price DECIMAL(15,2) DEFAULT 0,
+    markup_percent DECIMAL(5,2) DEFAULT 0,
+    markup_amount DECIMAL(15,2) DEFAULT 0,
+    selling_price DECIMAL(15,2) DEFAULT 0,
+    source VARCHAR(50) DEFAULT 'manual', -- created, manual, import, receipt, scheduled, reprice, reprice_undo, initial
+    effective_from TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    effective_to TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_price_history_product ON product_price_history(product_id, effective_from);
+CREATE INDEX IF NOT EXISTS idx_price_history_company ON product_price_history(company_id, effective_from);
+
+-- ============================================
+-- SCHEDULED PRICE CHANGES
+-- Applied by the backend price scheduler at effective_at
+-- ============================================
+CREATE TABLE IF NOT EXISTS scheduled_price_changes (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    price DECIMAL(15,2),          -- NULL keeps the current price
+    markup_percent DECIMAL(5,2),  -- NULL keeps the current markup
+    effective_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    status VARCHAR(50) DEFAULT 'pending', -- pending, applied, cancelled, failed
+    note TEXT,
+    error_message TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    applied_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_scheduled_prices_due ON scheduled_price_changes(effective_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS idx_scheduled_prices_product ON scheduled_price_changes(product_id);
+
+-- ============================================
+-- TRIGGER: Record every price change
+-- The source can be set per transaction with
+--   SELECT set_config('azaton.price_source', 'import', true)
+-- ============================================
+CREATE OR REPLACE FUNCTION record_product_price_change()
+RETURNS TRIGGER AS $$
+DECLARE
+    change_source text;
+BEGIN
+    IF TG_OP = 'UPDATE'
+       AND NEW.price IS NOT DISTINCT FROM OLD.price
+       AND NEW.markup_percent IS NOT DISTINCT FROM OLD.markup_percent
+       AND NEW.selling_price IS NOT DISTINCT FROM OLD.selling_price THEN
+        RETURN NEW;
+    END IF;
+
+    change_source := NULLIF(current_setting('azaton.price_source', true), '');
+    IF change_source IS NULL THEN
+        change_source := CASE WHEN TG_OP = 'INSERT' THEN 'created' ELSE 'manual' END;
+    END IF;
+
+    UPDATE product_price_history SET effective_to = NOW()
+    WHERE product_id = NEW.id AND effective_to IS NULL;
+
+    INSERT INTO product_price_history (product_id, company_id, price, markup_percent,
+                                       markup_amount, selling_price, source, effective_from)
+    VALUES (NEW.id, NEW.company_id, NEW.price, NEW.markup_percent,
+            NEW.markup_amount, NEW.selling_price, change_source, NOW());
+
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS products_price_history ON products;
+CREATE TRIGGER products_price_history
+    AFTER INSERT OR UPDATE OF price, markup_percent, markup_amount, selling_price ON products
+    FOR EACH ROW EXECUTE FUNCTION record_product_price_change();
+
+-- Existing products start their history with the current price
+INSERT INTO product_price_history (product_id, company_id, price, markup_percent,
+                                   markup_amount, selling_price, source, effective_from)
+SELECT p.id, p.company_id, p.price, p.markup_percent, p.markup_amount, p.selling_price,
+       'initial', COALESCE(p.updated_at, p.created_at, NOW())
+FROM products p
+WHERE NOT EXISTS (SELECT 1 FROM product_price_history h WHERE h.product_id = p.id);
@@ -0,0 +1,28 @@
+-- ============================================
+-- PRODUCT SUPPLIER
+-- ============================================
+ALTER TABLE products ADD COLUMN IF NOT EXISTS supplier VARCHAR(255);
+
+CREATE INDEX IF NOT EXISTS idx_products_supplier ON products(company_id, supplier);
+
+-- ============================================
+-- PRICING RULES
+-- Company defaults, overridden per category and per supplier.
+-- NULL fields inherit from the less specific rule.
+-- ============================================
+CREATE TABLE IF NOT EXISTS pricing_rules (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    scope VARCHAR(50) NOT NULL DEFAULT 'default', -- default, category, supplier
+    match VARCHAR(255),                           -- category or supplier name
+    markup_percent DECIMAL(5,2),
+    min_margin_percent DECIMAL(5,2),
+    rounding_mode VARCHAR(50),                    -- none, up, nearest, down, ending
+    rounding_step DECIMAL(15,2),
+    rounding_ending DECIMAL(15,2),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_pricing_rules_unique
+    ON pricing_rules(company_id, scope, COALESCE(match, ''));
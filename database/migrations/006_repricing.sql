@@ -0,0 +1,34 @@
+-- ============================================
+-- BULK REPRICING
+-- Each batch keeps the old and new price of every product it touched,
+-- so it can be undone.
+-- ============================================
+CREATE TABLE IF NOT EXISTS reprice_batches (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    filter JSONB NOT NULL DEFAULT '{}'::jsonb,
+    target VARCHAR(50) NOT NULL,     -- price, markup_percent
+    mode VARCHAR(50) NOT NULL,       -- percent, fixed
+    value DECIMAL(15,2) NOT NULL,
+    note TEXT,
+    product_count INTEGER DEFAULT 0,
+    status VARCHAR(50) DEFAULT 'applied', -- applied, undone
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    undone_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_reprice_batches_company ON reprice_batches(company_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS reprice_batch_items (
+    batch_id INTEGER NOT NULL REFERENCES reprice_batches(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    old_price DECIMAL(15,2) NOT NULL,
+    old_markup_percent DECIMAL(5,2) NOT NULL,
+    old_markup_amount DECIMAL(15,2) NOT NULL,
+    old_selling_price DECIMAL(15,2) NOT NULL,
+    new_price DECIMAL(15,2) NOT NULL,
+    new_markup_percent DECIMAL(5,2) NOT NULL,
+    new_markup_amount DECIMAL(15,2) NOT NULL,
+    new_selling_price DECIMAL(15,2) NOT NULL,
+    PRIMARY KEY (batch_id, product_id)
+);
@@ -0,0 +1,26 @@
+-- ============================================
+-- SOFT DELETE
+-- Deleted products and companies stay in the trash until they are
+-- restored or purged after the retention period.
+-- ============================================
+ALTER TABLE products ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_products_company_active ON products(company_id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_products_deleted ON products(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_companies_deleted ON companies(deleted_at) WHERE deleted_at IS NOT NULL;
+
+-- ============================================
+-- BULK DELETE CONFIRMATIONS
+-- A bulk delete first issues a short-lived token for an exact selection,
+-- which the client must send back to carry it out.
+-- ============================================
+CREATE TABLE IF NOT EXISTS delete_confirmations (
+    token VARCHAR(64) PRIMARY KEY,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    product_ids INTEGER[] NOT NULL,
+    product_count INTEGER NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
@@ -0,0 +1,17 @@
+-- ============================================
+-- PRODUCT BUNDLES
+-- A bundle (gift set, school kit) is a product with its own price, made
+-- of other products. Selling one takes its components out of stock; its
+-- available quantity is derived from the components' stock.
+-- ============================================
+ALTER TABLE products ADD COLUMN IF NOT EXISTS is_bundle BOOLEAN DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS product_bundle_items (
+    bundle_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    component_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    quantity INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (bundle_id, component_id),
+    CHECK (bundle_id <> component_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_bundle_items_component ON product_bundle_items(component_id);
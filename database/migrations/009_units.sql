@@ -0,0 +1,38 @@
+-- ============================================
+-- UNITS OF MEASURE
+-- Stock is kept in the product's base unit (pcs, kg, l, m, ...) with up to
+-- three decimal places; quantity_precision limits how many a product allows.
+-- ============================================
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_name = 'products' AND column_name = 'quantity') = 'integer' THEN
+        ALTER TABLE products ALTER COLUMN quantity TYPE NUMERIC(15,3);
+    END IF;
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_name = 'product_bundle_items' AND column_name = 'quantity') = 'integer' THEN
+        ALTER TABLE product_bundle_items ALTER COLUMN quantity TYPE NUMERIC(15,3);
+    END IF;
+END $$;
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS unit VARCHAR(10) NOT NULL DEFAULT 'pcs';
+ALTER TABLE products ADD COLUMN IF NOT EXISTS quantity_precision SMALLINT NOT NULL DEFAULT 0
+    CHECK (quantity_precision BETWEEN 0 AND 3);
+
+-- ============================================
+-- PACKAGING UNITS
+-- Other units a product is bought or sold in, as a number of base units:
+-- a box of 12 pieces, a 25 kg sack. Selling one takes factor base units
+-- out of stock, at factor times the base unit price.
+-- ============================================
+CREATE TABLE IF NOT EXISTS product_units (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    name VARCHAR(50) NOT NULL,
+    factor NUMERIC(15,3) NOT NULL CHECK (factor > 0),
+    barcode VARCHAR(100),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(product_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_units_barcode ON product_units(barcode) WHERE barcode IS NOT NULL;
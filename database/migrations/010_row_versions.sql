@@ -0,0 +1,30 @@
+-- ============================================
+-- ROW VERSIONS
+-- Every update bumps version; reads return it as the ETag and edits send
+-- it back in If-Match, so a change made in between is not overwritten.
+-- ============================================
+ALTER TABLE products ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE advertisements ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE company_custom_expenses ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+CREATE OR REPLACE FUNCTION bump_row_version()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.version = OLD.version + 1;
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+DO $$
+DECLARE
+    t text;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['products', 'companies', 'advertisements', 'expenses', 'company_custom_expenses']
+    LOOP
+        EXECUTE format('DROP TRIGGER IF EXISTS bump_%I_version ON %I', t, t);
+        EXECUTE format('CREATE TRIGGER bump_%I_version BEFORE UPDATE ON %I FOR EACH ROW EXECUTE FUNCTION bump_row_version()', t, t);
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,28 @@
+-- ============================================
+-- PRODUCT LISTING
+-- sold_quantity is the base-unit quantity sold through paid orders and
+-- backs the best-selling sort. It is backfilled once, when it is added.
+-- ============================================
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns
+                   WHERE table_name = 'products' AND column_name = 'sold_quantity') THEN
+        ALTER TABLE products ADD COLUMN sold_quantity NUMERIC(15,3) NOT NULL DEFAULT 0;
+
+        UPDATE products p SET sold_quantity = s.sold
+        FROM (
+            SELECT (item->>'product_id')::int AS product_id, SUM((item->>'quantity')::numeric) AS sold
+            FROM customer_orders o, jsonb_array_elements(o.items) item
+            WHERE o.payment_confirmed AND item ? 'product_id' AND item ? 'quantity'
+            GROUP BY 1
+        ) s
+        WHERE p.id = s.product_id;
+    END IF;
+END $$;
+
+-- Keyset pagination walks these in order instead of sorting the whole catalog
+CREATE INDEX IF NOT EXISTS idx_products_company_name ON products(company_id, name, id) WHERE deleted_at IS NULL;
+-- The price sort treats a missing price as 0, so its index is on that expression
+DROP INDEX IF EXISTS idx_products_company_price;
+CREATE INDEX IF NOT EXISTS idx_products_company_price_sort ON products(company_id, (COALESCE(selling_price, 0)), id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_products_company_sold ON products(company_id, sold_quantity, id) WHERE deleted_at IS NULL;
@@ -0,0 +1,52 @@
+-- ============================================
+-- PRODUCT CHANGE TRACKING
+-- change_xid is the transaction that last wrote a product. Clients sync
+-- incrementally by asking for rows written after a transaction horizon;
+-- purged products leave a tombstone so their removal reaches the client.
+-- ============================================
+ALTER TABLE products ADD COLUMN IF NOT EXISTS change_xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+
+CREATE TABLE IF NOT EXISTS product_tombstones (
+    product_id INTEGER PRIMARY KEY,
+    company_id INTEGER NOT NULL,
+    version INTEGER NOT NULL,
+    change_xid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+    deleted_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_products_changes ON products(change_xid, id);
+CREATE INDEX IF NOT EXISTS idx_products_company_changes ON products(company_id, change_xid, id);
+CREATE INDEX IF NOT EXISTS idx_product_tombstones_changes ON product_tombstones(company_id, change_xid);
+-- Lets the catalog ETag sum versions from the index alone
+CREATE INDEX IF NOT EXISTS idx_products_company_version ON products(company_id) INCLUDE (version);
+
+CREATE OR REPLACE FUNCTION stamp_product_change()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.change_xid = pg_current_xact_id();
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+-- The tombstone takes the next version, so the sum of versions over
+-- products and tombstones grows with every insert, update and purge
+CREATE OR REPLACE FUNCTION record_product_tombstone()
+RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO product_tombstones (product_id, company_id, version)
+    VALUES (OLD.id, OLD.company_id, OLD.version + 1)
+    ON CONFLICT (product_id) DO UPDATE SET
+        version = EXCLUDED.version,
+        change_xid = pg_current_xact_id(),
+        deleted_at = NOW();
+    RETURN OLD;
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS stamp_products_change ON products;
+CREATE TRIGGER stamp_products_change BEFORE UPDATE ON products
+    FOR EACH ROW EXECUTE FUNCTION stamp_product_change();
+
+DROP TRIGGER IF EXISTS record_products_tombstone ON products;
+CREATE TRIGGER record_products_tombstone AFTER DELETE ON products
+    FOR EACH ROW EXECUTE FUNCTION record_product_tombstone();
@@ -0,0 +1,35 @@
+-- ============================================
+-- PRODUCT REVIEWS
+-- One review per customer (phone) and product, allowed once the customer
+-- received the product in a completed order. Reviews are published at once;
+-- admins can hide them. rating/rating_count on products cover published
+-- reviews only.
+-- ============================================
+CREATE TABLE IF NOT EXISTS product_reviews (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    company_id INTEGER NOT NULL,
+    order_id INTEGER REFERENCES customer_orders(id) ON DELETE SET NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    user_phone VARCHAR(50) NOT NULL,
+    user_name VARCHAR(255),
+    rating INTEGER NOT NULL CHECK (rating >= 1 AND rating <= 5),
+    body TEXT NOT NULL DEFAULT '',
+    photos JSONB NOT NULL DEFAULT '[]'::jsonb,
+    status VARCHAR(20) NOT NULL DEFAULT 'published', -- published, hidden
+    moderation_reason TEXT,
+    moderated_by VARCHAR(255),
+    moderated_at TIMESTAMP WITH TIME ZONE,
+    reply TEXT,
+    replied_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(product_id, user_phone)
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_reviews_product ON product_reviews(product_id, status, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_product_reviews_company ON product_reviews(company_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_product_reviews_status ON product_reviews(status, created_at DESC);
+
+ALTER TABLE products ADD COLUMN IF NOT EXISTS rating DECIMAL(3,2) NOT NULL DEFAULT 0.00;
+ALTER TABLE products ADD COLUMN IF NOT EXISTS rating_count INTEGER NOT NULL DEFAULT 0;
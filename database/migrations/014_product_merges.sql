@@ -0,0 +1,28 @@
+-- ============================================
+-- DUPLICATE PRODUCTS
+-- Names are compared by trigram similarity. A merge moves the stock and
+-- every reference of the duplicates to the surviving product and trashes
+-- the duplicates; product_merges keeps what was merged.
+-- ============================================
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS idx_products_name_trgm ON products USING gin (lower(name) gin_trgm_ops) WHERE deleted_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS product_merges (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    survivor_id INTEGER NOT NULL, -- no foreign key: the audit outlives purged products
+    merged_ids INTEGER[] NOT NULL,
+    merged_products JSONB NOT NULL DEFAULT '[]'::jsonb, -- the duplicates as they were before the merge
+    quantity_added NUMERIC(15,3) NOT NULL DEFAULT 0,
+    rewritten JSONB NOT NULL DEFAULT '{}'::jsonb,       -- rows updated per kind of reference
+    merged_by VARCHAR(255),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_product_merges_company ON product_merges(company_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_product_merges_survivor ON product_merges(survivor_id);
+
+-- The cart and likes handlers keep whole items under these columns
+ALTER TABLE user_cart ADD COLUMN IF NOT EXISTS cart_items JSONB NOT NULL DEFAULT '[]'::jsonb;
+ALTER TABLE user_likes ADD COLUMN IF NOT EXISTS liked_products JSONB NOT NULL DEFAULT '[]'::jsonb;
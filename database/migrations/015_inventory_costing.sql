@@ -0,0 +1,117 @@
+-- ============================================
+-- INVENTORY COSTING
+-- Stock is kept in lots: each arrival of stock is a lot with its unit cost,
+-- and stock leaving takes the oldest lots first. A company values what it
+-- sells either FIFO, from those lots, or at the product's moving average
+-- cost. Stock receipts record deliveries at their purchase cost. Any other
+-- change of quantity (editing a product, imports) is kept in step by a
+-- trigger, adding a lot at the current cost or taking the oldest lots.
+-- Code that keeps the lots itself turns the trigger off per transaction:
+--   SELECT set_config('azaton.stock_lots', 'manual', true)
+-- ============================================
+ALTER TABLE companies ADD COLUMN IF NOT EXISTS costing_method VARCHAR(10) NOT NULL DEFAULT 'average'
+    CHECK (costing_method IN ('fifo', 'average'));
+
+-- NULL until the first receipt; the purchase price stands in until then
+ALTER TABLE products ADD COLUMN IF NOT EXISTS average_cost NUMERIC(15,4);
+
+CREATE TABLE IF NOT EXISTS stock_receipts (
+    id SERIAL PRIMARY KEY,
+    company_id INTEGER NOT NULL REFERENCES companies(id) ON DELETE CASCADE,
+    supplier VARCHAR(255),
+    note TEXT,
+    received_by VARCHAR(255),
+    total_cost NUMERIC(15,2) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_receipts_company ON stock_receipts(company_id, created_at DESC);
+
+CREATE TABLE IF NOT EXISTS stock_receipt_items (
+    id SERIAL PRIMARY KEY,
+    receipt_id INTEGER NOT NULL REFERENCES stock_receipts(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    quantity NUMERIC(15,3) NOT NULL CHECK (quantity > 0),
+    unit VARCHAR(50),                          -- a packaging unit; NULL is the base unit
+    unit_cost NUMERIC(15,4) NOT NULL CHECK (unit_cost >= 0), -- per unit
+    base_quantity NUMERIC(15,3) NOT NULL,
+    total_cost NUMERIC(15,2) NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_receipt_items_receipt ON stock_receipt_items(receipt_id);
+CREATE INDEX IF NOT EXISTS idx_stock_receipt_items_product ON stock_receipt_items(product_id);
+
+CREATE TABLE IF NOT EXISTS stock_lots (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    company_id INTEGER NOT NULL,
+    receipt_id INTEGER REFERENCES stock_receipts(id) ON DELETE SET NULL,
+    source VARCHAR(20) NOT NULL DEFAULT 'adjustment', -- receipt, opening, adjustment
+    quantity NUMERIC(15,3) NOT NULL,   -- base units that arrived
+    remaining NUMERIC(15,3) NOT NULL,  -- base units still on hand
+    unit_cost NUMERIC(15,4) NOT NULL,  -- per base unit
+    received_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_lots_open ON stock_lots(product_id, received_at, id) WHERE remaining > 0;
+
+-- Cost of goods sold, set when an order is paid or a sale recorded;
+-- NULL for the ones from before costing
+ALTER TABLE customer_orders ADD COLUMN IF NOT EXISTS cost_of_goods NUMERIC(15,2);
+ALTER TABLE sales_history ADD COLUMN IF NOT EXISTS cost_of_goods NUMERIC(15,2);
+
+-- ============================================
+-- TRIGGER: Keep stock lots in step with the quantity
+-- ============================================
+CREATE OR REPLACE FUNCTION sync_stock_lots()
+RETURNS TRIGGER AS $$
+DECLARE
+    delta NUMERIC;
+    taken NUMERIC;
+    lot RECORD;
+BEGIN
+    IF COALESCE(NEW.is_bundle, false)
+       OR COALESCE(current_setting('azaton.stock_lots', true), '') = 'manual' THEN
+        RETURN NEW;
+    END IF;
+
+    delta := COALESCE(NEW.quantity, 0);
+    IF TG_OP = 'UPDATE' THEN
+        delta := delta - COALESCE(OLD.quantity, 0);
+    END IF;
+
+    IF delta > 0 THEN
+        INSERT INTO stock_lots (product_id, company_id, source, quantity, remaining, unit_cost)
+        VALUES (NEW.id, NEW.company_id, CASE WHEN TG_OP = 'INSERT' THEN 'opening' ELSE 'adjustment' END,
+                delta, delta, COALESCE(NEW.average_cost, NEW.price, 0));
+    ELSIF delta < 0 THEN
+        delta := -delta;
+        FOR lot IN
+            SELECT id, remaining FROM stock_lots
+            WHERE product_id = NEW.id AND remaining > 0
+            ORDER BY received_at, id
+            FOR UPDATE
+        LOOP
+            taken := LEAST(lot.remaining, delta);
+            UPDATE stock_lots SET remaining = remaining - taken WHERE id = lot.id;
+            delta := delta - taken;
+            EXIT WHEN delta <= 0;
+        END LOOP;
+    END IF;
+
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+DROP TRIGGER IF EXISTS products_stock_lots ON products;
+CREATE TRIGGER products_stock_lots
+    AFTER INSERT OR UPDATE OF quantity ON products
+    FOR EACH ROW EXECUTE FUNCTION sync_stock_lots();
+
+-- Stock on hand from before lots opens at the purchase price
+INSERT INTO stock_lots (product_id, company_id, source, quantity, remaining, unit_cost, received_at)
+SELECT p.id, p.company_id, 'opening', p.quantity, p.quantity, COALESCE(p.price, 0),
+       COALESCE(p.updated_at, p.created_at, NOW())
+FROM products p
+WHERE p.quantity > 0 AND NOT COALESCE(p.is_bundle, false)
+  AND NOT EXISTS (SELECT 1 FROM stock_lots l WHERE l.product_id = p.id);
@@ -0,0 +1,34 @@
+-- ============================================
+-- ORDER LIFECYCLE
+-- pending → accepted → packing → ready / out_for_delivery → completed,
+-- plus cancelled and refunded. The legal transitions are enforced by the
+-- API; every transition is recorded in order_status_history.
+-- ============================================
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'customer_orders_status_check') THEN
+        -- NOT VALID: rows written before the lifecycle are left as they are
+        ALTER TABLE customer_orders ADD CONSTRAINT customer_orders_status_check
+            CHECK (status IN ('pending', 'accepted', 'packing', 'ready', 'out_for_delivery',
+                              'completed', 'cancelled', 'refunded')) NOT VALID;
+    END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES customer_orders(id) ON DELETE CASCADE,
+    from_status VARCHAR(50),           -- NULL when the order was placed
+    to_status VARCHAR(50) NOT NULL,
+    actor_role VARCHAR(20) NOT NULL,   -- customer, company, admin, system
+    actor VARCHAR(255),                -- who, as far as known: a name, phone or company
+    note TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_order_status_history_order ON order_status_history(order_id, created_at, id);
+
+-- Orders from before the history start with their current status
+INSERT INTO order_status_history (order_id, from_status, to_status, actor_role, note, created_at)
+SELECT o.id, NULL, o.status, 'system', 'initial', COALESCE(o.updated_at, o.created_date, NOW())
+FROM customer_orders o
+WHERE NOT EXISTS (SELECT 1 FROM order_status_history h WHERE h.order_id = o.id);
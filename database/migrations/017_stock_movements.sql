@@ -0,0 +1,25 @@
+-- ============================================
+-- STOCK MOVEMENTS
+-- Every change the API makes to a product's stock, in base units: sales on
+-- payment confirmation and till sales, refunds put back in stock and receipts.
+-- ============================================
+CREATE TABLE IF NOT EXISTS stock_movements (
+    id SERIAL PRIMARY KEY,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    company_id INTEGER REFERENCES companies(id) ON DELETE CASCADE,
+    reason VARCHAR(20) NOT NULL CHECK (reason IN ('sale', 'refund', 'receipt')),
+    quantity NUMERIC(15,3) NOT NULL,       -- signed: negative leaves stock
+    quantity_after NUMERIC(15,3) NOT NULL,
+    order_id INTEGER REFERENCES customer_orders(id) ON DELETE SET NULL,
+    receipt_id INTEGER REFERENCES stock_receipts(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Till sales take their stock out when they are recorded
+ALTER TABLE stock_movements ADD COLUMN IF NOT EXISTS sale_id INTEGER REFERENCES sales_history(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_stock_movements_product ON stock_movements(product_id, created_at DESC);
+
+-- An order takes a product out of stock once, however often its payment is confirmed
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_movements_order_sale
+    ON stock_movements(order_id, product_id) WHERE reason = 'sale';
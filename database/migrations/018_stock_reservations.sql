@@ -0,0 +1,23 @@
+-- ============================================
+-- STOCK RESERVATIONS
+-- An order holds the stock of its items from the moment it is placed until
+-- it is paid or cancelled, in base units, bundles as their components.
+-- A pending order's hold runs out at expires_at; once accepted it is kept
+-- until the order is closed (expires_at NULL).
+-- ============================================
+CREATE TABLE IF NOT EXISTS stock_reservations (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES customer_orders(id) ON DELETE CASCADE,
+    product_id INTEGER NOT NULL REFERENCES products(id) ON DELETE CASCADE,
+    company_id INTEGER REFERENCES companies(id) ON DELETE CASCADE,
+    quantity NUMERIC(15,3) NOT NULL CHECK (quantity > 0),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE(order_id, product_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_product ON stock_reservations(product_id);
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_company ON stock_reservations(company_id);
+
+-- Pending orders expire by their reservations running out
+CREATE INDEX IF NOT EXISTS idx_stock_reservations_expires ON stock_reservations(expires_at) WHERE expires_at IS NOT NULL;
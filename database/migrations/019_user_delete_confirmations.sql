@@ -0,0 +1,13 @@
+-- ============================================
+-- DELETE ALL USERS CONFIRMATIONS
+-- Deleting every user first issues a short-lived token for the users there
+-- are at that moment, as bulk product deletes do.
+-- ============================================
+CREATE TABLE IF NOT EXISTS user_delete_confirmations (
+    token VARCHAR(64) PRIMARY KEY,
+    user_ids INTEGER[] NOT NULL,
+    user_count INTEGER NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
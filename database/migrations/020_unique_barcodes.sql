@@ -0,0 +1,24 @@
+-- ============================================
+-- UNIQUE BARCODES
+-- A barcode names one live product per company. Trashed products keep
+-- theirs and cannot be restored while another product holds it.
+-- Existing duplicates must be merged first (/api/products/duplicates); until
+-- then the index is skipped with a warning and retried on the next start.
+-- The API checks for a live holder before every barcode write either way, so
+-- no new duplicates are written meanwhile; the index closes concurrent races.
+-- ============================================
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_indexes WHERE indexname = 'idx_products_company_barcode_unique') THEN
+        IF EXISTS (
+            SELECT 1 FROM products
+            WHERE deleted_at IS NULL AND barcode <> ''
+            GROUP BY company_id, barcode HAVING COUNT(*) > 1
+        ) THEN
+            RAISE WARNING 'Products share barcodes; merge them to enforce unique barcodes';
+        ELSE
+            CREATE UNIQUE INDEX idx_products_company_barcode_unique ON products(company_id, barcode)
+                WHERE deleted_at IS NULL AND barcode <> '';
+        END IF;
+    END IF;
+END $$;
@@ -1,6 +1,6 @@
 import React, { useState, useEffect } from 'react';
 import { Shield, LogOut, Users, Trash2, Building2, Save, RefreshCw, Eye, EyeOff, CreditCard, Megaphone, MessageCircle } from 'lucide-react';
-import { getUsers, deleteAllUsers, deleteAllProducts, getMainCompany, updateMainCompany } from '../utils/api';
+import { getUsers, deleteAllUsers, getMainCompany, updateMainCompany } from '../utils/api';
 import CompanyManagement from './CompanyManagement';
 import PaymentSettings from './PaymentSettings';
 import PaymentHistoryPanel from './PaymentHistoryPanel';
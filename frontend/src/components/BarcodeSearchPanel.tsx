@@ -1,7 +1,7 @@
 import { Barcode, CheckCircle, Minus, Package, Plus, RefreshCw, Search, ShoppingCart, Trash2, X } from 'lucide-react';
 import { useEffect, useRef, useState } from 'react';
 import { addCashierSale } from '../utils/api';
-import { localCache, queryClient, useProducts, useUpdateProduct } from '../utils/cache';
+import { localCache, queryClient, useProducts } from '../utils/cache';
 import { invalidateCache } from '../utils/productsCache';
 
 interface Product {
@@ -31,7 +31,6 @@ interface BarcodeSearchPanelProps {
 
 export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProps) {
   const { data: products = [], isLoading, refetch } = useProducts(companyId);
-  const updateProductMutation = useUpdateProduct();
   const [searchBarcode, setSearchBarcode] = useState('');
   const [cart, setCart] = useState<CartItem[]>([]);
   const [lastScannedProduct, setLastScannedProduct] = useState<Product | null>(null);
@@ -58,7 +57,11 @@ export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProp
   }, [products]);
 
   // 🎯 Вспомогательная функция для расчета цены с наценкой
-  const getPriceWithMarkup = (price: number, markupPercent: number = 0) => {
+  // The server prices sales at selling_price (after pricing rules); the markup formula is only a fallback
+  const getPriceWithMarkup = (price: number, markupPercent: number = 0, sellingPrice?: number) => {
+    if (sellingPrice && sellingPrice > 0) {
+      return sellingPrice;
+    }
     return price * (1 + markupPercent / 100);
   };
 
@@ -173,7 +176,7 @@ export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProp
 
   const getTotalAmount = () => {
     return cart.reduce((sum, item) => {
-      const priceWithMarkup = getPriceWithMarkup(item.product.price, item.product.markup_percent || 0);
+      const priceWithMarkup = getPriceWithMarkup(item.product.price, item.product.markup_percent || 0, item.product.selling_price);
       return sum + (priceWithMarkup * item.quantity);
     }, 0);
   };
@@ -225,7 +228,7 @@ export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProp
         items: cart.map(item => {
           const basePrice = item.product.price;
           const markupPercent = item.product.markup_percent || 0;
-          const priceWithMarkup = getPriceWithMarkup(basePrice, markupPercent);
+          const priceWithMarkup = getPriceWithMarkup(basePrice, markupPercent, item.product.selling_price);
           const markupAmount = priceWithMarkup - basePrice; // Наценка за 1 штуку
 
           // ✅ Добавляем прибыль от наценки этого товара
@@ -250,7 +253,7 @@ export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProp
       console.log('🛒 [Checkout] Sale data:', saleData);
       console.log(`💰 [Checkout] Total markup profit: ${totalMarkupProfit.toLocaleString()} сум`);
 
-      // 1. Сохраняем продажу в аналитику
+      // 1. Сохраняем продажу; сервер сам списывает товары со склада
       console.log('💾 [Checkout] Saving sale to analytics...');
       console.log(`💰 [Checkout] Данные для сохранения:`);
       console.log(`   - total_amount (selling_price): ${saleData.total_amount.toLocaleString()} сум`);
@@ -259,20 +262,7 @@ export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProp
       const saleResult = await addCashierSale(saleData);
       console.log('✅ [Checkout] Sale saved:', saleResult);
 
-      // 2. Уменьшаем количество товаров на складе
-      console.log('📦 [Checkout] Updating product quantities...');
-      for (const item of cart) {
-        console.log(`📦 [Checkout] Updating ${item.product.name}: ${item.product.quantity} - ${item.quantity} = ${item.product.quantity - item.quantity}`);
-        await updateProductMutation.mutateAsync({
-          id: item.product.id,
-          updates: {
-            quantity: item.product.quantity - item.quantity
-          }
-        });
-      }
-      console.log('✅ [Checkout] All products updated');
-
-      // 3. Очищаем кэш и обновляем данные
+      // 2. Очищаем кэш и обновляем данные
       console.log('🔄 [Checkout] Refreshing cache...');
       localCache.clear();
       queryClient.invalidateQueries({ queryKey: ['products'] });
@@ -282,7 +272,7 @@ export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProp
       await refetch();
       console.log('✅ [Checkout] Cache refreshed');
 
-      // 4. Очищаем корзину
+      // 3. Очищаем корзину
       setCart([]);
       setLastScannedProduct(null);
       setNotFound(false);
@@ -385,7 +375,7 @@ export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProp
           <div className="flex-1">
             <div className="text-green-800 font-medium text-lg">✅ Добавлено в заказ!</div>
             <div className="text-green-700">
-              {lastScannedProduct.name} - {formatPrice(getPriceWithMarkup(lastScannedProduct.price, lastScannedProduct.markup_percent || 0))}
+              {lastScannedProduct.name} - {formatPrice(getPriceWithMarkup(lastScannedProduct.price, lastScannedProduct.markup_percent || 0, lastScannedProduct.selling_price))}
             </div>
           </div>
           <button
@@ -448,7 +438,7 @@ export default function BarcodeSearchPanel({ companyId }: BarcodeSearchPanelProp
                     <div className="text-sm text-gray-600 font-mono">{item.product.barcode}</div>
                     <div className="text-green-600 font-medium mt-1">
                       {(() => {
-                        const priceWithMarkup = getPriceWithMarkup(item.product.price, item.product.markup_percent || 0);
+                        const priceWithMarkup = getPriceWithMarkup(item.product.price, item.product.markup_percent || 0, item.product.selling_price);
                         const totalPrice = priceWithMarkup * item.quantity;
                         return `${formatPrice(priceWithMarkup)} × ${item.quantity} = ${formatPrice(totalPrice)}`;
                       })()}
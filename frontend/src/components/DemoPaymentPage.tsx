@@ -162,9 +162,10 @@ export default function DemoPaymentPage({
         const updateResponse = await fetch(
           `${API_BASE}/products/${item.id}`,
           {
-            method: 'PUT',
+            method: 'PATCH',
             headers: {
-              'Content-Type': 'application/json'
+              'Content-Type': 'application/json',
+              'If-Match': `"${product.version}"`
             },
             body: JSON.stringify({
               quantity: newQuantity
@@ -2,7 +2,7 @@ import { useQueryClient } from '@tanstack/react-query';
 import { Check, Download, Edit2, Image as ImageIcon, Layers, Package, Plus, Search, Trash2, Upload, X } from 'lucide-react';
 import React, { useMemo, useState } from 'react';
 import * as XLSX from 'xlsx';
-import { addProduct, bulkImportProducts, deleteAllProducts, deleteProduct, toggleProductCustomerAvailability, updateProduct } from '../utils/api';
+import { addProduct, bulkImportProducts, confirmBulkDelete, deleteProduct, prepareBulkDelete, toggleProductCustomerAvailability, updateProduct } from '../utils/api';
 import { useCompanyProducts } from '../utils/cache';
 import { invalidateCache } from '../utils/productsCache';
 import ExcelColumnMapper, { ColumnMapping } from './ExcelColumnMapper';
@@ -157,7 +157,7 @@ export const DigitalWarehouse: React.FC<DigitalWarehouseProps> = ({ companyId })
         }
       }
 
-      await updateProduct(id, validatedForm); // 🔥 ИСПРАВЛЕНО: было (companyId, id, validatedForm)
+      await updateProduct(id, validatedForm, originalProduct?.version); // 🔥 ИСПРАВЛЕНО: было (companyId, id, validatedForm)
 
       // 🎯 Если это был последний реальный товар в старой категории, создаем маркер
       if (oldCategory && oldCategory !== newCategory) {
@@ -291,26 +291,26 @@ export const DigitalWarehouse: React.FC<DigitalWarehouseProps> = ({ companyId })
 
   // 🗑️ Массовое удаление ВСЕХ товаров
   const handleDeleteAllProducts = async () => {
-    // 🚫 Считаем только реальные товары
-    const realProducts = products.filter((p: any) => !p.name || !p.name.startsWith('__CATEGORY_MARKER__'));
-    const confirmMessage = `⚠️ ВНИМАНИЕ! Вы собираетесь удалить ВСЕ ${realProducts.length} товаров!\n\nЭто действие НЕЛЬЗЯ отменить!\n\nВведите "УДАЛИТЬ" для подтверждения:`;
-    const userInput = prompt(confirmMessage);
+    try {
+      // Сервер сам считает товары и выдаёт токен подтверждения
+      const { token, count } = await prepareBulkDelete(companyId);
+      const confirmMessage = `⚠️ ВНИМАНИЕ! Вы собираетесь удалить ВСЕ ${count} товаров!\n\nТовары будут перемещены в корзину.\n\nВведите "УДАЛИТЬ" для подтверждения:`;
+      const userInput = prompt(confirmMessage);
 
-    if (userInput !== 'УДАЛИТЬ') {
-      alert('Удаление отменено');
-      return;
-    }
+      if (userInput !== 'УДАЛИТЬ') {
+        alert('Удаление отменено');
+        return;
+      }
 
-    try {
       console.log('🗑️ Starting mass deletion of all products...');
-      await deleteAllProducts();
+      const { deleted } = await confirmBulkDelete(companyId, token);
 
       localCache.clear();
       queryClient.invalidateQueries({ queryKey: ['products'] });
       invalidateCache();
       await refetch();
 
-      alert(`✅ Успешно удалено ${realProducts.length} товаров!`);
+      alert(`✅ Успешно удалено ${deleted} товаров!`);
     } catch (error) {
       console.error('Error deleting all products:', error);
       alert('Ошибка при массовом удалении товаров');
@@ -995,7 +995,7 @@ export const DigitalWarehouse: React.FC<DigitalWarehouseProps> = ({ companyId })
                                           for (const product of categoryProducts) {
                                             await updateProduct(product.id, {
                                               category: editCategoryName.trim()
-                                            });
+                                            }, product.version);
                                           }
                                           setEditingCategory(null);
                                           setEditCategoryName('');
@@ -1054,7 +1054,7 @@ export const DigitalWarehouse: React.FC<DigitalWarehouseProps> = ({ companyId })
                                           for (const product of realProducts) {
                                             await updateProduct(product.id, {
                                               category: ''
-                                            });
+                                            }, product.version);
                                           }
 
                                           // Удаляем товар-маркер категории
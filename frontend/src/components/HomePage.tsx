@@ -690,7 +690,7 @@ export default function HomePage({ onLogout, userName, userPhone, userCompanyId,
 
       totalAmount += priceWithMarkup * purchasedQty;
       purchasedItems.push({
-        id: product.id,
+        product_id: product.id,
         name: product.name,
         quantity: purchasedQty,
         price: product.price, // Base price
@@ -788,7 +788,11 @@ export default function HomePage({ onLogout, userName, userPhone, userCompanyId,
     return new Intl.NumberFormat('uz-UZ').format(price) + ' сум';
   };
 
+  // The server prices orders at selling_price (after pricing rules); the markup formula is only a fallback
   const getPriceWithMarkup = (product: Product) => {
+    if (product.selling_price && product.selling_price > 0) {
+      return product.selling_price;
+    }
     const markupPercent = product.markup_percent || 0;
     return product.price * (1 + markupPercent / 100);
   };
@@ -1070,7 +1074,7 @@ export default function HomePage({ onLogout, userName, userPhone, userCompanyId,
 
                                       try {
                                         console.log(`🚫 [Cancel Order] Cancelling order ${order.orderId}...`);
-                                        await cancelOrder(order.orderId!);
+                                        await cancelOrder(order.orderId!, { user_phone: userPhone });
 
                                         // Update order status locally
                                         setMyOrders(prev => prev.map(o =>
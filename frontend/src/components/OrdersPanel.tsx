@@ -119,7 +119,7 @@ export default function OrdersPanel({ companyId }: OrdersPanelProps) {
     setProcessingOrderId(orderId);
 
     try {
-      await confirmOrderPayment(orderId);
+      await confirmOrderPayment(orderId, { company_id: companyId });
       await loadOrders();
       await loadRevenue(); // ✅ Обновить выручку после подтверждения
       // Clear search if confirming the found order
@@ -203,7 +203,7 @@ export default function SalesPanel({ companyId }: SalesPanelProps) {
     if (!confirm('Подтвердить получение оплаты за этот заказ?')) return;
 
     try {
-      await confirmOrderPayment(orderId);
+      await confirmOrderPayment(orderId, { company_id: companyId });
       await loadData();
       alert('Оплата подтверждена! Товары обновлены.');
     } catch (error) {
@@ -98,6 +98,13 @@ export const MAIN_COMPANY = {
     access_key: '123456789012345678901234567890'
 };
 
+// If-Match header for an edit based on the given version (the ETag or the
+// "version" field of a read). Without a version the edit applies to
+// whatever is stored.
+function ifMatch(version?: number | null): Record<string, string> {
+    return { 'If-Match': version !== undefined && version !== null ? `"${version}"` : '*' };
+}
+
 // ============================================
 // COMPANIES API
 // ============================================
@@ -166,9 +173,10 @@ export async function verifyCompanyAccess(companyId: number, accessKey: string)
     return data.company;
 }
 
-export async function updateCompany(id: number, updates: any) {
+export async function updateCompany(id: number, updates: any, version?: number) {
     await apiCall(`/companies/${id}`, {
         method: 'PUT',
+        headers: ifMatch(version),
         body: JSON.stringify(updates),
     });
 }
@@ -224,6 +232,7 @@ export async function updateMainCompany(updates: { name?: string; phone?: string
     const currentCompany = await getMainCompany();
     await apiCall(`/companies/${currentCompany.id}`, {
         method: 'PUT',
+        headers: ifMatch(currentCompany.version),
         body: JSON.stringify(updates),
     });
     return currentCompany;
@@ -243,10 +252,11 @@ export async function rateCompany(companyId: number, customerId: string, rating:
 
 export async function getCompanyRevenue(companyId: number) {
     try {
-        const data = await apiCall<{ stats: any }>(`/companies/${companyId}/financial-stats`);
+        const data = await apiCall<any>(`/companies/${companyId}/financial-stats`);
+        const stats = data.stats || data;
         return {
-            totalRevenue: data.stats?.totalRevenue || 0,
-            companyEarnings: data.stats?.totalMarkupProfit || 0,
+            totalRevenue: stats.totalRevenue || 0,
+            companyEarnings: stats.totalMarkupProfit || 0,
             sellersRevenue: 0
         };
     } catch (error) {
@@ -257,19 +267,61 @@ export async function getCompanyRevenue(companyId: number) {
 
 export async function getFinancialStats(companyId: number) {
     try {
-        const data = await apiCall<{ stats: any }>(`/companies/${companyId}/financial-stats`);
+        const data = await apiCall<any>(`/companies/${companyId}/financial-stats`);
+        const stats = data.stats || data;
         return {
-            totalMarkupProfit: data.stats?.totalMarkupProfit || 0,
-            totalRevenue: data.stats?.totalRevenue || 0,
-            salesCount: data.stats?.salesCount || 0,
-            orders: data.stats?.orders || []
+            totalMarkupProfit: stats.totalMarkupProfit || 0,
+            totalRevenue: stats.totalRevenue || 0,
+            totalCostOfGoods: stats.totalCostOfGoods || 0, // FIFO or average cost of what was sold
+            grossProfit: stats.grossProfit || 0,
+            grossMarginPercent: stats.grossMarginPercent || 0,
+            salesCount: stats.salesCount || 0,
+            orders: stats.orders || []
         };
     } catch (error) {
         console.error('❌ [API] Error getting financial stats:', error);
-        return { totalMarkupProfit: 0, totalRevenue: 0, salesCount: 0, orders: [] };
+        return { totalMarkupProfit: 0, totalRevenue: 0, totalCostOfGoods: 0, grossProfit: 0, grossMarginPercent: 0, salesCount: 0, orders: [] };
     }
 }
 
+// ============================================
+// LIVE EVENTS (Server-Sent Events)
+// ============================================
+
+export interface LiveEvent {
+    type: string; // product.created, product.updated, product.deleted, stock.changed, order.created, order.updated, sale.created, resync
+    company_id: number;
+    data?: any;
+}
+
+// Streams the events of a company (all companies without companyId).
+// The browser reconnects by itself; events missed meanwhile are not
+// replayed, so onEvent gets a resync event and should reload.
+export function subscribeToEvents(companyId: number | undefined, onEvent: (event: LiveEvent) => void): () => void {
+    const url = companyId ? `${API_BASE}/events?company_id=${companyId}` : `${API_BASE}/events`;
+    const source = new EventSource(url);
+    const types = ['product.created', 'product.updated', 'product.deleted', 'stock.changed',
+        'order.created', 'order.updated', 'sale.created', 'resync'];
+
+    const handle = (e: MessageEvent) => {
+        try {
+            onEvent(e.type === 'resync' ? { type: 'resync', company_id: companyId || 0 } : JSON.parse(e.data));
+        } catch (error) {
+            console.error('❌ [Events] Bad event:', error);
+        }
+    };
+    types.forEach((type) => source.addEventListener(type, handle as EventListener));
+
+    let opened = false;
+    source.onopen = () => {
+        // After a reconnect anything may have changed in between
+        if (opened) onEvent({ type: 'resync', company_id: companyId || 0 });
+        opened = true;
+    };
+
+    return () => source.close();
+}
+
 // ============================================
 // PRODUCTS API
 // ============================================
@@ -280,35 +332,95 @@ export async function getProducts(companyId?: number) {
     return data.products || [];
 }
 
+// Pass the nextCursor of the previous page as cursor to get the next one;
+// offset is only kept for older callers
 export async function getProductsPaginated(params: {
     companyId?: number;
     limit?: number;
     offset?: number;
+    cursor?: string | null;
     search?: string;
     availableOnly?: boolean;
+    sort?: 'newest' | 'name' | 'price' | 'stock' | 'best_selling';
+    order?: 'asc' | 'desc';
+    minPrice?: number;
+    maxPrice?: number;
+    category?: string;
+    inStock?: boolean;
+    hasImages?: boolean;
+    hasBarcode?: boolean;
 }) {
-    const { companyId, limit = 50, offset = 0, search = '', availableOnly = false } = params;
+    const { companyId, limit = 50, offset = 0, cursor, search = '', availableOnly = false } = params;
 
     const queryParams = new URLSearchParams({
         limit: limit.toString(),
-        offset: offset.toString(),
         available_only: availableOnly.toString(),
     });
 
+    if (cursor) {
+        queryParams.append('cursor', cursor);
+    } else if (offset > 0) {
+        queryParams.append('offset', offset.toString());
+    }
     if (companyId) queryParams.append('company_id', companyId.toString());
     if (search) queryParams.append('search', search);
-
-    const data = await apiCall<{ products: any[]; total: number; hasMore: boolean }>(
+    if (params.sort) queryParams.append('sort', params.sort);
+    if (params.order) queryParams.append('order', params.order);
+    if (params.minPrice !== undefined) queryParams.append('min_price', params.minPrice.toString());
+    if (params.maxPrice !== undefined) queryParams.append('max_price', params.maxPrice.toString());
+    if (params.category) queryParams.append('category', params.category);
+    if (params.inStock) queryParams.append('in_stock', 'true');
+    if (params.hasImages !== undefined) queryParams.append('has_images', params.hasImages.toString());
+    if (params.hasBarcode !== undefined) queryParams.append('has_barcode', params.hasBarcode.toString());
+
+    const data = await apiCall<{
+        products: any[];
+        total: number;
+        total_estimated: boolean;
+        next_cursor: string | null;
+        hasMore: boolean;
+    }>(
         `/products/paginated?${queryParams.toString()}`
     );
 
     return {
         products: data.products || [],
         total: data.total || 0,
+        totalEstimated: data.total_estimated || false,
+        nextCursor: data.next_cursor || null,
         hasMore: data.hasMore || false
     };
 }
 
+// Products written and removed since a sync cursor. Without since every
+// active product is returned; keep calling with nextCursor while hasMore.
+export async function getProductChanges(params: {
+    companyId?: number;
+    since?: string | null;
+    limit?: number;
+    availableOnly?: boolean;
+}) {
+    const queryParams = new URLSearchParams();
+    if (params.companyId) queryParams.append('company_id', params.companyId.toString());
+    if (params.since) queryParams.append('since', params.since);
+    if (params.limit) queryParams.append('limit', params.limit.toString());
+    if (params.availableOnly) queryParams.append('available_only', 'true');
+
+    const data = await apiCall<{
+        upserted: any[];
+        deleted: number[];
+        next_cursor: string;
+        has_more: boolean;
+    }>(`/products/changes?${queryParams.toString()}`);
+
+    return {
+        upserted: data.upserted || [],
+        deleted: data.deleted || [],
+        nextCursor: data.next_cursor,
+        hasMore: data.has_more || false
+    };
+}
+
 export async function addProduct(product: {
     company_id: number;
     name: string;
@@ -340,22 +452,34 @@ export async function addProduct(product: {
     return data;
 }
 
-export async function updateProduct(id: number, updates: any) {
+// Sends a JSON merge patch: only the fields present are changed and null clears
+// a field. The server rejects fields it does not allow, such as selling_price.
+export async function updateProduct(id: number, updates: any, version?: number) {
     const cleanedUpdates = { ...updates };
-    delete cleanedUpdates.company_id; // Never change company_id
+    ['id', 'company_id', 'markup_amount', 'selling_price', 'images', 'created_at', 'updated_at'].forEach(field => {
+        delete cleanedUpdates[field];
+    });
 
-    const numericFields = ['price', 'markup_percent', 'markup_amount', 'selling_price', 'quantity', 'barcode', 'barid'];
-    numericFields.forEach(field => {
-        if (cleanedUpdates[field] === '' || cleanedUpdates[field] === null || cleanedUpdates[field] === undefined) {
+    ['price', 'markup_percent', 'quantity', 'barid'].forEach(field => {
+        const value = cleanedUpdates[field];
+        if (value === undefined || value === null || typeof value !== 'string') return;
+        const parsed = parseFloat(value);
+        if (!isNaN(parsed)) {
+            cleanedUpdates[field] = parsed;
+        } else if (field === 'barid') {
             cleanedUpdates[field] = null;
-        } else if (typeof cleanedUpdates[field] === 'string') {
-            const parsed = parseFloat(cleanedUpdates[field]);
-            cleanedUpdates[field] = isNaN(parsed) ? null : parsed;
+        } else {
+            delete cleanedUpdates[field];
         }
     });
+    if (cleanedUpdates.barcode !== undefined && cleanedUpdates.barcode !== null) {
+        const code = String(cleanedUpdates.barcode).trim();
+        cleanedUpdates.barcode = code === '' ? null : code;
+    }
 
     await apiCall(`/products/${id}`, {
-        method: 'PUT',
+        method: 'PATCH',
+        headers: ifMatch(version),
         body: JSON.stringify(cleanedUpdates),
     });
 }
@@ -364,8 +488,20 @@ export async function deleteProduct(id: number) {
     await apiCall(`/products/${id}`, { method: 'DELETE' });
 }
 
-export async function deleteAllProducts() {
-    await apiCall('/products', { method: 'DELETE' });
+// Bulk delete is two-step: the server counts the selection and issues a
+// short-lived token that must be sent back to move the products to the trash
+export async function prepareBulkDelete(companyId: number, productIds?: number[]) {
+    return await apiCall<{ token: string; count: number; expires_at: string }>('/products/bulk-delete/prepare', {
+        method: 'POST',
+        body: JSON.stringify({ company_id: companyId, product_ids: productIds }),
+    });
+}
+
+export async function confirmBulkDelete(companyId: number, token: string) {
+    return await apiCall<{ deleted: number }>('/products/bulk-delete', {
+        method: 'POST',
+        body: JSON.stringify({ company_id: companyId, token }),
+    });
 }
 
 export async function bulkImportProducts(companyId: number, products: any[]) {
@@ -445,6 +581,128 @@ export async function deleteProductImage(productId: number, imageIndex: number)
     await apiCall(`/products/${productId}/images/${imageIndex}`, { method: 'DELETE' });
 }
 
+// Groups of products that share a barcode or have very similar names.
+// threshold is the name similarity (0-1) two products need, 0.6 by default.
+export async function findDuplicateProducts(companyId: number, threshold?: number) {
+    const params = new URLSearchParams({ company_id: String(companyId) });
+    if (threshold !== undefined) params.set('threshold', String(threshold));
+    return apiCall<{ groups: any[]; threshold: number; truncated: boolean }>(`/products/duplicates?${params}`);
+}
+
+// Merges duplicates into the survivor: stock, images, units, reviews and
+// every order, sale, cart and like move over; the duplicates go to the trash.
+export async function mergeProducts(companyId: number, survivorId: number, duplicateIds: number[], mergedBy?: string) {
+    console.log(`🔗 [API] Merging ${duplicateIds.length} products into ${survivorId}`);
+    const data = await apiCall<{ success: boolean; merge: any }>('/products/merge', {
+        method: 'POST',
+        body: JSON.stringify({ company_id: companyId, survivor_id: survivorId, duplicate_ids: duplicateIds, merged_by: mergedBy }),
+    });
+    return data.merge;
+}
+
+export async function getProductMerges(companyId: number) {
+    const data = await apiCall<{ merges: any[] }>(`/products/merges?company_id=${companyId}`);
+    return data.merges || [];
+}
+
+// Stock lots on hand, oldest first, with the average cost and stock value
+export async function getProductStockLots(productId: number) {
+    return apiCall<{ costing_method: string; quantity: number; average_cost: number; stock_value: number; lots: any[] }>(
+        `/products/${productId}/stock-lots`);
+}
+
+export async function getProductStockMovements(productId: number, limit?: number) {
+    const query = limit ? `?limit=${limit}` : '';
+    return apiCall<{ quantity: number; movements: any[] }>(`/products/${productId}/stock-movements${query}`);
+}
+
+// ============================================
+// PRODUCT REVIEWS API
+// ============================================
+
+export async function getProductReviews(productId: number, limit = 20, offset = 0) {
+    return await apiCall<{
+        reviews: any[];
+        rating: number;
+        rating_count: number;
+        distribution: Record<string, number>;
+        hasMore: boolean;
+    }>(`/products/${productId}/reviews?limit=${limit}&offset=${offset}`);
+}
+
+// Only customers who received the product in a completed order can review it
+export async function saveProductReview(productId: number, review: {
+    user_phone: string;
+    user_name?: string;
+    user_id?: number;
+    rating: number;
+    body?: string;
+}) {
+    const data = await apiCall<{ review: any }>(`/products/${productId}/reviews`, {
+        method: 'POST',
+        body: JSON.stringify(review),
+    });
+    return data.review;
+}
+
+export async function deleteProductReview(reviewId: number, userPhone: string) {
+    return await apiCall(`/reviews/${reviewId}?user_phone=${encodeURIComponent(userPhone)}`, {
+        method: 'DELETE',
+    });
+}
+
+export async function uploadReviewPhoto(reviewId: number, userPhone: string, file: File) {
+    const formData = new FormData();
+    formData.append('image', file);
+    formData.append('user_phone', userPhone);
+
+    const response = await fetch(`${API_BASE}/reviews/${reviewId}/photos`, {
+        method: 'POST',
+        body: formData,
+    });
+    const data = await response.json();
+    if (!response.ok) throw new Error(data.error || 'Failed to upload photo');
+    return data.photo;
+}
+
+export async function deleteReviewPhoto(reviewId: number, index: number, userPhone: string) {
+    return await apiCall(`/reviews/${reviewId}/photos/${index}?user_phone=${encodeURIComponent(userPhone)}`, {
+        method: 'DELETE',
+    });
+}
+
+export async function replyToReview(reviewId: number, companyId: number, reply: string) {
+    return await apiCall(`/reviews/${reviewId}/reply`, {
+        method: 'PUT',
+        body: JSON.stringify({ company_id: companyId, reply }),
+    });
+}
+
+// Moderation (admin panel)
+export async function getReviews(params: { status?: 'published' | 'hidden'; companyId?: number; productId?: number; limit?: number; offset?: number } = {}) {
+    const queryParams = new URLSearchParams();
+    if (params.status) queryParams.append('status', params.status);
+    if (params.companyId) queryParams.append('company_id', params.companyId.toString());
+    if (params.productId) queryParams.append('product_id', params.productId.toString());
+    if (params.limit) queryParams.append('limit', params.limit.toString());
+    if (params.offset) queryParams.append('offset', params.offset.toString());
+    return await apiCall<{ reviews: any[]; total: number }>(`/reviews?${queryParams.toString()}`);
+}
+
+export async function hideReview(reviewId: number, reason?: string, moderatedBy?: string) {
+    return await apiCall(`/reviews/${reviewId}/hide`, {
+        method: 'PUT',
+        body: JSON.stringify({ reason, moderated_by: moderatedBy }),
+    });
+}
+
+export async function publishReview(reviewId: number, moderatedBy?: string) {
+    return await apiCall(`/reviews/${reviewId}/publish`, {
+        method: 'PUT',
+        body: JSON.stringify({ moderated_by: moderatedBy }),
+    });
+}
+
 // ============================================
 // USERS API
 // ============================================
@@ -467,8 +725,10 @@ export async function getUserByPhone(phone: string) {
     return data.user || null;
 }
 
+// Deleting every user takes a confirmation token issued just before
 export async function deleteAllUsers() {
-    await apiCall('/users', { method: 'DELETE' });
+    const { token } = await apiCall<{ token: string }>('/users/delete-all/prepare', { method: 'POST' });
+    await apiCall('/users', { method: 'DELETE', body: JSON.stringify({ token }) });
 }
 
 // ============================================
@@ -507,6 +767,8 @@ export async function addCustomerOrder(order: {
             success: boolean;
             order_id: number;
             order_code: string;
+            items: any[];         // priced by the server, as stored
+            total_amount: number; // the server's total; the one sent is only checked against it
             unavailableItems?: any[];
             error?: string;
         }>('/customer-orders', {
@@ -522,31 +784,58 @@ export async function addCustomerOrder(order: {
         }
 
         console.log('✅ [API] Order created:', data.order_code);
-        return { order_id: data.order_id, order_code: data.order_code };
+        return { order_id: data.order_id, order_code: data.order_code, total_amount: data.total_amount };
     } catch (error) {
         console.error('❌ [API] Error creating order:', error);
         throw error;
     }
 }
 
-export async function confirmOrderPayment(orderId: number) {
+// Who moves an order along. Without one the company confirms payments and the customer cancels.
+export interface OrderActor {
+    actor?: 'customer' | 'company';
+    company_id?: number;
+    user_phone?: string;
+    changed_by?: string;
+    note?: string;
+}
+
+// The company confirms its own orders by company_id.
+// Fails with 409 and short_items when the order is not fully in stock; nothing is deducted then.
+export async function confirmOrderPayment(orderId: number, actor: OrderActor) {
     console.log(`💰 [API] Confirming payment for order #${orderId}...`);
-    const result = await apiCall<{ success: boolean }>(`/customer-orders/${orderId}/confirm-payment`, {
+    const result = await apiCall<{ success: boolean; already_confirmed?: boolean }>(`/customer-orders/${orderId}/confirm-payment`, {
         method: 'PUT',
+        body: JSON.stringify(actor),
     });
     console.log('✅ [API] Order confirmed!');
     return result;
 }
 
-export async function cancelOrder(orderId: number) {
+export async function cancelOrder(orderId: number, actor?: OrderActor) {
     console.log(`🚫 [API] Cancelling order ${orderId}...`);
     const data = await apiCall<{ success: boolean }>(`/customer-orders/${orderId}/cancel`, {
         method: 'PUT',
+        body: actor ? JSON.stringify(actor) : undefined,
     });
     console.log(`✅ [API] Order ${orderId} cancelled`);
     return data;
 }
 
+// Moves an order to accepted, packing, ready, out_for_delivery, cancelled or refunded.
+// A refund with restock puts the items back in stock.
+export async function updateOrderStatus(orderId: number, status: string, actor: OrderActor & { restock?: boolean }) {
+    console.log(`🔄 [API] Moving order ${orderId} to ${status}...`);
+    return apiCall<{ success: boolean; status: string; next_statuses: string[] }>(`/customer-orders/${orderId}/status`, {
+        method: 'PUT',
+        body: JSON.stringify({ ...actor, status }),
+    });
+}
+
+export async function getOrderStatusHistory(orderId: number) {
+    return apiCall<{ order_id: number; status: string; history: any[] }>(`/customer-orders/${orderId}/history`);
+}
+
 export async function searchOrderByCode(orderCode: string) {
     const data = await apiCall<{ order: any }>(`/customer-orders/search/${orderCode}`);
     return data.order;
@@ -578,14 +867,16 @@ export async function getSalesHistory(companyId: number) {
     }
 }
 
-export async function addSale(sale: { company_id: number; items: any[]; total_amount: number }) {
-    const data = await apiCall<{ success: boolean; sale_id: number }>('/sales-history', {
+// Lines may carry discount_percent; the server prices them and rejects a total_amount that differs
+export async function addSale(sale: { company_id: number; items: any[]; total_amount?: number; markup_profit?: number }) {
+    const data = await apiCall<{ success: boolean; sale_id: number; items: any[]; total_amount: number; markup_profit: number }>('/sales-history', {
         method: 'POST',
         body: JSON.stringify(sale),
     });
     return data;
 }
 
+// A till sale is recorded in the sales history, which takes its items out of stock
 export async function addCashierSale(sale: {
     company_id: number;
     items: any[];
@@ -594,35 +885,42 @@ export async function addCashierSale(sale: {
 }) {
     try {
         console.log('💰 [API] Creating cashier sale...');
-        const orderCode = `CASH-${Date.now()}-${Math.random().toString(36).substr(2, 9).toUpperCase()}`;
-
-        const data = await apiCall<{ success: boolean; order_id: number; order_code: string }>('/customer-orders', {
-            method: 'POST',
-            body: JSON.stringify({
-                company_id: sale.company_id,
-                user_name: 'Касса',
-                user_phone: 'CASH',
-                order_code: orderCode,
-                items: sale.items,
-                total_amount: sale.total_amount,
-                markup_profit: sale.markup_profit,
-                status: 'completed',
-                payment_confirmed: true,
-            })
-        });
-
-        if (data.order_id) {
-            await confirmOrderPayment(data.order_id);
-        }
-
+        const data = await addSale(sale);
         console.log('✅ [API] Cashier sale saved');
-        return { success: true, order: data };
+        return { success: true, sale: data };
     } catch (error) {
         console.error('❌ [API] Error creating cashier sale:', error);
         throw error;
     }
 }
 
+// ============================================
+// STOCK RECEIPTS API
+// ============================================
+
+// Records a delivery; unit_cost is the purchase cost per unit (a packaging
+// unit when unit is set). Stock and the average cost are updated.
+export async function createStockReceipt(receipt: {
+    company_id: number;
+    supplier?: string;
+    note?: string;
+    received_by?: string;
+    items: Array<{ product_id: number; quantity: number; unit?: string; unit_cost: number }>;
+}) {
+    console.log(`📦 [API] Stock receipt with ${receipt.items.length} items`);
+    const data = await apiCall<{ success: boolean; receipt: any }>('/stock-receipts', {
+        method: 'POST',
+        body: JSON.stringify(receipt),
+    });
+    return data.receipt;
+}
+
+export async function getStockReceipts(companyId: number, productId?: number) {
+    const query = productId ? `&product_id=${productId}` : '';
+    const data = await apiCall<{ receipts: any[] }>(`/stock-receipts?company_id=${companyId}${query}`);
+    return data.receipts || [];
+}
+
 // ============================================
 // EXPENSES API
 // ============================================
@@ -666,11 +964,13 @@ export async function updateCompanyExpenses(
         employee_expenses?: number;
         electricity_expenses?: number;
         purchase_costs?: number;
-    }
+    },
+    version?: number
 ) {
     console.log('💰 [API] Update company expenses:', { companyId, expenses });
     const data = await apiCall('/expenses', {
         method: 'POST',
+        headers: ifMatch(version),
         body: JSON.stringify({
             company_id: companyId,
             employee_expenses: expenses.employee_expenses ?? 0,
@@ -689,9 +989,10 @@ export async function addCustomExpense(companyId: number, expense: { name: strin
     });
 }
 
-export async function updateCustomExpense(expenseId: number, expense: { name?: string; amount?: number; description?: string }) {
+export async function updateCustomExpense(expenseId: number, expense: { name?: string; amount?: number; description?: string }, version?: number) {
     return await apiCall(`/expenses/custom/${expenseId}`, {
         method: 'PUT',
+        headers: ifMatch(version),
         body: JSON.stringify(expense),
     });
 }
@@ -80,24 +80,40 @@ export const realtimeManager = {
     }
   },
 
-  // 🚀 Подписка на обновления товаров компании (polling)
+  streams: new Map<string, () => void>(),
+
+  // 🚀 Подписка на обновления товаров компании (SSE, polling если SSE нет)
   subscribeToProducts: (companyId: number) => {
     const channel = `products_${companyId}`;
-    if (realtimeManager.intervals.has(channel)) return; // Уже подписаны
+    if (realtimeManager.intervals.has(channel) || realtimeManager.streams.has(channel)) return; // Уже подписаны
 
     console.log(`📡 [Realtime] Subscribing to products for company ${companyId}`);
 
-    realtimeManager.startPolling(
-      channel,
-      () => api.getProducts(companyId),
-      30000 // Обновление каждые 30 секунд
-    );
+    if (typeof EventSource === 'undefined') {
+      realtimeManager.startPolling(
+        channel,
+        () => api.getProducts(companyId),
+        30000 // Обновление каждые 30 секунд
+      );
+      return;
+    }
+
+    const close = api.subscribeToEvents(companyId, (event) => {
+      if (!event.type.startsWith('product.') && event.type !== 'stock.changed' && event.type !== 'resync') return;
+      ramCache.clear('products', companyId);
+      localCache.remove(`company_products_${companyId}`);
+      queryClient.invalidateQueries({ queryKey: ['company-products', companyId] });
+      realtimeManager.emit(channel, event);
+    });
+    realtimeManager.streams.set(channel, close);
   },
 
   // 🛑 Отписка от обновлений товаров
   unsubscribeFromProducts: (companyId: number) => {
     const channel = `products_${companyId}`;
     realtimeManager.stopPolling(channel);
+    realtimeManager.streams.get(channel)?.();
+    realtimeManager.streams.delete(channel);
   }
 };
 
@@ -252,8 +268,8 @@ export function useUpdateProduct() {
   const queryClient = useQueryClient();
 
   return useMutation({
-    mutationFn: ({ id, updates }: { id: number; updates: any }) =>
-      api.updateProduct(id, updates),
+    mutationFn: ({ id, updates, version }: { id: number; updates: any; version?: number }) =>
+      api.updateProduct(id, updates, version),
     onMutate: async ({ id, updates }) => {
       await queryClient.cancelQueries({ queryKey: ['products'] });
 
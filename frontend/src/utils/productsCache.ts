@@ -3,8 +3,11 @@
  * Инвалидация кэша при изменениях
  */
 
+import { getProductChanges } from './api';
 import { localCache, queryClient, ramCache } from './cache';
 
+const SYNC_CURSOR_KEY = 'products-sync-cursor';
+
 /**
  * Инвалидация всех кэшей товаров
  * Вызывается при любых изменениях (добавление, обновление, удаление)
@@ -25,6 +28,9 @@ export function invalidateCache() {
     // 4. Очищаем localStorage кэш
     localStorage.removeItem('products-cache');
     localStorage.removeItem('products-timestamp');
+    Object.keys(localStorage)
+      .filter((key) => key.startsWith(SYNC_CURSOR_KEY))
+      .forEach((key) => localStorage.removeItem(key));
 
     console.log('✅ [ProductsCache] Все кэши очищены (включая RAM)');
   } catch (error) {
@@ -59,4 +65,31 @@ export function getCachedProducts() {
 export function setCachedProducts(products: any[]) {
   queryClient.setQueryData(['products'], products);
   console.log(`✅ [ProductsCache] Кэш обновлен (${products.length} товаров)`);
-}
\ No newline at end of file
+}
+/**
+ * Инкрементальная синхронизация кэша товаров
+ * Загружает только изменённые и удалённые товары с последней синхронизации
+ */
+export async function syncProducts(companyId?: number) {
+  const cursorKey = `${SYNC_CURSOR_KEY}-${companyId ?? 'all'}`;
+  let since = localStorage.getItem(cursorKey);
+  const cached = (queryClient.getQueryData<any[]>(['products']) || []) as any[];
+  // Без кэша курсор бесполезен - начинаем полную загрузку
+  if (cached.length === 0) since = null;
+
+  const products = new Map<number, any>(since ? cached.map((p) => [p.id, p]) : []);
+  let hasMore = true;
+  while (hasMore) {
+    const changes = await getProductChanges({ companyId, since });
+    changes.upserted.forEach((p) => products.set(p.id, p));
+    changes.deleted.forEach((id) => products.delete(id));
+    since = changes.nextCursor;
+    hasMore = changes.hasMore;
+  }
+
+  const result = Array.from(products.values()).sort((a, b) => b.id - a.id);
+  queryClient.setQueryData(['products'], result);
+  localStorage.setItem(cursorKey, since || '');
+  console.log(`✅ [ProductsCache] Синхронизировано (${result.length} товаров)`);
+  return result;
+}